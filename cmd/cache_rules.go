@@ -0,0 +1,106 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+var createCacheRules bool
+
+// cacheRulesCmd represents the cache-rules command
+var cacheRulesCmd = &cobra.Command{
+	Use:   "cache-rules [registry[=prefix]]",
+	Short: "list and create ECR pull-through cache rules",
+	Long: `cache-rules subcommand lists pull-through cache rules of ECR, and rules of config which are not created yet.
+--create creates them. rules can be also specified by args, prefix is decided for known registries when it is omitted
+
+  trimg cache-rules
+  trimg cache-rules --create
+  trimg cache-rules --create quay.io public.ecr.aws=ecr-public
+
+config:
+  pullThroughCache:
+    - registry: quay.io
+      prefix: quay
+
+replace rewrites images of the registries in config to the cache, e.g. quay.io/coreos/etcd:v3.4 -> <ECR>/quay/coreos/etcd:v3.4,
+and transfer skips them
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		rules := append([]pkg.PullThroughCacheRule(nil), config.PullThroughCache...)
+		for _, arg := range args {
+			parts := strings.SplitN(arg, "=", 2)
+			rule := pkg.PullThroughCacheRule{Registry: parts[0]}
+			if len(parts) == 2 {
+				rule.Prefix = parts[1]
+			}
+			rules = append(rules, rule)
+		}
+		for i := range rules {
+			rules[i] = rules[i].WithDefaults()
+			if err := rules[i].Validate(); err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if destinationRegistry() != "" {
+			fmt.Println("pull-through cache is available only for ECR, destination registry can't be used")
+			os.Exit(1)
+		}
+		region := awsTarget()
+		svc := pkg.NewECRClient(region)
+		existing, err := pkg.ListPullThroughCacheRules(svc, accountId)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		missing, err := pkg.MissingCacheRules(existing, rules)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		registry := pkg.ECRRegistry(region, accountId)
+		for _, rule := range existing {
+			fmt.Printf("%s -> %s/%s\n", rule.Registry, registry, rule.Prefix)
+		}
+		for _, rule := range missing {
+			if !createCacheRules {
+				fmt.Printf("%s -> %s/%s (not created)\n", rule.Registry, registry, rule.Prefix)
+				continue
+			}
+			if err := pkg.CreatePullThroughCacheRule(svc, accountId, rule); err != nil {
+				fmt.Printf("%s failed to create. error message: %v\n", rule.Registry, err)
+				os.Exit(1)
+			}
+			fmt.Printf("%s -> %s/%s (created)\n", rule.Registry, registry, rule.Prefix)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cacheRulesCmd)
+
+	cacheRulesCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
+	cacheRulesCmd.PersistentFlags().BoolVar(&createCacheRules, "create", false, "create rules which don't exist in ECR")
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+var (
+	fromCluster   bool
+	kubeconfig    string
+	kubeContext   string
+	namespaces    []string
+	labelSelector string
+)
+
+// scan images of the cluster, and report which images are not served from ECR yet
+func clusterImages(mapper *pkg.ImageMapper) []string {
+	client, err := pkg.NewKubernetesClient(kubeconfig, kubeContext)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	images, err := pkg.ScanClusterImages(client, pkg.ClusterScanOptions{Namespaces: namespaces, LabelSelector: labelSelector})
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("images in cluster")
+	imagePaths := make([]string, 0, len(images))
+	notServed := 0
+	for _, image := range images {
+		status := "not in ECR"
+		ref, err := pkg.ParseImageReference(image.Image)
+		if _, _, ok := pkg.ParseECRRegistry(ref.Registry); err == nil && ok {
+			status = "ECR"
+		} else if mapper.IsMirrored(image.Image) {
+			status = "internal registry"
+		} else {
+			notServed++
+		}
+		fmt.Printf("%s (%s) used by %s\n", image.Image, status, strings.Join(image.Workloads, ", "))
+		imagePaths = append(imagePaths, image.Image)
+	}
+	fmt.Printf("%d of %d images are not served from ECR\n\n", notServed, len(images))
+	return imagePaths
+}
+
+// flags to scan cluster
+func addClusterFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().BoolVar(&fromCluster, "from-cluster", false, "get image paths from pods and workloads of kubernetes cluster")
+	cmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "", "kubeconfig for --from-cluster, default: $KUBECONFIG or ~/.kube/config")
+	cmd.PersistentFlags().StringVar(&kubeContext, "context", "", "context of kubeconfig for --from-cluster, default: current context")
+	cmd.PersistentFlags().StringArrayVarP(&namespaces, "namespace", "n", nil, "namespace to scan by --from-cluster, can be specified multiple times, default: all namespaces")
+	cmd.PersistentFlags().StringVarP(&labelSelector, "selector", "l", "", "label selector of workloads to scan by --from-cluster, e.g. \"app=web\"")
+}
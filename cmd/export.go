@@ -0,0 +1,100 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var outputFile string
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export <imagename>",
+	Short: "download images into a tar archive of OCI image layout, to carry them into air-gapped environment",
+	Long: `export subcommand download images from registries without docker daemon,
+and then write them into a single tar archive of OCI image layout, blobs shared by images are written once
+
+images are specified in the same way as transfer:
+  trimg export -f kubernetes-manifest.yml -o bundle.tar
+  trimg export nginx:1.17 redis -o bundle.tar
+
+index.json of the archive has the original image paths as "org.opencontainers.image.ref.name",
+images are pushed into ECR by "trimg import bundle.tar"
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if outputFile == "" {
+			fmt.Println("you should specify output file by -o")
+			os.Exit(1)
+		}
+		imagePaths := collectImages(args)
+
+		// ECR is not a target of export, only internal registries, --registry and filters are used
+		mapper := newImageMapper("")
+		var images []string
+		for _, imagePath := range imagePaths {
+			if reason := mapper.Skip(imagePath); reason != "" {
+				fmt.Printf("%s is skipped, %s\n", imagePath, reason)
+				continue
+			}
+			images = append(images, imagePath)
+		}
+
+		if err := exportImages(images, outputFile); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Remove(outputFile)
+			os.Exit(1)
+		}
+	},
+}
+
+func exportImages(images []string, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	client := newRegistryClient()
+	w := pkg.NewOCILayoutWriter(f)
+	for _, image := range images {
+		d, err := w.AddImage(client, image)
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %v", image, err)
+		}
+		fmt.Printf("%s is exported, %s\n", image, d.Digest)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.PersistentFlags().StringVarP(&outputFile, "output", "o", "", "tar archive to write images")
+	exportCmd.PersistentFlags().StringVarP(&filename, "filename", "f", "", "specify kubernetes manifest filepath")
+	exportCmd.PersistentFlags().StringVar(&fromList, "from-list", "", "specify file which lists image paths, one image per line")
+	exportCmd.PersistentFlags().StringVar(&helmChart, "helm-chart", "", "specify helm chart directory or packaged chart(.tgz)")
+	exportCmd.PersistentFlags().StringArrayVar(&valuesFiles, "values", nil, "values file for --helm-chart, can be specified multiple times")
+	exportCmd.PersistentFlags().BoolVar(&strict, "strict", false, "fail when manifest has broken documents, default: print warnings and skip them")
+	addImageFlags(exportCmd)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+	"os"
+)
+
+// helmValuesCmd represents the helm-values command
+var helmValuesCmd = &cobra.Command{
+	Use:   "helm-values <chart>",
+	Short: "generate helm values override which points images of the chart to ECR",
+	Long: `helm-values subcommand read values.yaml of the chart and its subcharts,
+and generate values override which replaces image settings with the path of the ECR will be sent by the transfer command
+
+image settings are detected by common conventions of charts, e.g. image.repository, image.registry.
+you can specify them for each chart in config file:
+
+  helm:
+    charts:
+      ingress-nginx:
+        images:
+          - path: controller.image
+            registryKey: registry
+            repositoryKey: image
+
+Generate values and install the chart:
+  trimg helm-values ./ingress-nginx > ecr-values.yaml
+  helm install ingress-nginx ./ingress-nginx -f ecr-values.yaml
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) != 1 {
+			fmt.Println("you can only specify one chart")
+			os.Exit(1)
+		}
+
+		region := awsTarget()
+
+		chart, err := pkg.LoadHelmChart(args[0])
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		values, err := pkg.GenerateHelmValues(chart, config, newImageMapper(region))
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		d, err := yaml.Marshal(values)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("# values override for chart %s generated by trimg\n%s", chart.Name, d)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(helmValuesCmd)
+	helmValuesCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
+	addImageFlags(helmValuesCmd)
+}
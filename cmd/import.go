@@ -0,0 +1,134 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import <bundle.tar>",
+	Short: "push images of OCI layout or docker-archive bundle into ECR",
+	Long: `import subcommand read images from tar archive made by "trimg export" or "docker save",
+and then create ECR repositories and push images into them without docker daemon
+
+image paths in ECR are decided by the same rules as replace, so manifests replaced on the connected side match them
+
+  trimg import bundle.tar
+  trimg import bundle.tar --dry-run
+
+settings of created repositories are read from "repository" of config file
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) != 1 {
+			fmt.Println("you can only specify one bundle")
+			os.Exit(1)
+		}
+		bundle, err := pkg.OpenImageBundle(args[0])
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		defer bundle.Close()
+
+		region := awsTarget()
+		mapper := newImageMapper(region)
+
+		if dryRun {
+			fmt.Println("following images will be imported")
+		}
+		client := newRegistryClient()
+		if !dryRun {
+			credential, err := mapper.Destination.Credential()
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+			if credential.Username != "" {
+				client.SetCredential(mapper.Destination.Registry(), credential)
+			}
+		}
+
+		failed := false
+		for i, image := range bundle.Images {
+			source := image.Annotations[pkg.AnnotationRefName]
+			msg, err := importImage(bundle, image, mapper, client)
+			switch {
+			case err != nil:
+				failed = true
+				fmt.Printf("%d: %s failed to import. error message: %v\n", i+1, source, err)
+			case dryRun:
+				fmt.Println(msg)
+			default:
+				fmt.Printf("%d: %s\n", i+1, msg)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// push the image of bundle, it returns result message
+func importImage(bundle *pkg.ImageBundle, image pkg.Descriptor, mapper *pkg.ImageMapper, client *pkg.RegistryClient) (string, error) {
+	source := image.Annotations[pkg.AnnotationRefName]
+	if reason := mapper.Skip(source); reason != "" {
+		return fmt.Sprintf("%s is skipped, %s", source, reason), nil
+	}
+	targets, err := mapper.Targets(source, image.Digest)
+	if err != nil {
+		return "", err
+	}
+	if dryRun {
+		return fmt.Sprintf("%s -> %s", source, strings.Join(targets, ", ")), nil
+	}
+
+	repository, err := mapper.Repository(source)
+	if err != nil {
+		return "", err
+	}
+	if err := mapper.Destination.CreateRepository(repository, mapper.RepositorySettings); err != nil {
+		return "", err
+	}
+	var tags []string
+	for _, target := range targets {
+		ref, err := pkg.ParseImageReference(target)
+		if err != nil {
+			return "", err
+		}
+		if ref.Tag != "" {
+			tags = append(tags, ref.Tag)
+		}
+	}
+	if err := bundle.PushImage(client, mapper.Destination.Registry(), repository, image, tags); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s import to %s", source, strings.Join(targets, ", ")), nil
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
+	importCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "only print the images that would be imported, without push them.")
+	addImageFlags(importCmd)
+}
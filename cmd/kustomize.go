@@ -0,0 +1,149 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	kustomizeWrite bool
+	kustomizeKRM   bool
+)
+
+// kustomizeCmd represents the kustomize command
+var kustomizeCmd = &cobra.Command{
+	Use:   "kustomize <dir>",
+	Short: "generate images field of kustomization.yaml which points images to ECR",
+	Long: `kustomize subcommand read resources of kustomization recursively,
+and generate or update images field of kustomization.yaml with the path of the ECR will be sent by the transfer command.
+existing entries of images field are updated, remote resources are not read.
+
+Print updated kustomization.yaml:
+  trimg kustomize ./overlays/production
+
+Update kustomization.yaml (comments in the file are not kept):
+  trimg kustomize ./overlays/production --write
+
+Record images to transfer:
+  trimg kustomize ./overlays/production --write --image-list images.txt
+  trimg transfer --from-list images.txt
+
+Run as KRM function, it reads ResourceList from stdin and replaces images of items.
+region and accountId can be set in data of functionConfig:
+  trimg kustomize --krm
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if kustomizeKRM {
+			runKRMFunction()
+			return
+		}
+
+		if len(args) != 1 {
+			fmt.Println("you can only specify one directory")
+			os.Exit(1)
+		}
+
+		region := awsTarget()
+
+		path, err := pkg.FindKustomization(args[0])
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		existing, err := pkg.ReadKustomizeImages(path)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		manifests, remote, err := pkg.LoadKustomizeManifests(args[0])
+		manifests = checkManifests(manifests, err)
+		for _, r := range remote {
+			fmt.Fprintf(os.Stderr, "warning: remote resource %s is not read\n", r)
+		}
+		images := removeDuplicateImage(manifestImages(manifests))
+
+		if imageListFile != "" {
+			if err := pkg.WriteImageList(imageListFile, removeDuplicateImage(pkg.ApplyKustomizeImages(images, existing))); err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		entries, err := pkg.KustomizeImages(existing, images, newImageMapper(region))
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		d, err := pkg.UpdateKustomization(path, entries)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		if !kustomizeWrite {
+			fmt.Printf("%s", d)
+			return
+		}
+		if err := ioutil.WriteFile(path, d, 0644); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// read ResourceList from stdin, and write it with replaced images
+func runKRMFunction() {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	manifests := loadManifestData("stdin", data)
+
+	// settings in functionConfig take precedence over environment
+	for _, m := range manifests {
+		fc, err := pkg.DigYaml(m.Body, "functionConfig", "data")
+		if err != nil {
+			continue
+		}
+		if r, err := pkg.DigYaml(fc, "region"); err == nil {
+			os.Setenv("AWS_DEFAULT_REGION", fmt.Sprintf("%v", r))
+		}
+		if a, err := pkg.DigYaml(fc, "accountId"); err == nil && accountId == "" {
+			accountId = fmt.Sprintf("%v", a)
+		}
+	}
+
+	region := awsTarget()
+	os.Stdout.Write(replaceManifests(manifests, region))
+}
+
+func init() {
+	rootCmd.AddCommand(kustomizeCmd)
+	kustomizeCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
+	kustomizeCmd.PersistentFlags().BoolVarP(&kustomizeWrite, "write", "w", false, "update kustomization file instead of printing it")
+	kustomizeCmd.PersistentFlags().BoolVar(&kustomizeKRM, "krm", false, "run as KRM function, read ResourceList from stdin and write it to stdout")
+	kustomizeCmd.PersistentFlags().StringVar(&imageListFile, "image-list", "", "write images used by the kustomization to the file, it can be used by \"transfer --from-list\"")
+	kustomizeCmd.PersistentFlags().BoolVar(&strict, "strict", false, "fail when manifest has broken documents, default: print warnings and skip them")
+	addImageFlags(kustomizeCmd)
+}
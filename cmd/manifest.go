@@ -0,0 +1,72 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"os"
+)
+
+// parse manifest file. broken documents stop the command with --strict, otherwise they are skipped with warnings
+func loadManifests(filepath string) []pkg.Manifest {
+	manifests, err := pkg.ParseManifestFile(filepath)
+	return checkManifests(manifests, err)
+}
+
+// parse manifests which are not read from file, e.g. rendered helm chart
+func loadManifestData(name string, data []byte) []pkg.Manifest {
+	manifests, err := pkg.ParseManifests(name, data)
+	return checkManifests(manifests, err)
+}
+
+func checkManifests(manifests []pkg.Manifest, err error) []pkg.Manifest {
+	if err != nil {
+		errs, ok := err.(pkg.ManifestErrors)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		for _, e := range errs {
+			reportManifestError(e)
+		}
+	}
+	return manifests
+}
+
+// stop the command with --strict, otherwise print warning.
+// messages are written to stderr not to break manifests written to stdout
+func reportManifestError(err *pkg.ManifestError) {
+	if strict {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+}
+
+// get image paths used in manifests
+func manifestImages(manifests []pkg.Manifest) []string {
+	var imagePaths []string
+	for _, m := range manifests {
+		images, err := pkg.GetUsingImages(m.Body)
+		if err != nil {
+			reportManifestError(m.Error(err))
+			continue
+		}
+		imagePaths = append(imagePaths, images...)
+	}
+	return imagePaths
+}
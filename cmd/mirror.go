@@ -0,0 +1,141 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+var tagSelector pkg.TagSelector
+
+// mirrorCmd represents the mirror command
+var mirrorCmd = &cobra.Command{
+	Use:   "mirror <repository>",
+	Short: "transfer tags of the repository selected by semver constraint, regex or latest N",
+	Long: `mirror subcommand list tags of the repository by registry API, and then transfer selected tags into ECR
+tags which already exist in ECR are skipped
+
+Mirror kube-proxy v1.20 and later:
+  trimg mirror registry.k8s.io/kube-proxy --semver ">=1.20.0 <1.30.0"
+
+Mirror the latest 3 versions of nginx:
+  trimg mirror nginx --latest 3
+
+credentials of source registry are read from docker config, e.g. ~/.docker/config.json
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) != 1 {
+			fmt.Println("you can only specify one repository")
+			os.Exit(1)
+		}
+		ref, err := pkg.ParseImageReference(args[0])
+		if err != nil || ref.Tag != "" || ref.Digest != "" {
+			fmt.Printf("%s is wrong, repository should be specified without tag and digest\n", args[0])
+			os.Exit(1)
+		}
+
+		region := awsTarget()
+
+		tags, err := newRegistryClient().ListTags(ref.Registry, ref.Repository)
+		if err != nil {
+			fmt.Printf("failed to list tags of %s: %v\n", args[0], err)
+			os.Exit(1)
+		}
+		tags, err = tagSelector.Select(tags)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if len(tags) == 0 {
+			fmt.Println("no tags are selected")
+			return
+		}
+
+		mapper := newImageMapper(region)
+		images, skipped := selectMirrorImages(ref.Name, tags, mapper)
+
+		if dryRun {
+			fmt.Println("following images will be transfer")
+			for _, imagePath := range images {
+				targets, err := mapper.Targets(imagePath, "")
+				if err != nil {
+					fmt.Printf("%s -> %v\n", imagePath, err)
+					continue
+				}
+				fmt.Printf("%s -> %s\n", imagePath, strings.Join(targets, ", "))
+			}
+			for _, msg := range skipped {
+				fmt.Println(msg)
+			}
+			return
+		}
+
+		exitOnRejected(transferImages(images, skipped, mapper))
+	},
+}
+
+// split tags of the repository into images to transfer and skipped messages,
+// tags which already exist in the destination are skipped
+func selectMirrorImages(name string, tags []string, mapper *pkg.ImageMapper) (images, skipped []string) {
+	for _, tag := range tags {
+		imagePath := name + ":" + tag
+		mapping, err := mapper.Map(imagePath)
+		if err != nil {
+			// target tag is decided after pull, e.g. digest is used in tag template
+			images = append(images, imagePath)
+			continue
+		}
+		if mapping.Skip != "" {
+			skipped = append(skipped, fmt.Sprintf("%s is skipped, %s", imagePath, mapping.Skip))
+			continue
+		}
+
+		target, err := pkg.ParseImageReference(mapping.Target)
+		if err != nil || target.Tag == "" {
+			images = append(images, imagePath)
+			continue
+		}
+		exists, err := mapper.Destination.ImageExists(target.Repository, target.Tag)
+		if err != nil {
+			fmt.Printf("failed to check %s: %v\n", mapping.Target, err)
+			os.Exit(1)
+		}
+		if exists {
+			skipped = append(skipped, fmt.Sprintf("%s is skipped, already exists in %s", imagePath, mapper.Destination.Registry()))
+			continue
+		}
+		images = append(images, imagePath)
+	}
+	return images, skipped
+}
+
+func init() {
+	rootCmd.AddCommand(mirrorCmd)
+
+	mirrorCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
+	mirrorCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "only print the images that would be transferred, without transfer them.")
+	mirrorCmd.PersistentFlags().StringVar(&tagSelector.Semver, "semver", "", "semantic version constraint of tags, e.g. \">=1.20.0 <1.30.0\", \"~1.20\", \"1.21.x || 1.22.x\"")
+	mirrorCmd.PersistentFlags().StringVar(&tagSelector.Regex, "tag-regex", "", "regular expression of tags, e.g. \"^v1\\.2[0-9]\\.\"")
+	mirrorCmd.PersistentFlags().IntVar(&tagSelector.Latest, "latest", 0, "only the latest N versions of selected tags, ordered by semantic version")
+	mirrorCmd.PersistentFlags().StringArrayVar(&tagSelector.Tags, "tag", nil, "tag to transfer in addition to selected tags, can be specified multiple times")
+	addImageFlags(mirrorCmd)
+	addTransferFlags(mirrorCmd)
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+)
+
+var imageListFile string
+
+// postRenderCmd represents the post-render command
+var postRenderCmd = &cobra.Command{
+	Use:   "post-render",
+	Short: "work as helm post-renderer, replace image paths of rendered manifests to ECR path",
+	Long: `post-render subcommand read rendered manifests from stdin,
+replace image paths to ECR path like replace command, and write them to stdout.
+it is used as "--post-renderer" of helm, so that upstream charts can be installed without modification
+
+Install chart with images in ECR:
+  helm install ingress-nginx ./ingress-nginx --post-renderer trimg --post-renderer-args post-render
+
+Record images of the chart, and transfer them:
+  helm template ingress-nginx ./ingress-nginx --post-renderer trimg --post-renderer-args post-render --post-renderer-args --image-list=images.txt
+  trimg transfer --from-list images.txt
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		region := awsTarget()
+
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		manifests := loadManifestData("stdin", data)
+
+		// record images to transfer before replacing
+		if imageListFile != "" {
+			mapper := newImageMapper(region)
+			var images []string
+			for _, image := range removeDuplicateImage(manifestImages(manifests)) {
+				if mapper.Skip(image) == "" {
+					images = append(images, image)
+				}
+			}
+			if err := pkg.WriteImageList(imageListFile, images); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		os.Stdout.Write(replaceManifests(manifests, region))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(postRenderCmd)
+	postRenderCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
+	postRenderCmd.PersistentFlags().StringVar(&imageListFile, "image-list", "", "write images found in manifests to the file, it can be used by \"transfer --from-list\"")
+	postRenderCmd.PersistentFlags().BoolVar(&strict, "strict", false, "fail when manifest has broken documents, default: print warnings and skip them")
+	addImageFlags(postRenderCmd)
+}
@@ -17,11 +17,7 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/esakat/trimg/pkg"
-	"gopkg.in/yaml.v2"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -33,6 +29,9 @@ var replaceCmd = &cobra.Command{
 	Short: "replace kubernetes manifest `image path` to ECR path",
 	Long: `replace subcommand replace kubernetes manifest
 get the value of the image from the manifest file and replace it to the path of the ECR will be sent by the transfer command
+
+Refuse to replace when ECR scan findings of the images are HIGH or higher:
+  trimg replace deployment.yml --fail-on HIGH
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 
@@ -41,54 +40,16 @@ get the value of the image from the manifest file and replace it to the path of
 			os.Exit(1)
 		}
 
-		region := os.Getenv("AWS_DEFAULT_REGION")
-		if region == "" {
-			fmt.Printf("you should do `export AWS_DEFAULT_REGION=...`")
-			os.Exit(1)
-		}
-
-		if accountId == "" {
-			svc := sts.New(session.New(&aws.Config{Region: aws.String(region)}))
-			t, err := svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
-			if err != nil {
-				fmt.Printf("%v\n", err)
-				os.Exit(1)
-			}
-			accountId = *t.Account
-		}
+		region := awsTarget()
 
 		// parse yaml file
-		yamls, err := pkg.ParseMultiDocYaml(args[0])
-		if err != nil {
-			fmt.Printf("%v\n", err)
-			os.Exit(1)
-		}
-
-		result := ""
-		for i, y := range yamls {
-			var d []byte
-			replacedManifest, err := pkg.ReplaceUsingImages(y, region, accountId)
-			if err != nil {
-				d, err = yaml.Marshal(y)
-				if err != nil {
-					fmt.Printf("%v\n", err)
-					os.Exit(1)
-				}
-			} else {
-				d, err = yaml.Marshal(replacedManifest)
-				if err != nil {
-					fmt.Printf("%v\n", err)
-					os.Exit(1)
-				}
-			}
-			if i != 0 {
-				result += "---\n" + string(d)
-			} else {
-				result += string(d)
-			}
+		manifests := loadManifests(args[0])
 
+		if failOn != "" {
+			checkScanFindings(manifests, newImageMapper(region))
 		}
 
+		result := replaceManifests(manifests, region)
 		fmt.Printf("%s", result)
 
 	},
@@ -97,4 +58,75 @@ get the value of the image from the manifest file and replace it to the path of
 func init() {
 	rootCmd.AddCommand(replaceCmd)
 	replaceCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
+	replaceCmd.PersistentFlags().BoolVar(&strict, "strict", false, "fail when manifest has broken documents, default: print warnings and skip them")
+	replaceCmd.PersistentFlags().StringVar(&failOn, "fail-on", "", "refuse to replace when scan findings of images in ECR are the severity or higher, e.g. \"HIGH\"")
+	addImageFlags(replaceCmd)
+}
+
+// exit when an image in ECR fails the scan gate of --fail-on, images which are not transferred are not checked
+func checkScanFindings(manifests []pkg.Manifest, mapper *pkg.ImageMapper) {
+	gate := mapper.Transfer.ScanGate
+	checked := map[string]bool{}
+	failed := false
+	for _, m := range manifests {
+		images, err := pkg.GetUsingImages(m.Body)
+		if err != nil {
+			// reported by replace
+			continue
+		}
+		for _, image := range images {
+			mapping, err := mapper.Map(image)
+			if err != nil || mapping.Skip != "" || checked[mapping.Target] {
+				continue
+			}
+			checked[mapping.Target] = true
+			_, err = gate.Check(mapping.Target)
+			if pkg.IsScanNotFound(err) {
+				fmt.Fprintf(os.Stderr, "%v, scan findings are not checked\n", err)
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				failed = true
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// replace images in manifests, and serialize them in the same format as input.
+// images already mirrored are left alone, and reported to stderr like transfer
+func replaceManifests(manifests []pkg.Manifest, region string) []byte {
+	mapper := newImageMapper(region)
+	var results []map[interface{}]interface{}
+	reported := map[string]bool{}
+	for _, m := range manifests {
+		images, _ := pkg.GetUsingImages(m.Body)
+		for _, image := range images {
+			if !reported[image] && mapper.Skip(image) == pkg.SkipAlreadyMirrored {
+				reported[image] = true
+				fmt.Fprintf(os.Stderr, "%s is skipped, %s\n", image, pkg.SkipAlreadyMirrored)
+			}
+		}
+		replacedManifest, err := pkg.ReplaceImages(m.Body, mapper)
+		if err != nil {
+			reportManifestError(m.Error(err))
+			results = append(results, m.Body)
+		} else {
+			results = append(results, replacedManifest)
+		}
+	}
+
+	format := pkg.FormatYAML
+	if len(manifests) != 0 {
+		format = manifests[0].Format
+	}
+	result, err := pkg.MarshalManifests(results, format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	return result
 }
@@ -17,13 +17,38 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/esakat/trimg/pkg"
 	"github.com/spf13/cobra"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 var (
 	cfgFile   string
 	accountId string
+	strict    bool
+	config    = &pkg.Config{}
+
+	includeFilters   []string
+	excludeFilters   []string
+	tagTemplate      string
+	tagDate          string
+	pushRegistry     string
+	insecureHosts    []string
+	copySignatures   bool
+	verifySignatures bool
+	signKey          string
+	signKMSKey       string
+	sbomFormat       string
+	sbomDir          string
+	waitForScan      bool
+	failOn           string
+	scanTimeout      time.Duration
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -47,7 +72,216 @@ func Execute() {
 	}
 }
 
-func init() {}
+func init() {
+	cobra.OnInitialize(initConfig)
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file, default: $HOME/.trimg.yaml")
+	rootCmd.PersistentFlags().StringArrayVar(&insecureHosts, "insecure-registry", nil, "access the registry by plain HTTP instead of HTTPS, e.g. \"localhost:5000\"")
+}
 
 // initConfig reads in config file and ENV variables if set.
-func initConfig() {}
+func initConfig() {
+	path := cfgFile
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		path = filepath.Join(home, ".trimg.yaml")
+		if _, err := os.Stat(path); err != nil {
+			// default config file is optional
+			return
+		}
+	}
+
+	c, err := pkg.LoadConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	config = c
+}
+
+// get region from AWS_DEFAULT_REGION, and set your IAM AccountId if --account-id is not specified.
+// errors are written to stderr, stdout of post-render is read by helm
+func awsTarget() string {
+	// AWS is not used when images are pushed to other registries
+	if destinationRegistry() != "" {
+		return ""
+	}
+	region := os.Getenv("AWS_DEFAULT_REGION")
+	if region == "" {
+		fmt.Fprintln(os.Stderr, "you should do `export AWS_DEFAULT_REGION=...`")
+		os.Exit(1)
+	}
+
+	if accountId == "" {
+		svc := sts.New(session.New(&aws.Config{Region: aws.String(region)}))
+		t, err := svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		accountId = *t.Account
+	}
+	return region
+}
+
+// ImageMapper for the target of --account-id and AWS_DEFAULT_REGION,
+// --include and --exclude are added to filters of config, and --tag-template overrides config
+func newImageMapper(region string) *pkg.ImageMapper {
+	c := *config
+	c.Filters.Include = append(append([]string(nil), c.Filters.Include...), includeFilters...)
+	c.Filters.Exclude = append(append([]string(nil), c.Filters.Exclude...), excludeFilters...)
+	if tagTemplate != "" {
+		c.TagPolicy.Template = tagTemplate
+	}
+	if tagDate != "" {
+		c.TagPolicy.Date = tagDate
+	}
+	c.Destination.Registry = destinationRegistry()
+	c.InsecureRegistries = insecureRegistries()
+	mapper, err := pkg.NewImageMapper(&c, region, accountId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if mapper.TagPolicy != nil && mapper.TagPolicy.UsesDigest() {
+		mapper.ResolveDigest = digestResolver()
+	}
+	mapper.Transfer.CopySignatures = copySignatures
+	if verifySignatures {
+		if len(config.SignaturePolicies) == 0 {
+			fmt.Fprintln(os.Stderr, "signaturePolicy should be set in config file to verify signatures")
+			os.Exit(1)
+		}
+		verifier, err := pkg.NewSignatureVerifier(config.SignaturePolicies, newRegistryClient())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		mapper.Transfer.Verifier = verifier
+	}
+	mapper.Transfer.Signer = newSigner(region)
+	if sbomFormat != "" || sbomDir != "" {
+		options := pkg.SBOMOptions{Format: sbomFormat, Dir: sbomDir}
+		if options.Format == "" {
+			options.Format = pkg.SBOMFormatSPDX
+		}
+		if err := options.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		mapper.Transfer.SBOM = &options
+	}
+	if waitForScan || failOn != "" {
+		mapper.Transfer.ScanGate = newScanGate(region)
+	}
+	return mapper
+}
+
+// gate of --fail-on for ECR of --account-id, allowlist of config is applied
+func newScanGate(region string) *pkg.ScanGate {
+	if destinationRegistry() != "" {
+		fmt.Fprintln(os.Stderr, "scan findings are only available for ECR, --wait-for-scan and --fail-on can't be used with --registry")
+		os.Exit(1)
+	}
+	gate, err := pkg.NewScanGate(pkg.NewECRClient(region), accountId, failOn, config.Scan)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	gate.Timeout = scanTimeout
+	return gate
+}
+
+// digests of images for tag template, each image is resolved once by registry API
+func digestResolver() func(image string) (string, error) {
+	client := newRegistryClient()
+	var mu sync.Mutex
+	digests := map[string]string{}
+	return func(image string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if digest, ok := digests[image]; ok {
+			return digest, nil
+		}
+		digest, err := client.ResolveDigest(image)
+		if err != nil {
+			return "", err
+		}
+		digests[image] = digest
+		return digest, nil
+	}
+}
+
+// signer of --sign-key or --sign-kms-key, nil when they are not set
+func newSigner(region string) pkg.Signer {
+	switch {
+	case signKey != "" && signKMSKey != "":
+		fmt.Fprintln(os.Stderr, "--sign-key and --sign-kms-key can't be used together")
+		os.Exit(1)
+	case signKey != "":
+		// the same environment variable as cosign
+		signer, err := pkg.LoadFileSigner(signKey, []byte(os.Getenv("COSIGN_PASSWORD")))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return signer
+	case signKMSKey != "":
+		// region of ECR is not resolved with --registry
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		signer := pkg.NewKMSSigner(signKMSKey, region)
+		if signer.Region == "" {
+			fmt.Fprintln(os.Stderr, "region of --sign-kms-key is unknown, you should do `export AWS_DEFAULT_REGION=...` or give ARN of the key")
+			os.Exit(1)
+		}
+		return signer
+	}
+	return nil
+}
+
+// registry of --registry or config, images are pushed there instead of ECR
+func destinationRegistry() string {
+	if pushRegistry != "" {
+		return pushRegistry
+	}
+	return config.Destination.Registry
+}
+
+// registries of config and --insecure-registry
+func insecureRegistries() []string {
+	return append(append([]string(nil), config.InsecureRegistries...), insecureHosts...)
+}
+
+// registry client with credentials of docker config, insecure registries are accessed by HTTP
+func newRegistryClient() *pkg.RegistryClient {
+	client := pkg.NewRegistryClient()
+	client.InsecureRegistries = insecureRegistries()
+	return client
+}
+
+// flags which change ImageMapper, the same flags should be given to transfer and replace
+func addImageFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&tagTemplate, "tag-template", "", "template of tags in ECR, e.g. \"{{.Tag}}-mirrored-{{.Date}}\", \"{{.DigestTag}}\"")
+	cmd.PersistentFlags().StringVar(&tagDate, "tag-date", "", "value of {{.Date}} in tag template, format is YYYYMMDD, default: today")
+	cmd.PersistentFlags().StringArrayVar(&includeFilters, "include", nil, "only images match the pattern are handled, e.g. \"gcr.io/*\", \"registry=docker.io\", \"tag=~^v1\\.\"")
+	cmd.PersistentFlags().StringArrayVar(&excludeFilters, "exclude", nil, "images match the pattern are not handled, e.g. \"repository=myorg/*\"")
+	cmd.PersistentFlags().StringVar(&pushRegistry, "registry", "", "push images to the registry instead of ECR, e.g. \"harbor.example.com/mirror\", \"localhost:5000\"")
+}
+
+// flags which change how images are transferred
+func addTransferFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().BoolVar(&copySignatures, "copy-signatures", false, "copy cosign signatures, attestations, SBOMs and OCI referrers of images, images are copied without docker to keep digests")
+	cmd.PersistentFlags().BoolVar(&verifySignatures, "verify-signatures", false, "refuse images whose cosign signatures are not verified by signaturePolicy of config file")
+	cmd.PersistentFlags().StringVar(&signKey, "sign-key", "", "sign pushed images by cosign private key file, the password is read from COSIGN_PASSWORD")
+	cmd.PersistentFlags().StringVar(&signKMSKey, "sign-kms-key", "", "sign pushed images by AWS KMS key, e.g. \"alias/cosign\", key ID or ARN")
+	cmd.PersistentFlags().StringVar(&sbomFormat, "sbom", "", "make SBOMs of pushed images from package databases and Go binaries, and attach them as OCI referrers, format is \"spdx\" or \"cyclonedx\"")
+	cmd.PersistentFlags().Lookup("sbom").NoOptDefVal = pkg.SBOMFormatSPDX
+	cmd.PersistentFlags().StringVar(&sbomDir, "sbom-dir", "", "write SBOMs into the directory instead of attaching them to images")
+	cmd.PersistentFlags().BoolVar(&waitForScan, "wait-for-scan", false, "wait for ECR scan findings of pushed images and report them, scanOnPush of repositories should be enabled")
+	cmd.PersistentFlags().StringVar(&failOn, "fail-on", "", "fail images which have scan findings of the severity or higher, e.g. \"HIGH\", vulnerabilities in scan.allowlist of config are ignored. it implies --wait-for-scan")
+	cmd.PersistentFlags().DurationVar(&scanTimeout, "scan-timeout", 10*time.Minute, "time to wait for scan findings of an image")
+}
@@ -0,0 +1,126 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	serveAddr     string
+	jobDB         string
+	maxAttempts   int
+	retryInterval time.Duration
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "run as a daemon which transfers images requested by HTTP API",
+	Long: `serve subcommand runs a long-running process, images submitted by HTTP API are transferred to ECR or --registry in background.
+images are copied by registry API with all platforms, docker daemon is not required
+
+  trimg serve --addr :8080 --db trimg.db --workers 4
+
+  curl -X POST localhost:8080/jobs -d '{"images": ["nginx:1.17", "redis:6"]}'
+  curl localhost:8080/jobs/1
+  curl localhost:8080/jobs?status=failed
+
+jobs are persisted into --db, unfinished jobs are resumed after restart
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		region := awsTarget()
+		mapper := newImageMapper(region)
+
+		store, err := pkg.OpenJobStore(jobDB)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		server := &pkg.MirrorServer{
+			Store:         store,
+			Mapper:        mapper,
+			Transfer:      pkg.NativeTransfer(newRegistryClient(), mapper),
+			Workers:       transferWorkers,
+			MaxAttempts:   maxAttempts,
+			RetryInterval: retryInterval,
+			OnUpdate: func(job *pkg.Job) {
+				switch job.Status {
+				case pkg.JobSucceeded:
+					fmt.Printf("job %d: %s is transferred to %s\n", job.ID, job.Image, strings.Join(job.Targets, ", "))
+				case pkg.JobFailed, pkg.JobQueued:
+					fmt.Printf("job %d: %s attempt %d failed: %s\n", job.ID, job.Image, job.Attempts, job.Message)
+				case pkg.JobRejected:
+					fmt.Printf("job %d: %s is rejected: %s\n", job.ID, job.Image, job.Message)
+				}
+			},
+		}
+		if err := server.Start(); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/jobs", server)
+		mux.Handle("/jobs/", server)
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})
+		httpServer := &http.Server{Addr: serveAddr, Handler: mux}
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-stop
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			httpServer.Shutdown(ctx)
+		}()
+
+		fmt.Printf("serving on %s\n", serveAddr)
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		// running jobs are finished, and queued jobs are resumed by the next serve
+		server.Stop()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	serveCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
+	serveCmd.PersistentFlags().StringVar(&serveAddr, "addr", ":8080", "address to listen")
+	serveCmd.PersistentFlags().StringVar(&jobDB, "db", "trimg.db", "file to persist jobs")
+	serveCmd.PersistentFlags().IntVar(&transferWorkers, "workers", 2, "number of images transferred at the same time")
+	serveCmd.PersistentFlags().IntVar(&maxAttempts, "max-attempts", 3, "a job fails after the number of attempts")
+	serveCmd.PersistentFlags().DurationVar(&retryInterval, "retry-interval", 30*time.Second, "interval before retrying failed transfer")
+	addImageFlags(serveCmd)
+	addTransferFlags(serveCmd)
+}
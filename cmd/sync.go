@@ -0,0 +1,112 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	syncFile string
+	prune    bool
+)
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "reconcile ECR with images.yaml, missing images are transferred and drifted repository settings are fixed",
+	Long: `sync subcommand read the spec of images and repositories, and then make ECR match it
+the plan is printed before changes are applied, and --dry-run only prints the plan
+
+  trimg sync -f images.yaml --dry-run
+  trimg sync -f images.yaml --prune
+
+images.yaml:
+  repository:
+    scanOnPush: true
+    tagMutability: IMMUTABLE
+  images:
+    - source: registry.k8s.io/kube-proxy
+      semver: ">=1.28.0"
+      latest: 3
+      destination: k8s/kube-proxy
+    - source: nginx
+      tags: ["1.25.3"]
+      repository:
+        tagMutability: MUTABLE
+
+with --prune, tags in the repositories of the spec which are not selected are deleted
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if syncFile == "" {
+			fmt.Println("you should specify spec file by -f")
+			os.Exit(1)
+		}
+		spec, err := pkg.LoadSyncSpec(syncFile)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		// settings of repositories are managed by ECR API
+		if destinationRegistry() != "" {
+			fmt.Println("sync supports only ECR, destination registry can't be used")
+			os.Exit(1)
+		}
+		region := awsTarget()
+		mapper := newImageMapper(region)
+		mapper.Destinations = spec.Destinations()
+
+		syncer := &pkg.Syncer{
+			ECR:      pkg.NewECRClient(region),
+			Registry: newRegistryClient(),
+			Mapper:   mapper,
+		}
+		plan, err := syncer.Plan(spec, prune)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		plan.Write(os.Stdout)
+		if dryRun || plan.Empty() {
+			return
+		}
+
+		fmt.Println()
+		err = syncer.Apply(plan, func(images []string) []string {
+			return transferImages(images, nil, mapper)
+		})
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+
+	syncCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
+	syncCmd.PersistentFlags().StringVarP(&syncFile, "filename", "f", "", "specify spec file of images, e.g. images.yaml")
+	syncCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "only print the plan, without applying it.")
+	syncCmd.PersistentFlags().BoolVar(&prune, "prune", false, "delete tags which are not in the spec from repositories of the spec")
+	addImageFlags(syncCmd)
+	addTransferFlags(syncCmd)
+}
@@ -17,20 +17,23 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/esakat/trimg/pkg"
 	"github.com/spf13/cobra"
 	"github.com/vbauerster/mpb"
 	"github.com/vbauerster/mpb/decor"
 	"os"
+	"strings"
 	"sync"
 )
 
 var (
-	filename string
-	dryRun   bool
+	filename    string
+	dryRun      bool
+	helmChart   string
+	valuesFiles []string
+	fromList    string
+	planFile    string
+	applyFile   string
 )
 
 // transferCmd represents the transfer command
@@ -49,128 +52,187 @@ Specify image paths by manual:
 Get image paths from kubernetes manifest:
   trimg transfer -f kubernetes-manifest.yml
 
+Get image paths from list file, one image per line:
+  trimg transfer --from-list images.txt
+
+Get image paths from helm chart, the chart is rendered by "helm template":
+  trimg transfer --helm-chart ./nginx-ingress-1.30.0.tgz --values values.yaml
+
+Get image paths from running kubernetes cluster, images already in ECR are skipped:
+  trimg transfer --from-cluster --namespace default --selector app=web
+
+Resolve images to digests and review them, and then transfer exactly these digests:
+  trimg transfer -f kubernetes-manifest.yml --plan plan.json
+  trimg transfer --apply plan.json
+
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 
-		region := os.Getenv("AWS_DEFAULT_REGION")
-		if region == "" {
-			fmt.Printf("you should do `export AWS_DEFAULT_REGION=...`")
-			os.Exit(1)
-		}
+		region := awsTarget()
 
-		if accountId == "" {
-			svc := sts.New(session.New(&aws.Config{Region: aws.String(region)}))
-			t, err := svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if applyFile != "" {
+			mapper := newImageMapper(region)
+			plan, err := pkg.ReadTransferPlan(applyFile, mapper)
 			if err != nil {
 				fmt.Printf("%v\n", err)
 				os.Exit(1)
 			}
-			accountId = *t.Account
-		}
-
-		// run image transfer
-		if filename == "" {
-			if len(args) == 0 {
-				fmt.Printf("You should set image paths")
-				os.Exit(1)
+			jobs := make([]pkg.TransferJob, 0, len(plan.Images))
+			for _, image := range plan.Images {
+				jobs = append(jobs, pkg.TransferJob{Source: image.Source, Digest: image.Digest, Targets: image.Targets})
 			}
+			exitOnRejected(transferJobs(jobs, plan.Skipped, mapper))
+			return
+		}
 
-			args = removeDuplicateImage(args)
+		mapper := newImageMapper(region)
 
-			if dryRun {
-				fmt.Println("following images will be transfer")
-				for _, imagePath := range args {
-					newImagePath := pkg.ConvertImagePathForECR(imagePath, region, accountId)
-					fmt.Printf("%s -> %s\n", imagePath, newImagePath)
-				}
-			} else {
-				var wg sync.WaitGroup
-				p := mpb.New(mpb.WithWaitGroup(&wg))
-				steps, numBars := 5, len(args)
-				wg.Add(numBars)
-
-				resultMsg := make(chan string, len(args))
-
-				for _, imagePath := range args {
-					name := fmt.Sprintf("[%s]", imagePath)
-					bar := p.AddBar(int64(steps),
-						mpb.PrependDecorators(
-							decor.Name(name),
-						),
-						mpb.AppendDecorators(
-							decor.Percentage(decor.WCSyncSpace),
-						),
-					)
-					go pkg.ImageTransfer(imagePath, region, accountId, &wg, bar, resultMsg)
-				}
-				// wait all task finish
-				wg.Wait()
-
-				// output result
-				for i, _ := range args {
-					msg := <-resultMsg
-					fmt.Printf("%d: %s\n", i+1, msg)
-				}
-			}
+		var imagePaths []string
+		if fromCluster {
+			imagePaths = clusterImages(mapper)
 		} else {
-			// parse yaml file
-			yamls, err := pkg.ParseMultiDocYaml(filename)
+			imagePaths = collectImages(args)
+		}
+
+		// resolve digests and write them instead of transfer
+		if planFile != "" {
+			plan, err := pkg.ResolveTransferPlan(imagePaths, mapper, newRegistryClient())
 			if err != nil {
 				fmt.Printf("%v\n", err)
 				os.Exit(1)
 			}
-
-			// get image paths to transfer
-			var imagePaths []string
-			for _, y := range yamls {
-				images, err := pkg.GetUsingImages(y)
-				if err == nil {
-					imagePaths = append(imagePaths, images...)
-				}
+			if err := pkg.WriteTransferPlan(planFile, plan); err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
 			}
+			fmt.Printf("following images will be transfer by --apply %s\n", planFile)
+			for _, image := range plan.Images {
+				fmt.Printf("%s@%s -> %s\n", image.Source, image.Digest, strings.Join(image.Targets, ", "))
+			}
+			for _, msg := range plan.Skipped {
+				fmt.Println(msg)
+			}
+			return
+		}
 
-			imagePaths = removeDuplicateImage(imagePaths)
-
-			// if dryRun "true", just output target image paths
-			if dryRun {
-				fmt.Println("following images will be transfer")
-				for _, imagePath := range imagePaths {
-					newImagePath := pkg.ConvertImagePathForECR(imagePath, region, accountId)
-					fmt.Printf("%s -> %s\n", imagePath, newImagePath)
-				}
-			} else {
-				var wg sync.WaitGroup
-				p := mpb.New(mpb.WithWaitGroup(&wg))
-				steps, numBars := 5, len(imagePaths)
-				wg.Add(numBars)
-
-				resultMsg := make(chan string, len(imagePaths))
-
-				for _, imagePath := range imagePaths {
-					name := fmt.Sprintf("[%s]", imagePath)
-					bar := p.AddBar(int64(steps),
-						mpb.PrependDecorators(
-							decor.Name(name),
-						),
-						mpb.AppendDecorators(
-							decor.Percentage(decor.WCSyncSpace),
-						),
-					)
-					go pkg.ImageTransfer(imagePath, region, accountId, &wg, bar, resultMsg)
-				}
-				// wait all task finish
-				wg.Wait()
+		var images, skipped []string
+		for _, imagePath := range imagePaths {
+			if reason := mapper.Skip(imagePath); reason != "" {
+				skipped = append(skipped, fmt.Sprintf("%s is skipped, %s", imagePath, reason))
+				continue
+			}
+			images = append(images, imagePath)
+		}
 
-				// output result
-				for i, _ := range imagePaths {
-					msg := <-resultMsg
-					fmt.Printf("%d: %s\n", i+1, msg)
+		// if dryRun "true", just output target image paths
+		if dryRun {
+			fmt.Println("following images will be transfer")
+			for _, imagePath := range images {
+				targets, err := mapper.Targets(imagePath, "")
+				if err != nil {
+					fmt.Printf("%s -> %v\n", imagePath, err)
+					continue
 				}
+				fmt.Printf("%s -> %s\n", imagePath, strings.Join(targets, ", "))
 			}
+			for _, msg := range skipped {
+				fmt.Println(msg)
+			}
+			return
 		}
+
+		exitOnRejected(transferImages(images, skipped, mapper))
 	},
 }
 
+// get image paths from --helm-chart, --from-list, -f or args, duplicated images are removed
+func collectImages(args []string) []string {
+	var imagePaths []string
+	switch {
+	case helmChart != "":
+		out, err := pkg.RenderHelmChart(helmChart, valuesFiles)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		imagePaths = manifestImages(loadManifestData(helmChart, out))
+	case fromList != "":
+		images, err := pkg.ReadImageList(fromList)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		imagePaths = images
+	case filename != "":
+		// parse yaml file
+		imagePaths = manifestImages(loadManifests(filename))
+	default:
+		if len(args) == 0 {
+			fmt.Printf("You should set image paths")
+			os.Exit(1)
+		}
+		imagePaths = args
+	}
+	return removeDuplicateImage(imagePaths)
+}
+
+// run image transfer with progress bars, skipped images are reported after transferred images.
+// it returns result messages of failed images
+func transferImages(imagePaths, skipped []string, mapper *pkg.ImageMapper) []string {
+	jobs := make([]pkg.TransferJob, 0, len(imagePaths))
+	for _, imagePath := range imagePaths {
+		jobs = append(jobs, pkg.TransferJob{Source: imagePath})
+	}
+	return transferJobs(jobs, skipped, mapper)
+}
+
+func transferJobs(jobs []pkg.TransferJob, skipped []string, mapper *pkg.ImageMapper) []string {
+	var wg sync.WaitGroup
+	p := mpb.New(mpb.WithWaitGroup(&wg))
+	steps, numBars := pkg.TransferSteps, len(jobs)
+	wg.Add(numBars)
+
+	resultMsg := make(chan string, len(jobs))
+
+	for _, job := range jobs {
+		name := fmt.Sprintf("[%s]", job.Source)
+		bar := p.AddBar(int64(steps),
+			mpb.PrependDecorators(
+				decor.Name(name),
+			),
+			mpb.AppendDecorators(
+				decor.Percentage(decor.WCSyncSpace),
+			),
+		)
+		go pkg.RunTransferJob(job, mapper, &wg, bar, resultMsg)
+	}
+	// wait all task finish
+	wg.Wait()
+
+	// output result
+	var failures []string
+	for i := range jobs {
+		msg := <-resultMsg
+		fmt.Printf("%d: %s\n", i+1, msg)
+		if pkg.IsTransferFailure(msg) {
+			failures = append(failures, msg)
+		}
+	}
+	for i, msg := range skipped {
+		fmt.Printf("%d: %s\n", len(jobs)+i+1, msg)
+	}
+	return failures
+}
+
+// images above --fail-on are pushed and images rejected by signature policy are not transferred, they should not be deployed
+func exitOnRejected(failures []string) {
+	for _, msg := range failures {
+		if pkg.IsTransferRejected(msg) {
+			os.Exit(1)
+		}
+	}
+}
+
 func removeDuplicateImage(images []string) []string {
 	results := make([]string, 0, len(images))
 	encountered := map[string]bool{}
@@ -189,4 +251,13 @@ func init() {
 	transferCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
 	transferCmd.PersistentFlags().StringVarP(&filename, "filename", "f", "", "specify kubernetes manifest filepath")
 	transferCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "only print the object that would be replaced, without transfer it.")
+	transferCmd.PersistentFlags().StringVar(&fromList, "from-list", "", "specify file which lists image paths, one image per line")
+	transferCmd.PersistentFlags().StringVar(&helmChart, "helm-chart", "", "specify helm chart directory or packaged chart(.tgz)")
+	transferCmd.PersistentFlags().StringArrayVar(&valuesFiles, "values", nil, "values file for --helm-chart, can be specified multiple times")
+	transferCmd.PersistentFlags().StringVar(&planFile, "plan", "", "resolve images to digests and write them into the file, without transfer them")
+	transferCmd.PersistentFlags().StringVar(&applyFile, "apply", "", "transfer exactly the digests of the plan file made by --plan")
+	transferCmd.PersistentFlags().BoolVar(&strict, "strict", false, "fail when manifest has broken documents, default: print warnings and skip them")
+	addImageFlags(transferCmd)
+	addTransferFlags(transferCmd)
+	addClusterFlags(transferCmd)
 }
@@ -0,0 +1,51 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/esakat/trimg/pkg"
+)
+
+// exitOnRejected is run in the test binary itself, because it exits
+func TestExitOnRejected(t *testing.T) {
+	if failures := os.Getenv("TRIMG_TEST_FAILURES"); failures != "" {
+		exitOnRejected([]string{failures})
+		return
+	}
+
+	for msg, code := range map[string]int{
+		"nginx:1.17 failed to transfer. error message: timeout":                                                            0,
+		"nginx:1.17 " + pkg.FailedScanGate + ". error message: CRITICAL findings":                                          1,
+		"ghcr.io/attacker/kyverno:v1.11.0 " + pkg.RejectedBySignaturePolicy + ". error message: signature is not verified": 1,
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestExitOnRejected$")
+		cmd.Env = append(os.Environ(), "TRIMG_TEST_FAILURES="+msg)
+		err := cmd.Run()
+		actual := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			actual = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if actual != code {
+			t.Errorf("%s: expected exit code %d, got: %d", msg, code, actual)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var platforms []string
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify <imagename>",
+	Short: "check all images of manifest exist in ECR",
+	Long: `verify subcommand checks images of replaced manifest exist in ECR, it exits with 1 when some images are missing
+it finds that replace was run but transfer was not
+
+  trimg verify -f replaced.yml
+  trimg verify -f replaced.yml --plan plan.json --platform linux/amd64 --platform linux/arm64
+
+with --plan, digests in ECR should be the same as the plan made by "transfer --plan"
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		imagePaths := collectImages(args)
+
+		region := awsTarget()
+		clients := map[string]ecriface.ECRAPI{}
+		mapper := newImageMapper(region)
+		verifier := &pkg.Verifier{
+			ECR: func(r string) ecriface.ECRAPI {
+				if _, ok := clients[r]; !ok {
+					clients[r] = pkg.NewECRClient(r)
+				}
+				return clients[r]
+			},
+			Registry:  newRegistryClient(),
+			Mapper:    mapper,
+			Platforms: platforms,
+		}
+		if planFile != "" {
+			plan, err := pkg.ReadTransferPlan(planFile, mapper)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+			verifier.Expected = pkg.ExpectedFromPlan(plan)
+		}
+
+		failed := 0
+		for _, r := range verifier.Verify(imagePaths) {
+			fmt.Printf("%-8s %s %s\n", r.Status, r.Image, r.Message)
+			if r.Failed() {
+				failed++
+			}
+		}
+		if failed != 0 {
+			fmt.Printf("\n%d of %d images are not available from ECR\n", failed, len(imagePaths))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
+	verifyCmd.PersistentFlags().StringVarP(&filename, "filename", "f", "", "specify kubernetes manifest filepath")
+	verifyCmd.PersistentFlags().StringVar(&fromList, "from-list", "", "specify file which lists image paths, one image per line")
+	verifyCmd.PersistentFlags().StringVar(&planFile, "plan", "", "plan file made by \"transfer --plan\", digests in ECR should match it")
+	verifyCmd.PersistentFlags().StringArrayVar(&platforms, "platform", nil, "platform which all images should have, e.g. linux/arm64, can be specified multiple times")
+	verifyCmd.PersistentFlags().BoolVar(&strict, "strict", false, "fail when manifest has broken documents, default: print warnings and skip them")
+}
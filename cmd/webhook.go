@@ -0,0 +1,138 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/esakat/trimg/pkg"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	listenAddr         string
+	tlsCertFile        string
+	tlsKeyFile         string
+	webhookNamespaces  []string
+	excludeNamespaces  []string
+	auditLog           string
+	backgroundTransfer bool
+	transferWorkers    int
+)
+
+// webhookCmd represents the webhook command
+var webhookCmd = &cobra.Command{
+	Use:   "webhook",
+	Short: "serve mutating admission webhook which replaces images of pods with ECR",
+	Long: `webhook subcommand serves kubernetes MutatingAdmissionWebhook over TLS,
+images of pods are replaced at admission time in the same way as replace subcommand
+
+  trimg webhook --tls-cert-file tls.crt --tls-key-file tls.key --namespace "team-*" --exclude-namespace kube-system
+
+register https://<service>/mutate as a webhook for CREATE of pods.
+pods are always allowed, images are kept as is when they can't be replaced.
+with --transfer, replaced images are transferred to ECR in background, docker daemon is required
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if tlsCertFile == "" || tlsKeyFile == "" {
+			fmt.Println("you should specify --tls-cert-file and --tls-key-file")
+			os.Exit(1)
+		}
+		region := awsTarget()
+		mapper := newImageMapper(region)
+
+		mutator := &pkg.PodImageMutator{
+			Mapper:            mapper,
+			Namespaces:        webhookNamespaces,
+			ExcludeNamespaces: excludeNamespaces,
+		}
+		if auditLog != "" {
+			audit, err := openAuditLog(auditLog)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+			defer audit.Close()
+			mutator.Audit = audit
+		}
+		var queue *pkg.TransferQueue
+		if backgroundTransfer {
+			queue = pkg.NewTransferQueue(mapper, transferWorkers, 100)
+			queue.Done = func(image, msg string) {
+				fmt.Println(msg)
+			}
+			mutator.OnReplace = func(image string) {
+				queue.Enqueue(image)
+			}
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/mutate", mutator)
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})
+		server := &http.Server{Addr: listenAddr, Handler: mux}
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-stop
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+		}()
+
+		fmt.Printf("serving webhook on %s\n", listenAddr)
+		if err := server.ListenAndServeTLS(tlsCertFile, tlsKeyFile); err != http.ErrServerClosed {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if queue != nil {
+			queue.Close()
+		}
+	},
+}
+
+// "-" means stdout
+func openAuditLog(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+func init() {
+	rootCmd.AddCommand(webhookCmd)
+
+	webhookCmd.PersistentFlags().StringVar(&accountId, "account-id", "", "target of pushing images, default: your IAM AccountId")
+	webhookCmd.PersistentFlags().StringVar(&listenAddr, "addr", ":8443", "address to listen")
+	webhookCmd.PersistentFlags().StringVar(&tlsCertFile, "tls-cert-file", "", "certificate file for TLS")
+	webhookCmd.PersistentFlags().StringVar(&tlsKeyFile, "tls-key-file", "", "private key file for TLS")
+	webhookCmd.PersistentFlags().StringArrayVar(&webhookNamespaces, "namespace", nil, "only pods in the namespace are mutated, can be specified multiple times, e.g. \"team-*\", default: all namespaces")
+	webhookCmd.PersistentFlags().StringArrayVar(&excludeNamespaces, "exclude-namespace", nil, "pods in the namespace are not mutated, can be specified multiple times")
+	webhookCmd.PersistentFlags().StringVar(&auditLog, "audit-log", "", "file to write replaced images as json lines, \"-\" for stdout")
+	webhookCmd.PersistentFlags().BoolVar(&backgroundTransfer, "transfer", false, "transfer replaced images to ECR in background")
+	webhookCmd.PersistentFlags().IntVar(&transferWorkers, "workers", 2, "number of images transferred at the same time by --transfer")
+	addImageFlags(webhookCmd)
+	addTransferFlags(webhookCmd)
+}
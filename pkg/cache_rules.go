@@ -0,0 +1,107 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"sort"
+)
+
+// PullThroughCacheRule serves images of the upstream registry from ECR, e.g. "quay.io/coreos/etcd" as "<ECR>/quay/coreos/etcd"
+type PullThroughCacheRule struct {
+	// upstream registry, e.g. "quay.io", "public.ecr.aws"
+	Registry string `yaml:"registry"`
+	// prefix of repositories in ECR, default is decided by the registry
+	Prefix string `yaml:"prefix"`
+}
+
+// prefixes used in AWS documents
+var defaultCachePrefixes = map[string]string{
+	"public.ecr.aws":  "ecr-public",
+	"quay.io":         "quay",
+	"registry.k8s.io": "k8s",
+}
+
+// WithDefaults returns the rule whose prefix is filled for known registries
+func (r PullThroughCacheRule) WithDefaults() PullThroughCacheRule {
+	if r.Prefix == "" {
+		r.Prefix = defaultCachePrefixes[r.Registry]
+	}
+	return r
+}
+
+func (r PullThroughCacheRule) Validate() error {
+	if r.Registry == "" {
+		return fmt.Errorf("registry is required")
+	}
+	if len(r.Prefix) < 2 {
+		return fmt.Errorf("%s: prefix should be 2 or more characters", r.Registry)
+	}
+	return nil
+}
+
+// ListPullThroughCacheRules returns rules of the registry in order of prefix
+func ListPullThroughCacheRules(svc ecriface.ECRAPI, accountId string) ([]PullThroughCacheRule, error) {
+	var rules []PullThroughCacheRule
+	input := &ecr.DescribePullThroughCacheRulesInput{RegistryId: aws.String(accountId)}
+	err := svc.DescribePullThroughCacheRulesPages(input, func(out *ecr.DescribePullThroughCacheRulesOutput, lastPage bool) bool {
+		for _, r := range out.PullThroughCacheRules {
+			rules = append(rules, PullThroughCacheRule{Registry: aws.StringValue(r.UpstreamRegistryUrl), Prefix: aws.StringValue(r.EcrRepositoryPrefix)})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Prefix < rules[j].Prefix })
+	return rules, nil
+}
+
+// MissingCacheRules returns rules which should be created, prefix used for another registry is error
+func MissingCacheRules(existing, rules []PullThroughCacheRule) ([]PullThroughCacheRule, error) {
+	registries := map[string]string{}
+	for _, r := range existing {
+		registries[r.Prefix] = r.Registry
+	}
+	var missing []PullThroughCacheRule
+	for _, r := range rules {
+		registry, ok := registries[r.Prefix]
+		if !ok {
+			missing = append(missing, r)
+			continue
+		}
+		if registry != r.Registry {
+			return nil, fmt.Errorf("prefix %s is already used for %s", r.Prefix, registry)
+		}
+	}
+	return missing, nil
+}
+
+// CreatePullThroughCacheRule create the rule, it does nothing when the rule already exists
+func CreatePullThroughCacheRule(svc ecriface.ECRAPI, accountId string, rule PullThroughCacheRule) error {
+	_, err := svc.CreatePullThroughCacheRule(&ecr.CreatePullThroughCacheRuleInput{
+		RegistryId:          aws.String(accountId),
+		EcrRepositoryPrefix: aws.String(rule.Prefix),
+		UpstreamRegistryUrl: aws.String(rule.Registry),
+	})
+	if err != nil && !isAWSErrorCode(err, ecr.ErrCodePullThroughCacheRuleAlreadyExistsException) {
+		return err
+	}
+	return nil
+}
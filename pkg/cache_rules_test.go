@@ -0,0 +1,128 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"reflect"
+	"testing"
+)
+
+// fakeCacheECR is a stand-in of pull-through cache API, rules are returned one per page
+type fakeCacheECR struct {
+	ecriface.ECRAPI
+	rules []*ecr.PullThroughCacheRule
+}
+
+func (f *fakeCacheECR) DescribePullThroughCacheRulesPages(input *ecr.DescribePullThroughCacheRulesInput, fn func(*ecr.DescribePullThroughCacheRulesOutput, bool) bool) error {
+	for i, r := range f.rules {
+		if !fn(&ecr.DescribePullThroughCacheRulesOutput{PullThroughCacheRules: []*ecr.PullThroughCacheRule{r}}, i == len(f.rules)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeCacheECR) CreatePullThroughCacheRule(input *ecr.CreatePullThroughCacheRuleInput) (*ecr.CreatePullThroughCacheRuleOutput, error) {
+	for _, r := range f.rules {
+		if *r.EcrRepositoryPrefix == *input.EcrRepositoryPrefix {
+			return nil, awserr.New(ecr.ErrCodePullThroughCacheRuleAlreadyExistsException, "rule already exists", nil)
+		}
+	}
+	f.rules = append(f.rules, &ecr.PullThroughCacheRule{EcrRepositoryPrefix: input.EcrRepositoryPrefix, UpstreamRegistryUrl: input.UpstreamRegistryUrl})
+	return &ecr.CreatePullThroughCacheRuleOutput{}, nil
+}
+
+func TestPullThroughCacheRules(t *testing.T) {
+	svc := &fakeCacheECR{rules: []*ecr.PullThroughCacheRule{
+		{EcrRepositoryPrefix: aws.String("quay"), UpstreamRegistryUrl: aws.String("quay.io")},
+		{EcrRepositoryPrefix: aws.String("ecr-public"), UpstreamRegistryUrl: aws.String("public.ecr.aws")},
+	}}
+	existing, err := ListPullThroughCacheRules(svc, "111222333444")
+	if err != nil {
+		t.Fatalf("failed to list: %v", err)
+	}
+	expected := []PullThroughCacheRule{{"public.ecr.aws", "ecr-public"}, {"quay.io", "quay"}}
+	if !reflect.DeepEqual(existing, expected) {
+		t.Errorf("expected: %v, got: %v", expected, existing)
+	}
+
+	rules := []PullThroughCacheRule{
+		PullThroughCacheRule{Registry: "quay.io"}.WithDefaults(),
+		PullThroughCacheRule{Registry: "registry.k8s.io"}.WithDefaults(),
+	}
+	missing, err := MissingCacheRules(existing, rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(missing, []PullThroughCacheRule{{"registry.k8s.io", "k8s"}}) {
+		t.Errorf("unexpected missing rules: %v", missing)
+	}
+	if _, err := MissingCacheRules(existing, []PullThroughCacheRule{{"ghcr.io", "quay"}}); err == nil {
+		t.Error("prefix used for another registry should be error")
+	}
+
+	for _, rule := range append(missing, rules[0]) {
+		if err := CreatePullThroughCacheRule(svc, "111222333444", rule); err != nil {
+			t.Errorf("failed to create %v: %v", rule, err)
+		}
+	}
+	if len(svc.rules) != 3 {
+		t.Errorf("expected 3 rules, got: %d", len(svc.rules))
+	}
+	if err := (PullThroughCacheRule{Registry: "ghcr.io"}).WithDefaults().Validate(); err == nil {
+		t.Error("prefix of unknown registry is required")
+	}
+}
+
+func TestImageMapperPullThroughCache(t *testing.T) {
+	mapper, err := NewImageMapper(&Config{PullThroughCache: []PullThroughCacheRule{{Registry: "quay.io"}}}, "ap-northeast-1", "111222333444")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ecr := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/"
+
+	patterns := []struct {
+		image    string
+		expected Mapping
+	}{
+		{"quay.io/coreos/etcd:v3.4", Mapping{"quay.io/coreos/etcd:v3.4", ecr + "quay/coreos/etcd:v3.4", SkipPullThroughCache}},
+		{"quay.io/coreos/etcd@sha256:abcd", Mapping{"quay.io/coreos/etcd@sha256:abcd", ecr + "quay/coreos/etcd@sha256:abcd", SkipPullThroughCache}},
+		{"nginx:1.17", Mapping{"nginx:1.17", ecr + "nginx:1.17", ""}},
+		{ecr + "quay/coreos/etcd:v3.4", Mapping{ecr + "quay/coreos/etcd:v3.4", ecr + "quay/coreos/etcd:v3.4", SkipAlreadyMirrored}},
+	}
+	for _, p := range patterns {
+		mapping, err := mapper.Map(p.image)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", p.image, err)
+		} else if mapping != p.expected {
+			t.Errorf("%s: want %v, actual %v", p.image, p.expected, mapping)
+		}
+	}
+	if !mapper.IsCached(ecr+"quay/coreos/etcd:v3.4") || mapper.IsCached(ecr+"nginx:1.17") {
+		t.Error("only images under the prefix are cached")
+	}
+
+	if _, err := NewImageMapper(&Config{
+		Destination:      DestinationConfig{Registry: "harbor.example.com"},
+		PullThroughCache: []PullThroughCacheRule{{Registry: "quay.io"}},
+	}, "", ""); err == nil {
+		t.Error("pull-through cache should be error for registry destination")
+	}
+}
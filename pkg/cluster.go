@@ -0,0 +1,186 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sort"
+)
+
+// NewKubernetesClient make client from kubeconfig, KUBECONFIG and ~/.kube/config are used when it is empty
+func NewKubernetesClient(kubeconfig, context string) (kubernetes.Interface, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// ClusterScanOptions select workloads to scan
+type ClusterScanOptions struct {
+	// all namespaces when it is empty
+	Namespaces []string
+	// label selector of workloads, e.g. "app=web,tier!=cache"
+	LabelSelector string
+}
+
+// ClusterImage is an image and workloads which use it
+type ClusterImage struct {
+	Image string
+	// e.g. "default/Deployment/web", sorted
+	Workloads []string
+}
+
+// ScanClusterImages collect images of containers, initContainers and ephemeralContainers
+// from pods and templates of workloads, images are sorted
+func ScanClusterImages(client kubernetes.Interface, opts ClusterScanOptions) ([]ClusterImage, error) {
+	namespaces := opts.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	listOptions := metav1.ListOptions{LabelSelector: opts.LabelSelector}
+	ctx := context.Background()
+
+	workloads := map[string]map[string]bool{}
+	add := func(namespace, kind, name string, spec corev1.PodSpec) {
+		workload := namespace + "/" + kind + "/" + name
+		for _, image := range podSpecImages(spec) {
+			if workloads[image] == nil {
+				workloads[image] = map[string]bool{}
+			}
+			workloads[image][workload] = true
+		}
+	}
+
+	for _, ns := range namespaces {
+		pods, err := client.CoreV1().Pods(ns).List(ctx, listOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pods: %v", err)
+		}
+		for _, o := range pods.Items {
+			add(o.Namespace, "Pod", o.Name, o.Spec)
+		}
+
+		// templates are scanned for workloads which have no pods, e.g. replicas: 0, cronjobs
+		deployments, err := client.AppsV1().Deployments(ns).List(ctx, listOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list deployments: %v", err)
+		}
+		for _, o := range deployments.Items {
+			add(o.Namespace, "Deployment", o.Name, o.Spec.Template.Spec)
+		}
+		statefulSets, err := client.AppsV1().StatefulSets(ns).List(ctx, listOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list statefulsets: %v", err)
+		}
+		for _, o := range statefulSets.Items {
+			add(o.Namespace, "StatefulSet", o.Name, o.Spec.Template.Spec)
+		}
+		daemonSets, err := client.AppsV1().DaemonSets(ns).List(ctx, listOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list daemonsets: %v", err)
+		}
+		for _, o := range daemonSets.Items {
+			add(o.Namespace, "DaemonSet", o.Name, o.Spec.Template.Spec)
+		}
+		jobs, err := client.BatchV1().Jobs(ns).List(ctx, listOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list jobs: %v", err)
+		}
+		for _, o := range jobs.Items {
+			add(o.Namespace, "Job", o.Name, o.Spec.Template.Spec)
+		}
+		cronJobs, err := listCronJobs(ctx, client, ns, listOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list cronjobs: %v", err)
+		}
+		for _, o := range cronJobs {
+			add(o.Namespace, "CronJob", o.Name, o.Spec.JobTemplate.Spec.Template.Spec)
+		}
+	}
+
+	results := make([]ClusterImage, 0, len(workloads))
+	for image, names := range workloads {
+		ci := ClusterImage{Image: image}
+		for name := range names {
+			ci.Workloads = append(ci.Workloads, name)
+		}
+		sort.Strings(ci.Workloads)
+		results = append(results, ci)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Image < results[j].Image })
+	return results, nil
+}
+
+func podSpecImages(spec corev1.PodSpec) []string {
+	var images []string
+	for _, c := range spec.InitContainers {
+		images = append(images, c.Image)
+	}
+	for _, c := range spec.Containers {
+		images = append(images, c.Image)
+	}
+	for _, c := range spec.EphemeralContainers {
+		images = append(images, c.Image)
+	}
+	return images
+}
+
+// listCronJobs list cronjobs of batch/v1 when the cluster serves it, batch/v1beta1 otherwise.
+// batch/v1beta1 CronJob was removed in Kubernetes 1.25, and it is treated as no cronjobs when it is not served
+func listCronJobs(ctx context.Context, client kubernetes.Interface, ns string, listOptions metav1.ListOptions) ([]batchv1beta1.CronJob, error) {
+	if resources, err := client.Discovery().ServerResourcesForGroupVersion("batch/v1"); err == nil {
+		for _, r := range resources.APIResources {
+			if r.Name != "cronjobs" {
+				continue
+			}
+			// batch/v1 CronJob has the same fields as batch/v1beta1 for the pod template
+			data, err := client.BatchV1().RESTClient().Get().
+				Namespace(ns).
+				Resource("cronjobs").
+				VersionedParams(&listOptions, scheme.ParameterCodec).
+				DoRaw(ctx)
+			if err != nil {
+				return nil, err
+			}
+			var cronJobs batchv1beta1.CronJobList
+			if err := json.Unmarshal(data, &cronJobs); err != nil {
+				return nil, err
+			}
+			return cronJobs.Items, nil
+		}
+	}
+	cronJobs, err := client.BatchV1beta1().CronJobs(ns).List(ctx, listOptions)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cronJobs.Items, nil
+}
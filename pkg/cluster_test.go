@@ -0,0 +1,117 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"reflect"
+	"testing"
+)
+
+func TestScanClusterImages(t *testing.T) {
+	meta := func(namespace, name string, labels map[string]string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels}
+	}
+	template := func(images ...string) corev1.PodTemplateSpec {
+		var containers []corev1.Container
+		for _, image := range images {
+			containers = append(containers, corev1.Container{Name: "c", Image: image})
+		}
+		return corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: containers}}
+	}
+	web := map[string]string{"app": "web"}
+
+	client := fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: meta("default", "web-1", web),
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init", Image: "busybox:1.31"}},
+				Containers:     []corev1.Container{{Name: "web", Image: "nginx:1.17"}},
+				EphemeralContainers: []corev1.EphemeralContainer{{
+					EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "nicolaka/netshoot"},
+				}},
+			},
+		},
+		&appsv1.Deployment{ObjectMeta: meta("default", "web", web), Spec: appsv1.DeploymentSpec{Template: template("nginx:1.17")}},
+		&appsv1.DaemonSet{ObjectMeta: meta("kube-system", "fluentd", nil), Spec: appsv1.DaemonSetSpec{Template: template("fluent/fluentd:v1.9")}},
+		&batchv1beta1.CronJob{
+			ObjectMeta: meta("batch", "report", nil),
+			Spec: batchv1beta1.CronJobSpec{JobTemplate: batchv1beta1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{Template: template("111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/report:v1")},
+			}},
+		},
+	)
+
+	images, err := ScanClusterImages(client, ClusterScanOptions{})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	expected := []ClusterImage{
+		{"111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/report:v1", []string{"batch/CronJob/report"}},
+		{"busybox:1.31", []string{"default/Pod/web-1"}},
+		{"fluent/fluentd:v1.9", []string{"kube-system/DaemonSet/fluentd"}},
+		{"nginx:1.17", []string{"default/Deployment/web", "default/Pod/web-1"}},
+		{"nicolaka/netshoot", []string{"default/Pod/web-1"}},
+	}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("expected: %v, got: %v", expected, images)
+	}
+
+	// namespace and label selector
+	images, err = ScanClusterImages(client, ClusterScanOptions{Namespaces: []string{"default", "kube-system"}, LabelSelector: "app=web"})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	var actual []string
+	for _, image := range images {
+		actual = append(actual, image.Image)
+	}
+	if !reflect.DeepEqual(actual, []string{"busybox:1.31", "nginx:1.17", "nicolaka/netshoot"}) {
+		t.Errorf("unexpected images: %v", actual)
+	}
+}
+
+func TestScanClusterImagesWithoutCronJobV1beta1(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx:1.17"}}},
+	})
+	// batch/v1beta1 is not served since Kubernetes 1.25
+	client.PrependReactor("list", "cronjobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetResource().Version != "v1beta1" {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewNotFound(schema.GroupResource{Group: "batch", Resource: "cronjobs"}, "")
+	})
+
+	images, err := ScanClusterImages(client, ClusterScanOptions{})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	expected := []ClusterImage{{"nginx:1.17", []string{"default/Pod/web-1"}}}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("expected: %v, got: %v", expected, images)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+)
+
+// Config is the setting file of trimg
+type Config struct {
+	// registries which images are not transferred from, glob pattern can be used
+	InternalRegistries []string        `yaml:"internalRegistries"`
+	Filters            FilterConfig    `yaml:"filters"`
+	TagPolicy          TagPolicyConfig `yaml:"tagPolicy"`
+	Helm               HelmConfig      `yaml:"helm"`
+	// settings of ECR repositories created by trimg
+	Repository RepositorySettings `yaml:"repository"`
+	// registry which images are transferred to instead of ECR
+	Destination DestinationConfig `yaml:"destination"`
+	// registries accessed by plain HTTP instead of HTTPS, e.g. "localhost:5000"
+	InsecureRegistries []string `yaml:"insecureRegistries"`
+	// upstream registries served by ECR pull-through cache, their images are replaced with the cache instead of transfer
+	PullThroughCache []PullThroughCacheRule `yaml:"pullThroughCache"`
+	// keys and identities of cosign signatures for each source registry, they are verified by --verify-signatures
+	SignaturePolicies []SignaturePolicy `yaml:"signaturePolicy"`
+	// vulnerabilities ignored by --fail-on
+	Scan ScanConfig `yaml:"scan"`
+}
+
+// DestinationConfig is the registry other than ECR
+type DestinationConfig struct {
+	// registry host and optional path prefix, e.g. "harbor.example.com/mirror", "localhost:5000"
+	Registry string `yaml:"registry"`
+}
+
+// TagPolicyConfig is settings of TagPolicy
+type TagPolicyConfig struct {
+	// text/template of tag, fields of TagData can be used, e.g. "{{.Tag}}-mirrored-{{.Date}}"
+	Template        string        `yaml:"template"`
+	KeepOriginalTag bool          `yaml:"keepOriginalTag"`
+	Overrides       []TagOverride `yaml:"overrides"`
+	// value of {{.Date}}, default: today
+	Date string `yaml:"date"`
+}
+
+// FilterConfig is patterns of ImageFilter
+type FilterConfig struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+type HelmConfig struct {
+	// settings for each chart, key is the chart name
+	Charts map[string]HelmChartConfig `yaml:"charts"`
+}
+
+type HelmChartConfig struct {
+	// don't detect image keys automatically, use only Images
+	DisableHeuristics bool           `yaml:"disableHeuristics"`
+	Images            []HelmImageKey `yaml:"images"`
+}
+
+// HelmImageKey points image settings in values of the chart
+type HelmImageKey struct {
+	// dot separated path of values, e.g. "controller.image"
+	Path string `yaml:"path"`
+	// key of registry under Path, e.g. "registry"
+	RegistryKey string `yaml:"registryKey"`
+	// key of repository under Path, e.g. "repository".
+	// when both RegistryKey and RepositoryKey are empty, Path holds whole image name
+	RepositoryKey string `yaml:"repositoryKey"`
+}
+
+// LoadConfig read config file, unknown keys are error
+func LoadConfig(filepath string) (*Config, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
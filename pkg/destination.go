@@ -0,0 +1,140 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"strings"
+	"sync"
+)
+
+// Destination is the registry which images are transferred to
+type Destination interface {
+	// Registry returns the registry host, e.g. "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com"
+	Registry() string
+	// ImagePath returns the image path in the destination, image already in the destination is not converted
+	ImagePath(image string) string
+	// CreateRepository prepare the repository to push, it does nothing when the repository exists
+	CreateRepository(repository string, settings RepositorySettings) error
+	// Credential returns user and password to push images, they are empty for anonymous access
+	Credential() (RegistryCredential, error)
+	// ImageExists returns true when the repository has the tag or digest
+	ImageExists(repository, reference string) (bool, error)
+}
+
+// ECRDestination is the private registry of ECR
+type ECRDestination struct {
+	Region    string
+	AccountId string
+	// client of ECR API, it is made from Region when it is nil
+	ECR ecriface.ECRAPI
+
+	once sync.Once
+}
+
+func NewECRDestination(region, accountId string) *ECRDestination {
+	return &ECRDestination{Region: region, AccountId: accountId}
+}
+
+func (d *ECRDestination) service() ecriface.ECRAPI {
+	d.once.Do(func() {
+		if d.ECR == nil {
+			d.ECR = NewECRClient(d.Region)
+		}
+	})
+	return d.ECR
+}
+
+func (d *ECRDestination) Registry() string {
+	return ECRRegistry(d.Region, d.AccountId)
+}
+
+func (d *ECRDestination) ImagePath(image string) string {
+	return ConvertImagePathForECR(image, d.Region, d.AccountId)
+}
+
+func (d *ECRDestination) CreateRepository(repository string, settings RepositorySettings) error {
+	return CreateRepository(d.service(), repository, settings)
+}
+
+func (d *ECRDestination) Credential() (RegistryCredential, error) {
+	return ECRCredential(d.service())
+}
+
+func (d *ECRDestination) ImageExists(repository, reference string) (bool, error) {
+	id := &ecr.ImageIdentifier{ImageTag: aws.String(reference)}
+	if strings.Contains(reference, ":") {
+		id = &ecr.ImageIdentifier{ImageDigest: aws.String(reference)}
+	}
+	out, err := d.service().BatchGetImage(&ecr.BatchGetImageInput{
+		RegistryId:         aws.String(d.AccountId),
+		RepositoryName:     aws.String(repository),
+		ImageIds:           []*ecr.ImageIdentifier{id},
+		AcceptedMediaTypes: aws.StringSlice(manifestMediaTypes),
+	})
+	if err != nil {
+		if isAWSErrorCode(err, ecr.ErrCodeRepositoryNotFoundException) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(out.Images) != 0, nil
+}
+
+// RegistryDestination is a registry which implements OCI distribution API, e.g. Harbor, GitLab registry, registry:2.
+// repositories are created by push, Harbor projects should be created in advance
+type RegistryDestination struct {
+	// registry host and optional path prefix, e.g. "harbor.example.com/mirror"
+	Path string
+	// credential of the registry is read from Client
+	Client *RegistryClient
+}
+
+func NewRegistryDestination(path string, client *RegistryClient) *RegistryDestination {
+	return &RegistryDestination{Path: strings.TrimSuffix(path, "/"), Client: client}
+}
+
+func (d *RegistryDestination) Registry() string {
+	return strings.SplitN(d.Path, "/", 2)[0]
+}
+
+// ImagePath returns the image path under Path, images already under Path are not converted.
+// images in the same registry outside Path are converted, e.g. "registry.local:5000/other/app"
+func (d *RegistryDestination) ImagePath(image string) string {
+	if strings.HasPrefix(image, d.Path+"/") {
+		return image
+	}
+	return d.Path + "/" + image
+}
+
+func (d *RegistryDestination) CreateRepository(repository string, settings RepositorySettings) error {
+	return nil
+}
+
+func (d *RegistryDestination) Credential() (RegistryCredential, error) {
+	credential, _ := d.Client.credential(d.Registry())
+	return credential, nil
+}
+
+func (d *RegistryDestination) ImageExists(repository, reference string) (bool, error) {
+	_, err := d.Client.GetManifest(d.Registry(), repository, reference)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
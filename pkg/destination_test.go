@@ -0,0 +1,118 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestECRDestination(t *testing.T) {
+	svc := newFakeECR()
+	m := fakeManifest{MediaTypeDockerManifest, []byte("{}")}
+	svc.repositories["nginx"] = &fakeECRRepository{images: map[string]fakeManifest{"1.17": m, Digest(m.body): m}}
+	d := &ECRDestination{Region: "ap-northeast-1", AccountId: "111222333444", ECR: svc}
+
+	if d.ImagePath("nginx:1.17") != "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/nginx:1.17" {
+		t.Errorf("unexpected image path: %s", d.ImagePath("nginx:1.17"))
+	}
+	patterns := []struct {
+		repository, reference string
+		expected              bool
+	}{
+		{"nginx", "1.17", true},
+		{"nginx", "1.18", false},
+		{"nginx", Digest(m.body), true},
+		{"redis", "6", false},
+	}
+	for _, p := range patterns {
+		exists, err := d.ImageExists(p.repository, p.reference)
+		if err != nil || exists != p.expected {
+			t.Errorf("%s:%s expected: %v, got: %v, %v", p.repository, p.reference, p.expected, exists, err)
+		}
+	}
+	if err := d.CreateRepository("redis", RepositorySettings{}); err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	if _, ok := svc.repositories["redis"]; !ok {
+		t.Error("repository should be created")
+	}
+	if credential, err := d.Credential(); err != nil || credential.Username != "user" {
+		t.Errorf("unexpected credential: %v, %v", credential, err)
+	}
+}
+
+func TestRegistryDestination(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	nginx := source.pushImage("library/nginx", "1.17", Platform{OS: "linux", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "arm64"})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(source.Certificate())
+	pool.AddCert(registry.Certificate())
+	client := &RegistryClient{Client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}}
+	client.SetCredential(source.Host(), RegistryCredential{Username: "user", Password: "pass"})
+	client.SetCredential(registry.Host(), RegistryCredential{Username: "user", Password: "pass"})
+
+	d := NewRegistryDestination(registry.Host()+"/mirror/", client)
+	mapper := &ImageMapper{Destination: d}
+	prefix := registry.Host() + "/mirror/"
+
+	// path formatting
+	mapping, err := mapper.Map("quay.io/coreos/etcd:v3.4")
+	if err != nil || mapping.Target != prefix+"quay.io/coreos/etcd:v3.4" {
+		t.Errorf("unexpected mapping: %v, %v", mapping, err)
+	}
+	if !mapper.IsMirrored(prefix + "nginx:1.17") {
+		t.Error("image in the registry should not be transferred")
+	}
+	// the same registry outside the path
+	other := registry.Host() + "/other/app:v1"
+	if mapper.IsMirrored(other) {
+		t.Error("image outside the path should be transferred")
+	}
+	if mapping, err := mapper.Map(other); err != nil || mapping.Target != prefix+other {
+		t.Errorf("unexpected mapping: %v, %v", mapping, err)
+	}
+	repository, err := mapper.Repository("nginx:1.17")
+	if err != nil || repository != "mirror/nginx" {
+		t.Errorf("unexpected repository: %s, %v", repository, err)
+	}
+
+	// transfer into the registry, and then it exists
+	image := source.Host() + "/library/nginx:1.17"
+	if exists, err := d.ImageExists("mirror/"+source.Host()+"/library/nginx", "1.17"); err != nil || exists {
+		t.Fatalf("image should not exist yet: %v, %v", exists, err)
+	}
+	targets, err := NativeTransfer(client, mapper)(image)
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+	if !reflect.DeepEqual(targets, []string{prefix + image}) {
+		t.Errorf("unexpected targets: %v", targets)
+	}
+	for _, reference := range []string{"1.17", nginx.Digest} {
+		exists, err := d.ImageExists("mirror/"+source.Host()+"/library/nginx", reference)
+		if err != nil || !exists {
+			t.Errorf("%s should exist: %v, %v", reference, exists, err)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NewECRClient make ECR API client for the region
+func NewECRClient(region string) ecriface.ECRAPI {
+	return ecr.New(session.New(&aws.Config{Region: aws.String(region)}))
+}
+
+var ecrRegistryPattern = regexp.MustCompile(`^(\d{12})\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// ParseECRRegistry returns account and region of ECR registry host
+func ParseECRRegistry(registry string) (accountId, region string, ok bool) {
+	m := ecrRegistryPattern.FindStringSubmatch(registry)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// ECRCredential returns user and password for docker login of ECR
+func ECRCredential(svc ecriface.ECRAPI) (RegistryCredential, error) {
+	out, err := svc.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return RegistryCredential{}, err
+	}
+	if len(out.AuthorizationData) == 0 {
+		return RegistryCredential{}, fmt.Errorf("cannot get registry login token")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(out.AuthorizationData[0].AuthorizationToken))
+	if err != nil {
+		return RegistryCredential{}, err
+	}
+	// AuthorizationToken format is "user:password"
+	userPass := strings.SplitN(string(decoded), ":", 2)
+	if len(userPass) != 2 {
+		return RegistryCredential{}, fmt.Errorf("cannot get registry login token")
+	}
+	return RegistryCredential{Username: userPass[0], Password: userPass[1]}, nil
+}
+
+// CreateRepository create ECR repository with settings, it is not error when the repository already exists
+func CreateRepository(svc ecriface.ECRAPI, name string, settings RepositorySettings) error {
+	err := createRepository(svc, name, settings)
+	if err != nil && !isAWSErrorCode(err, ecr.ErrCodeRepositoryAlreadyExistsException) {
+		return err
+	}
+	return nil
+}
+
+func isAWSErrorCode(err error, code string) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == code
+}
+
+// tags which exist in the ECR repository, empty when the repository doesn't exist
+func listImageTags(svc ecriface.ECRAPI, accountId, repository string) (map[string]bool, error) {
+	input := &ecr.ListImagesInput{
+		RepositoryName: aws.String(repository),
+		RegistryId:     aws.String(accountId),
+		Filter:         &ecr.ListImagesFilter{TagStatus: aws.String(ecr.TagStatusTagged)},
+	}
+	tags := map[string]bool{}
+	err := svc.ListImagesPages(input, func(page *ecr.ListImagesOutput, lastPage bool) bool {
+		for _, id := range page.ImageIds {
+			if id.ImageTag != nil {
+				tags[*id.ImageTag] = true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		if isAWSErrorCode(err, ecr.ErrCodeRepositoryNotFoundException) {
+			return tags, nil
+		}
+		return nil, err
+	}
+	return tags, nil
+}
+
+// deleteImageTags delete tags from the ECR repository, images are deleted when they lose all tags
+func deleteImageTags(svc ecriface.ECRAPI, accountId, repository string, tags []string) error {
+	// BatchDeleteImage accepts 100 images at once
+	for start := 0; start < len(tags); start += 100 {
+		end := start + 100
+		if end > len(tags) {
+			end = len(tags)
+		}
+		var ids []*ecr.ImageIdentifier
+		for _, tag := range tags[start:end] {
+			ids = append(ids, &ecr.ImageIdentifier{ImageTag: aws.String(tag)})
+		}
+		out, err := svc.BatchDeleteImage(&ecr.BatchDeleteImageInput{
+			RegistryId:     aws.String(accountId),
+			RepositoryName: aws.String(repository),
+			ImageIds:       ids,
+		})
+		if err != nil {
+			return err
+		}
+		for _, failure := range out.Failures {
+			if aws.StringValue(failure.FailureCode) != ecr.ImageFailureCodeImageNotFound {
+				return fmt.Errorf("failed to delete %s:%s: %s", repository, aws.StringValue(failure.ImageId.ImageTag), aws.StringValue(failure.FailureReason))
+			}
+		}
+	}
+	return nil
+}
+
+// RepositorySettings is settings of ECR repository, empty fields are not managed
+type RepositorySettings struct {
+	ScanOnPush *bool `yaml:"scanOnPush,omitempty"`
+	// MUTABLE or IMMUTABLE
+	TagMutability string `yaml:"tagMutability,omitempty"`
+	// JSON text of lifecycle policy
+	LifecyclePolicy string `yaml:"lifecyclePolicy,omitempty"`
+	// resource tags, tags not listed here are left as they are
+	Tags map[string]string `yaml:"tags,omitempty"`
+}
+
+// Merge returns settings which fields of override are preferred
+func (s RepositorySettings) Merge(override RepositorySettings) RepositorySettings {
+	merged := s
+	if override.ScanOnPush != nil {
+		merged.ScanOnPush = override.ScanOnPush
+	}
+	if override.TagMutability != "" {
+		merged.TagMutability = override.TagMutability
+	}
+	if override.LifecyclePolicy != "" {
+		merged.LifecyclePolicy = override.LifecyclePolicy
+	}
+	if len(override.Tags) != 0 {
+		merged.Tags = map[string]string{}
+		for k, v := range s.Tags {
+			merged.Tags[k] = v
+		}
+		for k, v := range override.Tags {
+			merged.Tags[k] = v
+		}
+	}
+	return merged
+}
+
+// Validate checks values which ECR accepts
+func (s RepositorySettings) Validate() error {
+	switch s.TagMutability {
+	case "", ecr.ImageTagMutabilityMutable, ecr.ImageTagMutabilityImmutable:
+	default:
+		return fmt.Errorf("tagMutability should be %s or %s, but %q", ecr.ImageTagMutabilityMutable, ecr.ImageTagMutabilityImmutable, s.TagMutability)
+	}
+	if s.LifecyclePolicy != "" {
+		if _, err := compactJSON(s.LifecyclePolicy); err != nil {
+			return fmt.Errorf("lifecyclePolicy is not JSON: %v", err)
+		}
+	}
+	return nil
+}
+
+// SettingChange is a drift of repository setting
+type SettingChange struct {
+	// e.g. "scanOnPush", "tags.team"
+	Name string
+	// empty when it is not set
+	From string
+	To   string
+}
+
+// Diff returns changes to make current settings desired, only fields set in desired are compared
+func (s RepositorySettings) Diff(current RepositorySettings) []SettingChange {
+	var changes []SettingChange
+	add := func(name, from, to string) {
+		if from != to {
+			changes = append(changes, SettingChange{Name: name, From: from, To: to})
+		}
+	}
+	if s.ScanOnPush != nil {
+		from := ""
+		if current.ScanOnPush != nil {
+			from = strconv.FormatBool(*current.ScanOnPush)
+		}
+		add("scanOnPush", from, strconv.FormatBool(*s.ScanOnPush))
+	}
+	if s.TagMutability != "" {
+		add("tagMutability", current.TagMutability, s.TagMutability)
+	}
+	if s.LifecyclePolicy != "" {
+		from, _ := compactJSON(current.LifecyclePolicy)
+		to, _ := compactJSON(s.LifecyclePolicy)
+		add("lifecyclePolicy", from, to)
+	}
+	keys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		add("tags."+k, current.Tags[k], s.Tags[k])
+	}
+	return changes
+}
+
+// JSON without spaces, to compare policies
+func compactJSON(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(s)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ECRRepository is the current state of ECR repository
+type ECRRepository struct {
+	Name     string
+	Arn      string
+	Settings RepositorySettings
+}
+
+// describeRepository returns nil when the repository doesn't exist
+func describeRepository(svc ecriface.ECRAPI, accountId, name string) (*ECRRepository, error) {
+	out, err := svc.DescribeRepositories(&ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(accountId),
+		RepositoryNames: []*string{aws.String(name)},
+	})
+	if err != nil {
+		if isAWSErrorCode(err, ecr.ErrCodeRepositoryNotFoundException) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(out.Repositories) == 0 {
+		return nil, nil
+	}
+	r := out.Repositories[0]
+	repo := &ECRRepository{Name: name, Arn: aws.StringValue(r.RepositoryArn)}
+	repo.Settings.TagMutability = aws.StringValue(r.ImageTagMutability)
+	if r.ImageScanningConfiguration != nil {
+		repo.Settings.ScanOnPush = r.ImageScanningConfiguration.ScanOnPush
+	}
+
+	policy, err := svc.GetLifecyclePolicy(&ecr.GetLifecyclePolicyInput{
+		RegistryId:     aws.String(accountId),
+		RepositoryName: aws.String(name),
+	})
+	if err == nil {
+		repo.Settings.LifecyclePolicy = aws.StringValue(policy.LifecyclePolicyText)
+	} else if !isAWSErrorCode(err, ecr.ErrCodeLifecyclePolicyNotFoundException) {
+		return nil, err
+	}
+
+	tags, err := svc.ListTagsForResource(&ecr.ListTagsForResourceInput{ResourceArn: r.RepositoryArn})
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags.Tags {
+		if repo.Settings.Tags == nil {
+			repo.Settings.Tags = map[string]string{}
+		}
+		repo.Settings.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return repo, nil
+}
+
+// createRepository create ECR repository with settings
+func createRepository(svc ecriface.ECRAPI, name string, settings RepositorySettings) error {
+	input := &ecr.CreateRepositoryInput{RepositoryName: aws.String(name)}
+	if settings.ScanOnPush != nil {
+		input.ImageScanningConfiguration = &ecr.ImageScanningConfiguration{ScanOnPush: settings.ScanOnPush}
+	}
+	if settings.TagMutability != "" {
+		input.ImageTagMutability = aws.String(settings.TagMutability)
+	}
+	input.Tags = resourceTags(settings.Tags)
+	if _, err := svc.CreateRepository(input); err != nil {
+		return err
+	}
+	if settings.LifecyclePolicy != "" {
+		_, err := svc.PutLifecyclePolicy(&ecr.PutLifecyclePolicyInput{
+			RepositoryName:      aws.String(name),
+			LifecyclePolicyText: aws.String(settings.LifecyclePolicy),
+		})
+		return err
+	}
+	return nil
+}
+
+// updateRepository fix drifted settings of the repository
+func updateRepository(svc ecriface.ECRAPI, accountId string, repo *ECRRepository, settings RepositorySettings) error {
+	current := repo.Settings
+	if settings.ScanOnPush != nil && (current.ScanOnPush == nil || *current.ScanOnPush != *settings.ScanOnPush) {
+		_, err := svc.PutImageScanningConfiguration(&ecr.PutImageScanningConfigurationInput{
+			RegistryId:                 aws.String(accountId),
+			RepositoryName:             aws.String(repo.Name),
+			ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: settings.ScanOnPush},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if settings.TagMutability != "" && current.TagMutability != settings.TagMutability {
+		_, err := svc.PutImageTagMutability(&ecr.PutImageTagMutabilityInput{
+			RegistryId:         aws.String(accountId),
+			RepositoryName:     aws.String(repo.Name),
+			ImageTagMutability: aws.String(settings.TagMutability),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if settings.LifecyclePolicy != "" {
+		from, _ := compactJSON(current.LifecyclePolicy)
+		to, _ := compactJSON(settings.LifecyclePolicy)
+		if from != to {
+			_, err := svc.PutLifecyclePolicy(&ecr.PutLifecyclePolicyInput{
+				RegistryId:          aws.String(accountId),
+				RepositoryName:      aws.String(repo.Name),
+				LifecyclePolicyText: aws.String(settings.LifecyclePolicy),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	changed := map[string]string{}
+	for k, v := range settings.Tags {
+		if current.Tags[k] != v {
+			changed[k] = v
+		}
+	}
+	if len(changed) != 0 {
+		_, err := svc.TagResource(&ecr.TagResourceInput{ResourceArn: aws.String(repo.Arn), Tags: resourceTags(changed)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resourceTags(tags map[string]string) []*ecr.Tag {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var results []*ecr.Tag
+	for _, k := range keys {
+		results = append(results, &ecr.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return results
+}
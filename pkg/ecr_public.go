@@ -0,0 +1,137 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecrpublic"
+	"github.com/aws/aws-sdk-go/service/ecrpublic/ecrpubliciface"
+	"strings"
+	"sync"
+)
+
+// ECRPublicRegistry is the registry host of ECR Public
+const ECRPublicRegistry = "public.ecr.aws"
+
+// NewECRPublicClient make client of ECR Public API, it is available only in us-east-1
+func NewECRPublicClient() ecrpubliciface.ECRPublicAPI {
+	return ecrpublic.New(session.New(&aws.Config{Region: aws.String("us-east-1")}))
+}
+
+// ECRPublicCredential returns user and password of ECR Public, the token is for all aliases and valid for 12 hours
+func ECRPublicCredential(svc ecrpubliciface.ECRPublicAPI) (RegistryCredential, error) {
+	out, err := svc.GetAuthorizationToken(&ecrpublic.GetAuthorizationTokenInput{})
+	if err != nil {
+		return RegistryCredential{}, err
+	}
+	if out.AuthorizationData == nil {
+		return RegistryCredential{}, fmt.Errorf("cannot get registry login token")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(out.AuthorizationData.AuthorizationToken))
+	if err != nil {
+		return RegistryCredential{}, err
+	}
+	// AuthorizationToken format is "user:password"
+	auth := strings.SplitN(string(decoded), ":", 2)
+	if len(auth) != 2 {
+		return RegistryCredential{}, fmt.Errorf("cannot get registry login token")
+	}
+	return RegistryCredential{Username: auth[0], Password: auth[1]}, nil
+}
+
+// ECRPublicDestination is the registry alias of ECR Public, e.g. "public.ecr.aws/myalias"
+type ECRPublicDestination struct {
+	Alias string
+	// client of ECR Public API, it is made when it is nil
+	ECR ecrpubliciface.ECRPublicAPI
+
+	once sync.Once
+}
+
+func NewECRPublicDestination(alias string) *ECRPublicDestination {
+	return &ECRPublicDestination{Alias: alias}
+}
+
+func (d *ECRPublicDestination) service() ecrpubliciface.ECRPublicAPI {
+	d.once.Do(func() {
+		if d.ECR == nil {
+			d.ECR = NewECRPublicClient()
+		}
+	})
+	return d.ECR
+}
+
+func (d *ECRPublicDestination) Registry() string {
+	return ECRPublicRegistry
+}
+
+// ImagePath returns "public.ecr.aws/<alias>/<image>", the image name is changed to fit repository names of ECR Public,
+// e.g. "localhost:5000/app" -> "public.ecr.aws/myalias/localhost-5000/app"
+func (d *ECRPublicDestination) ImagePath(image string) string {
+	prefix := ECRPublicRegistry + "/" + d.Alias + "/"
+	if strings.HasPrefix(image, prefix) {
+		return image
+	}
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return prefix + image
+	}
+	ref.Name = prefix + strings.Replace(strings.ToLower(ref.Name), ":", "-", -1)
+	return ref.String()
+}
+
+// CreateRepository create the repository under the alias, settings except tags are not supported by ECR Public
+func (d *ECRPublicDestination) CreateRepository(repository string, settings RepositorySettings) error {
+	input := &ecrpublic.CreateRepositoryInput{RepositoryName: aws.String(d.repositoryName(repository))}
+	for _, tag := range resourceTags(settings.Tags) {
+		input.Tags = append(input.Tags, &ecrpublic.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	_, err := d.service().CreateRepository(input)
+	if err != nil && !isAWSErrorCode(err, ecrpublic.ErrCodeRepositoryAlreadyExistsException) {
+		return err
+	}
+	return nil
+}
+
+// repository of image path has the alias, but API doesn't
+func (d *ECRPublicDestination) repositoryName(repository string) string {
+	return strings.TrimPrefix(repository, d.Alias+"/")
+}
+
+func (d *ECRPublicDestination) Credential() (RegistryCredential, error) {
+	return ECRPublicCredential(d.service())
+}
+
+func (d *ECRPublicDestination) ImageExists(repository, reference string) (bool, error) {
+	id := &ecrpublic.ImageIdentifier{ImageTag: aws.String(reference)}
+	if strings.Contains(reference, ":") {
+		id = &ecrpublic.ImageIdentifier{ImageDigest: aws.String(reference)}
+	}
+	out, err := d.service().DescribeImages(&ecrpublic.DescribeImagesInput{
+		RepositoryName: aws.String(d.repositoryName(repository)),
+		ImageIds:       []*ecrpublic.ImageIdentifier{id},
+	})
+	if err != nil {
+		if isAWSErrorCode(err, ecrpublic.ErrCodeRepositoryNotFoundException) || isAWSErrorCode(err, ecrpublic.ErrCodeImageNotFoundException) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(out.ImageDetails) != 0, nil
+}
@@ -0,0 +1,133 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecrpublic"
+	"github.com/aws/aws-sdk-go/service/ecrpublic/ecrpubliciface"
+	"testing"
+)
+
+// fakeECRPublic is a stand-in of ECR Public API, key of repositories is name without alias
+type fakeECRPublic struct {
+	ecrpubliciface.ECRPublicAPI
+	repositories map[string]map[string]bool
+	tags         map[string]map[string]string
+}
+
+func (f *fakeECRPublic) CreateRepository(input *ecrpublic.CreateRepositoryInput) (*ecrpublic.CreateRepositoryOutput, error) {
+	name := aws.StringValue(input.RepositoryName)
+	if _, ok := f.repositories[name]; ok {
+		return nil, awserr.New(ecrpublic.ErrCodeRepositoryAlreadyExistsException, "repository already exists", nil)
+	}
+	f.repositories[name] = map[string]bool{}
+	f.tags[name] = map[string]string{}
+	for _, tag := range input.Tags {
+		f.tags[name][*tag.Key] = *tag.Value
+	}
+	return &ecrpublic.CreateRepositoryOutput{}, nil
+}
+
+func (f *fakeECRPublic) DescribeImages(input *ecrpublic.DescribeImagesInput) (*ecrpublic.DescribeImagesOutput, error) {
+	images, ok := f.repositories[aws.StringValue(input.RepositoryName)]
+	if !ok {
+		return nil, awserr.New(ecrpublic.ErrCodeRepositoryNotFoundException, "repository not found", nil)
+	}
+	out := &ecrpublic.DescribeImagesOutput{}
+	for _, id := range input.ImageIds {
+		if !images[aws.StringValue(id.ImageTag)+aws.StringValue(id.ImageDigest)] {
+			return nil, awserr.New(ecrpublic.ErrCodeImageNotFoundException, "image not found", nil)
+		}
+		out.ImageDetails = append(out.ImageDetails, &ecrpublic.ImageDetail{})
+	}
+	return out, nil
+}
+
+func (f *fakeECRPublic) GetAuthorizationToken(input *ecrpublic.GetAuthorizationTokenInput) (*ecrpublic.GetAuthorizationTokenOutput, error) {
+	// "AWS:token"
+	return &ecrpublic.GetAuthorizationTokenOutput{AuthorizationData: &ecrpublic.AuthorizationData{AuthorizationToken: aws.String("QVdTOnRva2Vu")}}, nil
+}
+
+func TestECRPublicDestination(t *testing.T) {
+	svc := &fakeECRPublic{repositories: map[string]map[string]bool{}, tags: map[string]map[string]string{}}
+	d := &ECRPublicDestination{Alias: "myalias", ECR: svc}
+	mapper := &ImageMapper{Destination: d}
+
+	patterns := map[string]string{
+		"nginx:1.17":                        "public.ecr.aws/myalias/nginx:1.17",
+		"quay.io/coreos/etcd:v3.4":          "public.ecr.aws/myalias/quay.io/coreos/etcd:v3.4",
+		"localhost:5000/MyApp@sha256:abcd":  "public.ecr.aws/myalias/localhost-5000/myapp@sha256:abcd",
+		"public.ecr.aws/nginx/nginx:1.25":   "public.ecr.aws/myalias/public.ecr.aws/nginx/nginx:1.25",
+		"public.ecr.aws/myalias/nginx:1.17": "public.ecr.aws/myalias/nginx:1.17",
+	}
+	for image, expected := range patterns {
+		mapping, err := mapper.Map(image)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", image, err)
+		} else if mapping.Target != expected {
+			t.Errorf("%s: want %s, actual %s", image, expected, mapping.Target)
+		}
+	}
+	// images of other aliases are transferred
+	if mapper.IsMirrored("public.ecr.aws/nginx/nginx:1.25") || !mapper.IsMirrored("public.ecr.aws/myalias/nginx:1.17") {
+		t.Error("only images of the alias are mirrored")
+	}
+
+	repository, err := mapper.Repository("quay.io/coreos/etcd:v3.4")
+	if err != nil || repository != "myalias/quay.io/coreos/etcd" {
+		t.Fatalf("unexpected repository: %s, %v", repository, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.CreateRepository(repository, RepositorySettings{Tags: map[string]string{"team": "platform"}}); err != nil {
+			t.Fatalf("failed to create repository: %v", err)
+		}
+	}
+	if svc.tags["quay.io/coreos/etcd"]["team"] != "platform" {
+		t.Errorf("repository should be created without alias: %v", svc.tags)
+	}
+
+	svc.repositories["quay.io/coreos/etcd"]["v3.4"] = true
+	for reference, expected := range map[string]bool{"v3.4": true, "v3.5": false} {
+		if exists, err := d.ImageExists(repository, reference); err != nil || exists != expected {
+			t.Errorf("%s: want %v, actual %v, %v", reference, expected, exists, err)
+		}
+	}
+	if exists, err := d.ImageExists("myalias/redis", "6"); err != nil || exists {
+		t.Errorf("image of missing repository should not exist: %v, %v", exists, err)
+	}
+
+	credential, err := d.Credential()
+	if err != nil || credential.Username != "AWS" || credential.Password != "token" {
+		t.Errorf("unexpected credential: %v, %v", credential, err)
+	}
+}
+
+func TestNewImageMapperECRPublic(t *testing.T) {
+	mapper, err := NewImageMapper(&Config{Destination: DestinationConfig{Registry: "public.ecr.aws/myalias"}}, "", "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d, ok := mapper.Destination.(*ECRPublicDestination); !ok || d.Alias != "myalias" {
+		t.Errorf("want ECRPublicDestination of myalias, actual %#v", mapper.Destination)
+	}
+	for _, registry := range []string{"public.ecr.aws/", "public.ecr.aws/myalias/nginx"} {
+		if _, err := NewImageMapper(&Config{Destination: DestinationConfig{Registry: registry}}, "", ""); err == nil {
+			t.Errorf("%s should be error", registry)
+		}
+	}
+}
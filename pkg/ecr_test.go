@@ -0,0 +1,289 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeECR is a stand-in of ECR API, methods which are not implemented panic
+type fakeECR struct {
+	ecriface.ECRAPI
+	repositories map[string]*fakeECRRepository
+}
+
+type fakeECRRepository struct {
+	settings RepositorySettings
+	tags     map[string]bool
+	// manifests, key is tag and digest
+	images map[string]fakeManifest
+}
+
+func newFakeECR() *fakeECR {
+	return &fakeECR{repositories: map[string]*fakeECRRepository{}}
+}
+
+func (f *fakeECR) repository(name *string) (*fakeECRRepository, error) {
+	repo, ok := f.repositories[aws.StringValue(name)]
+	if !ok {
+		return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "repository not found", nil)
+	}
+	return repo, nil
+}
+
+func (f *fakeECR) DescribeRepositories(input *ecr.DescribeRepositoriesInput) (*ecr.DescribeRepositoriesOutput, error) {
+	out := &ecr.DescribeRepositoriesOutput{}
+	for _, name := range input.RepositoryNames {
+		repo, err := f.repository(name)
+		if err != nil {
+			return nil, err
+		}
+		out.Repositories = append(out.Repositories, &ecr.Repository{
+			RepositoryName:             name,
+			RepositoryArn:              aws.String("arn:" + *name),
+			ImageTagMutability:         aws.String(repo.settings.TagMutability),
+			ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: repo.settings.ScanOnPush},
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeECR) GetLifecyclePolicy(input *ecr.GetLifecyclePolicyInput) (*ecr.GetLifecyclePolicyOutput, error) {
+	repo, err := f.repository(input.RepositoryName)
+	if err != nil {
+		return nil, err
+	}
+	if repo.settings.LifecyclePolicy == "" {
+		return nil, awserr.New(ecr.ErrCodeLifecyclePolicyNotFoundException, "lifecycle policy not found", nil)
+	}
+	return &ecr.GetLifecyclePolicyOutput{LifecyclePolicyText: aws.String(repo.settings.LifecyclePolicy)}, nil
+}
+
+func (f *fakeECR) ListTagsForResource(input *ecr.ListTagsForResourceInput) (*ecr.ListTagsForResourceOutput, error) {
+	repo, err := f.repository(aws.String(strings.TrimPrefix(*input.ResourceArn, "arn:")))
+	if err != nil {
+		return nil, err
+	}
+	return &ecr.ListTagsForResourceOutput{Tags: resourceTags(repo.settings.Tags)}, nil
+}
+
+func (f *fakeECR) ListImagesPages(input *ecr.ListImagesInput, fn func(*ecr.ListImagesOutput, bool) bool) error {
+	repo, err := f.repository(input.RepositoryName)
+	if err != nil {
+		return err
+	}
+	var tags []string
+	for tag := range repo.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	// 2 tags per page
+	for i := 0; i < len(tags) || i == 0; i += 2 {
+		page := &ecr.ListImagesOutput{}
+		for j := i; j < i+2 && j < len(tags); j++ {
+			page.ImageIds = append(page.ImageIds, &ecr.ImageIdentifier{ImageTag: aws.String(tags[j])})
+		}
+		if !fn(page, i+2 >= len(tags)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeECR) CreateRepository(input *ecr.CreateRepositoryInput) (*ecr.CreateRepositoryOutput, error) {
+	name := aws.StringValue(input.RepositoryName)
+	if _, ok := f.repositories[name]; ok {
+		return nil, awserr.New(ecr.ErrCodeRepositoryAlreadyExistsException, "repository already exists", nil)
+	}
+	repo := &fakeECRRepository{tags: map[string]bool{}}
+	repo.settings.TagMutability = aws.StringValue(input.ImageTagMutability)
+	if repo.settings.TagMutability == "" {
+		repo.settings.TagMutability = ecr.ImageTagMutabilityMutable
+	}
+	repo.settings.ScanOnPush = aws.Bool(false)
+	if input.ImageScanningConfiguration != nil {
+		repo.settings.ScanOnPush = input.ImageScanningConfiguration.ScanOnPush
+	}
+	for _, tag := range input.Tags {
+		if repo.settings.Tags == nil {
+			repo.settings.Tags = map[string]string{}
+		}
+		repo.settings.Tags[*tag.Key] = *tag.Value
+	}
+	f.repositories[name] = repo
+	return &ecr.CreateRepositoryOutput{}, nil
+}
+
+func (f *fakeECR) PutLifecyclePolicy(input *ecr.PutLifecyclePolicyInput) (*ecr.PutLifecyclePolicyOutput, error) {
+	repo, err := f.repository(input.RepositoryName)
+	if err != nil {
+		return nil, err
+	}
+	repo.settings.LifecyclePolicy = *input.LifecyclePolicyText
+	return &ecr.PutLifecyclePolicyOutput{}, nil
+}
+
+func (f *fakeECR) PutImageScanningConfiguration(input *ecr.PutImageScanningConfigurationInput) (*ecr.PutImageScanningConfigurationOutput, error) {
+	repo, err := f.repository(input.RepositoryName)
+	if err != nil {
+		return nil, err
+	}
+	repo.settings.ScanOnPush = input.ImageScanningConfiguration.ScanOnPush
+	return &ecr.PutImageScanningConfigurationOutput{}, nil
+}
+
+func (f *fakeECR) PutImageTagMutability(input *ecr.PutImageTagMutabilityInput) (*ecr.PutImageTagMutabilityOutput, error) {
+	repo, err := f.repository(input.RepositoryName)
+	if err != nil {
+		return nil, err
+	}
+	repo.settings.TagMutability = *input.ImageTagMutability
+	return &ecr.PutImageTagMutabilityOutput{}, nil
+}
+
+func (f *fakeECR) TagResource(input *ecr.TagResourceInput) (*ecr.TagResourceOutput, error) {
+	repo, err := f.repository(aws.String(strings.TrimPrefix(*input.ResourceArn, "arn:")))
+	if err != nil {
+		return nil, err
+	}
+	if repo.settings.Tags == nil {
+		repo.settings.Tags = map[string]string{}
+	}
+	for _, tag := range input.Tags {
+		repo.settings.Tags[*tag.Key] = *tag.Value
+	}
+	return &ecr.TagResourceOutput{}, nil
+}
+
+func (f *fakeECR) BatchDeleteImage(input *ecr.BatchDeleteImageInput) (*ecr.BatchDeleteImageOutput, error) {
+	repo, err := f.repository(input.RepositoryName)
+	if err != nil {
+		return nil, err
+	}
+	out := &ecr.BatchDeleteImageOutput{}
+	for _, id := range input.ImageIds {
+		if !repo.tags[*id.ImageTag] {
+			out.Failures = append(out.Failures, &ecr.ImageFailure{ImageId: id, FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)})
+			continue
+		}
+		delete(repo.tags, *id.ImageTag)
+		out.ImageIds = append(out.ImageIds, id)
+	}
+	return out, nil
+}
+
+func (f *fakeECR) BatchGetImage(input *ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error) {
+	repo, err := f.repository(input.RepositoryName)
+	if err != nil {
+		return nil, err
+	}
+	out := &ecr.BatchGetImageOutput{}
+	for _, id := range input.ImageIds {
+		key := aws.StringValue(id.ImageTag)
+		if id.ImageDigest != nil {
+			key = *id.ImageDigest
+		}
+		m, ok := repo.images[key]
+		if !ok {
+			out.Failures = append(out.Failures, &ecr.ImageFailure{ImageId: id, FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)})
+			continue
+		}
+		out.Images = append(out.Images, &ecr.Image{
+			ImageId:                &ecr.ImageIdentifier{ImageTag: id.ImageTag, ImageDigest: aws.String(Digest(m.body))},
+			ImageManifest:          aws.String(string(m.body)),
+			ImageManifestMediaType: aws.String(m.mediaType),
+			RepositoryName:         input.RepositoryName,
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeECR) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []*ecr.AuthorizationData{{
+		// "user:pass", the same as fake registry
+		AuthorizationToken: aws.String("dXNlcjpwYXNz"),
+		ProxyEndpoint:      aws.String("https://111222333444.dkr.ecr.ap-northeast-1.amazonaws.com"),
+	}}}, nil
+}
+
+func TestListImageTags(t *testing.T) {
+	svc := newFakeECR()
+	svc.repositories["nginx"] = &fakeECRRepository{tags: map[string]bool{"1.17": true, "1.18": true, "1.19": true}}
+
+	actual, err := listImageTags(svc, "111222333444", "nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, svc.repositories["nginx"].tags) {
+		t.Errorf("expected: %v, got: %v", svc.repositories["nginx"].tags, actual)
+	}
+
+	actual, err = listImageTags(svc, "111222333444", "unknown")
+	if err != nil || len(actual) != 0 {
+		t.Errorf("unknown repository should be empty, got: %v, %v", actual, err)
+	}
+}
+
+func TestRepositorySettingsDiff(t *testing.T) {
+	current := RepositorySettings{
+		ScanOnPush:      aws.Bool(false),
+		TagMutability:   ecr.ImageTagMutabilityMutable,
+		LifecyclePolicy: `{"rules": []}`,
+		Tags:            map[string]string{"team": "platform", "extra": "kept"},
+	}
+	desired := RepositorySettings{
+		ScanOnPush:      aws.Bool(true),
+		LifecyclePolicy: `{"rules":[]}`,
+		Tags:            map[string]string{"team": "sre", "env": "prod"},
+	}
+	expected := []SettingChange{
+		{"scanOnPush", "false", "true"},
+		{"tags.env", "", "prod"},
+		{"tags.team", "platform", "sre"},
+	}
+	if actual := desired.Diff(current); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %v, got: %v", expected, actual)
+	}
+
+	merged := RepositorySettings{TagMutability: "IMMUTABLE", Tags: map[string]string{"team": "platform"}}.
+		Merge(RepositorySettings{Tags: map[string]string{"env": "prod"}})
+	if merged.TagMutability != "IMMUTABLE" || !reflect.DeepEqual(merged.Tags, map[string]string{"team": "platform", "env": "prod"}) {
+		t.Errorf("unexpected merged settings: %+v", merged)
+	}
+
+	if err := (RepositorySettings{TagMutability: "immutable"}).Validate(); err == nil {
+		t.Errorf("lower case tagMutability should be error")
+	}
+}
+
+func TestParseECRRegistry(t *testing.T) {
+	accountId, region, ok := ParseECRRegistry("111222333444.dkr.ecr.ap-northeast-1.amazonaws.com")
+	if !ok || accountId != "111222333444" || region != "ap-northeast-1" {
+		t.Errorf("unexpected result: %s, %s, %v", accountId, region, ok)
+	}
+	for _, registry := range []string{"docker.io", "public.ecr.aws", "111.dkr.ecr.ap-northeast-1.amazonaws.com"} {
+		if _, _, ok := ParseECRRegistry(registry); ok {
+			t.Errorf("%s is not ECR registry", registry)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// HelmCommand is the executable of helm, it is used to render charts
+var HelmCommand = "helm"
+
+// RenderHelmChart render chart with `helm template`, it doesn't access to kubernetes cluster
+func RenderHelmChart(chart string, valuesFiles []string) ([]byte, error) {
+	args := []string{"template", "trimg", chart}
+	for _, v := range valuesFiles {
+		args = append(args, "--values", v)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(HelmCommand, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to render chart %s: %v: %s", chart, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// HelmChart is values of the chart and its subcharts
+type HelmChart struct {
+	Name      string
+	Values    map[interface{}]interface{}
+	Subcharts map[string]*HelmChart // key is the name or alias of dependency
+}
+
+type chartMetadata struct {
+	Name         string `yaml:"name"`
+	Dependencies []struct {
+		Name  string `yaml:"name"`
+		Alias string `yaml:"alias"`
+	} `yaml:"dependencies"`
+}
+
+// LoadHelmChart read chart directory or packaged chart(.tgz)
+func LoadHelmChart(path string) (*HelmChart, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files map[string][]byte
+	if info.IsDir() {
+		files, err = readChartDir(path)
+	} else {
+		var data []byte
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files, err = readChartArchive(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return loadChartFiles(path, files)
+}
+
+// only Chart.yaml, values.yaml and subcharts are needed
+func isChartFile(name string) bool {
+	return name == "Chart.yaml" || name == "values.yaml" || strings.HasPrefix(name, "charts/")
+}
+
+func readChartDir(dir string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !isChartFile(rel) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[rel] = data
+		return nil
+	})
+	return files, err
+}
+
+// files in packaged chart are placed under the directory of chart name
+func readChartArchive(data []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(header.Name, "./"), "/", 2)
+		if len(parts) != 2 || !isChartFile(parts[1]) {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[parts[1]] = content
+	}
+	return files, nil
+}
+
+func loadChartFiles(name string, files map[string][]byte) (*HelmChart, error) {
+	chartFile, ok := files["Chart.yaml"]
+	if !ok {
+		return nil, fmt.Errorf("%s: Chart.yaml not found", name)
+	}
+	var metadata chartMetadata
+	if err := yaml.Unmarshal(chartFile, &metadata); err != nil {
+		return nil, fmt.Errorf("%s: Chart.yaml: %v", name, err)
+	}
+	if metadata.Name == "" {
+		return nil, fmt.Errorf("%s: name is not specified in Chart.yaml", name)
+	}
+
+	chart := &HelmChart{
+		Name:      metadata.Name,
+		Values:    map[interface{}]interface{}{},
+		Subcharts: map[string]*HelmChart{},
+	}
+	if valuesFile, ok := files["values.yaml"]; ok {
+		if err := yaml.Unmarshal(valuesFile, &chart.Values); err != nil {
+			return nil, fmt.Errorf("%s: values.yaml: %v", name, err)
+		}
+		if chart.Values == nil {
+			chart.Values = map[interface{}]interface{}{}
+		}
+	}
+
+	// subcharts are unpacked directories or packaged charts in charts/
+	subFiles := map[string]map[string][]byte{}
+	var subcharts []*HelmChart
+	for path, data := range files {
+		parts := strings.SplitN(strings.TrimPrefix(path, "charts/"), "/", 2)
+		if len(parts) == 2 && path != parts[1] {
+			if subFiles[parts[0]] == nil {
+				subFiles[parts[0]] = map[string][]byte{}
+			}
+			subFiles[parts[0]][parts[1]] = data
+		} else if len(parts) == 1 && strings.HasSuffix(path, ".tgz") {
+			archive, err := readChartArchive(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", name, path, err)
+			}
+			sub, err := loadChartFiles(name+"/"+path, archive)
+			if err != nil {
+				return nil, err
+			}
+			subcharts = append(subcharts, sub)
+		}
+	}
+	for dir, f := range subFiles {
+		sub, err := loadChartFiles(name+"/charts/"+dir, f)
+		if err != nil {
+			return nil, err
+		}
+		subcharts = append(subcharts, sub)
+	}
+
+	for _, sub := range subcharts {
+		key := sub.Name
+		for _, dep := range metadata.Dependencies {
+			if dep.Name == sub.Name && dep.Alias != "" {
+				key = dep.Alias
+			}
+		}
+		chart.Subcharts[key] = sub
+	}
+	return chart, nil
+}
+
+// GenerateHelmValues make values override which points images of the chart to ECR.
+// image keys are detected by common conventions of charts, and can be specified in config
+func GenerateHelmValues(chart *HelmChart, config *Config, mapper *ImageMapper) (map[interface{}]interface{}, error) {
+	g := helmValuesGenerator{
+		mapper:   mapper,
+		override: map[interface{}]interface{}{},
+	}
+	if err := g.generate(chart, config, nil); err != nil {
+		return nil, err
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+	return g.override, nil
+}
+
+type helmValuesGenerator struct {
+	mapper   *ImageMapper
+	override map[interface{}]interface{}
+	// the first error of mapping images
+	err error
+}
+
+func (g *helmValuesGenerator) generate(chart *HelmChart, config *Config, prefix []string) error {
+	// values of parent chart take precedence over subcharts
+	keys := make([]string, 0, len(chart.Subcharts))
+	for key := range chart.Subcharts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := g.generate(chart.Subcharts[key], config, appendPath(prefix, key)); err != nil {
+			return err
+		}
+	}
+
+	var chartConfig HelmChartConfig
+	if config != nil {
+		chartConfig = config.Helm.Charts[chart.Name]
+	}
+
+	if !chartConfig.DisableHeuristics {
+		g.detect(chart.Values, prefix)
+	}
+
+	for _, key := range chartConfig.Images {
+		path := strings.Split(key.Path, ".")
+		value, err := DigYaml(chart.Values, stringsToKeys(path)...)
+		if err != nil {
+			return fmt.Errorf("chart %s: %s: %v", chart.Name, key.Path, err)
+		}
+		if key.RegistryKey == "" && key.RepositoryKey == "" {
+			image, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("chart %s: %s is not a string", chart.Name, key.Path)
+			}
+			g.setPath(appendPath(prefix, path...), image)
+			continue
+		}
+		node, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("chart %s: %s is not a map", chart.Name, key.Path)
+		}
+		repositoryKey := key.RepositoryKey
+		if repositoryKey == "" {
+			repositoryKey = "repository"
+		}
+		if !g.setImage(node, appendPath(prefix, path...), key.RegistryKey, repositoryKey) {
+			return fmt.Errorf("chart %s: %s.%s is not a string", chart.Name, key.Path, repositoryKey)
+		}
+	}
+	return nil
+}
+
+// detect image settings by conventions of charts
+//   image: {registry: docker.io, repository: bitnami/nginx, tag: 1.0}
+//   image: {repository: nginx, tag: 1.0}
+//   image: {registry: registry.k8s.io, image: ingress-nginx/controller, tag: 1.0}
+//   image: nginx:1.0, initImage: busybox
+func (g *helmValuesGenerator) detect(values map[interface{}]interface{}, path []string) {
+	handled := map[string]bool{}
+
+	repositoryKey := ""
+	if s, ok := values["repository"].(string); ok && s != "" {
+		repositoryKey = "repository"
+	} else if s, ok := values["image"].(string); ok && s != "" {
+		if _, ok := values["registry"].(string); ok {
+			repositoryKey = "image"
+		}
+	}
+	if repositoryKey != "" && g.setImage(values, path, "registry", repositoryKey) {
+		handled["registry"] = true
+		handled[repositoryKey] = true
+	}
+
+	for k, v := range values {
+		key := fmt.Sprintf("%v", k)
+		if handled[key] {
+			continue
+		}
+		switch value := v.(type) {
+		case map[interface{}]interface{}:
+			g.detect(value, appendPath(path, key))
+		case string:
+			if isImageKey(key) && looksLikeImage(value) {
+				g.setPath(appendPath(path, key), value)
+			}
+		}
+	}
+}
+
+// rewrite registry, repository and tag keys, registry and tag are optional
+func (g *helmValuesGenerator) setImage(node map[interface{}]interface{}, path []string, registryKey, repositoryKey string) bool {
+	repository, ok := node[repositoryKey].(string)
+	if !ok || repository == "" {
+		return false
+	}
+	registry := ""
+	if registryKey != "" {
+		registry, _ = node[registryKey].(string)
+	}
+	name := repository
+	if registry != "" {
+		name = registry + "/" + repository
+	}
+	// tag can be a number in values, e.g. "tag: 1.17"
+	tag := ""
+	if t, ok := node["tag"]; ok && t != nil {
+		tag = fmt.Sprintf("%v", t)
+	}
+	image := name
+	if tag != "" {
+		image += ":" + tag
+	}
+
+	mapping, err := g.mapper.Map(image)
+	if err != nil {
+		if g.err == nil {
+			g.err = err
+		}
+		return true
+	}
+	if !mapping.Replaced() {
+		return true
+	}
+	target, err := ParseImageReference(mapping.Target)
+	if err != nil {
+		if g.err == nil {
+			g.err = err
+		}
+		return true
+	}
+
+	if registry == "" {
+		g.set(appendPath(path, repositoryKey), target.Name)
+	} else {
+		// ECR path keeps the original registry as a part of repository
+		destination := g.mapper.destination().Registry()
+		g.set(appendPath(path, registryKey), destination)
+		g.set(appendPath(path, repositoryKey), strings.TrimPrefix(target.Name, destination+"/"))
+	}
+	if tag != "" && target.Tag != "" && target.Tag != tag {
+		g.set(appendPath(path, "tag"), target.Tag)
+	}
+	return true
+}
+
+// set the target of image, images which are not transferred are not overridden
+func (g *helmValuesGenerator) setPath(path []string, image string) {
+	mapping, err := g.mapper.Map(image)
+	if err != nil {
+		if g.err == nil {
+			g.err = err
+		}
+		return
+	}
+	if !mapping.Replaced() {
+		return
+	}
+	g.set(path, mapping.Target)
+}
+
+func (g *helmValuesGenerator) set(path []string, value string) {
+	node := g.override
+	for _, key := range path[:len(path)-1] {
+		child, ok := node[key].(map[interface{}]interface{})
+		if !ok {
+			child = map[interface{}]interface{}{}
+			node[key] = child
+		}
+		node = child
+	}
+	node[path[len(path)-1]] = value
+}
+
+func isImageKey(key string) bool {
+	return strings.HasSuffix(strings.ToLower(key), "image")
+}
+
+func looksLikeImage(value string) bool {
+	return value != "" && !strings.ContainsAny(value, " \t\n{}")
+}
+
+func appendPath(path []string, keys ...string) []string {
+	p := make([]string, 0, len(path)+len(keys))
+	p = append(p, path...)
+	return append(p, keys...)
+}
+
+func stringsToKeys(path []string) []interface{} {
+	keys := make([]interface{}, 0, len(path))
+	for _, key := range path {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,209 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadHelmChart(t *testing.T) {
+	chart, err := LoadHelmChart("../testfiles/input/chart")
+	if err != nil {
+		t.Fatalf("failed to load chart: %v", err)
+	}
+	if chart.Name != "webapp" {
+		t.Fatalf("expected: %v, got: %v", "webapp", chart.Name)
+	}
+	// subchart is placed by alias
+	cache, ok := chart.Subcharts["cache"]
+	if !ok {
+		t.Fatalf("subchart is not loaded: %v", chart.Subcharts)
+	}
+	if cache.Name != "redis" {
+		t.Fatalf("expected: %v, got: %v", "redis", cache.Name)
+	}
+}
+
+func TestLoadHelmChartArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "webapp-0.1.0.tgz")
+	if err := packChart("../testfiles/input/chart", archive); err != nil {
+		t.Fatalf("failed to pack chart: %v", err)
+	}
+
+	chart, err := LoadHelmChart(archive)
+	if err != nil {
+		t.Fatalf("failed to load chart: %v", err)
+	}
+	expected, _ := LoadHelmChart("../testfiles/input/chart")
+	if !reflect.DeepEqual(expected, chart) {
+		t.Fatalf("expected: %v, got: %v", expected, chart)
+	}
+}
+
+func TestGenerateHelmValues(t *testing.T) {
+	chart, err := LoadHelmChart("../testfiles/input/chart")
+	if err != nil {
+		t.Fatalf("failed to load chart: %v", err)
+	}
+
+	config := &Config{Helm: HelmConfig{Charts: map[string]HelmChartConfig{
+		"webapp": {Images: []HelmImageKey{{Path: "sidecar.config.image"}}},
+	}}}
+	actual, err := GenerateHelmValues(chart, config, &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444"})
+	if err != nil {
+		t.Fatalf("failed to generate values: %v", err)
+	}
+
+	ecr := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com"
+	expected := map[interface{}]interface{}{
+		"image": map[interface{}]interface{}{
+			"repository": ecr + "/nginx",
+		},
+		"controller": map[interface{}]interface{}{
+			"image": map[interface{}]interface{}{
+				"registry": ecr,
+				"image":    "registry.k8s.io/ingress-nginx/controller",
+			},
+		},
+		"metrics": map[interface{}]interface{}{
+			"image": map[interface{}]interface{}{
+				"registry":   ecr,
+				"repository": "docker.io/bitnami/nginx-exporter",
+			},
+		},
+		"initImage": ecr + "/busybox:1.31",
+		"sidecar": map[interface{}]interface{}{
+			"config": map[interface{}]interface{}{
+				"image": ecr + "/prom/statsd-exporter:v0.15.0",
+			},
+		},
+		"cache": map[interface{}]interface{}{
+			"image": map[interface{}]interface{}{
+				"repository": ecr + "/redis",
+			},
+		},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+}
+
+func TestGenerateHelmValuesWithoutHeuristics(t *testing.T) {
+	chart, err := LoadHelmChart("../testfiles/input/chart")
+	if err != nil {
+		t.Fatalf("failed to load chart: %v", err)
+	}
+
+	config := &Config{Helm: HelmConfig{Charts: map[string]HelmChartConfig{
+		"webapp": {DisableHeuristics: true, Images: []HelmImageKey{{Path: "controller.image", RegistryKey: "registry", RepositoryKey: "image"}}},
+		"redis":  {DisableHeuristics: true},
+	}}}
+	actual, err := GenerateHelmValues(chart, config, &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444"})
+	if err != nil {
+		t.Fatalf("failed to generate values: %v", err)
+	}
+
+	expected := map[interface{}]interface{}{
+		"controller": map[interface{}]interface{}{
+			"image": map[interface{}]interface{}{
+				"registry": "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com",
+				"image":    "registry.k8s.io/ingress-nginx/controller",
+			},
+		},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+
+	// wrong path is reported
+	config.Helm.Charts["webapp"] = HelmChartConfig{Images: []HelmImageKey{{Path: "notExists.image"}}}
+	if _, err := GenerateHelmValues(chart, config, &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444"}); err == nil {
+		t.Fatalf("expected error for wrong path")
+	}
+}
+
+func TestRenderHelmChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// fake helm which prints arguments as a manifest
+	fakeHelm := filepath.Join(dir, "helm")
+	script := "#!/bin/sh\necho \"kind: Pod\"\necho \"args: $*\"\n"
+	if err := ioutil.WriteFile(fakeHelm, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(c string) { HelmCommand = c }(HelmCommand)
+	HelmCommand = fakeHelm
+
+	out, err := RenderHelmChart("./chart", []string{"a.yaml", "b.yaml"})
+	if err != nil {
+		t.Fatalf("failed to render: %v", err)
+	}
+	expected := "kind: Pod\nargs: template trimg ./chart --values a.yaml --values b.yaml\n"
+	if string(out) != expected {
+		t.Fatalf("expected: %q, got: %q", expected, string(out))
+	}
+
+	HelmCommand = filepath.Join(dir, "not-exists")
+	if _, err := RenderHelmChart("./chart", nil); err == nil {
+		t.Fatalf("expected error when helm is not found")
+	}
+}
+
+// make packaged chart like "helm package"
+func packChart(dir, archive string) error {
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+	tw := tar.NewWriter(gz)
+	defer tw.Close()
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{Name: "webapp/" + filepath.ToSlash(rel), Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+}
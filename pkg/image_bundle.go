@@ -0,0 +1,330 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// ImageBundle is tar archive of OCI image layout or docker-archive (output of "docker save")
+type ImageBundle struct {
+	f *os.File
+	// offset and size of files in archive
+	files map[string]tarEntry
+	// blobs of docker-archive are converted into OCI, key is digest
+	blobs     map[string]tarEntry
+	manifests map[string][]byte
+	// images in the bundle, the image path is in AnnotationRefName
+	Images []Descriptor
+}
+
+type tarEntry struct {
+	name   string
+	offset int64
+	size   int64
+}
+
+// OpenImageBundle read index of the archive, Close should be called
+func OpenImageBundle(filepath string) (*ImageBundle, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	b := &ImageBundle{f: f, files: map[string]tarEntry{}, blobs: map[string]tarEntry{}, manifests: map[string][]byte{}}
+	if err := b.scan(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", filepath, err)
+	}
+
+	switch {
+	case b.has("index.json"):
+		err = b.loadOCILayout()
+	case b.has("manifest.json"):
+		err = b.loadDockerArchive()
+	default:
+		err = fmt.Errorf("neither index.json nor manifest.json is found")
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", filepath, err)
+	}
+	return b, nil
+}
+
+// Close the archive file
+func (b *ImageBundle) Close() error {
+	return b.f.Close()
+}
+
+// countingReader counts read bytes, to know offsets of files in archive.
+// tar.Reader skips contents of files by Seek
+type countingReader struct {
+	r io.ReadSeeker
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := c.r.Seek(offset, whence)
+	if err == nil {
+		c.n = n
+	}
+	return n, err
+}
+
+func (b *ImageBundle) scan() error {
+	cr := &countingReader{r: b.f}
+	tr := tar.NewReader(cr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+		// data of the file starts just after the header
+		name := path.Clean(strings.TrimPrefix(h.Name, "./"))
+		b.files[name] = tarEntry{name: name, offset: cr.n, size: h.Size}
+	}
+}
+
+func (b *ImageBundle) has(name string) bool {
+	_, ok := b.files[name]
+	return ok
+}
+
+func (b *ImageBundle) open(e tarEntry) io.ReadCloser {
+	return ioutil.NopCloser(io.NewSectionReader(b.f, e.offset, e.size))
+}
+
+func (b *ImageBundle) readFile(name string) ([]byte, error) {
+	e, ok := b.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is not found", name)
+	}
+	return ioutil.ReadAll(b.open(e))
+}
+
+// OpenBlob returns reader and size of the blob
+func (b *ImageBundle) OpenBlob(digest string) (io.ReadCloser, int64, error) {
+	if m, ok := b.manifests[digest]; ok {
+		return ioutil.NopCloser(bytes.NewReader(m)), int64(len(m)), nil
+	}
+	e, ok := b.blobs[digest]
+	if !ok {
+		e, ok = b.files[blobPath(digest)]
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("blob %s is not found in bundle", digest)
+	}
+	return b.open(e), e.size, nil
+}
+
+// ReadBlob returns the content of blob, it should be used for small blobs, e.g. manifest
+func (b *ImageBundle) ReadBlob(digest string) ([]byte, error) {
+	r, _, err := b.OpenBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if Digest(data) != digest {
+		return nil, fmt.Errorf("digest of blob %s doesn't match", digest)
+	}
+	return data, nil
+}
+
+func (b *ImageBundle) loadOCILayout() error {
+	data, err := b.readFile("index.json")
+	if err != nil {
+		return err
+	}
+	index, err := ParseImageManifest(data, MediaTypeOCIIndex)
+	if err != nil {
+		return fmt.Errorf("index.json: %v", err)
+	}
+	for _, d := range index.Manifests {
+		// image path is required to decide the target, ref.name of other tools may be only tag
+		name := d.Annotations[AnnotationRefName]
+		if ref, err := ParseImageReference(name); err != nil || (ref.Tag == "" && ref.Digest == "") {
+			name = d.Annotations[AnnotationContainerdImageName]
+		}
+		if name == "" {
+			return fmt.Errorf("index.json: image path of %s is not found in annotations", d.Digest)
+		}
+		if d.Annotations == nil {
+			d.Annotations = map[string]string{}
+		}
+		d.Annotations[AnnotationRefName] = name
+		b.Images = append(b.Images, d)
+	}
+	return nil
+}
+
+// converts images of "docker save" into OCI manifests, layers are not compressed
+func (b *ImageBundle) loadDockerArchive() error {
+	data, err := b.readFile("manifest.json")
+	if err != nil {
+		return err
+	}
+	var manifests []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return fmt.Errorf("manifest.json: %v", err)
+	}
+
+	for _, m := range manifests {
+		if len(m.RepoTags) == 0 {
+			return fmt.Errorf("manifest.json: image %s has no tag", m.Config)
+		}
+		config, err := b.hashFile(m.Config)
+		if err != nil {
+			return err
+		}
+		config.MediaType = "application/vnd.oci.image.config.v1+json"
+		manifest := ImageManifest{SchemaVersion: 2, MediaType: MediaTypeOCIManifest, Config: &config}
+		for _, layer := range m.Layers {
+			d, err := b.hashFile(layer)
+			if err != nil {
+				return err
+			}
+			d.MediaType = "application/vnd.oci.image.layer.v1.tar"
+			manifest.Layers = append(manifest.Layers, d)
+		}
+		body, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		digest := Digest(body)
+		b.manifests[digest] = body
+		for _, tag := range m.RepoTags {
+			b.Images = append(b.Images, Descriptor{
+				MediaType:   MediaTypeOCIManifest,
+				Digest:      digest,
+				Size:        int64(len(body)),
+				Annotations: map[string]string{AnnotationRefName: tag},
+			})
+		}
+	}
+	return nil
+}
+
+// digest of file in archive, the file is registered as blob
+func (b *ImageBundle) hashFile(name string) (Descriptor, error) {
+	e, ok := b.files[path.Clean(name)]
+	if !ok {
+		return Descriptor{}, fmt.Errorf("%s is not found", name)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, b.open(e)); err != nil {
+		return Descriptor{}, err
+	}
+	digest := fmt.Sprintf("sha256:%x", h.Sum(nil))
+	b.blobs[digest] = e
+	return Descriptor{Digest: digest, Size: e.size}, nil
+}
+
+// PushImage push the image of bundle into the repository with tags, blobs which already exist are not uploaded
+func (b *ImageBundle) PushImage(client *RegistryClient, registry, repository string, d Descriptor, tags []string) error {
+	body, err := b.pushManifest(client, registry, repository, d)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := client.PutManifest(registry, repository, tag, d.MediaType, body); err != nil {
+			return fmt.Errorf("failed to push %s:%s: %v", repository, tag, err)
+		}
+	}
+	return nil
+}
+
+// push contents of the manifest, and then the manifest by digest
+func (b *ImageBundle) pushManifest(client *RegistryClient, registry, repository string, d Descriptor) ([]byte, error) {
+	body, err := b.ReadBlob(d.Digest)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ParseImageManifest(body, d.MediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsIndex(manifest.MediaType) {
+		for _, child := range manifest.Manifests {
+			if _, err := b.pushManifest(client, registry, repository, child); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		var blobs []Descriptor
+		if manifest.Config != nil {
+			blobs = append(blobs, *manifest.Config)
+		}
+		blobs = append(blobs, manifest.Layers...)
+		for _, blob := range blobs {
+			if err := b.pushBlob(client, registry, repository, blob); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := client.PutManifest(registry, repository, d.Digest, manifest.MediaType, body); err != nil {
+		return nil, fmt.Errorf("failed to push manifest %s@%s: %v", repository, d.Digest, err)
+	}
+	return body, nil
+}
+
+func (b *ImageBundle) pushBlob(client *RegistryClient, registry, repository string, blob Descriptor) error {
+	exists, err := client.BlobExists(registry, repository, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	err = client.PushBlob(registry, repository, blob, func() (io.ReadCloser, error) {
+		r, _, err := b.OpenBlob(blob.Digest)
+		return r, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to push blob %s@%s: %v", repository, blob.Digest, err)
+	}
+	return nil
+}
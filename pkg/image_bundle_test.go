@@ -0,0 +1,145 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageBundleOCILayout(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	nginx := source.pushImage("library/nginx", "1.17", Platform{OS: "linux", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "arm64"})
+
+	dir, err := ioutil.TempDir("", "trimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bundle.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewOCILayoutWriter(f)
+	if _, err := w.AddImage(source.Client(), source.Host()+"/library/nginx:1.17"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	bundle, err := OpenImageBundle(path)
+	if err != nil {
+		t.Fatalf("failed to open bundle: %v", err)
+	}
+	defer bundle.Close()
+	if len(bundle.Images) != 1 || bundle.Images[0].Digest != nginx.Digest {
+		t.Fatalf("unexpected images: %+v", bundle.Images)
+	}
+
+	target := newFakeRegistry()
+	defer target.Close()
+	if err := bundle.PushImage(target.Client(), target.Host(), "nginx", bundle.Images[0], []string{"1.17", "stable"}); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+	for _, tag := range []string{"1.17", "stable", nginx.Digest} {
+		m, ok := target.manifests["nginx"][tag]
+		if !ok || Digest(m.body) != nginx.Digest {
+			t.Errorf("nginx:%s is not pushed", tag)
+		}
+	}
+	// index, 2 manifests, 2 configs and 2 layers
+	pushed := len(target.blobs)
+	if pushed != 4 {
+		t.Errorf("expected 4 blobs are pushed, got: %d", pushed)
+	}
+	for digest, data := range target.blobs {
+		if !bytes.Equal(source.blobs[digest], data) {
+			t.Errorf("blob %s is broken", digest)
+		}
+	}
+}
+
+func TestImageBundleDockerArchive(t *testing.T) {
+	config := []byte(`{"os":"linux","architecture":"amd64"}`)
+	layer := []byte("layer of app")
+	manifest := `[{"Config":"` + Digest(config)[7:] + `.json","RepoTags":["myorg/app:v1","myorg/app:latest"],"Layers":["0123/layer.tar"]}]`
+
+	dir, err := ioutil.TempDir("", "trimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.tar")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"0123/", nil},
+		{"0123/layer.tar", layer},
+		{Digest(config)[7:] + ".json", config},
+		{"manifest.json", []byte(manifest)},
+	} {
+		h := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data)), Typeflag: tar.TypeReg}
+		if file.data == nil {
+			h.Typeflag = tar.TypeDir
+		}
+		tw.WriteHeader(h)
+		tw.Write(file.data)
+	}
+	tw.Close()
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := OpenImageBundle(path)
+	if err != nil {
+		t.Fatalf("failed to open bundle: %v", err)
+	}
+	defer bundle.Close()
+	if len(bundle.Images) != 2 || bundle.Images[1].Annotations[AnnotationRefName] != "myorg/app:latest" {
+		t.Fatalf("unexpected images: %+v", bundle.Images)
+	}
+
+	body, err := bundle.ReadBlob(bundle.Images[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m ImageManifest
+	json.Unmarshal(body, &m)
+	if m.Config.Digest != Digest(config) || len(m.Layers) != 1 || m.Layers[0].Digest != Digest(layer) {
+		t.Errorf("unexpected manifest: %s", body)
+	}
+
+	target := newFakeRegistry()
+	defer target.Close()
+	if err := bundle.PushImage(target.Client(), target.Host(), "myorg/app", bundle.Images[0], []string{"v1"}); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+	if !bytes.Equal(target.blobs[Digest(layer)], layer) {
+		t.Errorf("layer is not pushed")
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ImageFilter select images to transfer and replace by patterns.
+// pattern is "[field=]glob" or "[field=]~regex", field is one of registry, repository and tag.
+// pattern without field is matched with the whole image path.
+//   gcr.io/*, registry=docker.io, repository=myorg/*, tag=~^v1\.2[0-9]\.
+type ImageFilter struct {
+	include []imagePattern
+	exclude []imagePattern
+}
+
+type imagePattern struct {
+	raw   string
+	field string
+	re    *regexp.Regexp
+}
+
+var patternFields = []string{"registry", "repository", "tag"}
+
+// NewImageFilter compile patterns, images are selected when they match any of include and none of exclude.
+// all images match include when it is empty
+func NewImageFilter(include, exclude []string) (*ImageFilter, error) {
+	f := &ImageFilter{}
+	for _, p := range include {
+		pattern, err := compileImagePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, pattern)
+	}
+	for _, p := range exclude {
+		pattern, err := compileImagePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, pattern)
+	}
+	return f, nil
+}
+
+func compileImagePattern(raw string) (imagePattern, error) {
+	p := imagePattern{raw: raw}
+	expr := raw
+	for _, field := range patternFields {
+		if strings.HasPrefix(raw, field+"=") {
+			p.field = field
+			expr = strings.TrimPrefix(raw, field+"=")
+			break
+		}
+	}
+
+	var err error
+	if strings.HasPrefix(expr, "~") {
+		p.re, err = regexp.Compile(strings.TrimPrefix(expr, "~"))
+	} else {
+		p.re, err = regexp.Compile(globToRegexp(expr))
+	}
+	if err != nil {
+		return imagePattern{}, fmt.Errorf("filter %q is wrong: %v", raw, err)
+	}
+	return p, nil
+}
+
+// "*" matches any characters including "/"
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func (p imagePattern) match(image string, ref ImageReference) bool {
+	switch p.field {
+	case "registry":
+		return p.re.MatchString(ref.Registry)
+	case "repository":
+		return p.re.MatchString(ref.Repository)
+	case "tag":
+		tag := ref.Tag
+		if tag == "" {
+			tag = "latest"
+		}
+		return p.re.MatchString(tag)
+	default:
+		return p.re.MatchString(image)
+	}
+}
+
+// Check returns the reason why the image is filtered out, empty when it is selected
+func (f *ImageFilter) Check(image string) string {
+	if f == nil {
+		return ""
+	}
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		// wrong image is reported when it is transferred
+		ref = ImageReference{Name: image}
+	}
+
+	if len(f.include) != 0 {
+		included := false
+		for _, p := range f.include {
+			if p.match(image, ref) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return "not matched by any include filter"
+		}
+	}
+	for _, p := range f.exclude {
+		if p.match(image, ref) {
+			return fmt.Sprintf("excluded by %q", p.raw)
+		}
+	}
+	return ""
+}
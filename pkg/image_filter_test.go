@@ -0,0 +1,80 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"testing"
+)
+
+func TestImageFilterCheck(t *testing.T) {
+	patterns := []struct {
+		include  []string
+		exclude  []string
+		image    string
+		expected string
+	}{
+		{nil, nil, "nginx", ""},
+		{[]string{"gcr.io/*"}, nil, "gcr.io/google_samples/gb-frontend:v3", ""},
+		{[]string{"gcr.io/*"}, nil, "nginx", "not matched by any include filter"},
+		{[]string{"registry=docker.io"}, nil, "nginx:1.17", ""},
+		{[]string{"registry=docker.io"}, nil, "quay.io/coreos/etcd", "not matched by any include filter"},
+		{nil, []string{"repository=myorg/*"}, "myorg/app:v1", `excluded by "repository=myorg/*"`},
+		{nil, []string{"repository=library/*"}, "nginx", `excluded by "repository=library/*"`},
+		{nil, []string{"tag=latest"}, "nginx", `excluded by "tag=latest"`},
+		{nil, []string{"tag=~-rc[0-9]+$"}, "nginx:1.19-rc1", `excluded by "tag=~-rc[0-9]+$"`},
+		{nil, []string{"tag=~-rc[0-9]+$"}, "nginx:1.19", ""},
+		{[]string{"~^k8s\\.gcr\\.io/"}, []string{"*/pause:*"}, "k8s.gcr.io/pause:3.1", `excluded by "*/pause:*"`},
+		{[]string{"~^k8s\\.gcr\\.io/"}, []string{"*/pause:*"}, "k8s.gcr.io/kube-proxy:v1.17.0", ""},
+		// "?" matches one character, "." is not a wildcard
+		{nil, []string{"redis:?"}, "redis:5", `excluded by "redis:?"`},
+		{nil, []string{"redis.5"}, "redis:5", ""},
+	}
+
+	for idx, pattern := range patterns {
+		f, err := NewImageFilter(pattern.include, pattern.exclude)
+		if err != nil {
+			t.Fatalf("pattern %d: failed to compile: %v", idx, err)
+		}
+		actual := f.Check(pattern.image)
+		if actual != pattern.expected {
+			t.Errorf("pattern %d: want %q, actual %q", idx, pattern.expected, actual)
+		}
+	}
+}
+
+func TestNewImageFilterWrongPattern(t *testing.T) {
+	if _, err := NewImageFilter(nil, []string{"tag=~[0-9"}); err == nil {
+		t.Fatalf("expected error for wrong regexp")
+	}
+}
+
+func TestImageMapperFilter(t *testing.T) {
+	config := &Config{Filters: FilterConfig{Exclude: []string{"repository=myorg/*"}}}
+	mapper, err := NewImageMapper(config, "ap-northeast-1", "111222333444")
+	if err != nil {
+		t.Fatalf("failed to make mapper: %v", err)
+	}
+
+	// excluded image is not replaced
+	m, _ := mapper.Map("myorg/app:v1")
+	if m.Target != "myorg/app:v1" || m.Skip == "" {
+		t.Fatalf("unexpected mapping: %v", m)
+	}
+	m, _ = mapper.Map("nginx")
+	if m.Target != "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/nginx" || m.Skip != "" {
+		t.Fatalf("unexpected mapping: %v", m)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestImageList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "images.txt")
+	expected := []string{"nginx:latest", "gcr.io/google_samples/gb-frontend:v3"}
+	if err := WriteImageList(path, expected); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	actual, err := ReadImageList(path)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+
+	// comments and empty lines are ignored
+	content := "# images of nginx chart\nnginx:latest\n\n  redis  \n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	actual, err = ReadImageList(path)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	expected = []string{"nginx:latest", "redis"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+}
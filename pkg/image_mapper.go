@@ -0,0 +1,278 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ImageMapper decides the path in ECR for images, and which images are not transferred
+type ImageMapper struct {
+	Region    string
+	AccountId string
+	// registry which images are transferred to, ECR of Region and AccountId when it is nil
+	Destination Destination
+	// registries which are already available from clusters, e.g. "harbor.example.com", "*.dkr.ecr.*.amazonaws.com"
+	InternalRegistries []string
+	// registries accessed by plain HTTP, they are given to registry clients made for transfer
+	InsecureRegistries []string
+	// images filtered out are not transferred and replaced
+	Filter *ImageFilter
+	// tags in ECR are the same as source when it is nil
+	TagPolicy *TagPolicy
+	// repository in ECR for image name, e.g. "registry.k8s.io/kube-proxy" -> "k8s/kube-proxy",
+	// default is the same as image name
+	Destinations map[string]string
+	// settings of repositories created in ECR
+	RepositorySettings RepositorySettings
+	// prefixes of ECR pull-through cache, key is upstream registry. images of them are replaced with the cache instead of transfer
+	CacheRules map[string]string
+	// options of transfer into the destination
+	Transfer TransferOptions
+	// digest of the image which is not pinned by digest, e.g. by registry API.
+	// it is used by tag template which refers digest, images fail such template when it is nil
+	ResolveDigest func(image string) (string, error)
+}
+
+// Mapping is the result of ImageMapper
+type Mapping struct {
+	Source string
+	Target string
+	// reason why the image is not transferred, empty when it should be transferred
+	Skip string
+}
+
+// Replaced returns true when the image path is changed
+func (m Mapping) Replaced() bool {
+	return m.Target != m.Source
+}
+
+const (
+	SkipAlreadyMirrored  = "already mirrored"
+	SkipPullThroughCache = "served by pull-through cache"
+)
+
+// NewImageMapper make ImageMapper with settings of config
+func NewImageMapper(config *Config, region, accountId string) (*ImageMapper, error) {
+	m := &ImageMapper{Region: region, AccountId: accountId, Destination: NewECRDestination(region, accountId)}
+	if config == nil {
+		return m, nil
+	}
+	if registry := config.Destination.Registry; registry != "" {
+		if strings.Contains(registry, "://") {
+			return nil, fmt.Errorf("destination: registry should be specified without scheme, e.g. \"harbor.example.com/mirror\"")
+		}
+		if strings.HasPrefix(registry, ECRPublicRegistry+"/") {
+			alias := strings.Trim(strings.TrimPrefix(registry, ECRPublicRegistry+"/"), "/")
+			if alias == "" || strings.Contains(alias, "/") {
+				return nil, fmt.Errorf("destination: ECR Public should be specified with the alias, e.g. \"public.ecr.aws/myalias\"")
+			}
+			m.Destination = NewECRPublicDestination(alias)
+		} else {
+			client := NewRegistryClient()
+			client.InsecureRegistries = config.InsecureRegistries
+			m.Destination = NewRegistryDestination(registry, client)
+		}
+	}
+	m.InsecureRegistries = config.InsecureRegistries
+	m.InternalRegistries = config.InternalRegistries
+	if err := config.Repository.Validate(); err != nil {
+		return nil, fmt.Errorf("repository: %v", err)
+	}
+	m.RepositorySettings = config.Repository
+	if len(config.PullThroughCache) != 0 {
+		if _, ok := m.Destination.(*ECRDestination); !ok {
+			return nil, fmt.Errorf("pullThroughCache: it is available only for ECR")
+		}
+		m.CacheRules = map[string]string{}
+		for _, rule := range config.PullThroughCache {
+			rule = rule.WithDefaults()
+			if err := rule.Validate(); err != nil {
+				return nil, fmt.Errorf("pullThroughCache: %v", err)
+			}
+			m.CacheRules[rule.Registry] = rule.Prefix
+		}
+	}
+	filter, err := NewImageFilter(config.Filters.Include, config.Filters.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	m.Filter = filter
+	if config.TagPolicy.Template != "" || len(config.TagPolicy.Overrides) != 0 {
+		policy, err := NewTagPolicy(config.TagPolicy)
+		if err != nil {
+			return nil, err
+		}
+		m.TagPolicy = policy
+	}
+	return m, nil
+}
+
+// Map returns where the image is transferred.
+// images in the target registry or internal registries are not transferred, and target is the same as source.
+// images of pull-through cache are not transferred, and target is the path of the cache
+func (m *ImageMapper) Map(image string) (Mapping, error) {
+	if reason := m.Skip(image); reason == SkipPullThroughCache {
+		return Mapping{Source: image, Target: m.cachePath(image), Skip: reason}, nil
+	} else if reason != "" {
+		return Mapping{Source: image, Target: image, Skip: reason}, nil
+	}
+	target, err := m.target(image, "")
+	if err != nil {
+		return Mapping{}, err
+	}
+	return Mapping{Source: image, Target: target}, nil
+}
+
+// Skip returns the reason why the image is not transferred, empty when it should be transferred
+func (m *ImageMapper) Skip(image string) string {
+	if m.IsMirrored(image) {
+		return SkipAlreadyMirrored
+	}
+	if reason := m.Filter.Check(image); reason != "" {
+		return reason
+	}
+	if ref, err := ParseImageReference(image); err == nil && m.CacheRules[ref.Registry] != "" {
+		return SkipPullThroughCache
+	}
+	return ""
+}
+
+// path of the image in pull-through cache, e.g. "quay.io/coreos/etcd:v3.4" -> "<ECR>/quay/coreos/etcd:v3.4"
+func (m *ImageMapper) cachePath(image string) string {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return image
+	}
+	ref.Name = ECRRegistry(m.Region, m.AccountId) + "/" + m.CacheRules[ref.Registry] + "/" + ref.Repository
+	return ref.String()
+}
+
+// IsCached returns true if the image points pull-through cache of the target registry
+func (m *ImageMapper) IsCached(image string) bool {
+	ref, err := ParseImageReference(image)
+	if err != nil || ref.Registry != ECRRegistry(m.Region, m.AccountId) {
+		return false
+	}
+	for _, prefix := range m.CacheRules {
+		if strings.HasPrefix(ref.Repository, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Targets returns all image paths in ECR which the image is pushed to, digest is the digest of pulled image
+func (m *ImageMapper) Targets(image, digest string) ([]string, error) {
+	target, err := m.target(image, digest)
+	if err != nil {
+		return nil, err
+	}
+	targets := []string{target}
+	if m.TagPolicy != nil && m.TagPolicy.KeepOriginalTag {
+		original := m.destination().ImagePath(m.rename(image))
+		if original != target {
+			targets = append(targets, original)
+		}
+	}
+	return targets, nil
+}
+
+// registry client with credentials of docker config and insecure registries of the mapper
+func (m *ImageMapper) registryClient() *RegistryClient {
+	client := NewRegistryClient()
+	client.InsecureRegistries = m.InsecureRegistries
+	return client
+}
+
+func (m *ImageMapper) destination() Destination {
+	if m.Destination == nil {
+		return NewECRDestination(m.Region, m.AccountId)
+	}
+	return m.Destination
+}
+
+// Repository returns the name of ECR repository which the image is pushed to
+func (m *ImageMapper) Repository(image string) (string, error) {
+	ref, err := ParseImageReference(m.destination().ImagePath(m.rename(image)))
+	if err != nil {
+		return "", err
+	}
+	return ref.Repository, nil
+}
+
+// replace image name by Destinations, tag and digest are kept
+func (m *ImageMapper) rename(image string) string {
+	if len(m.Destinations) == 0 {
+		return image
+	}
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return image
+	}
+	if destination, ok := m.Destinations[ref.Name]; ok {
+		ref.Name = destination
+		return ref.String()
+	}
+	return image
+}
+
+func (m *ImageMapper) target(image, digest string) (string, error) {
+	if m.TagPolicy == nil {
+		return m.destination().ImagePath(m.rename(image)), nil
+	}
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+	if digest == "" && ref.Digest == "" && m.TagPolicy.UsesDigest() && m.ResolveDigest != nil {
+		digest, err = m.ResolveDigest(image)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve digest of %s: %v", image, err)
+		}
+	}
+	tag, err := m.TagPolicy.Tag(ref, digest)
+	if err != nil {
+		return "", err
+	}
+	// keep the original form, e.g. tag is omitted
+	if tag == "" || tag == ref.Tag || (ref.Tag == "" && ref.Digest == "" && tag == "latest") {
+		return m.destination().ImagePath(m.rename(image)), nil
+	}
+	// digest of the reference is kept with the new tag
+	ref.Tag = tag
+	return m.destination().ImagePath(m.rename(ref.String())), nil
+}
+
+// IsMirrored returns true if the image points the target registry or internal registries
+func (m *ImageMapper) IsMirrored(image string) bool {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return false
+	}
+	// image path in the destination is not converted
+	if m.destination().ImagePath(image) == image {
+		return true
+	}
+	for _, pattern := range m.InternalRegistries {
+		if ok, _ := path.Match(pattern, ref.Registry); ok {
+			return true
+		}
+	}
+	return false
+}
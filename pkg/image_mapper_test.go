@@ -0,0 +1,145 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestImageMapperMap(t *testing.T) {
+	mapper := &ImageMapper{
+		Region:             "ap-northeast-1",
+		AccountId:          "111222333444",
+		InternalRegistries: []string{"harbor.example.com", "*.dkr.ecr.*.amazonaws.com"},
+	}
+	ecr := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/"
+
+	patterns := []struct {
+		image    string
+		expected Mapping
+	}{
+		{"nginx", Mapping{"nginx", ecr + "nginx", ""}},
+		{"gcr.io/google_samples/gb-frontend:v3", Mapping{"gcr.io/google_samples/gb-frontend:v3", ecr + "gcr.io/google_samples/gb-frontend:v3", ""}},
+		{ecr + "nginx", Mapping{ecr + "nginx", ecr + "nginx", SkipAlreadyMirrored}},
+		{"harbor.example.com/app/web:v1", Mapping{"harbor.example.com/app/web:v1", "harbor.example.com/app/web:v1", SkipAlreadyMirrored}},
+		{"999888777666.dkr.ecr.us-east-1.amazonaws.com/app", Mapping{"999888777666.dkr.ecr.us-east-1.amazonaws.com/app", "999888777666.dkr.ecr.us-east-1.amazonaws.com/app", SkipAlreadyMirrored}},
+		// only registry is matched
+		{"docker.io/harbor.example.com", Mapping{"docker.io/harbor.example.com", ecr + "docker.io/harbor.example.com", ""}},
+	}
+
+	for idx, pattern := range patterns {
+		actual, err := mapper.Map(pattern.image)
+		if err != nil {
+			t.Errorf("pattern %d: unexpected error %v", idx, err)
+		} else if actual != pattern.expected {
+			t.Errorf("pattern %d: want %v, actual %v", idx, pattern.expected, actual)
+		}
+	}
+}
+
+func TestReplaceImagesIdempotent(t *testing.T) {
+	manifests, _ := ParseMultiDocYaml("../testfiles/input/deployment.yml")
+	mapper := &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444"}
+
+	once, err := ReplaceImages(manifests[0], mapper)
+	if err != nil {
+		t.Fatalf("failed to replace manifest: %v", err)
+	}
+	expected, _ := GetUsingImages(once)
+
+	twice, err := ReplaceImages(once, mapper)
+	if err != nil {
+		t.Fatalf("failed to replace manifest: %v", err)
+	}
+	actual, _ := GetUsingImages(twice)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+}
+
+func TestKustomizeImagesIdempotent(t *testing.T) {
+	mapper := &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444"}
+	images := []string{"nginx:latest", "quay.io/esakat/initpod:v2.1.0"}
+
+	once, err := KustomizeImages(nil, images, mapper)
+	if err != nil {
+		t.Fatalf("failed to generate images: %v", err)
+	}
+	twice, err := KustomizeImages(once, images, mapper)
+	if err != nil {
+		t.Fatalf("failed to generate images: %v", err)
+	}
+	if !reflect.DeepEqual(once, twice) {
+		t.Fatalf("expected: %v, got: %v", once, twice)
+	}
+}
+
+func TestImageMapperDestinations(t *testing.T) {
+	mapper := &ImageMapper{
+		Region:       "ap-northeast-1",
+		AccountId:    "111222333444",
+		Destinations: map[string]string{"registry.k8s.io/kube-proxy": "k8s/kube-proxy"},
+	}
+	ecr := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/"
+
+	mapping, err := mapper.Map("registry.k8s.io/kube-proxy:v1.28.0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if mapping.Target != ecr+"k8s/kube-proxy:v1.28.0" {
+		t.Errorf("want %s, actual %s", ecr+"k8s/kube-proxy:v1.28.0", mapping.Target)
+	}
+
+	patterns := map[string]string{
+		"registry.k8s.io/kube-proxy:v1.28.0": "k8s/kube-proxy",
+		"nginx:1.17":                         "nginx",
+		"gcr.io/google_samples/gb-frontend":  "gcr.io/google_samples/gb-frontend",
+	}
+	for image, expected := range patterns {
+		actual, err := mapper.Repository(image)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", image, err)
+		} else if actual != expected {
+			t.Errorf("%s: want %s, actual %s", image, expected, actual)
+		}
+	}
+}
+
+func TestNewImageMapperDestination(t *testing.T) {
+	mapper, err := NewImageMapper(&Config{Destination: DestinationConfig{Registry: "harbor.example.com/mirror"}}, "", "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, ok := mapper.Destination.(*RegistryDestination); !ok {
+		t.Fatalf("want RegistryDestination, actual %T", mapper.Destination)
+	}
+	mapping, _ := mapper.Map("nginx:1.17")
+	if mapping.Target != "harbor.example.com/mirror/nginx:1.17" {
+		t.Errorf("want harbor.example.com/mirror/nginx:1.17, actual %s", mapping.Target)
+	}
+	if mapper.Skip("harbor.example.com/mirror/redis:6") != SkipAlreadyMirrored {
+		t.Error("images in the destination path should be skipped")
+	}
+	// other projects of the registry are transferred, internalRegistries skips them
+	if reason := mapper.Skip("harbor.example.com/library/redis:6"); reason != "" {
+		t.Errorf("images outside the destination path should not be skipped, but %s", reason)
+	}
+
+	if _, err := NewImageMapper(&Config{Destination: DestinationConfig{Registry: "https://harbor.example.com"}}, "", ""); err == nil {
+		t.Error("registry with scheme should be error")
+	}
+}
@@ -42,3 +42,64 @@ func SeparateImageName(imageName string) (ImageName, error) {
 		return ImageName{}, errors.New("image format is wrong")
 	}
 }
+
+// ImageReference is the image path separated into its parts
+type ImageReference struct {
+	// image name as written, without tag and digest, e.g. "nginx", "gcr.io/google_samples/gb-frontend"
+	Name string
+	// registry host, "docker.io" when it is omitted
+	Registry string
+	// path of the repository in the registry, "library/" is added to official images of Docker Hub
+	Repository string
+	// empty when it is omitted
+	Tag    string
+	Digest string
+}
+
+// ParseImageReference separate image path into registry, repository, tag and digest
+func ParseImageReference(image string) (ImageReference, error) {
+	if image == "" || strings.ContainsAny(image, " \t\n") {
+		return ImageReference{}, errors.New("image format is wrong")
+	}
+
+	ref := ImageReference{Name: image}
+	if i := strings.Index(ref.Name, "@"); i >= 0 {
+		ref.Name, ref.Digest = ref.Name[:i], ref.Name[i+1:]
+		if !strings.Contains(ref.Digest, ":") {
+			return ImageReference{}, errors.New("image format is wrong")
+		}
+	}
+	// colon after the last slash is separator of tag, otherwise it is port of the registry
+	if i := strings.LastIndex(ref.Name, ":"); i > strings.LastIndex(ref.Name, "/") {
+		ref.Name, ref.Tag = ref.Name[:i], ref.Name[i+1:]
+		if ref.Tag == "" {
+			return ImageReference{}, errors.New("image format is wrong")
+		}
+	}
+	if ref.Name == "" {
+		return ImageReference{}, errors.New("image format is wrong")
+	}
+
+	parts := strings.SplitN(ref.Name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry, ref.Repository = parts[0], parts[1]
+	} else {
+		ref.Registry, ref.Repository = "docker.io", ref.Name
+		if len(parts) == 1 {
+			ref.Repository = "library/" + ref.Name
+		}
+	}
+	return ref, nil
+}
+
+// String returns the image path
+func (r ImageReference) String() string {
+	s := r.Name
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -52,3 +52,38 @@ func TestSeparateImageName(t *testing.T) {
 		}
 	}
 }
+
+func TestParseImageReference(t *testing.T) {
+	patterns := []struct {
+		image    string
+		expected ImageReference
+		err      bool
+	}{
+		{"nginx", ImageReference{"nginx", "docker.io", "library/nginx", "", ""}, false},
+		{"nginx:1.17", ImageReference{"nginx", "docker.io", "library/nginx", "1.17", ""}, false},
+		{"esaka/cowsay", ImageReference{"esaka/cowsay", "docker.io", "esaka/cowsay", "", ""}, false},
+		{"docker.io/library/nginx:latest", ImageReference{"docker.io/library/nginx", "docker.io", "library/nginx", "latest", ""}, false},
+		{"gcr.io/google_samples/gb-frontend:v3", ImageReference{"gcr.io/google_samples/gb-frontend", "gcr.io", "google_samples/gb-frontend", "v3", ""}, false},
+		{"localhost:5000/app", ImageReference{"localhost:5000/app", "localhost:5000", "app", "", ""}, false},
+		{"localhost/app:v1", ImageReference{"localhost/app", "localhost", "app", "v1", ""}, false},
+		{"registry.k8s.io/ingress-nginx/controller:v0.30.0@sha256:abcd", ImageReference{"registry.k8s.io/ingress-nginx/controller", "registry.k8s.io", "ingress-nginx/controller", "v0.30.0", "sha256:abcd"}, false},
+		{"nginx@sha256:abcd", ImageReference{"nginx", "docker.io", "library/nginx", "", "sha256:abcd"}, false},
+
+		// Failed Case
+		{"", ImageReference{}, true},
+		{"nginx:", ImageReference{}, true},
+		{"nginx@abcd", ImageReference{}, true},
+		{"gafas gafas fas", ImageReference{}, true},
+	}
+
+	for idx, pattern := range patterns {
+		actual, err := ParseImageReference(pattern.image)
+		if (err != nil) != pattern.err {
+			t.Errorf("pattern %d: unexpected error %v", idx, err)
+		} else if pattern.expected != actual {
+			t.Errorf("pattern %d: want %v, actual %v", idx, pattern.expected, actual)
+		} else if err == nil && actual.String() != pattern.image {
+			t.Errorf("pattern %d: want %v, actual %v", idx, pattern.image, actual.String())
+		}
+	}
+}
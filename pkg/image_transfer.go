@@ -21,10 +21,6 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecr"
 	distreference "github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
@@ -37,16 +33,133 @@ import (
 	"time"
 )
 
-// convert image path
+// registry host of ECR
+func ECRRegistry(region, accountId string) string {
+	return fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", accountId, region)
+}
+
+// convert image path, image already in the ECR is not converted
 func ConvertImagePathForECR(imageName, region, accountId string) string {
-	return fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s", accountId, region, imageName)
+	registry := ECRRegistry(region, accountId)
+	if strings.HasPrefix(imageName, registry+"/") {
+		return imageName
+	}
+	return registry + "/" + imageName
+}
+
+// TransferJob is an image to transfer
+type TransferJob struct {
+	// image path, e.g. "nginx:1.17"
+	Source string
+	// the digest is copied by registry API instead of docker when it is set, docker push changes digests of multi-platform images
+	Digest string
+	// image paths in ECR, they are decided by ImageMapper after pull when it is empty
+	Targets []string
+}
+
+// TransferSteps is the total of progress bar of a transfer
+const TransferSteps = 5
+
+// TransferOptions are optional steps of transfer
+type TransferOptions struct {
+	// cosign signatures, attestations, SBOMs and OCI referrers of images are copied.
+	// images are copied by registry API instead of docker, digests are changed by docker push
+	CopySignatures bool
+	// cosign signatures of images are verified before they are pushed, nil skips verification
+	Verifier *SignatureVerifier
+	// pushed images are signed by the signer, nil doesn't sign
+	Signer Signer
+	// SBOMs of pushed images are made, nil doesn't make them
+	SBOM *SBOMOptions
+	// scan findings of pushed images are waited for, nil doesn't wait
+	ScanGate *ScanGate
+}
+
+// SBOMs and signatures of pushed images, and their scan findings.
+// the scan gate is checked first, images which fail it are not signed
+func (o TransferOptions) attach(client *RegistryClient, targets []string) ([]string, []*ScanReport, error) {
+	var reports []*ScanReport
+	if o.ScanGate != nil {
+		var err error
+		reports, err = o.ScanGate.WaitTargets(targets)
+		if err != nil {
+			return nil, reports, err
+		}
+	}
+	var attached []string
+	if o.SBOM != nil {
+		sboms, err := AttachSBOMs(client, *o.SBOM, targets)
+		if err != nil {
+			return nil, reports, err
+		}
+		attached = append(attached, sboms...)
+	}
+	if o.Signer != nil {
+		signatures, err := SignTargets(client, o.Signer, targets)
+		if err != nil {
+			return nil, reports, err
+		}
+		attached = append(attached, signatures...)
+	}
+	return attached, reports, nil
+}
+
+// RejectedBySignaturePolicy is in result message of images whose signatures are not verified
+const RejectedBySignaturePolicy = "rejected by signature policy"
+
+// IsTransferFailure returns true when the result message of transfer reports failure
+func IsTransferFailure(msg string) bool {
+	return strings.Contains(msg, ". error message: ")
+}
+
+// IsTransferRejected returns true when the result message reports the image is rejected by signature policy or scan gate
+func IsTransferRejected(msg string) bool {
+	return strings.Contains(msg, RejectedBySignaturePolicy+". error message: ") || strings.Contains(msg, FailedScanGate+". error message: ")
+}
+
+// result message of failed transfer, images rejected by signature policy are reported apart from errors
+func failureMessage(image string, err error) string {
+	if IsSignatureError(err) {
+		return fmt.Sprintf("%s %s. error message: %v", image, RejectedBySignaturePolicy, err)
+	}
+	if IsScanGateError(err) {
+		return fmt.Sprintf("%s %s. error message: %v", image, FailedScanGate, err)
+	}
+	return fmt.Sprintf("%s failed to transfer. error message: %v", image, err)
+}
+
+// result message of succeeded transfer, scan findings of each pushed image are appended
+func transferMessage(image string, targets []string, reports []*ScanReport) string {
+	msg := fmt.Sprintf("%s transfer to %s", image, strings.Join(targets, ", "))
+	for _, report := range reports {
+		msg += fmt.Sprintf("\n    scan findings of %s: %s", report.Image, report.Summary())
+	}
+	return msg
 }
 
 // main func of transfer
-func ImageTransfer(pullImageName, region, accountId string, wg *sync.WaitGroup, bar *mpb.Bar, resultMsg chan<- string) {
+func ImageTransfer(pullImageName string, mapper *ImageMapper, wg *sync.WaitGroup, bar *mpb.Bar, resultMsg chan<- string) {
+	RunTransferJob(TransferJob{Source: pullImageName}, mapper, wg, bar, resultMsg)
+}
+
+// RunTransferJob transfer the image of job
+func RunTransferJob(job TransferJob, mapper *ImageMapper, wg *sync.WaitGroup, bar *mpb.Bar, resultMsg chan<- string) {
 
 	defer wg.Done()
 
+	pullImageName := job.Source
+
+	if mapper.Transfer.CopySignatures || job.Digest != "" {
+		targets, reports, err := CopyTransferJob(mapper.registryClient(), mapper, job)
+		if err != nil {
+			resultMsg <- failureMessage(pullImageName, err)
+			return
+		}
+		bar.IncrBy(TransferSteps)
+		resultMsg <- transferMessage(pullImageName, targets, reports)
+		return
+	}
+
 	// Step1. Pull Docker image from external registry.
 	cl, err := client.NewEnvClient()
 	if err != nil {
@@ -57,24 +170,33 @@ func ImageTransfer(pullImageName, region, accountId string, wg *sync.WaitGroup,
 	opts := types.ImagePullOptions{}
 	ctx := context.Background()
 
-	image, err := SeparateImageName(pullImageName)
+	// registry may have port, e.g. "localhost:5000/app:1", and the image may be pinned by digest
+	ref, err := ParseImageReference(pullImageName)
 	if err != nil {
 		resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
 		return
 	}
+	// docker lists images by familiar name, e.g. "nginx:1.17", "localhost:5000/app@sha256:..."
+	familiar := familiarName(ref)
+	suffix := ":" + manifestReference(ref)
+	if ref.Digest != "" {
+		suffix = "@" + ref.Digest
+	}
 
-	resp, err := cl.ImagePull(ctx, pullImageName, opts)
+	// ECR Public allows anonymous pulls, but authenticated pulls have higher rate limit.
+	// its token is issued by API of us-east-1 regardless of the target region, so it is used when it can be got
+	if ref.Registry == ECRPublicRegistry {
+		if credential, err := ECRPublicCredential(NewECRPublicClient()); err == nil {
+			opts.RegistryAuth = registryAuth(credential.Username, credential.Password)
+		}
+	}
+
+	pullRef := pullImageName
+	resp, err := cl.ImagePull(ctx, pullRef, opts)
 	if err != nil {
 		if err == distreference.ErrNameNotCanonical {
-			imageNameLen := strings.Split(image.RepositoryName, "/")
-			var pullingImagePrefix string
-			switch len(imageNameLen) {
-			case 1:
-				pullingImagePrefix = "docker.io/library/"
-			default:
-				pullingImagePrefix = "docker.io/"
-			}
-			resp, err = cl.ImagePull(ctx, pullingImagePrefix+image.RepositoryName+":"+image.Tag, opts)
+			pullRef = ref.Registry + "/" + ref.Repository + suffix
+			resp, err = cl.ImagePull(ctx, pullRef, opts)
 			if err != nil {
 				resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
 				return
@@ -93,56 +215,60 @@ func ImageTransfer(pullImageName, region, accountId string, wg *sync.WaitGroup,
 	}
 	bar.Increment()
 
-	// Step2. Create repository in ECR
-	ecrSvc := ecr.New(session.New(&aws.Config{Region: aws.String(region)}))
-	repositoryInfo := ecr.CreateRepositoryInput{
-		RepositoryName: aws.String(image.RepositoryName),
-	}
-	_, err = ecrSvc.CreateRepository(&repositoryInfo)
-	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() != ecr.ErrCodeRepositoryAlreadyExistsException {
-				resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
-				return
-			}
+	// verify signature of the pulled digest before it is pushed
+	if mapper.Transfer.Verifier != nil {
+		inspect, _, err := cl.ImageInspectWithRaw(ctx, pullRef)
+		if err != nil {
+			resultMsg <- failureMessage(pullImageName, err)
+			return
+		}
+		digest := repoDigest(inspect.RepoDigests, familiar)
+		if err := mapper.Transfer.Verifier.Verify(pullImageName, digest); err != nil {
+			resultMsg <- failureMessage(pullImageName, err)
+			return
 		}
 	}
-	bar.Increment()
 
-	// Step3. Get authorization for ECR
-	loginAuth, err := ecrSvc.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+	// Step2. Create repository in ECR
+	repositoryName, err := mapper.Repository(pullImageName)
 	if err != nil {
 		resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
 		return
 	}
-
-	decodedData, _ := base64.StdEncoding.DecodeString(*loginAuth.AuthorizationData[0].AuthorizationToken)
-	decodedString := string(decodedData)
-
-	// AuthorizationToken format is "user:password"
-	authList := strings.Split(decodedString, ":")
-	if len(authList) != 2 {
-		resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, "cannot get registry login token")
+	destination := mapper.destination()
+	err = destination.CreateRepository(repositoryName, mapper.RepositorySettings)
+	if err != nil {
+		resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
 		return
 	}
-	username := authList[0]
-	password := authList[1]
-	serverAddress := *loginAuth.AuthorizationData[0].ProxyEndpoint
+	bar.Increment()
 
-	auth := types.AuthConfig{
-		Username:      username,
-		Password:      password,
-		ServerAddress: serverAddress,
-	}
-	_, err = cl.RegistryLogin(context.Background(), auth)
+	// Step3. Get authorization for ECR
+	credential, err := destination.Credential()
 	if err != nil {
 		resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
 		return
 	}
+	username := credential.Username
+	password := credential.Password
+
+	// anonymous push is allowed by some registries, e.g. registry:2
+	if username != "" {
+		auth := types.AuthConfig{
+			Username:      username,
+			Password:      password,
+			ServerAddress: destination.Registry(),
+		}
+		_, err = cl.RegistryLogin(context.Background(), auth)
+		if err != nil {
+			resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
+			return
+		}
+	}
 	bar.Increment()
 
 	// Step4. Tag image as ECR
-	filtMap := map[string][]string{"reference": {image.RepositoryName + ":" + image.Tag}}
+	filtMap := map[string][]string{"reference": {familiar + suffix}}
 	filtBytes, _ := json.Marshal(filtMap)
 	filt, err := filters.FromParam(string(filtBytes))
 	if err != nil {
@@ -158,17 +284,71 @@ func ImageTransfer(pullImageName, region, accountId string, wg *sync.WaitGroup,
 		resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
 		return
 	}
+	if len(img) == 0 {
+		resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %s is not found in docker after pull", pullImageName, familiar+suffix)
+		return
+	}
 
-	newImageTag := ConvertImagePathForECR(pullImageName, region, accountId)
+	// digest of pulled image is used by tag policy
+	digest := ""
+	inspect, _, err := cl.ImageInspectWithRaw(ctx, img[0].ID)
+	if err == nil && len(inspect.RepoDigests) != 0 {
+		digest = inspect.RepoDigests[0][strings.Index(inspect.RepoDigests[0], "@")+1:]
+	}
 
-	err = cl.ImageTag(ctx, img[0].ID, newImageTag)
-	if err != nil {
-		resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
-		return
+	newImageTags := job.Targets
+	if len(newImageTags) == 0 {
+		newImageTags, err = mapper.Targets(pullImageName, digest)
+		if err != nil {
+			resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
+			return
+		}
+	}
+
+	for _, newImageTag := range newImageTags {
+		err = cl.ImageTag(ctx, img[0].ID, newImageTag)
+		if err != nil {
+			resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
+			return
+		}
 	}
 	bar.Increment()
 
-	// Step5. Push image into ECR
+	// Step6. Wait for scan findings and attach SBOMs and signatures, pushImages calls it after push of Step5
+	var attach func(targets []string) ([]string, []*ScanReport, error)
+	if options := mapper.Transfer; options.SBOM != nil || options.Signer != nil || options.ScanGate != nil {
+		attach = func(targets []string) ([]string, []*ScanReport, error) {
+			client := mapper.registryClient()
+			if username != "" {
+				client.SetCredential(destination.Registry(), credential)
+			}
+			return options.attach(client, targets)
+		}
+	}
+	pushImages(cl, pullImageName, newImageTags, username, password, attach, bar, resultMsg)
+}
+
+// name of the image in docker, "docker.io/" and "library/" of Docker Hub are omitted
+func familiarName(ref ImageReference) string {
+	if ref.Registry == "docker.io" {
+		return strings.TrimPrefix(ref.Repository, "library/")
+	}
+	return ref.Registry + "/" + ref.Repository
+}
+
+// digest of the repository in RepoDigests of docker image, e.g. "nginx@sha256:..."
+func repoDigest(repoDigests []string, repository string) string {
+	for _, repoDigest := range repoDigests {
+		i := strings.Index(repoDigest, "@")
+		if i >= 0 && strings.HasSuffix(repoDigest[:i], repository) {
+			return repoDigest[i+1:]
+		}
+	}
+	return ""
+}
+
+// auth of docker API, base64 encoded json
+func registryAuth(username, password string) string {
 	authJson := struct {
 		Username string
 		Password string
@@ -176,25 +356,39 @@ func ImageTransfer(pullImageName, region, accountId string, wg *sync.WaitGroup,
 		Username: username,
 		Password: password,
 	}
-
 	authBytes, _ := json.Marshal(authJson)
-	authTokenBase64 := base64.StdEncoding.EncodeToString(authBytes)
+	return base64.StdEncoding.EncodeToString(authBytes)
+}
 
+// Step5. Push image into ECR
+func pushImages(cl *client.Client, pullImageName string, newImageTags []string, username, password string, attach func([]string) ([]string, []*ScanReport, error), bar *mpb.Bar, resultMsg chan<- string) {
+	ctx := context.Background()
 	pushOpts := types.ImagePushOptions{
-		RegistryAuth: authTokenBase64,
+		RegistryAuth: registryAuth(username, password),
 	}
 
-	resp, err = cl.ImagePush(ctx, newImageTag, pushOpts)
-	if err != nil {
-		resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
-		return
-	}
+	for _, newImageTag := range newImageTags {
+		resp, err := cl.ImagePush(ctx, newImageTag, pushOpts)
+		if err != nil {
+			resultMsg <- fmt.Sprintf("%s failed to transfer. error message: %v", pullImageName, err)
+			return
+		}
 
-	scanner = bufio.NewScanner(resp)
-	for scanner.Scan() {
+		scanner := bufio.NewScanner(resp)
+		for scanner.Scan() {
+		}
+	}
+	var reports []*ScanReport
+	if attach != nil {
+		attached, r, err := attach(newImageTags)
+		if err != nil {
+			resultMsg <- failureMessage(pullImageName, err)
+			return
+		}
+		newImageTags, reports = append(newImageTags, attached...), r
 	}
 	bar.Increment()
-	resultMsg <- fmt.Sprintf("%s transfer to %s", pullImageName, newImageTag)
+	resultMsg <- transferMessage(pullImageName, newImageTags, reports)
 
 	// wait a few time, to display progress 100%
 	time.Sleep(1 * time.Second)
@@ -1,6 +1,9 @@
 package pkg
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestConvertImagePathForECR(t *testing.T) {
 	expected := "123456789012.dkr.ecr.ap-northeast1.amazonaws.com/nginx:latest"
@@ -10,3 +13,31 @@ func TestConvertImagePathForECR(t *testing.T) {
 		t.Fatalf("expected: %v, got: %v", expected, actual)
 	}
 }
+
+func TestConvertImagePathForECRAlreadyConverted(t *testing.T) {
+	expected := "123456789012.dkr.ecr.ap-northeast1.amazonaws.com/nginx:latest"
+	actual := ConvertImagePathForECR(expected, "ap-northeast1", "123456789012")
+
+	if expected != actual {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+}
+
+func TestFamiliarName(t *testing.T) {
+	patterns := map[string]string{
+		"nginx:1.17":                   "nginx",
+		"docker.io/library/nginx:1.17": "nginx",
+		"bitnami/redis:6":              "bitnami/redis",
+		"localhost:5000/app:1":         "localhost:5000/app",
+		"quay.io/coreos/etcd@sha256:" + strings.Repeat("a", 64): "quay.io/coreos/etcd",
+	}
+	for image, expected := range patterns {
+		ref, err := ParseImageReference(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := familiarName(ref); actual != expected {
+			t.Errorf("%s: expected: %v, got: %v", image, expected, actual)
+		}
+	}
+}
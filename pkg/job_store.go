@@ -0,0 +1,153 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// status of transfer job
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobSkipped   = "skipped"
+	// signature of the image is not verified or it failed the scan gate, it is not retried
+	JobRejected = "rejected"
+)
+
+// Job is a transfer of image requested to serve
+type Job struct {
+	ID       uint64 `json:"id"`
+	Image    string `json:"image"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	// image paths pushed to
+	Targets []string `json:"targets,omitempty"`
+	// error of the last attempt, or the reason why it is skipped
+	Message   string    `json:"message,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Done returns true when the job is not transferred any more
+func (j *Job) Done() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobSkipped || j.Status == JobRejected
+}
+
+var ErrJobNotFound = errors.New("job is not found")
+
+var jobBucket = []byte("jobs")
+
+// JobStore persists jobs into a BoltDB file, jobs are resumed after restart
+type JobStore struct {
+	db *bolt.DB
+}
+
+// OpenJobStore open the file, it is created when it doesn't exist
+func OpenJobStore(path string) (*JobStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &JobStore{db: db}, nil
+}
+
+func (s *JobStore) Close() error {
+	return s.db.Close()
+}
+
+// keys are big endian to list jobs in order of ID
+func jobKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// Create add a new job, ID and times are set
+func (s *JobStore) Create(job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		job.ID = id
+		job.CreatedAt = time.Now().UTC()
+		job.UpdatedAt = job.CreatedAt
+		data, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		return b.Put(jobKey(id), data)
+	})
+}
+
+// Update overwrite the job
+func (s *JobStore) Update(job *Job) error {
+	job.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobBucket).Put(jobKey(job.ID), data)
+	})
+}
+
+func (s *JobStore) Get(id uint64) (*Job, error) {
+	job := &Job{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(jobBucket).Get(jobKey(id))
+		if data == nil {
+			return ErrJobNotFound
+		}
+		return json.Unmarshal(data, job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// List returns jobs in order of ID
+func (s *JobStore) List() ([]*Job, error) {
+	var jobs []*Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobBucket).ForEach(func(k, v []byte) error {
+			job := &Job{}
+			if err := json.Unmarshal(v, job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	return jobs, err
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.db")
+
+	store, err := OpenJobStore(path)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	for _, image := range []string{"nginx:1.17", "redis:6", "busybox:1.31"} {
+		if err := store.Create(&Job{Image: image, Status: JobQueued}); err != nil {
+			t.Fatalf("failed to create: %v", err)
+		}
+	}
+	job, err := store.Get(2)
+	if err != nil || job.Image != "redis:6" {
+		t.Fatalf("unexpected job: %v, %v", job, err)
+	}
+	job.Status = JobFailed
+	job.Message = "manifest unknown"
+	if err := store.Update(job); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if _, err := store.Get(4); err != ErrJobNotFound {
+		t.Errorf("expected ErrJobNotFound, got: %v", err)
+	}
+	store.Close()
+
+	// jobs are kept after reopen
+	store, err = OpenJobStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer store.Close()
+	jobs, err := store.List()
+	if err != nil {
+		t.Fatalf("failed to list: %v", err)
+	}
+	if len(jobs) != 3 {
+		t.Fatalf("expected 3 jobs, got: %d", len(jobs))
+	}
+	for i, job := range jobs {
+		if job.ID != uint64(i+1) {
+			t.Errorf("jobs should be in order of ID: %v", jobs)
+		}
+	}
+	if jobs[1].Status != JobFailed || jobs[1].Message != "manifest unknown" || jobs[1].Done() != true {
+		t.Errorf("updated job is not persisted: %v", jobs[1])
+	}
+	if err := store.Create(&Job{Image: "alpine:3.11"}); err != nil || jobs[2].ID >= 4 {
+		t.Errorf("ID should not be reused: %v", err)
+	}
+}
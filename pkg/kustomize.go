@@ -0,0 +1,264 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var kustomizationFiles = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// KustomizeImage is an entry of images field in kustomization.yaml
+type KustomizeImage struct {
+	Name    string `yaml:"name"`
+	NewName string `yaml:"newName,omitempty"`
+	NewTag  string `yaml:"newTag,omitempty"`
+	Digest  string `yaml:"digest,omitempty"`
+}
+
+type kustomization struct {
+	Resources []string         `yaml:"resources"`
+	Bases     []string         `yaml:"bases"`
+	Images    []KustomizeImage `yaml:"images"`
+}
+
+// FindKustomization returns path of kustomization file in dir
+func FindKustomization(dir string) (string, error) {
+	for _, name := range kustomizationFiles {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("kustomization file is not found in %s", dir)
+}
+
+func readKustomization(path string) (*kustomization, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var k kustomization
+	if err := yaml.Unmarshal(data, &k); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &k, nil
+}
+
+// ReadKustomizeImages returns images field of kustomization file
+func ReadKustomizeImages(path string) ([]KustomizeImage, error) {
+	k, err := readKustomization(path)
+	if err != nil {
+		return nil, err
+	}
+	return k.Images, nil
+}
+
+// LoadKustomizeManifests read manifests of resources in kustomization directory recursively.
+// remote resources are not read, they are returned as the second value.
+// broken documents are reported as ManifestErrors with the manifests which can be parsed
+func LoadKustomizeManifests(dir string) ([]Manifest, []string, error) {
+	l := kustomizeLoader{visited: map[string]bool{}}
+	if err := l.load(dir); err != nil {
+		return nil, nil, err
+	}
+	if len(l.errs) != 0 {
+		return l.manifests, l.remote, l.errs
+	}
+	return l.manifests, l.remote, nil
+}
+
+type kustomizeLoader struct {
+	visited   map[string]bool
+	manifests []Manifest
+	remote    []string
+	errs      ManifestErrors
+}
+
+func (l *kustomizeLoader) load(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if l.visited[abs] {
+		return nil
+	}
+	l.visited[abs] = true
+
+	path, err := FindKustomization(dir)
+	if err != nil {
+		return err
+	}
+	k, err := readKustomization(path)
+	if err != nil {
+		return err
+	}
+
+	for _, resource := range append(k.Resources, k.Bases...) {
+		if isRemoteResource(resource) {
+			l.remote = append(l.remote, resource)
+			continue
+		}
+		resourcePath := filepath.Join(dir, resource)
+		info, err := os.Stat(resourcePath)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if info.IsDir() {
+			if err := l.load(resourcePath); err != nil {
+				return err
+			}
+			continue
+		}
+		manifests, err := ParseManifestFile(resourcePath)
+		if err != nil {
+			errs, ok := err.(ManifestErrors)
+			if !ok {
+				return err
+			}
+			l.errs = append(l.errs, errs...)
+		}
+		l.manifests = append(l.manifests, manifests...)
+	}
+	return nil
+}
+
+// git repositories and urls
+func isRemoteResource(resource string) bool {
+	return strings.Contains(resource, "://") || strings.Contains(resource, "?ref=") ||
+		strings.HasPrefix(resource, "github.com/") || strings.HasPrefix(resource, "git@")
+}
+
+// KustomizeImages make images field of kustomization which points images to ECR.
+// entries of existing are updated, and entries for other images are kept as they are
+func KustomizeImages(existing []KustomizeImage, images []string, mapper *ImageMapper) ([]KustomizeImage, error) {
+	results := make([]KustomizeImage, len(existing))
+	copy(results, existing)
+	index := map[string]int{}
+	for i, entry := range existing {
+		index[entry.Name] = i
+	}
+
+	var added []KustomizeImage
+	generated := map[string]KustomizeImage{}
+	for _, image := range images {
+		ref, err := ParseImageReference(image)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", image, err)
+		}
+		i, exists := index[ref.Name]
+		entry := KustomizeImage{Name: ref.Name}
+		if exists {
+			entry = existing[i]
+		}
+
+		// image is renamed by the existing entry, so the new name is in the external registry
+		source := ApplyKustomizeImages([]string{image}, []KustomizeImage{entry})[0]
+		mapping, err := mapper.Map(source)
+		if err != nil {
+			return nil, err
+		}
+		if !mapping.Replaced() {
+			continue
+		}
+		sourceRef, _ := ParseImageReference(source)
+		target, err := ParseImageReference(mapping.Target)
+		if err != nil {
+			return nil, err
+		}
+		entry.NewName = target.Name
+		if target.Tag != "" && target.Tag != sourceRef.Tag {
+			entry.NewTag = target.Tag
+		}
+
+		// one entry is shared by the same name with different tags
+		if prev, ok := generated[ref.Name]; ok {
+			if prev != entry {
+				return nil, fmt.Errorf("images of %s are pushed with different tags, images field of kustomization can't express it", ref.Name)
+			}
+			continue
+		}
+		generated[ref.Name] = entry
+
+		if exists {
+			results[i] = entry
+		} else {
+			added = append(added, entry)
+		}
+	}
+
+	sort.Slice(added, func(i, j int) bool { return added[i].Name < added[j].Name })
+	return append(results, added...), nil
+}
+
+// UpdateKustomization set images field of kustomization file, other fields keep their order
+func UpdateKustomization(path string, images []KustomizeImage) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var k yaml.MapSlice
+	if err := yaml.Unmarshal(data, &k); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	updated := false
+	for i := range k {
+		if k[i].Key == "images" {
+			k[i].Value = images
+			updated = true
+		}
+	}
+	if !updated {
+		k = append(k, yaml.MapItem{Key: "images", Value: images})
+	}
+	return yaml.Marshal(k)
+}
+
+// ApplyKustomizeImages returns image paths after the images field of kustomization is applied
+func ApplyKustomizeImages(images []string, entries []KustomizeImage) []string {
+	results := make([]string, 0, len(images))
+	for _, image := range images {
+		ref, err := ParseImageReference(image)
+		if err != nil {
+			results = append(results, image)
+			continue
+		}
+		for _, entry := range entries {
+			if entry.Name != ref.Name {
+				continue
+			}
+			if entry.NewName != "" {
+				ref.Name = entry.NewName
+			}
+			if entry.NewTag != "" {
+				ref.Tag = entry.NewTag
+			}
+			if entry.Digest != "" {
+				ref.Tag, ref.Digest = "", entry.Digest
+			}
+			break
+		}
+		results = append(results, ref.String())
+	}
+	return results
+}
@@ -0,0 +1,121 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"gopkg.in/yaml.v2"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLoadKustomizeManifests(t *testing.T) {
+	manifests, remote, err := LoadKustomizeManifests("../testfiles/input/kustomize/overlay")
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if len(manifests) != 2 {
+		t.Fatalf("expected 2 manifests, got: %d", len(manifests))
+	}
+	expectedRemote := []string{"https://github.com/esakat/trimg//testfiles/input?ref=master"}
+	if !reflect.DeepEqual(expectedRemote, remote) {
+		t.Fatalf("expected: %v, got: %v", expectedRemote, remote)
+	}
+
+	var images []string
+	for _, m := range manifests {
+		i, _ := GetUsingImages(m.Body)
+		images = append(images, i...)
+	}
+	sort.Strings(images)
+	expected := []string{"initImage:latest", "initPod:v2.0.0", "nginx", "nginx:latest", "nginx:latest"}
+	if !reflect.DeepEqual(expected, images) {
+		t.Fatalf("expected: %v, got: %v", expected, images)
+	}
+}
+
+func TestKustomizeImages(t *testing.T) {
+	existing, err := ReadKustomizeImages("../testfiles/input/kustomize/overlay/kustomization.yaml")
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	images := []string{"nginx:latest", "initImage:latest", "initPod:v2.0.0", "nginx"}
+
+	actual, err := KustomizeImages(existing, images, &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444"})
+	if err != nil {
+		t.Fatalf("failed to generate images: %v", err)
+	}
+	ecr := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/"
+	expected := []KustomizeImage{
+		{Name: "initPod", NewName: ecr + "quay.io/esakat/initpod", NewTag: "v2.1.0"},
+		{Name: "unused", NewTag: "1.0"},
+		{Name: "initImage", NewName: ecr + "initImage"},
+		{Name: "nginx", NewName: ecr + "nginx"},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+
+	// images to transfer are the images after existing entries are applied
+	expectedImages := []string{"nginx:latest", "initImage:latest", "quay.io/esakat/initpod:v2.1.0", "nginx"}
+	actualImages := ApplyKustomizeImages(images, existing)
+	if !reflect.DeepEqual(expectedImages, actualImages) {
+		t.Fatalf("expected: %v, got: %v", expectedImages, actualImages)
+	}
+}
+
+func TestUpdateKustomization(t *testing.T) {
+	images := []KustomizeImage{{Name: "nginx", NewName: "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/nginx"}}
+	d, err := UpdateKustomization("../testfiles/input/kustomize/overlay/kustomization.yaml", images)
+	if err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+
+	var actual yaml.MapSlice
+	if err := yaml.Unmarshal(d, &actual); err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	// order of fields is kept
+	var keys []interface{}
+	for _, item := range actual {
+		keys = append(keys, item.Key)
+	}
+	expectedKeys := []interface{}{"namespace", "resources", "images", "commonLabels"}
+	if !reflect.DeepEqual(expectedKeys, keys) {
+		t.Fatalf("expected: %v, got: %v", expectedKeys, keys)
+	}
+
+	var k kustomization
+	if err := yaml.Unmarshal(d, &k); err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if !reflect.DeepEqual(images, k.Images) {
+		t.Fatalf("expected: %v, got: %v", images, k.Images)
+	}
+
+	// images field is added when it doesn't exist
+	d, err = UpdateKustomization("../testfiles/input/kustomize/base/kustomization.yaml", images)
+	if err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	k = kustomization{}
+	if err := yaml.Unmarshal(d, &k); err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if !reflect.DeepEqual(images, k.Images) {
+		t.Fatalf("expected: %v, got: %v", images, k.Images)
+	}
+}
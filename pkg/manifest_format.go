@@ -0,0 +1,209 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"strconv"
+)
+
+// Format is the serialization format of manifest file
+type Format int
+
+const (
+	FormatYAML Format = iota
+	FormatJSON
+)
+
+func (f Format) String() string {
+	if f == FormatJSON {
+		return "json"
+	}
+	return "yaml"
+}
+
+// DetectFormat detect json by the first character of object or array, otherwise yaml
+func DetectFormat(data []byte) Format {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) != 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return FormatJSON
+	}
+	return FormatYAML
+}
+
+// MarshalManifests serialize manifests in the format.
+// yaml documents are joined by "---", json objects are joined by new line
+func MarshalManifests(manifests []map[interface{}]interface{}, format Format) ([]byte, error) {
+	var buf bytes.Buffer
+	for i, m := range manifests {
+		if format == FormatJSON {
+			d, err := json.MarshalIndent(convertToJSON(m), "", "    ")
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(d)
+			buf.WriteString("\n")
+		} else {
+			d, err := yaml.Marshal(m)
+			if err != nil {
+				return nil, err
+			}
+			if i != 0 {
+				buf.WriteString("---\n")
+			}
+			buf.Write(d)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// split json stream into top-level values, elements of top-level array are split in the same way,
+// e.g. [{"kind": "Pod"}, {"kind": "Service"}] has two documents
+func splitJSONDocuments(data []byte) []document {
+	var docs []document
+	// depth of values in the top-level array
+	base := 0
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); len(trimmed) != 0 && trimmed[0] == '[' {
+		base = 1
+	}
+	depth := 0
+	opened := false
+	inString, escaped := false, false
+	start, startLine, line := -1, 1, 1
+
+	for i, c := range data {
+		if c == '\n' {
+			line++
+		}
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		// brackets and separators of the top-level array
+		if base != 0 && start < 0 {
+			switch {
+			case c == '[' && !opened:
+				opened, depth = true, base
+				continue
+			case c == ',' && depth == base:
+				continue
+			case c == ']' && depth == base:
+				depth = 0
+				continue
+			}
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+		}
+		if start < 0 {
+			start, startLine = i, line
+		}
+		if depth <= base && (c == '}' || c == ']') {
+			docs = append(docs, document{index: len(docs) + 1, line: startLine, data: data[start : i+1]})
+			start, depth = -1, base
+		}
+	}
+	// unterminated value
+	if start >= 0 {
+		docs = append(docs, document{index: len(docs) + 1, line: startLine, data: data[start:]})
+	}
+	return docs
+}
+
+func unmarshalJSON(data []byte) (map[interface{}]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	m, ok := convertFromJSON(v).(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("json: document is not an object")
+	}
+	return m, nil
+}
+
+// convert decoded json into the same types as yaml.v2
+func convertFromJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[interface{}]interface{}, len(t))
+		for key, value := range t {
+			m[key] = convertFromJSON(value)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = convertFromJSON(t[i])
+		}
+		return t
+	case json.Number:
+		// integers are resolved in the same way as yaml.v2, int when it fits
+		if n, err := t.Int64(); err == nil {
+			if n == int64(int(n)) {
+				return int(n)
+			}
+			return n
+		}
+		if n, err := strconv.ParseUint(t.String(), 10, 64); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+// convert yaml.v2 types into types which encoding/json can marshal
+func convertToJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for key, value := range t {
+			m[fmt.Sprintf("%v", key)] = convertToJSON(value)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i := range t {
+			l[i] = convertToJSON(t[i])
+		}
+		return l
+	default:
+		return v
+	}
+}
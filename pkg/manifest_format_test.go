@@ -0,0 +1,141 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	patterns := []struct {
+		data     string
+		expected Format
+	}{
+		{"apiVersion: v1\nkind: Pod\n", FormatYAML},
+		{"---\n{\"kind\": \"Pod\"}\n", FormatYAML},
+		{"{\"kind\": \"Pod\"}", FormatJSON},
+		{"\n  {\n\"kind\": \"Pod\"}", FormatJSON},
+		{"[{\"kind\": \"Pod\"}]", FormatJSON},
+		{"", FormatYAML},
+	}
+
+	for idx, pattern := range patterns {
+		actual := DetectFormat([]byte(pattern.data))
+		if actual != pattern.expected {
+			t.Errorf("pattern %d: want %v, actual %v", idx, pattern.expected, actual)
+		}
+	}
+}
+
+func TestParseManifestsJSON(t *testing.T) {
+	manifests, err := ParseManifestFile("../testfiles/input/podlist.json")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(manifests) != 2 {
+		t.Fatalf("expected 2 documents, got: %d", len(manifests))
+	}
+	if manifests[0].Format != FormatJSON {
+		t.Fatalf("expected json format")
+	}
+	if manifests[1].Index != 2 || manifests[1].Line != 31 {
+		t.Fatalf("unexpected position of second document: %d, %d", manifests[1].Index, manifests[1].Line)
+	}
+
+	// numbers are decoded as int like yaml.v2
+	port, err := DigYaml(manifests[0].Body, "items", 0, "spec", "containers", 0, "ports", 0, "containerPort")
+	if err != nil {
+		t.Fatalf("failed to dig: %v", err)
+	}
+	if port != 80 {
+		t.Fatalf("expected: %v, got: %#v", 80, port)
+	}
+}
+
+func TestParseManifestsJSONArray(t *testing.T) {
+	data := "[\n  {\"kind\": \"Pod\", \"spec\": {\"containers\": [{\"image\": \"nginx:1.17\"}]}},\n  {\"kind\": \"Service\"}\n]\n"
+	manifests, err := ParseManifests("list.json", []byte(data))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(manifests) != 2 || manifests[0].Format != FormatJSON {
+		t.Fatalf("elements of array should be json documents, got: %v", manifests)
+	}
+	if manifests[0].Body["kind"] != "Pod" || manifests[1].Body["kind"] != "Service" || manifests[1].Line != 3 {
+		t.Errorf("unexpected documents: %v", manifests)
+	}
+	images, _ := GetUsingImages(manifests[0].Body)
+	if !reflect.DeepEqual(images, []string{"nginx:1.17"}) {
+		t.Errorf("unexpected images: %v", images)
+	}
+}
+
+func TestParseManifestsNumbers(t *testing.T) {
+	// the same manifest in json and yaml has the same types of numbers
+	values := "a: 80\nb: 4294967296\nc: 18446744073709551615\nd: 0.5\n"
+	fromYAML, err := ParseManifests("numbers.yml", []byte(values))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	fromJSON, err := ParseManifests("numbers.json", []byte(`{"a": 80, "b": 4294967296, "c": 18446744073709551615, "d": 0.5}`))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if !reflect.DeepEqual(fromYAML[0].Body, fromJSON[0].Body) {
+		t.Errorf("expected: %#v, got: %#v", fromYAML[0].Body, fromJSON[0].Body)
+	}
+}
+
+func TestParseManifestsBrokenJSON(t *testing.T) {
+	data := "{\"kind\": \"Pod\"}\n{\n  \"kind\": \"Pod\",\n  \"spec\": }\n{\"kind\": \"Job\"}\n"
+	manifests, err := ParseManifests("broken.json", []byte(data))
+	if len(manifests) != 2 {
+		t.Fatalf("expected 2 documents, got: %d", len(manifests))
+	}
+	errs, ok := err.(ManifestErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected one ManifestError, got: %v", err)
+	}
+	if errs[0].Index != 2 || errs[0].Line != 4 {
+		t.Fatalf("unexpected error position: %v", errs[0])
+	}
+}
+
+func TestMarshalManifestsJSON(t *testing.T) {
+	manifests := []map[interface{}]interface{}{
+		{"kind": "Pod", "spec": map[interface{}]interface{}{"containers": []interface{}{map[interface{}]interface{}{"image": "nginx"}}}},
+		{"kind": "Job"},
+	}
+
+	d, err := MarshalManifests(manifests, FormatJSON)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+
+	actual, err := ParseManifests("marshaled.json", d)
+	if err != nil {
+		t.Fatalf("failed to parse marshaled json: %v", err)
+	}
+	if len(actual) != 2 {
+		t.Fatalf("expected 2 documents, got: %d", len(actual))
+	}
+	for i := range manifests {
+		if !reflect.DeepEqual(manifests[i], actual[i].Body) {
+			t.Fatalf("expected: %v, got: %v", manifests[i], actual[i].Body)
+		}
+	}
+}
@@ -16,288 +16,331 @@ limitations under the License.
 package pkg
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"gopkg.in/yaml.v2"
-	"os"
+	"io/ioutil"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
+// Manifest is a document of kubernetes manifest file
+type Manifest struct {
+	File   string
+	Index  int // position of the document in the file, 1-origin
+	Line   int // line number where the document starts
+	Format Format
+	Body   map[interface{}]interface{}
+}
+
+// Error wrap err with position of the document
+func (m Manifest) Error(err error) *ManifestError {
+	return &ManifestError{File: m.File, Index: m.Index, Line: m.Line, Err: err}
+}
+
+// ManifestError is an error about a document of manifest file
+type ManifestError struct {
+	File  string
+	Index int
+	Line  int
+	Err   error
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("%s:%d: document %d: %v", e.File, e.Line, e.Index, e.Err)
+}
+
+// ManifestErrors is returned when some documents of manifest file are broken
+type ManifestErrors []*ManifestError
+
+func (e ManifestErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// yaml.v2 reports line number relative to the document
+var yamlLinePattern = regexp.MustCompile(`line (\d+)`)
+
 func ParseMultiDocYaml(filepath string) ([]map[interface{}]interface{}, error) {
-	f, err := os.Open(filepath)
-	defer f.Close()
+	manifests, err := ParseManifestFile(filepath)
+	yamls := make([]map[interface{}]interface{}, 0, len(manifests))
+	for _, m := range manifests {
+		yamls = append(yamls, m.Body)
+	}
+	return yamls, err
+}
+
+// ParseManifestFile parse all documents in the file.
+// broken documents are skipped and reported as ManifestErrors with the documents which can be parsed
+func ParseManifestFile(filepath string) ([]Manifest, error) {
+	data, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		return nil, err
 	}
+	return ParseManifests(filepath, data)
+}
 
-	dec := yaml.NewDecoder(f)
+// ParseManifests parse multi document yaml or json stream, name is used for error messages
+func ParseManifests(name string, data []byte) ([]Manifest, error) {
+	var manifests []Manifest
+	var errs ManifestErrors
 
-	var yamls []map[interface{}]interface{}
+	format := DetectFormat(data)
+	var docs []document
+	if format == FormatJSON {
+		docs = splitJSONDocuments(data)
+	} else {
+		docs = splitDocuments(data)
+	}
 
-	var tmp map[interface{}]interface{}
-	for (dec.Decode(&tmp)) == nil {
-		yamls = append(yamls, tmp)
-		tmp = nil
+	for _, doc := range docs {
+		var body map[interface{}]interface{}
+		var err error
+		if format == FormatJSON {
+			body, err = unmarshalJSON(doc.data)
+		} else {
+			err = yaml.Unmarshal(doc.data, &body)
+		}
+		if err != nil {
+			errs = append(errs, doc.error(name, err))
+			continue
+		}
+		if body == nil {
+			// empty document
+			continue
+		}
+		manifests = append(manifests, Manifest{File: name, Index: doc.index, Line: doc.line, Format: format, Body: body})
 	}
 
-	return yamls, nil
+	if len(errs) != 0 {
+		return manifests, errs
+	}
+	return manifests, nil
 }
 
-func GetUsingImages(manifest map[interface{}]interface{}) ([]string, error) {
+type document struct {
+	index int
+	line  int
+	data  []byte
+}
 
-	kind, ok := manifest["kind"]
-	if !ok {
-		return nil, errors.New("invalid format manifest")
+// convert line number of yaml error to the line number in the file
+func (d document) error(name string, err error) *ManifestError {
+	if e, ok := err.(*json.SyntaxError); ok {
+		line := d.line + bytes.Count(d.data[:e.Offset], []byte("\n"))
+		return &ManifestError{File: name, Index: d.index, Line: line, Err: err}
 	}
 
-	var images []string
-
-	switch kind {
-	case "Deployment", "ReplicaSet", "StatefulSet", "Job":
-		y, err := DigYaml(manifest, "spec", "template", "spec")
-		if err != nil {
-			return nil, err
-		}
-		podSpec, ok := y.(map[interface{}]interface{})
-		if !ok {
-			return nil, errors.New("invalid format manifest")
-		}
-		for psKey, psValue := range podSpec {
-			if psKey == "containers" || psKey == "initContainers" {
-				tmp, ok := psValue.([]interface{})
-				if !ok {
-					return nil, errors.New("invalid format manifest")
-				}
-				for _, tmpContainer := range tmp {
-					container, ok := tmpContainer.(map[interface{}]interface{})
-					if !ok {
-						return nil, errors.New("invalid format manifest")
-					}
-					for cKey, cValue := range container {
-						if cKey == "image" {
-							images = append(images, cValue.(string))
-						}
-					}
-				}
-			}
+	line := d.line
+	msg := yamlLinePattern.ReplaceAllStringFunc(err.Error(), func(s string) string {
+		n, _ := strconv.Atoi(strings.TrimPrefix(s, "line "))
+		n += d.line - 1
+		if line == d.line {
+			line = n
 		}
+		return fmt.Sprintf("line %d", n)
+	})
+	return &ManifestError{File: name, Index: d.index, Line: line, Err: errors.New(msg)}
+}
 
-	case "Pod":
-		for key, value := range manifest {
-			if key == "spec" {
-				podSpec, ok := value.(map[interface{}]interface{})
-				if !ok {
-					return nil, errors.New("invalid format manifest")
-				}
-				for psKey, psValue := range podSpec {
-					if psKey == "containers" || psKey == "initContainers" {
-						tmp, ok := psValue.([]interface{})
-						if !ok {
-							return nil, errors.New("invalid format manifest")
-						}
-						for _, tmpContainer := range tmp {
-							container, ok := tmpContainer.(map[interface{}]interface{})
-							if !ok {
-								return nil, errors.New("invalid format manifest")
-							}
-							for cKey, cValue := range container {
-								if cKey == "image" {
-									images = append(images, cValue.(string))
-								}
-							}
-						}
-					}
-				}
+// split multi document yaml by "---", "..." ends a document
+func splitDocuments(data []byte) []document {
+	var docs []document
+	current := document{index: 1, line: 1}
+	var buf bytes.Buffer
+	hasContent := false
+	// the document is ended by "...", "---" after it doesn't make empty document
+	ended := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		separator := isDocumentMarker(line, "---")
+		if separator || isDocumentMarker(line, "...") {
+			// separator before first document doesn't make empty document
+			if !ended && (hasContent || len(docs) != 0) {
+				current.data = append([]byte(nil), buf.Bytes()...)
+				docs = append(docs, current)
+				current = document{index: current.index + 1}
 			}
+			buf.Reset()
+			hasContent = false
+			ended = !separator
+			current.line = lineNum + 1
+			continue
 		}
-	case "CronJob":
-		y, err := DigYaml(manifest, "spec", "jobTemplate", "spec", "template", "spec")
-		if err != nil {
-			return nil, err
-		}
-		podSpec, ok := y.(map[interface{}]interface{})
-		if !ok {
-			return nil, errors.New("invalid format manifest")
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			hasContent = true
+			ended = false
 		}
-		for psKey, psValue := range podSpec {
-			if psKey == "containers" || psKey == "initContainers" {
-				tmp, ok := psValue.([]interface{})
-				if !ok {
-					return nil, errors.New("invalid format manifest")
-				}
-				for _, tmpContainer := range tmp {
-					container, ok := tmpContainer.(map[interface{}]interface{})
-					if !ok {
-						return nil, errors.New("invalid format manifest")
-					}
-					for cKey, cValue := range container {
-						if cKey == "image" {
-							images = append(images, cValue.(string))
-						}
-					}
-				}
-			}
-		}
-	default:
-		// don't have images resorces
-		return nil, nil
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	if hasContent {
+		current.data = buf.Bytes()
+		docs = append(docs, current)
 	}
+	return docs
+}
 
-	return images, nil
+// "---" or "..." at the beginning of line, followed by space or comment
+func isDocumentMarker(line, marker string) bool {
+	return line == marker || strings.HasPrefix(line, marker+" ") || strings.HasPrefix(line, marker+"\t")
 }
 
-func ReplaceUsingImages(manifest map[interface{}]interface{}, region, accountId string) (map[interface{}]interface{}, error) {
+// path to pod spec for each kind
+var podSpecPaths = map[string][]string{
+	"Deployment":  {"spec", "template", "spec"},
+	"ReplicaSet":  {"spec", "template", "spec"},
+	"StatefulSet": {"spec", "template", "spec"},
+	"Job":         {"spec", "template", "spec"},
+	"Pod":         {"spec"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+var containerKeys = []string{"containers", "initContainers"}
 
+// walkImages call fn for each container image in manifest, and replace the image with returned value
+func walkImages(manifest map[interface{}]interface{}, fn func(image string) (string, error)) error {
 	kind, ok := manifest["kind"]
 	if !ok {
-		return nil, errors.New("invalid format manifest")
+		return errors.New("kind is not specified")
 	}
+	kindName, ok := kind.(string)
+	if !ok {
+		return errors.New("kind is not a string")
+	}
+	return walkImagesOfKind(manifest, kindName, fn)
+}
 
-	switch kind {
-	case "Deployment", "ReplicaSet", "StatefulSet", "Job":
-		y, err := DigYaml(manifest, "spec", "template", "spec")
-		if err != nil {
-			return nil, err
+func walkImagesOfKind(manifest map[interface{}]interface{}, kind string, fn func(image string) (string, error)) error {
+	// List, e.g. "kubectl get -o yaml", and typed lists, e.g. DeploymentList
+	if strings.HasSuffix(kind, "List") {
+		value, ok := manifest["items"]
+		if !ok || value == nil {
+			return nil
 		}
-		podSpec, ok := y.(map[interface{}]interface{})
+		items, ok := value.([]interface{})
 		if !ok {
-			return nil, errors.New("invalid format manifest")
+			return errors.New("items is not a list")
 		}
-		for psKey, psValue := range podSpec {
-			if psKey == "containers" {
-				tmp, ok := psValue.([]interface{})
-				if !ok {
-					return nil, errors.New("invalid format manifest")
-				}
-				for i, tmpContainer := range tmp {
-					container, ok := tmpContainer.(map[interface{}]interface{})
-					if !ok {
-						return nil, errors.New("invalid format manifest")
-					}
-					for cKey, cValue := range container {
-						if cKey == "image" {
-							manifest["spec"].(map[interface{}]interface{})["template"].(map[interface{}]interface{})["spec"].(map[interface{}]interface{})["containers"].([]interface{})[i].(map[interface{}]interface{})["image"] =
-								ConvertImagePathForECR(cValue.(string), region, accountId)
-						}
-					}
-				}
-			} else if psKey == "initContainers" {
-				tmp, ok := psValue.([]interface{})
-				if !ok {
-					return nil, errors.New("invalid format manifest")
-				}
-				for i, tmpContainer := range tmp {
-					container, ok := tmpContainer.(map[interface{}]interface{})
-					if !ok {
-						return nil, errors.New("invalid format manifest")
-					}
-					for cKey, cValue := range container {
-						if cKey == "image" {
-							manifest["spec"].(map[interface{}]interface{})["template"].(map[interface{}]interface{})["spec"].(map[interface{}]interface{})["initContainers"].([]interface{})[i].(map[interface{}]interface{})["image"] =
-								ConvertImagePathForECR(cValue.(string), region, accountId)
-						}
-					}
-				}
+		for i, v := range items {
+			item, ok := v.(map[interface{}]interface{})
+			if !ok {
+				return fmt.Errorf("items[%d] is not a map", i)
 			}
-		}
-
-	case "Pod":
-		for key, value := range manifest {
-			if key == "spec" {
-				podSpec, ok := value.(map[interface{}]interface{})
-				if !ok {
-					return nil, errors.New("invalid format manifest")
-				}
-				for psKey, psValue := range podSpec {
-					if psKey == "containers" {
-						tmp, ok := psValue.([]interface{})
-						if !ok {
-							return nil, errors.New("invalid format manifest")
-						}
-						for i, tmpContainer := range tmp {
-							container, ok := tmpContainer.(map[interface{}]interface{})
-							if !ok {
-								return nil, errors.New("invalid format manifest")
-							}
-							for cKey, cValue := range container {
-								if cKey == "image" {
-									manifest["spec"].(map[interface{}]interface{})["containers"].([]interface{})[i].(map[interface{}]interface{})["image"] =
-										ConvertImagePathForECR(cValue.(string), region, accountId)
-								}
-							}
-						}
-					} else if psKey == "initContainers" {
-						tmp, ok := psValue.([]interface{})
-						if !ok {
-							return nil, errors.New("invalid format manifest")
-						}
-						for i, tmpContainer := range tmp {
-							container, ok := tmpContainer.(map[interface{}]interface{})
-							if !ok {
-								return nil, errors.New("invalid format manifest")
-							}
-							for cKey, cValue := range container {
-								if cKey == "image" {
-									manifest["spec"].(map[interface{}]interface{})["initContainers"].([]interface{})[i].(map[interface{}]interface{})["image"] =
-										ConvertImagePathForECR(cValue.(string), region, accountId)
-								}
-							}
-						}
-					}
+			// items of typed list don't have kind
+			itemKind := strings.TrimSuffix(kind, "List")
+			if k, ok := item["kind"]; ok {
+				if itemKind, ok = k.(string); !ok {
+					return fmt.Errorf("items[%d].kind is not a string", i)
 				}
 			}
+			if err := walkImagesOfKind(item, itemKind, fn); err != nil {
+				return fmt.Errorf("items[%d]: %v", i, err)
+			}
 		}
-	case "CronJob":
-		y, err := DigYaml(manifest, "spec", "jobTemplate", "spec", "template", "spec")
-		if err != nil {
-			return nil, err
+		return nil
+	}
+
+	path, ok := podSpecPaths[kind]
+	if !ok {
+		// don't have images resorces
+		return nil
+	}
+
+	y, err := DigYaml(manifest, stringsToKeys(path)...)
+	if err != nil {
+		return err
+	}
+	podSpecPath := strings.Join(path, ".")
+	podSpec, ok := y.(map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("%s is not a map", podSpecPath)
+	}
+
+	for _, key := range containerKeys {
+		value, ok := podSpec[key]
+		if !ok || value == nil {
+			continue
 		}
-		podSpec, ok := y.(map[interface{}]interface{})
+		containers, ok := value.([]interface{})
 		if !ok {
-			return nil, errors.New("invalid format manifest")
+			return fmt.Errorf("%s.%s is not a list", podSpecPath, key)
 		}
-		for psKey, psValue := range podSpec {
-			if psKey == "containers" {
-				tmp, ok := psValue.([]interface{})
-				if !ok {
-					return nil, errors.New("invalid format manifest")
-				}
-				for i, tmpContainer := range tmp {
-					container, ok := tmpContainer.(map[interface{}]interface{})
-					if !ok {
-						return nil, errors.New("invalid format manifest")
-					}
-					for cKey, cValue := range container {
-						if cKey == "image" {
-							manifest["spec"].(map[interface{}]interface{})["jobTemplate"].(map[interface{}]interface{})["spec"].(map[interface{}]interface{})["template"].(map[interface{}]interface{})["spec"].(map[interface{}]interface{})["containers"].([]interface{})[i].(map[interface{}]interface{})["image"] =
-								ConvertImagePathForECR(cValue.(string), region, accountId)
-						}
-					}
-				}
-			} else if psKey == "initContainers" {
-				tmp, ok := psValue.([]interface{})
-				if !ok {
-					return nil, errors.New("invalid format manifest")
-				}
-				for i, tmpContainer := range tmp {
-					container, ok := tmpContainer.(map[interface{}]interface{})
-					if !ok {
-						return nil, errors.New("invalid format manifest")
-					}
-					for cKey, cValue := range container {
-						if cKey == "image" {
-							manifest["spec"].(map[interface{}]interface{})["jobTemplate"].(map[interface{}]interface{})["spec"].(map[interface{}]interface{})["template"].(map[interface{}]interface{})["spec"].(map[interface{}]interface{})["initContainers"].([]interface{})[i].(map[interface{}]interface{})["image"] =
-								ConvertImagePathForECR(cValue.(string), region, accountId)
-						}
-					}
-				}
+		for i, c := range containers {
+			container, ok := c.(map[interface{}]interface{})
+			if !ok {
+				return fmt.Errorf("%s.%s[%d] is not a map", podSpecPath, key, i)
+			}
+			value, ok := container["image"]
+			if !ok {
+				continue
+			}
+			image, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s.%s[%d].image is not a string", podSpecPath, key, i)
+			}
+			newImage, err := fn(image)
+			if err != nil {
+				return err
 			}
+			container["image"] = newImage
 		}
+	}
+	return nil
+}
 
-	default:
-		// don't have images resorces
+func GetUsingImages(manifest map[interface{}]interface{}) ([]string, error) {
+	var images []string
+	err := walkImages(manifest, func(image string) (string, error) {
+		images = append(images, image)
+		return image, nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return images, nil
+}
 
+func ReplaceUsingImages(manifest map[interface{}]interface{}, region, accountId string) (map[interface{}]interface{}, error) {
+	return ReplaceImages(manifest, &ImageMapper{Region: region, AccountId: accountId})
+}
+
+// ReplaceImages replace images in manifest with the target of mapper, skipped images are not replaced
+func ReplaceImages(manifest map[interface{}]interface{}, mapper *ImageMapper) (map[interface{}]interface{}, error) {
+	// validate whole manifest before replacing, not to leave it half replaced
+	images, err := GetUsingImages(manifest)
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		if _, err := mapper.Map(image); err != nil {
+			return nil, err
+		}
+	}
+	err = walkImages(manifest, func(image string) (string, error) {
+		mapping, err := mapper.Map(image)
+		if err != nil {
+			return "", err
+		}
+		return mapping.Target, nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return manifest, nil
 }
 
@@ -330,3 +330,115 @@ func TestDigYaml(t *testing.T) {
 		t.Fatalf("expected: %v, got: %v", expected2, actual2)
 	}
 }
+
+func TestParseManifestFileBrokenDocument(t *testing.T) {
+	manifests, err := ParseManifestFile("../testfiles/input/broken.yml")
+	if err == nil {
+		t.Fatalf("expected error for broken document")
+	}
+
+	// documents after the broken one should be parsed
+	if len(manifests) != 2 {
+		t.Fatalf("expected 2 documents, got: %d", len(manifests))
+	}
+	if manifests[0].Index != 1 || manifests[0].Line != 1 {
+		t.Fatalf("unexpected position of first document: %d, %d", manifests[0].Index, manifests[0].Line)
+	}
+	if manifests[1].Index != 3 || manifests[1].Line != 18 {
+		t.Fatalf("unexpected position of last document: %d, %d", manifests[1].Index, manifests[1].Line)
+	}
+
+	errs, ok := err.(ManifestErrors)
+	if !ok {
+		t.Fatalf("expected ManifestErrors, got: %T", err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got: %d", len(errs))
+	}
+	if errs[0].File != "../testfiles/input/broken.yml" || errs[0].Index != 2 || errs[0].Line != 14 {
+		t.Fatalf("unexpected error position: %v", errs[0])
+	}
+}
+
+func TestParseManifestsDocumentEnd(t *testing.T) {
+	data := []byte("a: 1\n...\n---\nb: 2\n...\n# comment\nc: 3\n...\n")
+	manifests, err := ParseManifests("end.yml", data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(manifests) != 3 {
+		t.Fatalf("expected 3 documents, got: %d", len(manifests))
+	}
+	for i, key := range []string{"a", "b", "c"} {
+		if manifests[i].Index != i+1 || manifests[i].Body[key] != i+1 {
+			t.Errorf("unexpected document %d: %v", manifests[i].Index, manifests[i].Body)
+		}
+	}
+	if manifests[1].Line != 4 || manifests[2].Line != 6 {
+		t.Errorf("unexpected lines of documents: %d, %d", manifests[1].Line, manifests[2].Line)
+	}
+}
+
+func TestParseManifestFileNotExists(t *testing.T) {
+	_, err := ParseManifestFile("../testfiles/input/not_exists.yml")
+	if err == nil {
+		t.Fatalf("expected error for missing file")
+	}
+	if _, ok := err.(ManifestErrors); ok {
+		t.Fatalf("missing file should not be reported as broken documents")
+	}
+}
+
+func TestGetUsingImagesInvalidImage(t *testing.T) {
+	manifest := map[interface{}]interface{}{
+		"kind": "Pod",
+		"spec": map[interface{}]interface{}{
+			"containers": []interface{}{
+				map[interface{}]interface{}{"name": "web", "image": 1},
+			},
+		},
+	}
+
+	_, err := GetUsingImages(manifest)
+	if err == nil {
+		t.Fatalf("expected error for invalid image")
+	}
+	expected := "spec.containers[0].image is not a string"
+	if err.Error() != expected {
+		t.Fatalf("expected: %v, got: %v", expected, err)
+	}
+}
+
+func TestGetUsingImagesList(t *testing.T) {
+	list, _ := ParseMultiDocYaml("../testfiles/input/list.yml")
+	actual, err := GetUsingImages(list[0])
+	if err != nil {
+		t.Fatalf("failed to get list images: %v", err)
+	}
+	expected := []string{"nginx:1.17", "redis:5"}
+
+	sort.Strings(actual)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+}
+
+func TestReplaceUsingImagesTypedList(t *testing.T) {
+	manifests, err := ParseManifestFile("../testfiles/input/podlist.json")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	actualManifest, err := ReplaceUsingImages(manifests[0].Body, "ap-northeast-1", "111222333444")
+	if err != nil {
+		t.Fatalf("failed to replace manifest: %v", err)
+	}
+
+	actual, _ := GetUsingImages(actualManifest)
+	expected := []string{
+		"111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/nginx",
+		"111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/busybox:1.31",
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+}
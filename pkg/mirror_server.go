@@ -0,0 +1,296 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransferFunc transfer the image, and returns image paths pushed to
+type TransferFunc func(image string) ([]string, error)
+
+// NativeTransfer transfer images into the destination of mapper by registry API without docker daemon, all platforms are copied
+func NativeTransfer(client *RegistryClient, mapper *ImageMapper) TransferFunc {
+	return func(image string) ([]string, error) {
+		targets, _, err := CopyTransferJob(client, mapper, TransferJob{Source: image})
+		return targets, err
+	}
+}
+
+// MirrorServer accepts images by HTTP API, and transfers them by bounded workers with retries.
+// jobs are persisted into Store, and unfinished jobs are resumed by Start
+type MirrorServer struct {
+	Store    *JobStore
+	Mapper   *ImageMapper
+	Transfer TransferFunc
+	Workers  int
+	// a job fails after the attempts
+	MaxAttempts   int
+	RetryInterval time.Duration
+	// called when status of job is changed, e.g. for logging
+	OnUpdate func(job *Job)
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []uint64
+	// job ID of queued or running image, the same image is not transferred twice at the same time
+	active  map[string]uint64
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// Start resume unfinished jobs, and start workers
+func (s *MirrorServer) Start() error {
+	s.cond = sync.NewCond(&s.mu)
+	s.active = map[string]uint64{}
+	jobs, err := s.Store.List()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.Done() {
+			continue
+		}
+		// interrupted by stop of the process
+		if job.Status == JobRunning {
+			job.Status = JobQueued
+			if err := s.Store.Update(job); err != nil {
+				return err
+			}
+		}
+		s.active[job.Image] = job.ID
+		s.pending = append(s.pending, job.ID)
+	}
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go s.work()
+	}
+	return nil
+}
+
+// Stop waits running jobs, queued jobs are resumed by the next Start
+func (s *MirrorServer) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Submit add jobs of images, the job in progress is returned for the same image
+func (s *MirrorServer) Submit(images []string) ([]*Job, error) {
+	for _, image := range images {
+		if _, err := ParseImageReference(image); err != nil {
+			return nil, fmt.Errorf("%s: %v", image, err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []*Job
+	for _, image := range images {
+		if id, ok := s.active[image]; ok {
+			job, err := s.Store.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, job)
+			continue
+		}
+		job := &Job{Image: image, Status: JobQueued}
+		if reason := s.Mapper.Skip(image); reason != "" {
+			job.Status = JobSkipped
+			job.Message = reason
+		}
+		if err := s.Store.Create(job); err != nil {
+			return nil, err
+		}
+		if !job.Done() {
+			s.active[image] = job.ID
+			s.pending = append(s.pending, job.ID)
+			s.cond.Signal()
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (s *MirrorServer) work() {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		for len(s.pending) == 0 && !s.stopped {
+			s.cond.Wait()
+		}
+		if s.stopped {
+			s.mu.Unlock()
+			return
+		}
+		id := s.pending[0]
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+		s.run(id)
+	}
+}
+
+func (s *MirrorServer) run(id uint64) {
+	retry := false
+	// the image is released unless the job is retried, also when the store fails
+	defer func() {
+		if !retry {
+			s.release(id)
+		}
+	}()
+	job, err := s.Store.Get(id)
+	if err != nil {
+		return
+	}
+	job.Status = JobRunning
+	job.Attempts++
+	if err := s.update(job); err != nil {
+		return
+	}
+
+	targets, err := s.Transfer(job.Image)
+	if err == nil {
+		job.Status = JobSucceeded
+		job.Targets = targets
+		job.Message = ""
+	} else if IsSignatureError(err) || IsScanGateError(err) {
+		job.Status = JobRejected
+		job.Message = err.Error()
+	} else if job.Attempts < s.MaxAttempts {
+		job.Status = JobQueued
+		job.Message = err.Error()
+	} else {
+		job.Status = JobFailed
+		job.Message = err.Error()
+	}
+	if err := s.update(job); err != nil {
+		return
+	}
+	if job.Status == JobQueued {
+		retry = true
+		time.AfterFunc(s.RetryInterval, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if !s.stopped {
+				s.pending = append(s.pending, id)
+				s.cond.Signal()
+			}
+		})
+	}
+}
+
+// release the image of the job, the job ID is looked up because the job may not be read from the store
+func (s *MirrorServer) release(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for image, active := range s.active {
+		if active == id {
+			delete(s.active, image)
+		}
+	}
+}
+
+func (s *MirrorServer) update(job *Job) error {
+	if err := s.Store.Update(job); err != nil {
+		return err
+	}
+	if s.OnUpdate != nil {
+		s.OnUpdate(job)
+	}
+	return nil
+}
+
+type jobsResponse struct {
+	Jobs []*Job `json:"jobs"`
+}
+
+// ServeHTTP handles API of jobs
+//
+//	POST /jobs {"images": ["nginx:1.17"]}
+//	GET  /jobs?status=failed
+//	GET  /jobs/<id>
+func (s *MirrorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "jobs" && r.Method == http.MethodPost:
+		request := struct {
+			Images []string `json:"images"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Images) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "images are required")
+			return
+		}
+		jobs, err := s.Submit(request.Images)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, jobsResponse{Jobs: jobs})
+	case path == "jobs" && r.Method == http.MethodGet:
+		jobs, err := s.Store.List()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		status := r.URL.Query().Get("status")
+		filtered := []*Job{}
+		for _, job := range jobs {
+			if status == "" || job.Status == status {
+				filtered = append(filtered, job)
+			}
+		}
+		writeJSON(w, http.StatusOK, jobsResponse{Jobs: filtered})
+	case strings.HasPrefix(path, "jobs/") && r.Method == http.MethodGet:
+		id, err := strconv.ParseUint(strings.TrimPrefix(path, "jobs/"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, ErrJobNotFound.Error())
+			return
+		}
+		job, err := s.Store.Get(id)
+		if err == ErrJobNotFound {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,259 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hostTransport sends requests for the hosts to other hosts, e.g. ECR to fake registry
+type hostTransport struct {
+	hosts     map[string]string
+	transport http.RoundTripper
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if host, ok := t.hosts[req.URL.Host]; ok {
+		req = req.Clone(req.Context())
+		req.URL.Host = host
+	}
+	return t.transport.RoundTrip(req)
+}
+
+func openTestJobStore(t *testing.T) (*JobStore, func()) {
+	dir, err := ioutil.TempDir("", "trimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenJobStore(filepath.Join(dir, "jobs.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// wait until all jobs are done
+func waitJobs(t *testing.T, store *JobStore) []*Job {
+	for i := 0; i < 500; i++ {
+		jobs, err := store.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := true
+		for _, job := range jobs {
+			done = done && job.Done()
+		}
+		if done {
+			return jobs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("jobs are not finished")
+	return nil
+}
+
+func request(handler http.Handler, method, path, body string) (int, []byte) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec.Code, rec.Body.Bytes()
+}
+
+func TestMirrorServer(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	destination := newFakeRegistry()
+	defer destination.Close()
+	nginx := source.pushImage("library/nginx", "1.17", Platform{OS: "linux", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "arm64"})
+
+	// ECR is served by destination
+	ecrHost := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com"
+	pool := x509.NewCertPool()
+	pool.AddCert(source.Certificate())
+	pool.AddCert(destination.Certificate())
+	client := &RegistryClient{Client: &http.Client{Transport: &hostTransport{
+		hosts:     map[string]string{ecrHost: destination.Host()},
+		transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}}}
+	client.SetCredential(source.Host(), RegistryCredential{Username: "user", Password: "pass"})
+	svc := newFakeECR()
+	mapper := &ImageMapper{
+		Region:       "ap-northeast-1",
+		AccountId:    "111222333444",
+		Destination:  &ECRDestination{Region: "ap-northeast-1", AccountId: "111222333444", ECR: svc},
+		Destinations: map[string]string{source.Host() + "/library/nginx": "nginx", source.Host() + "/missing": "missing"},
+	}
+
+	store, cleanup := openTestJobStore(t)
+	defer cleanup()
+	server := &MirrorServer{
+		Store:         store,
+		Mapper:        mapper,
+		Transfer:      NativeTransfer(client, mapper),
+		Workers:       1,
+		MaxAttempts:   2,
+		RetryInterval: 10 * time.Millisecond,
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	images := []string{source.Host() + "/library/nginx:1.17", source.Host() + "/missing:v1", ecrHost + "/app:v1"}
+	body, _ := json.Marshal(map[string][]string{"images": images})
+	code, _ := request(server, http.MethodPost, "/jobs", string(body))
+	if code != http.StatusAccepted {
+		t.Fatalf("unexpected status: %d", code)
+	}
+
+	jobs := waitJobs(t, store)
+	var statuses []string
+	for _, job := range jobs {
+		statuses = append(statuses, job.Status)
+	}
+	if !reflect.DeepEqual(statuses, []string{JobSucceeded, JobFailed, JobSkipped}) {
+		t.Errorf("unexpected statuses: %v", statuses)
+	}
+	if !reflect.DeepEqual(jobs[0].Targets, []string{ecrHost + "/nginx:1.17"}) {
+		t.Errorf("unexpected targets: %v", jobs[0].Targets)
+	}
+	if jobs[1].Attempts != 2 || jobs[1].Message == "" {
+		t.Errorf("failed job should be retried: %v", jobs[1])
+	}
+	if jobs[2].Message != SkipAlreadyMirrored {
+		t.Errorf("unexpected reason of skip: %v", jobs[2])
+	}
+
+	// all platforms are copied into ECR
+	if _, ok := svc.repositories["nginx"]; !ok {
+		t.Error("repository should be created")
+	}
+	copied, ok := destination.manifests["nginx"]["1.17"]
+	if !ok || Digest(copied.body) != nginx.Digest || copied.mediaType != MediaTypeDockerManifestList {
+		t.Fatalf("index is not copied: %v", destination.manifests["nginx"])
+	}
+	if len(destination.manifests["nginx"]) != 4 || len(destination.blobs) != 4 {
+		t.Errorf("platform images are not copied: %d manifests, %d blobs", len(destination.manifests["nginx"]), len(destination.blobs))
+	}
+
+	// job status
+	code, data := request(server, http.MethodGet, "/jobs/1", "")
+	job := &Job{}
+	if code != http.StatusOK || json.Unmarshal(data, job) != nil || job.Status != JobSucceeded {
+		t.Errorf("unexpected job: %d %s", code, data)
+	}
+	code, data = request(server, http.MethodGet, "/jobs?status=failed", "")
+	list := jobsResponse{}
+	if code != http.StatusOK || json.Unmarshal(data, &list) != nil || len(list.Jobs) != 1 || list.Jobs[0].ID != 2 {
+		t.Errorf("unexpected jobs: %d %s", code, data)
+	}
+	if code, _ := request(server, http.MethodGet, "/jobs/10", ""); code != http.StatusNotFound {
+		t.Errorf("expected 404, got: %d", code)
+	}
+	if code, _ := request(server, http.MethodPost, "/jobs", `{"images": ["nginx::"]}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400, got: %d", code)
+	}
+}
+
+func TestMirrorServerResume(t *testing.T) {
+	store, cleanup := openTestJobStore(t)
+	defer cleanup()
+	// jobs left by the previous process
+	store.Create(&Job{Image: "nginx:1.17", Status: JobRunning, Attempts: 1})
+	store.Create(&Job{Image: "redis:6", Status: JobQueued})
+	store.Create(&Job{Image: "busybox:1.31", Status: JobSucceeded})
+	store.Create(&Job{Image: "alpine:3.12", Status: JobQueued})
+
+	var transferred []string
+	server := &MirrorServer{
+		Store:  store,
+		Mapper: &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444"},
+		Transfer: func(image string) ([]string, error) {
+			transferred = append(transferred, image)
+			if image == "redis:6" {
+				return nil, errors.New("manifest unknown")
+			}
+			if image == "alpine:3.12" {
+				return nil, &SignatureError{Image: image, Reason: "no signature"}
+			}
+			return []string{"111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/" + image}, nil
+		},
+		MaxAttempts: 1,
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	jobs := waitJobs(t, store)
+	server.Stop()
+
+	if !reflect.DeepEqual(transferred, []string{"nginx:1.17", "redis:6", "alpine:3.12"}) {
+		t.Errorf("unfinished jobs should be resumed: %v", transferred)
+	}
+	if jobs[0].Status != JobSucceeded || jobs[0].Attempts != 2 || jobs[1].Status != JobFailed {
+		t.Errorf("unexpected jobs: %v %v", jobs[0], jobs[1])
+	}
+	if jobs[3].Status != JobRejected || jobs[3].Attempts != 1 {
+		t.Errorf("image rejected by signature policy should not be retried: %v", jobs[3])
+	}
+}
+
+func TestMirrorServerReleaseOnStoreFailure(t *testing.T) {
+	store, cleanup := openTestJobStore(t)
+	defer cleanup()
+	server := &MirrorServer{
+		Store:  store,
+		Mapper: &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444"},
+		Transfer: func(image string) ([]string, error) {
+			// the result of the job can't be saved
+			store.Close()
+			return []string{"111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/" + image}, nil
+		},
+		MaxAttempts: 1,
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if _, err := server.Submit([]string{"nginx:1.17"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 500; i++ {
+		server.mu.Lock()
+		active := len(server.active)
+		server.mu.Unlock()
+		if active == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("image should be released when the job can't be updated")
+}
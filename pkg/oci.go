@@ -0,0 +1,110 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// media types of manifests, Docker and OCI
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIEmpty           = "application/vnd.oci.empty.v1+json"
+)
+
+// manifestMediaTypes are accepted when manifest is fetched
+var manifestMediaTypes = []string{
+	MediaTypeOCIIndex,
+	MediaTypeDockerManifestList,
+	MediaTypeOCIManifest,
+	MediaTypeDockerManifest,
+}
+
+// IsIndex returns true if the media type is manifest list or image index
+func IsIndex(mediaType string) bool {
+	return mediaType == MediaTypeDockerManifestList || mediaType == MediaTypeOCIIndex
+}
+
+// Platform is os and architecture of image
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Descriptor points content by digest
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// type of artifact in referrers, e.g. "application/spdx+json"
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// ImageManifest is image manifest or index, fields of the other kind are empty
+type ImageManifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType,omitempty"`
+	// image manifest
+	Config *Descriptor  `json:"config,omitempty"`
+	Layers []Descriptor `json:"layers,omitempty"`
+	// index
+	Manifests []Descriptor `json:"manifests,omitempty"`
+	// artifact which refers the image, e.g. signature and SBOM
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Subject      *Descriptor       `json:"subject,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// ParseImageManifest parse manifest, mediaType is used when manifest doesn't have it
+func ParseImageManifest(data []byte, mediaType string) (*ImageManifest, error) {
+	var m ImageManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("manifest is broken: %v", err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = mediaType
+	}
+	if m.MediaType == "" {
+		// OCI manifest may not have mediaType
+		if len(m.Manifests) != 0 {
+			m.MediaType = MediaTypeOCIIndex
+		} else {
+			m.MediaType = MediaTypeOCIManifest
+		}
+	}
+	return &m, nil
+}
+
+// Digest of the content, e.g. "sha256:..."
+func Digest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
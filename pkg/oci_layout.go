@@ -0,0 +1,201 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// annotations of index.json in OCI image layout
+const (
+	// image path as written in manifests, e.g. "nginx:1.17"
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+	// full image path, it is used by "ctr images import"
+	AnnotationContainerdImageName = "io.containerd.image.name"
+)
+
+// OCILayoutWriter write images into tar archive of OCI image layout, blobs are written once
+type OCILayoutWriter struct {
+	tw      *tar.Writer
+	started bool
+	written map[string]bool
+	index   ImageManifest
+	// modification time of files in archive
+	ModTime time.Time
+}
+
+// NewOCILayoutWriter make writer, Close should be called to write index.json
+func NewOCILayoutWriter(w io.Writer) *OCILayoutWriter {
+	return &OCILayoutWriter{
+		tw:      tar.NewWriter(w),
+		written: map[string]bool{},
+		index:   ImageManifest{SchemaVersion: 2, MediaType: MediaTypeOCIIndex},
+		ModTime: time.Now(),
+	}
+}
+
+// oci-layout is written at first
+func (w *OCILayoutWriter) writeFile(name string, size int64, r io.Reader) error {
+	if !w.started {
+		w.started = true
+		layout := []byte(`{"imageLayoutVersion":"1.0.0"}`)
+		if err := w.writeFile("oci-layout", int64(len(layout)), bytes.NewReader(layout)); err != nil {
+			return err
+		}
+	}
+	if err := w.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  w.ModTime,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	n, err := io.Copy(w.tw, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("size of %s is %d, expected %d", name, n, size)
+	}
+	return nil
+}
+
+func (w *OCILayoutWriter) writeBytes(name string, data []byte) error {
+	return w.writeFile(name, int64(len(data)), bytes.NewReader(data))
+}
+
+func blobPath(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+func (w *OCILayoutWriter) writeBlob(digest string, data []byte) error {
+	if w.written[digest] {
+		return nil
+	}
+	if err := w.writeBytes(blobPath(digest), data); err != nil {
+		return err
+	}
+	w.written[digest] = true
+	return nil
+}
+
+// AddImage download the image from registry with all platforms, it returns the descriptor in index.json
+func (w *OCILayoutWriter) AddImage(client *RegistryClient, image string) (Descriptor, error) {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	reference := ref.Digest
+	if reference == "" {
+		reference = ref.Tag
+	}
+	if reference == "" {
+		reference = "latest"
+	}
+	m, err := client.GetManifest(ref.Registry, ref.Repository, reference)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if err := w.addManifest(client, ref, m); err != nil {
+		return Descriptor{}, err
+	}
+
+	fullName := ref.Registry + "/" + ref.Repository
+	if ref.Tag != "" {
+		fullName += ":" + ref.Tag
+	} else if ref.Digest == "" {
+		fullName += ":latest"
+	}
+	if ref.Digest != "" {
+		fullName += "@" + ref.Digest
+	}
+	d := Descriptor{
+		MediaType: m.MediaType,
+		Digest:    m.Digest,
+		Size:      int64(len(m.Body)),
+		Annotations: map[string]string{
+			AnnotationRefName:             image,
+			AnnotationContainerdImageName: fullName,
+		},
+	}
+	w.index.Manifests = append(w.index.Manifests, d)
+	return d, nil
+}
+
+// manifests are written after their contents
+func (w *OCILayoutWriter) addManifest(client *RegistryClient, ref ImageReference, m *RegistryManifest) error {
+	if w.written[m.Digest] {
+		return nil
+	}
+	manifest, err := ParseImageManifest(m.Body, m.MediaType)
+	if err != nil {
+		return err
+	}
+	if IsIndex(m.MediaType) {
+		for _, d := range manifest.Manifests {
+			child, err := client.GetManifest(ref.Registry, ref.Repository, d.Digest)
+			if err != nil {
+				return err
+			}
+			if err := w.addManifest(client, ref, child); err != nil {
+				return err
+			}
+		}
+		return w.writeBlob(m.Digest, m.Body)
+	}
+
+	var blobs []Descriptor
+	if manifest.Config != nil {
+		blobs = append(blobs, *manifest.Config)
+	}
+	blobs = append(blobs, manifest.Layers...)
+	for _, d := range blobs {
+		if w.written[d.Digest] {
+			continue
+		}
+		r, err := client.OpenBlob(ref.Registry, ref.Repository, d.Digest)
+		if err != nil {
+			return err
+		}
+		err = w.writeFile(blobPath(d.Digest), d.Size, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to download %s@%s: %v", ref.Name, d.Digest, err)
+		}
+		w.written[d.Digest] = true
+	}
+	return w.writeBlob(m.Digest, m.Body)
+}
+
+// Close write index.json, the underlying writer is not closed
+func (w *OCILayoutWriter) Close() error {
+	index, err := json.Marshal(w.index)
+	if err != nil {
+		return err
+	}
+	if err := w.writeBytes("index.json", index); err != nil {
+		return err
+	}
+	return w.tw.Close()
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// read files of tar archive, it fails when the same file is written twice
+func readTar(t *testing.T, r io.Reader) map[string][]byte {
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := files[h.Name]; ok {
+			t.Fatalf("%s is written twice", h.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = data
+	}
+}
+
+func TestOCILayoutWriter(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	multi := registry.pushImage("library/nginx", "1.17", Platform{OS: "linux", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "arm64"})
+	single := registry.pushImage("app", "v1", Platform{OS: "linux", Architecture: "amd64"})
+
+	var buf bytes.Buffer
+	w := NewOCILayoutWriter(&buf)
+	client := registry.Client()
+	images := []string{
+		registry.Host() + "/library/nginx:1.17",
+		registry.Host() + "/app:v1",
+		// the same image by digest
+		registry.Host() + "/app@" + single.Digest,
+	}
+	for _, image := range images {
+		if _, err := w.AddImage(client, image); err != nil {
+			t.Fatalf("failed to add %s: %v", image, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readTar(t, &buf)
+	if string(files["oci-layout"]) != `{"imageLayoutVersion":"1.0.0"}` {
+		t.Errorf("unexpected oci-layout: %s", files["oci-layout"])
+	}
+	// index, 2 manifests, 2 configs, 2 layers of nginx, and manifest, layer of app.
+	// config of app is the same as amd64 of nginx
+	blobs := 0
+	for name, data := range files {
+		if len(name) > 6 && name[:6] == "blobs/" {
+			blobs++
+			if "blobs/"+Digest(data)[:6]+"/"+Digest(data)[7:] != name {
+				t.Errorf("digest of %s doesn't match", name)
+			}
+		}
+	}
+	if blobs != 9 {
+		t.Errorf("expected 9 blobs, got: %d", blobs)
+	}
+
+	var index ImageManifest
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 3 {
+		t.Fatalf("expected 3 manifests in index, got: %d", len(index.Manifests))
+	}
+	expected := []struct{ digest, ref, name string }{
+		{multi.Digest, images[0], registry.Host() + "/library/nginx:1.17"},
+		{single.Digest, images[1], registry.Host() + "/app:v1"},
+		{single.Digest, images[2], registry.Host() + "/app@" + single.Digest},
+	}
+	for i, e := range expected {
+		d := index.Manifests[i]
+		if d.Digest != e.digest || d.Annotations[AnnotationRefName] != e.ref || d.Annotations[AnnotationContainerdImageName] != e.name {
+			t.Errorf("unexpected descriptor %d: %+v", i, d)
+		}
+	}
+}
+
+func TestOCILayoutWriterBrokenBlob(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	d := registry.pushImage("app", "v1", Platform{OS: "linux", Architecture: "amd64"})
+
+	// replace layer with other content of the same size
+	m, _ := ParseImageManifest(registry.manifests["app"][d.Digest].body, d.MediaType)
+	layer := registry.blobs[m.Layers[0].Digest]
+	registry.blobs[m.Layers[0].Digest] = bytes.Repeat([]byte("x"), len(layer))
+
+	w := NewOCILayoutWriter(ioutil.Discard)
+	if _, err := w.AddImage(registry.Client(), registry.Host()+"/app:v1"); err == nil {
+		t.Errorf("broken blob should be error")
+	}
+}
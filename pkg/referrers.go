@@ -0,0 +1,207 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// suffixes of tags which cosign attaches to image, e.g. "sha256-<hex>.sig"
+var cosignTagSuffixes = []string{".sig", ".att", ".sbom"}
+
+// CosignTag returns the tag of cosign artifact for the digest, suffix is ".sig", ".att" or ".sbom"
+func CosignTag(digest, suffix string) string {
+	return referrersTag(digest) + suffix
+}
+
+// tag of referrers tag schema, it is used by registries which don't support referrers API
+func referrersTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
+
+// Referrers returns descriptors of manifests whose subject is the digest.
+// the index tagged "sha256-<hex>" is read when the registry doesn't support referrers API
+func (c *RegistryClient) Referrers(registry, repository, digest string) ([]Descriptor, error) {
+	referrers, supported, err := c.referrersAPI(registry, repository, digest)
+	if err != nil || supported {
+		return referrers, err
+	}
+	return c.referrersIndex(registry, repository, digest)
+}
+
+// supported is false when the registry doesn't have referrers API
+func (c *RegistryClient) referrersAPI(registry, repository, digest string) ([]Descriptor, bool, error) {
+	resp, err := c.do(registry, pullScope(repository), func(endpoint string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, endpoint+"/v2/"+repository+"/referrers/"+digest, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", MediaTypeOCIIndex)
+		return req, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, responseError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	var index ImageManifest
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, false, fmt.Errorf("failed to parse referrers of %s@%s: %v", repository, digest, err)
+	}
+	return index.Manifests, true, nil
+}
+
+func (c *RegistryClient) referrersIndex(registry, repository, digest string) ([]Descriptor, error) {
+	m, err := c.GetManifest(registry, repository, referrersTag(digest))
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	index, err := ParseImageManifest(m.Body, m.MediaType)
+	if err != nil {
+		return nil, err
+	}
+	return index.Manifests, nil
+}
+
+// CopyArtifacts copy cosign signatures, attestations, SBOMs and OCI referrers of the image digest,
+// and of each platform when the digest is index. it returns image paths of copied artifacts
+func (c *RegistryClient) CopyArtifacts(image, registry, repository string) ([]string, error) {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Digest == "" {
+		return nil, fmt.Errorf("%s should have digest to copy its artifacts", image)
+	}
+	m, err := c.GetManifest(ref.Registry, ref.Repository, ref.Digest)
+	if err != nil {
+		return nil, err
+	}
+	digests := []string{m.Digest}
+	if IsIndex(m.MediaType) {
+		index, err := ParseImageManifest(m.Body, m.MediaType)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range index.Manifests {
+			digests = append(digests, d.Digest)
+		}
+	}
+
+	var copied []string
+	for _, digest := range digests {
+		paths, err := c.copyArtifacts(ref, digest, registry, repository)
+		if err != nil {
+			return copied, err
+		}
+		copied = append(copied, paths...)
+	}
+	return copied, nil
+}
+
+func (c *RegistryClient) copyArtifacts(src ImageReference, digest, registry, repository string) ([]string, error) {
+	var copied []string
+	for _, suffix := range cosignTagSuffixes {
+		tag := CosignTag(digest, suffix)
+		m, err := c.GetManifest(src.Registry, src.Repository, tag)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return copied, err
+		}
+		if err := c.copyManifest(src, m, registry, repository); err != nil {
+			return copied, err
+		}
+		if err := c.PutManifest(registry, repository, tag, m.MediaType, m.Body); err != nil {
+			return copied, fmt.Errorf("failed to push %s:%s: %v", repository, tag, err)
+		}
+		copied = append(copied, registry+"/"+repository+":"+tag)
+	}
+
+	referrers, err := c.Referrers(src.Registry, src.Repository, digest)
+	if err != nil {
+		return copied, fmt.Errorf("failed to get referrers of %s: %v", digest, err)
+	}
+	if len(referrers) == 0 {
+		return copied, nil
+	}
+	for _, d := range referrers {
+		m, err := c.GetManifest(src.Registry, src.Repository, d.Digest)
+		if err != nil {
+			return copied, err
+		}
+		if err := c.copyManifest(src, m, registry, repository); err != nil {
+			return copied, err
+		}
+		copied = append(copied, registry+"/"+repository+"@"+d.Digest)
+	}
+	if err := c.putReferrersIndex(registry, repository, digest, referrers); err != nil {
+		return copied, err
+	}
+	return copied, nil
+}
+
+// referrers are listed by the tag "sha256-<hex>" in the registry without referrers API,
+// they are merged into the existing index
+func (c *RegistryClient) putReferrersIndex(registry, repository, digest string, referrers []Descriptor) error {
+	_, supported, err := c.referrersAPI(registry, repository, digest)
+	if err != nil || supported {
+		return err
+	}
+	existing, err := c.referrersIndex(registry, repository, digest)
+	if err != nil {
+		return err
+	}
+	index := ImageManifest{SchemaVersion: 2, MediaType: MediaTypeOCIIndex, Manifests: existing}
+	for _, d := range referrers {
+		found := false
+		for _, e := range existing {
+			if e.Digest == d.Digest {
+				found = true
+				break
+			}
+		}
+		if !found {
+			index.Manifests = append(index.Manifests, d)
+		}
+	}
+	body, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tag := referrersTag(digest)
+	if err := c.PutManifest(registry, repository, tag, MediaTypeOCIIndex, body); err != nil {
+		return fmt.Errorf("failed to push %s:%s: %v", repository, tag, err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// pushArtifact put OCI artifact manifest with a layer, subject is set when it is not empty
+func (r *fakeRegistry) pushArtifact(repository, tag, artifactType, content string, subject *Descriptor) Descriptor {
+	config := r.putBlob([]byte("{}"))
+	config.MediaType = MediaTypeOCIEmpty
+	layer := r.putBlob([]byte(content))
+	layer.MediaType = artifactType
+	body, _ := json.Marshal(ImageManifest{
+		SchemaVersion: 2, MediaType: MediaTypeOCIManifest, ArtifactType: artifactType,
+		Config: &config, Layers: []Descriptor{layer}, Subject: subject,
+	})
+	d := r.putManifest(repository, tag, MediaTypeOCIManifest, body)
+	d.ArtifactType = artifactType
+	return d
+}
+
+func TestCopyArtifacts(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	source.referrers = true
+	registry := newFakeRegistry()
+	defer registry.Close()
+
+	nginx := source.pushImage("library/nginx", "1.17", Platform{OS: "linux", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "arm64"})
+	index, _ := ParseImageManifest(source.manifests["library/nginx"][nginx.Digest].body, nginx.MediaType)
+	amd64 := index.Manifests[0]
+	source.pushArtifact("library/nginx", CosignTag(nginx.Digest, ".sig"), "application/vnd.dev.cosign.simplesigning.v1+json", "signature", nil)
+	sbom := source.pushArtifact("library/nginx", "", "application/spdx+json", "sbom", &Descriptor{MediaType: amd64.MediaType, Digest: amd64.Digest, Size: amd64.Size})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(source.Certificate())
+	pool.AddCert(registry.Certificate())
+	client := &RegistryClient{Client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}}
+	client.SetCredential(source.Host(), RegistryCredential{Username: "user", Password: "pass"})
+	client.SetCredential(registry.Host(), RegistryCredential{Username: "user", Password: "pass"})
+
+	referrers, err := client.Referrers(source.Host(), "library/nginx", amd64.Digest)
+	if err != nil || !reflect.DeepEqual(referrers, []Descriptor{sbom}) {
+		t.Fatalf("unexpected referrers: %v, %v", referrers, err)
+	}
+
+	mapper := &ImageMapper{Destination: NewRegistryDestination(registry.Host()+"/mirror", client)}
+	image := source.Host() + "/library/nginx:1.17"
+	repository := "mirror/" + source.Host() + "/library/nginx"
+	prefix := registry.Host() + "/" + repository
+
+	// artifacts are not copied by default
+	targets, err := NativeTransfer(client, mapper)(image)
+	if err != nil || !reflect.DeepEqual(targets, []string{registry.Host() + "/mirror/" + image}) {
+		t.Fatalf("unexpected targets: %v, %v", targets, err)
+	}
+	if _, ok := registry.manifests[repository][CosignTag(nginx.Digest, ".sig")]; ok {
+		t.Error("signature should not be copied")
+	}
+
+	mapper.Transfer.CopySignatures = true
+	targets, err = NativeTransfer(client, mapper)(image)
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+	expected := []string{
+		registry.Host() + "/mirror/" + image,
+		prefix + ":" + CosignTag(nginx.Digest, ".sig"),
+		prefix + "@" + sbom.Digest,
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected: %v, got: %v", expected, targets)
+	}
+	if _, ok := registry.manifests[repository][CosignTag(nginx.Digest, ".sig")]; !ok {
+		t.Error("signature should be copied with the tag")
+	}
+
+	// the registry doesn't have referrers API, so referrers are listed by the tag
+	referrers, err = client.Referrers(registry.Host(), repository, amd64.Digest)
+	if err != nil || !reflect.DeepEqual(referrers, []Descriptor{sbom}) {
+		t.Errorf("unexpected referrers in the registry: %v, %v", referrers, err)
+	}
+	if _, ok := registry.manifests[repository][referrersTag(amd64.Digest)]; !ok {
+		t.Error("referrers should be tagged by the digest")
+	}
+
+	// copy again, referrers are not duplicated
+	if _, err := NativeTransfer(client, mapper)(image); err != nil {
+		t.Fatalf("failed to transfer again: %v", err)
+	}
+	referrers, err = client.Referrers(registry.Host(), repository, amd64.Digest)
+	if err != nil || len(referrers) != 1 {
+		t.Errorf("referrers should not be duplicated: %v, %v", referrers, err)
+	}
+}
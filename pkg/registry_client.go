@@ -0,0 +1,528 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// RegistryCredential is user and password for registry
+type RegistryCredential struct {
+	Username string
+	Password string
+}
+
+// RegistryClient access Docker Registry HTTP API V2 without docker daemon
+type RegistryClient struct {
+	Client *http.Client
+	// key is registry host, e.g. "docker.io", "gcr.io"
+	Credentials map[string]RegistryCredential
+	// registries accessed by plain HTTP instead of HTTPS, e.g. "localhost:5000"
+	InsecureRegistries []string
+
+	mu sync.Mutex
+	// bearer tokens, key is registry and scope
+	tokens map[string]string
+}
+
+// NewRegistryClient make client with credentials of docker config, e.g. ~/.docker/config.json
+func NewRegistryClient() *RegistryClient {
+	return &RegistryClient{
+		Client:      http.DefaultClient,
+		Credentials: LoadDockerCredentials(),
+	}
+}
+
+// LoadDockerCredentials read "auths" of docker config, credential helpers are not supported
+func LoadDockerCredentials() map[string]RegistryCredential {
+	credentials := map[string]RegistryCredential{}
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return credentials
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return credentials
+	}
+	var dockerConfig struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &dockerConfig); err != nil {
+		return credentials
+	}
+	for host, a := range dockerConfig.Auths {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			continue
+		}
+		userPass := strings.SplitN(string(decoded), ":", 2)
+		if len(userPass) != 2 {
+			continue
+		}
+		// e.g. "https://index.docker.io/v1/"
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+		host = strings.SplitN(host, "/", 2)[0]
+		if host == "index.docker.io" || host == "registry-1.docker.io" {
+			host = "docker.io"
+		}
+		credentials[host] = RegistryCredential{Username: userPass[0], Password: userPass[1]}
+	}
+	return credentials
+}
+
+// SetCredential set user and password for the registry
+func (c *RegistryClient) SetCredential(registry string, credential RegistryCredential) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Credentials == nil {
+		c.Credentials = map[string]RegistryCredential{}
+	}
+	c.Credentials[registry] = credential
+}
+
+func (c *RegistryClient) credential(registry string) (RegistryCredential, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	credential, ok := c.Credentials[registry]
+	return credential, ok
+}
+
+// API endpoint of Docker Hub is different from its name, insecure registries are accessed by HTTP
+func (c *RegistryClient) endpoint(registry string) string {
+	if registry == "docker.io" {
+		return "https://registry-1.docker.io"
+	}
+	for _, insecure := range c.InsecureRegistries {
+		if insecure == registry {
+			return "http://" + registry
+		}
+	}
+	return "https://" + registry
+}
+
+// RegistryError is an error response of registry
+type RegistryError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("registry returns %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound returns true if err means the manifest or blob doesn't exist
+func IsNotFound(err error) bool {
+	e, ok := err.(*RegistryError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// do send request to registry, scope is used for bearer token, e.g. "repository:library/nginx:pull"
+func (c *RegistryClient) do(registry, scope string, newRequest func(endpoint string) (*http.Request, error)) (*http.Response, error) {
+	endpoint := c.endpoint(registry)
+	req, err := newRequest(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	tokenKey := registry + " " + scope
+	c.mu.Lock()
+	token, ok := c.tokens[tokenKey]
+	c.mu.Unlock()
+	if ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if credential, ok := c.credential(registry); ok {
+		req.SetBasicAuth(credential.Username, credential.Password)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	// authenticate by challenge and retry
+	req, err = newRequest(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(strings.ToLower(challenge), "bearer "):
+		token, err := c.fetchToken(registry, challenge, scope)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		if c.tokens == nil {
+			c.tokens = map[string]string{}
+		}
+		c.tokens[tokenKey] = token
+		c.mu.Unlock()
+		req.Header.Set("Authorization", "Bearer "+token)
+	case strings.HasPrefix(strings.ToLower(challenge), "basic "):
+		credential, ok := c.credential(registry)
+		if !ok {
+			return nil, &RegistryError{StatusCode: http.StatusUnauthorized, Message: "credential for " + registry + " is required"}
+		}
+		req.SetBasicAuth(credential.Username, credential.Password)
+	default:
+		return nil, &RegistryError{StatusCode: http.StatusUnauthorized, Message: "unsupported authentication: " + challenge}
+	}
+	return c.Client.Do(req)
+}
+
+var challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// get bearer token from the realm of challenge, e.g. Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func (c *RegistryClient) fetchToken(registry, challenge, scope string) (string, error) {
+	params := map[string]string{}
+	for _, m := range challengeParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("realm is not found in challenge: %s", challenge)
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	if scope == "" {
+		scope = params["scope"]
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if credential, ok := c.credential(registry); ok {
+		req.SetBasicAuth(credential.Username, credential.Password)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		msg = resp.Status
+	}
+	return &RegistryError{StatusCode: resp.StatusCode, Message: msg}
+}
+
+func pullScope(repository string) string {
+	return "repository:" + repository + ":pull"
+}
+
+var linkPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// ListTags returns all tags of the repository
+func (c *RegistryClient) ListTags(registry, repository string) ([]string, error) {
+	var tags []string
+	next := "/v2/" + repository + "/tags/list?n=1000"
+	for next != "" {
+		path := next
+		resp, err := c.do(registry, pullScope(repository), func(endpoint string) (*http.Request, error) {
+			return http.NewRequest(http.MethodGet, endpoint+path, nil)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := responseError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, list.Tags...)
+
+		// pagination, e.g. Link: </v2/library/nginx/tags/list?last=1.17&n=1000>; rel="next"
+		next = ""
+		if m := linkPattern.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			next = m[1]
+			if u, err := url.Parse(m[1]); err == nil && u.IsAbs() {
+				next = u.RequestURI()
+			}
+		}
+	}
+	return tags, nil
+}
+
+// RegistryManifest is manifest fetched from registry
+type RegistryManifest struct {
+	MediaType string
+	Digest    string
+	Body      []byte
+}
+
+// GetManifest fetch manifest by tag or digest
+func (c *RegistryClient) GetManifest(registry, repository, reference string) (*RegistryManifest, error) {
+	resp, err := c.do(registry, pullScope(repository), func(endpoint string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, endpoint+"/v2/"+repository+"/manifests/"+reference, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := Digest(body)
+	if strings.HasPrefix(reference, "sha256:") && reference != digest {
+		return nil, fmt.Errorf("digest of manifest %s@%s is %s", repository, reference, digest)
+	}
+	mediaType := strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0])
+	m, err := ParseImageManifest(body, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	return &RegistryManifest{MediaType: m.MediaType, Digest: digest, Body: body}, nil
+}
+
+// GetBlob fetch blob by digest, the content is verified by the digest
+func (c *RegistryClient) GetBlob(registry, repository, digest string) ([]byte, error) {
+	r, err := c.OpenBlob(registry, repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// OpenBlob returns reader of blob, reading it is error at the end when the digest doesn't match
+func (c *RegistryClient) OpenBlob(registry, repository, digest string) (io.ReadCloser, error) {
+	resp, err := c.do(registry, pullScope(repository), func(endpoint string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, endpoint+"/v2/"+repository+"/blobs/"+digest, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return &verifyingReader{r: resp.Body, hash: sha256.New(), digest: digest, name: repository + "@" + digest}, nil
+}
+
+// verifyingReader checks digest of content when it reaches EOF
+type verifyingReader struct {
+	r      io.ReadCloser
+	hash   hash.Hash
+	digest string
+	name   string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF {
+		if actual := fmt.Sprintf("sha256:%x", v.hash.Sum(nil)); actual != v.digest {
+			return n, fmt.Errorf("digest of blob %s doesn't match, got %s", v.name, actual)
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
+
+func pushScope(repository string) string {
+	return "repository:" + repository + ":pull,push"
+}
+
+// BlobExists returns true if the blob is in the repository
+func (c *RegistryClient) BlobExists(registry, repository, digest string) (bool, error) {
+	resp, err := c.do(registry, pushScope(repository), func(endpoint string) (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, endpoint+"/v2/"+repository+"/blobs/"+digest, nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, responseError(resp)
+}
+
+// PushBlob upload blob, open is called again when the request is retried for authentication
+func (c *RegistryClient) PushBlob(registry, repository string, d Descriptor, open func() (io.ReadCloser, error)) error {
+	// start upload session
+	resp, err := c.do(registry, pushScope(repository), func(endpoint string) (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, endpoint+"/v2/"+repository+"/blobs/uploads/", nil)
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		defer resp.Body.Close()
+		return responseError(resp)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+
+	// upload whole content, and then commit it by digest
+	resp, err = c.do(registry, pushScope(repository), func(endpoint string) (*http.Request, error) {
+		u, err := uploadURL(endpoint, location)
+		if err != nil {
+			return nil, err
+		}
+		body, err := open()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPatch, u.String(), body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		req.ContentLength = d.Size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+		defer resp.Body.Close()
+		return responseError(resp)
+	}
+	resp.Body.Close()
+	if l := resp.Header.Get("Location"); l != "" {
+		location = l
+	}
+
+	resp, err = c.do(registry, pushScope(repository), func(endpoint string) (*http.Request, error) {
+		u, err := uploadURL(endpoint, location)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("digest", d.Digest)
+		u.RawQuery = q.Encode()
+		return http.NewRequest(http.MethodPut, u.String(), nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// Location of upload may be relative
+func uploadURL(endpoint, location string) (*url.URL, error) {
+	base, err := url.Parse(endpoint + "/")
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(u), nil
+}
+
+// PutManifest upload manifest by tag or digest
+func (c *RegistryClient) PutManifest(registry, repository, reference, mediaType string, body []byte) error {
+	resp, err := c.do(registry, pushScope(repository), func(endpoint string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, endpoint+"/v2/"+repository+"/manifests/"+reference, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mediaType)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry is a stand-in of registry which requires bearer token of token server
+type fakeManifest struct {
+	mediaType string
+	body      []byte
+}
+
+type fakeRegistry struct {
+	*httptest.Server
+	mu sync.Mutex
+	// key is repository
+	tags map[string][]string
+	// key is repository, and then tag or digest
+	manifests map[string]map[string]fakeManifest
+	// key is digest
+	blobs map[string][]byte
+	// uploading blobs, key is upload id
+	uploads map[string][]byte
+	// number of requests to token server
+	tokenRequests int
+	// referrers API is served, registry without it returns 404
+	referrers bool
+}
+
+const fakeToken = "fake-token"
+
+// the caller should close it
+func newFakeRegistry() *fakeRegistry {
+	r := &fakeRegistry{
+		tags:      map[string][]string{},
+		manifests: map[string]map[string]fakeManifest{},
+		blobs:     map[string][]byte{},
+		uploads:   map[string][]byte{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		r.tokenRequests++
+		r.mu.Unlock()
+		if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": fakeToken})
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer "+fakeToken {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, r.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.serveV2(w, req)
+	})
+	r.Server = httptest.NewTLSServer(mux)
+	return r
+}
+
+func (r *fakeRegistry) serveV2(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if strings.HasSuffix(path, "/tags/list") {
+		r.mu.Lock()
+		tags, ok := r.tags[strings.TrimSuffix(path, "/tags/list")]
+		r.mu.Unlock()
+		if !ok {
+			http.Error(w, `{"errors":[{"code":"NAME_UNKNOWN"}]}`, http.StatusNotFound)
+			return
+		}
+		sort.Strings(tags)
+		// pagination by "n" and "last"
+		n, _ := strconv.Atoi(req.URL.Query().Get("n"))
+		last := req.URL.Query().Get("last")
+		start := sort.SearchStrings(tags, last)
+		if last != "" && start < len(tags) && tags[start] == last {
+			start++
+		}
+		end := len(tags)
+		if n > 0 && start+n < end {
+			end = start + n
+			w.Header().Set("Link", fmt.Sprintf(`</v2/%s?n=%d&last=%s>; rel="next"`, path, n, tags[end-1]))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": path, "tags": tags[start:end]})
+		return
+	}
+	if i := strings.LastIndex(path, "/referrers/"); i >= 0 && r.referrers {
+		r.serveReferrers(w, path[:i], path[i+len("/referrers/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/uploads/"); i >= 0 {
+		r.serveUpload(w, req, path[:i], path[i+len("/blobs/uploads/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 && req.Method == http.MethodPut {
+		body, _ := ioutil.ReadAll(req.Body)
+		repository, reference := path[:i], path[i+len("/manifests/"):]
+		if strings.HasPrefix(reference, "sha256:") && reference != Digest(body) {
+			http.Error(w, `{"errors":[{"code":"DIGEST_INVALID"}]}`, http.StatusBadRequest)
+			return
+		}
+		if reference == Digest(body) {
+			reference = ""
+		}
+		r.putManifest(repository, reference, req.Header.Get("Content-Type"), body)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		r.mu.Lock()
+		m, ok := r.manifests[path[:i]][path[i+len("/manifests/"):]]
+		r.mu.Unlock()
+		if !ok {
+			http.Error(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", Digest(m.body))
+		w.Write(m.body)
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		r.mu.Lock()
+		blob, ok := r.blobs[path[i+len("/blobs/"):]]
+		r.mu.Unlock()
+		if !ok {
+			http.Error(w, `{"errors":[{"code":"BLOB_UNKNOWN"}]}`, http.StatusNotFound)
+			return
+		}
+		w.Write(blob)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// manifests whose subject is the digest
+func (r *fakeRegistry) serveReferrers(w http.ResponseWriter, repository, digest string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := ImageManifest{SchemaVersion: 2, MediaType: MediaTypeOCIIndex, Manifests: []Descriptor{}}
+	for reference, m := range r.manifests[repository] {
+		var manifest ImageManifest
+		if reference != Digest(m.body) || json.Unmarshal(m.body, &manifest) != nil {
+			continue
+		}
+		if manifest.Subject != nil && manifest.Subject.Digest == digest {
+			index.Manifests = append(index.Manifests, Descriptor{
+				MediaType: m.mediaType, Digest: reference, Size: int64(len(m.body)), ArtifactType: manifest.ArtifactType,
+			})
+		}
+	}
+	sort.Slice(index.Manifests, func(i, j int) bool { return index.Manifests[i].Digest < index.Manifests[j].Digest })
+	w.Header().Set("Content-Type", MediaTypeOCIIndex)
+	json.NewEncoder(w).Encode(index)
+}
+
+// monolithic upload by PATCH, and then commit by PUT
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repository, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch req.Method {
+	case http.MethodPost:
+		id = fmt.Sprintf("upload-%d", len(r.uploads)+1)
+		r.uploads[id] = nil
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch:
+		body, _ := ioutil.ReadAll(req.Body)
+		r.uploads[id] = append(r.uploads[id], body...)
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		data := r.uploads[id]
+		if Digest(data) != req.URL.Query().Get("digest") {
+			http.Error(w, `{"errors":[{"code":"DIGEST_INVALID"}]}`, http.StatusBadRequest)
+			return
+		}
+		delete(r.uploads, id)
+		r.blobs[Digest(data)] = data
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) putBlob(data []byte) Descriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[Digest(data)] = data
+	return Descriptor{Digest: Digest(data), Size: int64(len(data))}
+}
+
+func (r *fakeRegistry) putManifest(repository, tag, mediaType string, body []byte) Descriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.manifests[repository] == nil {
+		r.manifests[repository] = map[string]fakeManifest{}
+	}
+	m := fakeManifest{mediaType: mediaType, body: body}
+	r.manifests[repository][Digest(body)] = m
+	if tag != "" {
+		if _, ok := r.manifests[repository][tag]; !ok {
+			r.tags[repository] = append(r.tags[repository], tag)
+		}
+		r.manifests[repository][tag] = m
+	}
+	return Descriptor{MediaType: mediaType, Digest: Digest(body), Size: int64(len(body))}
+}
+
+// pushImage put image of the platforms, it is index when there are multiple platforms
+func (r *fakeRegistry) pushImage(repository, tag string, platforms ...Platform) Descriptor {
+	var descriptors []Descriptor
+	for i, p := range platforms {
+		config, _ := json.Marshal(map[string]string{"os": p.OS, "architecture": p.Architecture, "variant": p.Variant})
+		configDesc := r.putBlob(config)
+		configDesc.MediaType = "application/vnd.docker.container.image.v1+json"
+		layer := r.putBlob([]byte(fmt.Sprintf("layer of %s:%s %s", repository, tag, p)))
+		layer.MediaType = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+		body, _ := json.Marshal(ImageManifest{SchemaVersion: 2, MediaType: MediaTypeDockerManifest, Config: &configDesc, Layers: []Descriptor{layer}})
+
+		manifestTag := ""
+		if len(platforms) == 1 {
+			manifestTag = tag
+		}
+		d := r.putManifest(repository, manifestTag, MediaTypeDockerManifest, body)
+		d.Platform = &platforms[i]
+		descriptors = append(descriptors, d)
+	}
+	if len(platforms) == 1 {
+		descriptors[0].Platform = nil
+		return descriptors[0]
+	}
+	body, _ := json.Marshal(ImageManifest{SchemaVersion: 2, MediaType: MediaTypeDockerManifestList, Manifests: descriptors})
+	return r.putManifest(repository, tag, MediaTypeDockerManifestList, body)
+}
+
+// registry host of fake registry, e.g. "127.0.0.1:12345"
+func (r *fakeRegistry) Host() string {
+	return strings.TrimPrefix(r.URL, "https://")
+}
+
+func (r *fakeRegistry) Client() *RegistryClient {
+	c := &RegistryClient{Client: r.Server.Client()}
+	c.SetCredential(r.Host(), RegistryCredential{Username: "user", Password: "pass"})
+	return c
+}
+
+func TestRegistryClientListTags(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	var expected []string
+	for i := 0; i < 2500; i++ {
+		expected = append(expected, fmt.Sprintf("v1.%04d", i))
+	}
+	registry.tags["kube-proxy"] = expected
+
+	c := registry.Client()
+	actual, err := c.ListTags(registry.Host(), "kube-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("ListTags() returns %d tags, expected %d", len(actual), len(expected))
+	}
+	// token is reused for pages
+	if registry.tokenRequests != 1 {
+		t.Errorf("token is requested %d times, expected 1", registry.tokenRequests)
+	}
+
+	_, err = c.ListTags(registry.Host(), "unknown")
+	if !IsNotFound(err) {
+		t.Errorf("ListTags() of unknown repository should be not found, but %v", err)
+	}
+
+	// without credential
+	c = &RegistryClient{Client: registry.Server.Client()}
+	if _, err = c.ListTags(registry.Host(), "kube-proxy"); err == nil {
+		t.Errorf("ListTags() without credential should be error")
+	}
+}
+
+func TestRegistryClientInsecure(t *testing.T) {
+	// registry:2 without TLS
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/app/tags/list" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": "app", "tags": []string{"v1"}})
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	c := &RegistryClient{Client: server.Client()}
+	if _, err := c.ListTags(host, "app"); err == nil {
+		t.Errorf("registry is accessed by HTTPS by default")
+	}
+	c.InsecureRegistries = []string{host}
+	tags, err := c.ListTags(host, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"v1"}) {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+}
+
+func TestRegistryClientPushBlobError(t *testing.T) {
+	denied := `{"errors":[{"code":"DENIED","message":"requested access to the resource is denied"}]}`
+	for _, method := range []string{http.MethodPost, http.MethodPatch} {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == method {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(denied))
+				return
+			}
+			w.Header().Set("Location", "/v2/app/blobs/uploads/1")
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		c := &RegistryClient{Client: server.Client()}
+		err := c.PushBlob(server.Listener.Addr().String(), "app", Descriptor{Digest: Digest([]byte("blob")), Size: 4}, func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("blob")), nil
+		})
+		server.Close()
+		// error body of the registry is reported
+		if err == nil || !strings.Contains(err.Error(), "DENIED") {
+			t.Errorf("%s: expected error of the registry, got: %v", method, err)
+		}
+	}
+}
+
+func TestLoadDockerCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "dXNlcjpwYXNz"},
+		"gcr.io": {"auth": "X2pzb25fa2V5OnNlY3JldDp3aXRoOmNvbG9u"},
+		"broken.example.com": {"auth": "!!!"}
+	}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	os.Setenv("DOCKER_CONFIG", dir)
+
+	expected := map[string]RegistryCredential{
+		"docker.io": {Username: "user", Password: "pass"},
+		"gcr.io":    {Username: "_json_key", Password: "secret:with:colon"},
+	}
+	if actual := LoadDockerCredentials(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("LoadDockerCredentials() = %v, expected %v", actual, expected)
+	}
+}
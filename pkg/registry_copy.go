@@ -0,0 +1,226 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"fmt"
+	"io"
+)
+
+// CopyTransferJob transfer the image of job by registry API without docker daemon, digests of all platforms are kept.
+// it returns image paths pushed to, copied signatures and made SBOMs and signatures are included, and scan findings of them
+func CopyTransferJob(client *RegistryClient, mapper *ImageMapper, job TransferJob) ([]string, []*ScanReport, error) {
+	ref, err := ParseImageReference(job.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := job.Digest
+	if digest == "" {
+		m, err := client.GetManifest(ref.Registry, ref.Repository, manifestReference(ref))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get manifest: %v", err)
+		}
+		digest = m.Digest
+	}
+	if mapper.Transfer.Verifier != nil {
+		if err := mapper.Transfer.Verifier.Verify(job.Source, digest); err != nil {
+			return nil, nil, err
+		}
+	}
+	targets := job.Targets
+	if len(targets) == 0 {
+		targets, err = mapper.Targets(job.Source, digest)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// targets are pushed as they are, repositories of the plan are not decided again by mapper
+	destination := mapper.destination()
+	registry := destination.Registry()
+	var repositories []string
+	tags := map[string][]string{}
+	for _, target := range targets {
+		t, err := ParseImageReference(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		if t.Registry != registry {
+			return nil, nil, fmt.Errorf("target %s is not in the destination %s", target, registry)
+		}
+		if _, ok := tags[t.Repository]; !ok {
+			repositories = append(repositories, t.Repository)
+			tags[t.Repository] = nil
+		}
+		if t.Tag != "" {
+			tags[t.Repository] = append(tags[t.Repository], t.Tag)
+		}
+	}
+	for _, repository := range repositories {
+		if err := destination.CreateRepository(repository, mapper.RepositorySettings); err != nil {
+			return nil, nil, fmt.Errorf("failed to create repository: %v", err)
+		}
+	}
+	credential, err := destination.Credential()
+	if err != nil {
+		return nil, nil, err
+	}
+	if credential.Username != "" {
+		client.SetCredential(registry, credential)
+	}
+
+	// copy the resolved digest, the tag may be moved while copying
+	image := ref.Name + "@" + digest
+	pushed := targets
+	for _, repository := range repositories {
+		copied, err := client.CopyImage(image, registry, repository, tags[repository])
+		if err != nil {
+			return nil, nil, err
+		}
+		// digest of plan should be pushed as it is, e.g. existing immutable tags point other images
+		if job.Digest != "" {
+			if err := client.checkPushedDigest(registry, repository, tags[repository], copied.Digest, job.Digest); err != nil {
+				return nil, nil, err
+			}
+		}
+		if mapper.Transfer.CopySignatures {
+			artifacts, err := client.CopyArtifacts(image, registry, repository)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to copy signatures: %v", err)
+			}
+			pushed = append(pushed, artifacts...)
+		}
+	}
+	// signature is appended to the copied signatures
+	attached, reports, err := mapper.Transfer.attach(client, targets)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(pushed, attached...), reports, nil
+}
+
+// tags in the destination should point the digest of plan
+func (c *RegistryClient) checkPushedDigest(registry, repository string, tags []string, pushed, planned string) error {
+	if pushed != planned {
+		return fmt.Errorf("pushed digest %s is different from the plan %s", pushed, planned)
+	}
+	for _, tag := range tags {
+		m, err := c.GetManifest(registry, repository, tag)
+		if err != nil {
+			return fmt.Errorf("failed to check %s:%s: %v", repository, tag, err)
+		}
+		if m.Digest != planned {
+			return fmt.Errorf("%s:%s points %s, it is different from the plan %s", repository, tag, m.Digest, planned)
+		}
+	}
+	return nil
+}
+
+// CopyImage copy the image with all platforms into the repository of registry without docker daemon,
+// the manifest is pushed by digest and tags. it returns the descriptor of the copied manifest
+func (c *RegistryClient) CopyImage(image, registry, repository string, tags []string) (Descriptor, error) {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	m, err := c.GetManifest(ref.Registry, ref.Repository, manifestReference(ref))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if err := c.copyManifest(ref, m, registry, repository); err != nil {
+		return Descriptor{}, err
+	}
+	for _, tag := range tags {
+		if err := c.PutManifest(registry, repository, tag, m.MediaType, m.Body); err != nil {
+			return Descriptor{}, fmt.Errorf("failed to push %s:%s: %v", repository, tag, err)
+		}
+	}
+	return Descriptor{MediaType: m.MediaType, Digest: m.Digest, Size: int64(len(m.Body))}, nil
+}
+
+// ResolveDigest returns the digest of manifest which the image points, the digest in image path is verified
+func (c *RegistryClient) ResolveDigest(image string) (string, error) {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+	m, err := c.GetManifest(ref.Registry, ref.Repository, manifestReference(ref))
+	if err != nil {
+		return "", err
+	}
+	return m.Digest, nil
+}
+
+// digest or tag to get manifest, tag is "latest" when it is omitted
+func manifestReference(ref ImageReference) string {
+	if ref.Digest != "" {
+		return ref.Digest
+	}
+	if ref.Tag != "" {
+		return ref.Tag
+	}
+	return "latest"
+}
+
+// manifests are pushed after their contents
+func (c *RegistryClient) copyManifest(src ImageReference, m *RegistryManifest, registry, repository string) error {
+	manifest, err := ParseImageManifest(m.Body, m.MediaType)
+	if err != nil {
+		return err
+	}
+	if IsIndex(m.MediaType) {
+		for _, d := range manifest.Manifests {
+			child, err := c.GetManifest(src.Registry, src.Repository, d.Digest)
+			if err != nil {
+				return err
+			}
+			if err := c.copyManifest(src, child, registry, repository); err != nil {
+				return err
+			}
+		}
+	} else {
+		var blobs []Descriptor
+		if manifest.Config != nil {
+			blobs = append(blobs, *manifest.Config)
+		}
+		blobs = append(blobs, manifest.Layers...)
+		for _, blob := range blobs {
+			if err := c.copyBlob(src, blob, registry, repository); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.PutManifest(registry, repository, m.Digest, m.MediaType, m.Body); err != nil {
+		return fmt.Errorf("failed to push manifest %s@%s: %v", repository, m.Digest, err)
+	}
+	return nil
+}
+
+func (c *RegistryClient) copyBlob(src ImageReference, blob Descriptor, registry, repository string) error {
+	exists, err := c.BlobExists(registry, repository, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	err = c.PushBlob(registry, repository, blob, func() (io.ReadCloser, error) {
+		return c.OpenBlob(src.Registry, src.Repository, blob.Digest)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to push blob %s@%s: %v", repository, blob.Digest, err)
+	}
+	return nil
+}
@@ -0,0 +1,647 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formats of SBOM
+const (
+	SBOMFormatSPDX      = "spdx"
+	SBOMFormatCycloneDX = "cyclonedx"
+)
+
+// artifact types of SBOM referrer
+const (
+	MediaTypeSPDX      = "application/spdx+json"
+	MediaTypeCycloneDX = "application/vnd.cyclonedx+json"
+)
+
+// SBOMOptions is how SBOMs of pushed images are made and stored
+type SBOMOptions struct {
+	// "spdx" or "cyclonedx"
+	Format string
+	// SBOMs are written into the directory instead of being attached to images as referrers
+	Dir string
+}
+
+// Validate returns error when the format is unknown
+func (o SBOMOptions) Validate() error {
+	if o.Format != SBOMFormatSPDX && o.Format != SBOMFormatCycloneDX {
+		return fmt.Errorf("format of SBOM should be %s or %s: %q", SBOMFormatSPDX, SBOMFormatCycloneDX, o.Format)
+	}
+	return nil
+}
+
+// SBOMPackage is a package found in image layers
+type SBOMPackage struct {
+	Name    string
+	Version string
+	Arch    string
+	Epoch   int
+	// "deb", "apk", "rpm" or "golang"
+	Type string
+	// file which the package is found in, e.g. "/var/lib/dpkg/status", "/usr/local/bin/app"
+	Location string
+}
+
+// PURL returns package URL, distro is ID of os-release, e.g. "debian"
+func (p SBOMPackage) PURL(distro string) string {
+	var qualifiers []string
+	namespace := distro
+	switch p.Type {
+	case "golang":
+		namespace = ""
+	case "apk":
+		if namespace == "" {
+			namespace = "alpine"
+		}
+	}
+	if p.Arch != "" {
+		qualifiers = append(qualifiers, "arch="+url.QueryEscape(p.Arch))
+	}
+	if p.Epoch != 0 {
+		qualifiers = append(qualifiers, "epoch="+strconv.Itoa(p.Epoch))
+	}
+	purl := "pkg:" + p.Type + "/"
+	if namespace != "" {
+		purl += namespace + "/"
+	}
+	purl += p.Name
+	if p.Version != "" {
+		purl += "@" + url.PathEscape(p.Version)
+	}
+	if len(qualifiers) != 0 {
+		purl += "?" + strings.Join(qualifiers, "&")
+	}
+	return purl
+}
+
+// ImagePackages is packages found in a platform image
+type ImagePackages struct {
+	// image path without tag, e.g. "<registry>/nginx"
+	Name   string
+	Digest string
+	// ID and VERSION_ID of os-release, e.g. "debian", "12"
+	Distro        string
+	DistroVersion string
+	Packages      []SBOMPackage
+}
+
+// package databases in image, the last layer wins
+var sbomDatabases = []string{
+	"var/lib/dpkg/status", "lib/apk/db/installed", "var/lib/rpm/Packages", "var/lib/rpm/rpmdb.sqlite", "usr/lib/sysimage/rpm/rpmdb.sqlite",
+	"etc/os-release", "usr/lib/os-release",
+}
+
+// Go binaries larger than this are not read
+const maxGoBinarySize = 512 << 20
+
+// ScanPackages read package databases of dpkg, apk and rpm and build info of Go binaries in layers of the image manifest
+func (c *RegistryClient) ScanPackages(registry, repository, digest string) (*ImagePackages, error) {
+	m, err := c.GetManifest(registry, repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ParseImageManifest(m.Body, m.MediaType)
+	if err != nil {
+		return nil, err
+	}
+	if IsIndex(m.MediaType) {
+		return nil, fmt.Errorf("%s@%s is index, packages are scanned for each platform", repository, digest)
+	}
+
+	files := map[string][]byte{}
+	binaries := map[string][]SBOMPackage{}
+	for _, layer := range manifest.Layers {
+		if err := c.scanLayer(registry, repository, layer, files, binaries); err != nil {
+			return nil, fmt.Errorf("failed to read layer %s: %v", layer.Digest, err)
+		}
+	}
+
+	image := &ImagePackages{Name: registry + "/" + repository, Digest: digest}
+	release := files["etc/os-release"]
+	if release == nil {
+		release = files["usr/lib/os-release"]
+	}
+	image.Distro, image.DistroVersion = parseOSRelease(release)
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data, location := files[name], "/"+name
+		switch {
+		case name == "var/lib/dpkg/status" || strings.HasPrefix(name, "var/lib/dpkg/status.d/"):
+			image.Packages = append(image.Packages, parseDpkgStatus(data, location)...)
+		case name == "lib/apk/db/installed":
+			image.Packages = append(image.Packages, parseApkInstalled(data, location)...)
+		case name == "var/lib/rpm/Packages":
+			packages, err := parseRpmPackages(data, location)
+			if err != nil {
+				return nil, err
+			}
+			image.Packages = append(image.Packages, packages...)
+		case name == "var/lib/rpm/rpmdb.sqlite" || name == "usr/lib/sysimage/rpm/rpmdb.sqlite":
+			packages, err := parseRpmSqlite(data, location)
+			if err != nil {
+				return nil, err
+			}
+			image.Packages = append(image.Packages, packages...)
+		}
+	}
+	names = names[:0]
+	for name := range binaries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		image.Packages = append(image.Packages, binaries[name]...)
+	}
+	return image, nil
+}
+
+// files of package databases and Go binaries in the layer are put, whiteouts remove them
+func (c *RegistryClient) scanLayer(registry, repository string, layer Descriptor, files map[string][]byte, binaries map[string][]SBOMPackage) error {
+	blob, err := c.OpenBlob(registry, repository, layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	r := bufio.NewReader(blob)
+	var content io.Reader = r
+	if magic, _ := r.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		content = gz
+	} else if strings.Contains(layer.MediaType, "zstd") {
+		return fmt.Errorf("%s is not supported", layer.MediaType)
+	}
+
+	// Go binaries are written to temporary file to read build info section without loading whole of them
+	var binary *os.File
+	defer func() {
+		if binary != nil {
+			binary.Close()
+			os.Remove(binary.Name())
+		}
+	}()
+
+	tr := tar.NewReader(content)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+h.Name), "/")
+		dir, base := path.Split(name)
+		if strings.HasPrefix(base, ".wh.") {
+			removed := dir + strings.TrimPrefix(base, ".wh.")
+			for file := range files {
+				if isUnder(file, removed) {
+					delete(files, file)
+				}
+			}
+			for file := range binaries {
+				if isUnder(file, removed) {
+					delete(binaries, file)
+				}
+			}
+			continue
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+		delete(binaries, name)
+		if isSBOMDatabase(name) {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			files[name] = data
+			continue
+		}
+		if h.Mode&0111 == 0 || h.Size < 4 || h.Size > maxGoBinarySize {
+			continue
+		}
+		tr := bufio.NewReader(tr)
+		if magic, _ := tr.Peek(4); !bytes.Equal(magic, []byte("\x7fELF")) {
+			continue
+		}
+		if binary == nil {
+			if binary, err = ioutil.TempFile("", "trimg-binary"); err != nil {
+				return err
+			}
+		}
+		if err := binary.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := binary.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		size, err := io.Copy(binary, tr)
+		if err != nil {
+			return err
+		}
+		if packages := parseGoBinary(io.NewSectionReader(binary, 0, size), "/"+name); len(packages) != 0 {
+			binaries[name] = packages
+		}
+	}
+	// the digest is verified at the end of blob
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// file is the path or in the directory of the path
+func isUnder(file, path string) bool {
+	return file == path || strings.HasPrefix(file, path+"/")
+}
+
+func isSBOMDatabase(name string) bool {
+	if strings.HasPrefix(name, "var/lib/dpkg/status.d/") {
+		return true
+	}
+	for _, database := range sbomDatabases {
+		if name == database {
+			return true
+		}
+	}
+	return false
+}
+
+// ID and VERSION_ID of os-release
+func parseOSRelease(data []byte) (string, string) {
+	var id, version string
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.Trim(kv[1], `"'`)
+		switch kv[0] {
+		case "ID":
+			id = value
+		case "VERSION_ID":
+			version = value
+		}
+	}
+	return id, version
+}
+
+// fields of paragraphs separated by blank lines, e.g. "Package: nginx"
+func parseParagraphs(data []byte, separator string) []map[string]string {
+	var paragraphs []map[string]string
+	current := map[string]string{}
+	last := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			if len(current) != 0 {
+				paragraphs = append(paragraphs, current)
+			}
+			current, last = map[string]string{}, ""
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && last != "" {
+			// continuation of the previous field
+			continue
+		}
+		kv := strings.SplitN(line, separator, 2)
+		if len(kv) != 2 {
+			continue
+		}
+		last = kv[0]
+		current[kv[0]] = strings.TrimSpace(kv[1])
+	}
+	if len(current) != 0 {
+		paragraphs = append(paragraphs, current)
+	}
+	return paragraphs
+}
+
+// installed packages of dpkg, status.d of distroless has no status
+func parseDpkgStatus(data []byte, location string) []SBOMPackage {
+	var packages []SBOMPackage
+	for _, p := range parseParagraphs(data, ":") {
+		if status, ok := p["Status"]; p["Package"] == "" || (ok && !strings.HasSuffix(status, " installed")) {
+			continue
+		}
+		pkg := SBOMPackage{Name: p["Package"], Version: p["Version"], Arch: p["Architecture"], Type: "deb", Location: location}
+		// epoch is a part of version, e.g. "1:2.3-4"
+		if i := strings.Index(pkg.Version, ":"); i > 0 {
+			if epoch, err := strconv.Atoi(pkg.Version[:i]); err == nil {
+				pkg.Epoch, pkg.Version = epoch, pkg.Version[i+1:]
+			}
+		}
+		packages = append(packages, pkg)
+	}
+	return packages
+}
+
+// installed packages of apk, e.g. "P:musl", "V:1.2.4-r2"
+func parseApkInstalled(data []byte, location string) []SBOMPackage {
+	var packages []SBOMPackage
+	for _, p := range parseParagraphs(data, ":") {
+		if p["P"] == "" {
+			continue
+		}
+		packages = append(packages, SBOMPackage{Name: p["P"], Version: p["V"], Arch: p["A"], Type: "apk", Location: location})
+	}
+	return packages
+}
+
+// SBOM returns the document of packages in the format, created is the time of the document
+func (p *ImagePackages) SBOM(format string, created time.Time) ([]byte, error) {
+	switch format {
+	case SBOMFormatSPDX:
+		return json.MarshalIndent(p.spdx(created), "", "  ")
+	case SBOMFormatCycloneDX:
+		return json.MarshalIndent(p.cycloneDX(created), "", "  ")
+	}
+	return nil, SBOMOptions{Format: format}.Validate()
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+func (p *ImagePackages) spdx(created time.Time) spdxDocument {
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              p.Name + "@" + p.Digest,
+		DocumentNamespace: "https://github.com/esakat/trimg/spdx/" + p.Name + "@" + p.Digest + "-" + newUUID(),
+		CreationInfo:      spdxCreationInfo{Created: created.UTC().Format(time.RFC3339), Creators: []string{"Tool: trimg"}},
+	}
+	image := spdxPackage{
+		Name: p.Name, SPDXID: "SPDXRef-Image", VersionInfo: p.Digest, DownloadLocation: "NOASSERTION",
+		ExternalRefs: []spdxExternalRef{{"PACKAGE-MANAGER", "purl", ociPURL(p.Name, p.Digest)}},
+	}
+	doc.Packages = append(doc.Packages, image)
+	doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-DOCUMENT", "DESCRIBES", image.SPDXID})
+	for i, pkg := range p.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i+1)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name: pkg.Name, SPDXID: id, VersionInfo: pkg.Version, DownloadLocation: "NOASSERTION",
+			SourceInfo:   "found in " + pkg.Location,
+			ExternalRefs: []spdxExternalRef{{"PACKAGE-MANAGER", "purl", pkg.PURL(p.Distro)}},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{image.SPDXID, "CONTAINS", id})
+	}
+	return doc
+}
+
+type cycloneDXDocument struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cycloneDXMetadata    `json:"metadata"`
+	Components   []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     []cycloneDXTool    `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTool struct {
+	Name string `json:"name"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func (p *ImagePackages) cycloneDX(created time.Time) cycloneDXDocument {
+	doc := cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: created.UTC().Format(time.RFC3339),
+			Tools:     []cycloneDXTool{{Name: "trimg"}},
+			Component: cycloneDXComponent{Type: "container", Name: p.Name, Version: p.Digest, PURL: ociPURL(p.Name, p.Digest)},
+		},
+		Components: []cycloneDXComponent{},
+	}
+	if p.Distro != "" {
+		doc.Components = append(doc.Components, cycloneDXComponent{Type: "operating-system", Name: p.Distro, Version: p.DistroVersion})
+	}
+	for _, pkg := range p.Packages {
+		purl := pkg.PURL(p.Distro)
+		doc.Components = append(doc.Components, cycloneDXComponent{
+			Type: "library", BOMRef: purl, Name: pkg.Name, Version: pkg.Version, PURL: purl,
+			Properties: []cycloneDXProperty{{Name: "trimg:location", Value: pkg.Location}},
+		})
+	}
+	return doc
+}
+
+// package URL of the image, e.g. "pkg:oci/nginx@sha256%3A...?repository_url=registry/library/nginx"
+func ociPURL(name, digest string) string {
+	return "pkg:oci/" + path.Base(name) + "@" + url.QueryEscape(digest) + "?repository_url=" + url.QueryEscape(name)
+}
+
+// random UUID version 4
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// AttachSBOMs make SBOMs of pushed images of targets for each platform, they are pushed as referrers of platform manifests
+// or written into the directory. it returns image paths of referrers or the files
+func AttachSBOMs(client *RegistryClient, options SBOMOptions, targets []string) ([]string, error) {
+	var attached []string
+	done := map[string]bool{}
+	for _, target := range targets {
+		ref, err := ParseImageReference(target)
+		if err != nil {
+			return attached, err
+		}
+		m, err := client.GetManifest(ref.Registry, ref.Repository, manifestReference(ref))
+		if err != nil {
+			return attached, fmt.Errorf("failed to get pushed manifest of %s: %v", target, err)
+		}
+		subjects := []Descriptor{{MediaType: m.MediaType, Digest: m.Digest, Size: int64(len(m.Body))}}
+		if IsIndex(m.MediaType) {
+			index, err := ParseImageManifest(m.Body, m.MediaType)
+			if err != nil {
+				return attached, err
+			}
+			subjects = index.Manifests
+		}
+		for _, subject := range subjects {
+			key := ref.Registry + "/" + ref.Repository + "@" + subject.Digest
+			if done[key] {
+				continue
+			}
+			done[key] = true
+			image, err := client.ScanPackages(ref.Registry, ref.Repository, subject.Digest)
+			if err != nil {
+				return attached, fmt.Errorf("failed to scan packages of %s: %v", key, err)
+			}
+			sbom, err := image.SBOM(options.Format, time.Now())
+			if err != nil {
+				return attached, err
+			}
+			var path string
+			if options.Dir != "" {
+				path, err = writeSBOM(options, image, sbom)
+			} else {
+				path, err = pushSBOM(client, options, ref, subject, sbom)
+			}
+			if err != nil {
+				return attached, err
+			}
+			attached = append(attached, path)
+		}
+	}
+	return attached, nil
+}
+
+// file name is made of repository and digest, e.g. "nginx@sha256-<hex>.spdx.json"
+func writeSBOM(options SBOMOptions, image *ImagePackages, sbom []byte) (string, error) {
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return "", err
+	}
+	extension := ".spdx.json"
+	if options.Format == SBOMFormatCycloneDX {
+		extension = ".cdx.json"
+	}
+	name := strings.NewReplacer("/", "_", ":", "-").Replace(image.Name + "@" + image.Digest)
+	file := filepath.Join(options.Dir, name+extension)
+	if err := ioutil.WriteFile(file, sbom, 0644); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// SBOM is pushed as OCI artifact whose subject is the platform manifest
+func pushSBOM(client *RegistryClient, options SBOMOptions, ref ImageReference, subject Descriptor, sbom []byte) (string, error) {
+	artifactType := MediaTypeSPDX
+	if options.Format == SBOMFormatCycloneDX {
+		artifactType = MediaTypeCycloneDX
+	}
+	empty := []byte("{}")
+	config := Descriptor{MediaType: MediaTypeOCIEmpty, Digest: Digest(empty), Size: int64(len(empty))}
+	layer := Descriptor{MediaType: artifactType, Digest: Digest(sbom), Size: int64(len(sbom))}
+	for _, blob := range []struct {
+		descriptor Descriptor
+		data       []byte
+	}{{config, empty}, {layer, sbom}} {
+		data := blob.data
+		err := client.PushBlob(ref.Registry, ref.Repository, blob.descriptor, func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to push SBOM: %v", err)
+		}
+	}
+	subject = Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size}
+	manifest := ImageManifest{
+		SchemaVersion: 2, MediaType: MediaTypeOCIManifest, ArtifactType: artifactType,
+		Config: &config, Layers: []Descriptor{layer}, Subject: &subject,
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	digest := Digest(body)
+	if err := client.PutManifest(ref.Registry, ref.Repository, digest, MediaTypeOCIManifest, body); err != nil {
+		return "", fmt.Errorf("failed to push SBOM: %v", err)
+	}
+	// referrers are listed by the tag in the registry without referrers API
+	referrer := Descriptor{MediaType: MediaTypeOCIManifest, Digest: digest, Size: int64(len(body)), ArtifactType: artifactType}
+	if err := client.putReferrersIndex(ref.Registry, ref.Repository, subject.Digest, []Descriptor{referrer}); err != nil {
+		return "", err
+	}
+	return ref.Registry + "/" + ref.Repository + "@" + digest, nil
+}
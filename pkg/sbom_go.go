@@ -0,0 +1,90 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// build info section larger than this is not read, it has only versions of Go and modules
+const maxGoBuildInfoSize = 4 << 20
+
+// magic of build info section of Go binary
+var goBuildInfoMagic = []byte("\xff Go buildinf:")
+
+// parseGoBinary read modules in build info of Go binary, it is empty when the file is not Go binary.
+// build info of Go 1.18 or later is supported, older binaries have pointers to data instead of strings.
+// only headers and build info section are read from the file
+func parseGoBinary(file io.ReaderAt, location string) []SBOMPackage {
+	f, err := elf.NewFile(file)
+	if err != nil {
+		return nil
+	}
+	section := f.Section(".go.buildinfo")
+	if section == nil || section.Size > maxGoBuildInfoSize {
+		return nil
+	}
+	info, err := section.Data()
+	if err != nil || len(info) < 32 || !bytes.HasPrefix(info, goBuildInfoMagic) {
+		return nil
+	}
+	// strings are inlined when the flag is set
+	if info[15]&2 == 0 {
+		return nil
+	}
+	info = info[32:]
+	goVersion, info := readVarString(info)
+	modInfo, _ := readVarString(info)
+	if goVersion == "" {
+		return nil
+	}
+
+	packages := []SBOMPackage{{Name: "stdlib", Version: goVersion, Type: "golang", Location: location}}
+	// mod info is surrounded by 16 bytes sentinels
+	if len(modInfo) >= 33 && modInfo[len(modInfo)-17] == '\n' {
+		modInfo = modInfo[16 : len(modInfo)-16]
+	} else {
+		return packages
+	}
+	for _, line := range strings.Split(modInfo, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[0] {
+		case "mod", "dep":
+			packages = append(packages, SBOMPackage{Name: fields[1], Version: fields[2], Type: "golang", Location: location})
+		case "=>":
+			// replacement of the previous module
+			last := &packages[len(packages)-1]
+			last.Name, last.Version = fields[1], fields[2]
+		}
+	}
+	return packages
+}
+
+// string prefixed by uvarint length
+func readVarString(data []byte) (string, []byte) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return "", nil
+	}
+	return string(data[n : n+int(length)]), data[n+int(length):]
+}
@@ -0,0 +1,447 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// BerkeleyDB hash database of rpm, e.g. /var/lib/rpm/Packages.
+// values are rpm headers of installed packages, they are stored in overflow pages
+const (
+	bdbHashMagic        = 0x061561
+	bdbPageHeaderSize   = 26
+	bdbHashUnsortedPage = 2
+	bdbOverflowPage     = 7
+	bdbHashPage         = 13
+	bdbHashOffPage      = 3
+)
+
+// rpm header tags and types
+const (
+	rpmTagName    = 1000
+	rpmTagVersion = 1001
+	rpmTagRelease = 1002
+	rpmTagEpoch   = 1003
+	rpmTagArch    = 1022
+	rpmTypeInt32  = 4
+	rpmTypeString = 6
+)
+
+// parseRpmPackages read installed packages in BerkeleyDB of rpm
+func parseRpmPackages(data []byte, location string) ([]SBOMPackage, error) {
+	if len(data) < 512 {
+		return nil, errors.New("rpm database is too short")
+	}
+	// byte order is of the machine which made the database
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint32(data[12:16]) != bdbHashMagic {
+		order = binary.BigEndian
+		if order.Uint32(data[12:16]) != bdbHashMagic {
+			return nil, errors.New("rpm database is not BerkeleyDB hash, ndb is not supported")
+		}
+	}
+	pageSize := int(order.Uint32(data[20:24]))
+	if pageSize < bdbPageHeaderSize {
+		return nil, fmt.Errorf("page size of rpm database is wrong: %d", pageSize)
+	}
+	page := func(pgno uint32) []byte {
+		start := int(pgno) * pageSize
+		if pgno == 0 || start+pageSize > len(data) {
+			return nil
+		}
+		return data[start : start+pageSize]
+	}
+
+	var packages []SBOMPackage
+	for pgno := uint32(1); int(pgno)*pageSize < len(data); pgno++ {
+		p := page(pgno)
+		if p == nil || (p[25] != bdbHashUnsortedPage && p[25] != bdbHashPage) {
+			continue
+		}
+		entries := int(order.Uint16(p[20:22]))
+		// entries are pairs of key and value
+		for i := 1; i < entries; i += 2 {
+			at := bdbPageHeaderSize + i*2
+			if at+2 > len(p) {
+				break
+			}
+			offset := int(order.Uint16(p[at : at+2]))
+			if offset+12 > len(p) || p[offset] != bdbHashOffPage {
+				continue
+			}
+			header, err := bdbOverflow(page, order, order.Uint32(p[offset+4:offset+8]))
+			if err != nil {
+				return nil, err
+			}
+			pkg, err := parseRpmHeader(header)
+			if err != nil {
+				return nil, err
+			}
+			pkg.Location = location
+			packages = append(packages, pkg)
+		}
+	}
+	return packages, nil
+}
+
+// value stored in the chain of overflow pages
+func bdbOverflow(page func(uint32) []byte, order binary.ByteOrder, pgno uint32) ([]byte, error) {
+	var value []byte
+	seen := map[uint32]bool{}
+	for pgno != 0 {
+		p := page(pgno)
+		if p == nil || p[25] != bdbOverflowPage || seen[pgno] {
+			return nil, fmt.Errorf("overflow page %d of rpm database is broken", pgno)
+		}
+		seen[pgno] = true
+		next := order.Uint32(p[16:20])
+		if next == 0 {
+			// offset of free area is length of the value in the last page
+			length := int(order.Uint16(p[22:24]))
+			if bdbPageHeaderSize+length > len(p) {
+				return nil, fmt.Errorf("overflow page %d of rpm database is broken", pgno)
+			}
+			value = append(value, p[bdbPageHeaderSize:bdbPageHeaderSize+length]...)
+		} else {
+			value = append(value, p[bdbPageHeaderSize:]...)
+		}
+		pgno = next
+	}
+	return value, nil
+}
+
+// parseRpmHeader read name, version, release, epoch and arch of rpm header blob
+func parseRpmHeader(blob []byte) (SBOMPackage, error) {
+	if len(blob) < 8 {
+		return SBOMPackage{}, errors.New("rpm header is too short")
+	}
+	count := int(binary.BigEndian.Uint32(blob[0:4]))
+	size := int(binary.BigEndian.Uint32(blob[4:8]))
+	store := 8 + count*16
+	if count < 0 || size < 0 || store+size > len(blob) {
+		return SBOMPackage{}, errors.New("rpm header is broken")
+	}
+	data := blob[store : store+size]
+
+	pkg := SBOMPackage{Type: "rpm"}
+	var release string
+	for i := 0; i < count; i++ {
+		entry := blob[8+i*16 : 8+(i+1)*16]
+		tag := binary.BigEndian.Uint32(entry[0:4])
+		typ := binary.BigEndian.Uint32(entry[4:8])
+		offset := int(binary.BigEndian.Uint32(entry[8:12]))
+		if offset < 0 || offset >= len(data) {
+			continue
+		}
+		switch {
+		case typ == rpmTypeString:
+			value := data[offset:]
+			if end := bytes.IndexByte(value, 0); end >= 0 {
+				value = value[:end]
+			}
+			switch tag {
+			case rpmTagName:
+				pkg.Name = string(value)
+			case rpmTagVersion:
+				pkg.Version = string(value)
+			case rpmTagRelease:
+				release = string(value)
+			case rpmTagArch:
+				pkg.Arch = string(value)
+			}
+		case typ == rpmTypeInt32 && tag == rpmTagEpoch && offset+4 <= len(data):
+			pkg.Epoch = int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		}
+	}
+	if pkg.Name == "" {
+		return SBOMPackage{}, errors.New("rpm header has no name")
+	}
+	if release != "" {
+		pkg.Version += "-" + release
+	}
+	return pkg, nil
+}
+
+// SQLite database of rpm 4.16 or later, e.g. /var/lib/rpm/rpmdb.sqlite of RHEL 9.
+// rpm headers are blob column of Packages table, they are read from b-tree pages of the file.
+// changes left in rpmdb.sqlite-wal are not read, rpm checkpoints them when the database is closed
+const (
+	sqliteMagic         = "SQLite format 3\x00"
+	sqliteFileHeader    = 100
+	sqliteInteriorTable = 0x05
+	sqliteLeafTable     = 0x0d
+)
+
+// parseRpmSqlite read installed packages in rpmdb.sqlite
+func parseRpmSqlite(data []byte, location string) ([]SBOMPackage, error) {
+	db, err := openSqlite(data)
+	if err != nil {
+		return nil, err
+	}
+	// tables are listed in the schema table of page 1, columns are type, name, tbl_name, rootpage and sql
+	var root int64
+	err = db.rows(1, func(columns []sqliteColumn) error {
+		if len(columns) >= 4 && string(columns[0].value) == "table" && string(columns[1].value) == "Packages" {
+			root = columns[3].int()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root <= 0 {
+		return nil, errors.New("rpm database has no Packages table")
+	}
+
+	var packages []SBOMPackage
+	// columns are hnum and blob, hnum is NULL because it is rowid
+	err = db.rows(uint32(root), func(columns []sqliteColumn) error {
+		if len(columns) < 2 {
+			return errors.New("row of Packages table has no blob")
+		}
+		pkg, err := parseRpmHeader(columns[1].value)
+		if err != nil {
+			return err
+		}
+		pkg.Location = location
+		packages = append(packages, pkg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+type sqliteDB struct {
+	data     []byte
+	pageSize int
+	// page size without reserved bytes at the end of each page
+	usable int
+}
+
+func openSqlite(data []byte) (*sqliteDB, error) {
+	if len(data) < sqliteFileHeader || string(data[:len(sqliteMagic)]) != sqliteMagic {
+		return nil, errors.New("rpm database is not SQLite")
+	}
+	pageSize := int(binary.BigEndian.Uint16(data[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	usable := pageSize - int(data[20])
+	if pageSize < 512 || usable < 480 {
+		return nil, fmt.Errorf("page size of rpm database is wrong: %d", pageSize)
+	}
+	return &sqliteDB{data: data, pageSize: pageSize, usable: usable}, nil
+}
+
+// page numbers start from 1
+func (db *sqliteDB) page(pgno uint32) []byte {
+	start := (int(pgno) - 1) * db.pageSize
+	if pgno == 0 || start+db.pageSize > len(db.data) {
+		return nil
+	}
+	return db.data[start : start+db.pageSize]
+}
+
+// rows calls fn with columns of each row in the table b-tree of the root page, in order of rowid
+func (db *sqliteDB) rows(root uint32, fn func(columns []sqliteColumn) error) error {
+	seen := map[uint32]bool{}
+	var walk func(pgno uint32) error
+	walk = func(pgno uint32) error {
+		p := db.page(pgno)
+		if p == nil || seen[pgno] {
+			return fmt.Errorf("page %d of rpm database is broken", pgno)
+		}
+		seen[pgno] = true
+		header := 0
+		if pgno == 1 {
+			header = sqliteFileHeader
+		}
+		kind := p[header]
+		pointers := header + 8
+		if kind == sqliteInteriorTable {
+			pointers = header + 12
+		} else if kind != sqliteLeafTable {
+			return fmt.Errorf("page %d of rpm database is not table", pgno)
+		}
+		cells := int(binary.BigEndian.Uint16(p[header+3 : header+5]))
+		for i := 0; i < cells; i++ {
+			at := pointers + i*2
+			if at+2 > len(p) {
+				return fmt.Errorf("page %d of rpm database is broken", pgno)
+			}
+			offset := int(binary.BigEndian.Uint16(p[at : at+2]))
+			// interior cell is the left child and rowid
+			if kind == sqliteInteriorTable {
+				if offset+4 > len(p) {
+					return fmt.Errorf("page %d of rpm database is broken", pgno)
+				}
+				if err := walk(binary.BigEndian.Uint32(p[offset : offset+4])); err != nil {
+					return err
+				}
+				continue
+			}
+			payload, err := db.payload(p, offset)
+			if err != nil {
+				return fmt.Errorf("page %d of rpm database is broken: %v", pgno, err)
+			}
+			columns, err := sqliteRecord(payload)
+			if err != nil {
+				return fmt.Errorf("page %d of rpm database is broken: %v", pgno, err)
+			}
+			if err := fn(columns); err != nil {
+				return err
+			}
+		}
+		if kind == sqliteInteriorTable {
+			return walk(binary.BigEndian.Uint32(p[header+8 : header+12]))
+		}
+		return nil
+	}
+	return walk(root)
+}
+
+// payload of the leaf cell, the rest of large payload is stored in the chain of overflow pages
+func (db *sqliteDB) payload(p []byte, offset int) ([]byte, error) {
+	if offset >= len(p) {
+		return nil, errors.New("cell is out of page")
+	}
+	size, n := sqliteVarint(p[offset:])
+	if n == 0 || size > uint64(len(db.data)) {
+		return nil, errors.New("size of payload is wrong")
+	}
+	offset += n
+	// rowid
+	if _, n = sqliteVarint(p[offset:]); n == 0 {
+		return nil, errors.New("rowid is wrong")
+	}
+	offset += n
+
+	local := int(size)
+	if maxLocal := db.usable - 35; local > maxLocal {
+		minLocal := (db.usable-12)*32/255 - 23
+		local = minLocal + (int(size)-minLocal)%(db.usable-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	if offset+local > len(p) {
+		return nil, errors.New("payload is out of page")
+	}
+	payload := append([]byte(nil), p[offset:offset+local]...)
+	if local == int(size) {
+		return payload, nil
+	}
+	if offset+local+4 > len(p) {
+		return nil, errors.New("overflow page is missing")
+	}
+	next := binary.BigEndian.Uint32(p[offset+local : offset+local+4])
+	seen := map[uint32]bool{}
+	for len(payload) < int(size) {
+		overflow := db.page(next)
+		if overflow == nil || seen[next] {
+			return nil, fmt.Errorf("overflow page %d is broken", next)
+		}
+		seen[next] = true
+		n := int(size) - len(payload)
+		if n > db.usable-4 {
+			n = db.usable - 4
+		}
+		payload = append(payload, overflow[4:4+n]...)
+		next = binary.BigEndian.Uint32(overflow[0:4])
+	}
+	return payload, nil
+}
+
+// sqliteColumn is a value of record, serial is the type and size of the value
+type sqliteColumn struct {
+	serial uint64
+	value  []byte
+}
+
+// int returns the value of integer column, 0 for other types
+func (c sqliteColumn) int() int64 {
+	switch {
+	case c.serial == 9:
+		return 1
+	case c.serial >= 1 && c.serial <= 6:
+		// big endian two's complement
+		v := int64(int8(c.value[0]))
+		for _, b := range c.value[1:] {
+			v = v<<8 | int64(b)
+		}
+		return v
+	}
+	return 0
+}
+
+// sqliteRecord split the record into columns, the header has serial types of columns
+func sqliteRecord(payload []byte) ([]sqliteColumn, error) {
+	headerSize, n := sqliteVarint(payload)
+	if n == 0 || headerSize > uint64(len(payload)) {
+		return nil, errors.New("record header is wrong")
+	}
+	var columns []sqliteColumn
+	offset := int(headerSize)
+	for at := n; at < int(headerSize); {
+		serial, n := sqliteVarint(payload[at:headerSize])
+		if n == 0 {
+			return nil, errors.New("record header is wrong")
+		}
+		at += n
+		var size int
+		switch {
+		case serial <= 4:
+			size = int(serial)
+		case serial == 5:
+			size = 6
+		case serial == 6 || serial == 7:
+			size = 8
+		case serial == 8 || serial == 9:
+			size = 0
+		case serial >= 12:
+			size = int((serial - 12) / 2)
+		default:
+			return nil, fmt.Errorf("serial type %d is reserved", serial)
+		}
+		if offset+size > len(payload) {
+			return nil, errors.New("record is shorter than the header")
+		}
+		columns = append(columns, sqliteColumn{serial: serial, value: payload[offset : offset+size]})
+		offset += size
+	}
+	return columns, nil
+}
+
+// sqliteVarint read big endian varint of 1 to 9 bytes, the size is 0 when it is broken
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,453 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type layerFile struct {
+	name string
+	mode int64
+	data []byte
+}
+
+func gzipLayer(files ...layerFile) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		mode := f.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: mode, Size: int64(len(f.data)), Typeflag: tar.TypeReg})
+		tw.Write(f.data)
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// pushLayers put image manifest of the layers
+func (r *fakeRegistry) pushLayers(repository, tag string, layers ...[]byte) Descriptor {
+	config := r.putBlob([]byte(`{"os":"linux","architecture":"amd64"}`))
+	config.MediaType = "application/vnd.docker.container.image.v1+json"
+	var descriptors []Descriptor
+	for _, layer := range layers {
+		d := r.putBlob(layer)
+		d.MediaType = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+		descriptors = append(descriptors, d)
+	}
+	body, _ := json.Marshal(ImageManifest{SchemaVersion: 2, MediaType: MediaTypeDockerManifest, Config: &config, Layers: descriptors})
+	return r.putManifest(repository, tag, MediaTypeDockerManifest, body)
+}
+
+func TestScanPackages(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+
+	debian := registry.pushLayers("library/debian", "12",
+		gzipLayer(
+			layerFile{name: "etc/os-release", data: []byte("PRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\nID=debian\nVERSION_ID=\"12\"\n")},
+			layerFile{name: "var/lib/dpkg/status", data: []byte("Package: base-files\nStatus: install ok installed\nVersion: 12.4\nArchitecture: amd64\n")},
+			layerFile{name: "usr/bin/tool", mode: 0755, data: []byte("#!/bin/sh\n")},
+		),
+		// the later layer wins, and whiteout removes files
+		gzipLayer(
+			layerFile{name: "./var/lib/dpkg/status", data: []byte(strings.Join([]string{
+				"Package: base-files\nStatus: install ok installed\nVersion: 12.4\nArchitecture: amd64\nDescription: base files\n multi line\n",
+				"Package: libc6\nStatus: install ok installed\nVersion: 2.36-9+deb12u3\nArchitecture: amd64\n",
+				"Package: removed\nStatus: deinstall ok config-files\nVersion: 1.0\n",
+				"Package: tzdata\nStatus: install ok installed\nVersion: 1:2024a-0+deb12u1\nArchitecture: all\n",
+			}, "\n"))},
+			layerFile{name: "var/lib/dpkg/status.d/nginx", data: []byte("Package: nginx\nVersion: 1.25.3\nArchitecture: amd64\n")},
+			layerFile{name: "usr/bin/.wh.tool"},
+		),
+	)
+	alpine := registry.pushLayers("library/alpine", "3.19", gzipLayer(
+		layerFile{name: "etc/os-release", data: []byte("ID=alpine\nVERSION_ID=3.19.1\n")},
+		layerFile{name: "lib/apk/db/installed", data: []byte("C:Q1abc=\nP:musl\nV:1.2.4_git20230717-r4\nA:x86_64\n\nP:busybox\nV:1.36.1-r15\nA:x86_64\n")},
+	))
+
+	image, err := registry.Client().ScanPackages(registry.Host(), "library/debian", debian.Digest)
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	expected := []SBOMPackage{
+		{Name: "base-files", Version: "12.4", Arch: "amd64", Type: "deb", Location: "/var/lib/dpkg/status"},
+		{Name: "libc6", Version: "2.36-9+deb12u3", Arch: "amd64", Type: "deb", Location: "/var/lib/dpkg/status"},
+		{Name: "tzdata", Version: "2024a-0+deb12u1", Arch: "all", Epoch: 1, Type: "deb", Location: "/var/lib/dpkg/status"},
+		{Name: "nginx", Version: "1.25.3", Arch: "amd64", Type: "deb", Location: "/var/lib/dpkg/status.d/nginx"},
+	}
+	if image.Distro != "debian" || image.DistroVersion != "12" || !reflect.DeepEqual(image.Packages, expected) {
+		t.Errorf("unexpected packages: %s %s %v", image.Distro, image.DistroVersion, image.Packages)
+	}
+	if purl := image.Packages[2].PURL(image.Distro); purl != "pkg:deb/debian/tzdata@2024a-0+deb12u1?arch=all&epoch=1" {
+		t.Errorf("unexpected purl: %s", purl)
+	}
+
+	image, err = registry.Client().ScanPackages(registry.Host(), "library/alpine", alpine.Digest)
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	if len(image.Packages) != 2 || image.Packages[1].PURL(image.Distro) != "pkg:apk/alpine/busybox@1.36.1-r15?arch=x86_64" {
+		t.Errorf("unexpected packages: %v", image.Packages)
+	}
+
+	// SBOM documents
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	data, err := image.SBOM(SBOMFormatSPDX, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spdx spdxDocument
+	if err := json.Unmarshal(data, &spdx); err != nil || spdx.SPDXVersion != "SPDX-2.3" || len(spdx.Packages) != 3 || len(spdx.Relationships) != 3 {
+		t.Errorf("unexpected SPDX: %s, %v", data, err)
+	}
+	data, err = image.SBOM(SBOMFormatCycloneDX, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cdx cycloneDXDocument
+	if err := json.Unmarshal(data, &cdx); err != nil || cdx.BOMFormat != "CycloneDX" || len(cdx.Components) != 3 || cdx.Components[0].Type != "operating-system" {
+		t.Errorf("unexpected CycloneDX: %s, %v", data, err)
+	}
+	if _, err := image.SBOM("syft", created); err == nil {
+		t.Error("unknown format should be error")
+	}
+}
+
+// rpmHeader make header blob of rpm with string tags and epoch
+func rpmHeader(name, version, release, arch string, epoch uint32) []byte {
+	var index, data bytes.Buffer
+	entry := func(tag, typ uint32, value []byte) {
+		binary.Write(&index, binary.BigEndian, []uint32{tag, typ, uint32(data.Len()), 1})
+		data.Write(value)
+	}
+	for _, e := range []struct {
+		tag   uint32
+		value string
+	}{{rpmTagName, name}, {rpmTagVersion, version}, {rpmTagRelease, release}, {rpmTagArch, arch}} {
+		entry(e.tag, rpmTypeString, append([]byte(e.value), 0))
+	}
+	// int32 is aligned
+	for data.Len()%4 != 0 {
+		data.WriteByte(0)
+	}
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, epoch)
+	entry(rpmTagEpoch, rpmTypeInt32, value)
+
+	var blob bytes.Buffer
+	binary.Write(&blob, binary.BigEndian, []uint32{uint32(index.Len() / 16), uint32(data.Len())})
+	blob.Write(index.Bytes())
+	blob.Write(data.Bytes())
+	return blob.Bytes()
+}
+
+// bdbPackages make BerkeleyDB hash of little endian, headers are stored in overflow pages
+func bdbPackages(pageSize int, headers ...[]byte) []byte {
+	pages := [][]byte{make([]byte, pageSize)}
+	binary.LittleEndian.PutUint32(pages[0][12:], bdbHashMagic)
+	binary.LittleEndian.PutUint32(pages[0][20:], uint32(pageSize))
+	pages[0][25] = 8
+
+	hash := make([]byte, pageSize)
+	hash[25] = bdbHashPage
+	pages = append(pages, hash)
+	binary.LittleEndian.PutUint16(hash[20:], uint16(len(headers)*2))
+	offset := pageSize
+	for i, header := range headers {
+		// key is record number
+		offset -= 5
+		hash[offset] = 1
+		binary.LittleEndian.PutUint32(hash[offset+1:], uint32(i+1))
+		binary.LittleEndian.PutUint16(hash[bdbPageHeaderSize+i*4:], uint16(offset))
+
+		// value is in the chain of overflow pages
+		offset -= 12
+		hash[offset] = bdbHashOffPage
+		binary.LittleEndian.PutUint32(hash[offset+4:], uint32(len(pages)))
+		binary.LittleEndian.PutUint32(hash[offset+8:], uint32(len(header)))
+		binary.LittleEndian.PutUint16(hash[bdbPageHeaderSize+i*4+2:], uint16(offset))
+		for len(header) > 0 {
+			page := make([]byte, pageSize)
+			page[25] = bdbOverflowPage
+			n := copy(page[bdbPageHeaderSize:], header)
+			header = header[n:]
+			if len(header) > 0 {
+				binary.LittleEndian.PutUint32(page[16:], uint32(len(pages)+1))
+			} else {
+				binary.LittleEndian.PutUint16(page[22:], uint16(n))
+			}
+			pages = append(pages, page)
+		}
+	}
+	return bytes.Join(pages, nil)
+}
+
+func TestParseRpmPackages(t *testing.T) {
+	db := bdbPackages(512,
+		rpmHeader("bash", "5.1.8", "6.el9", "x86_64", 0),
+		// header over multiple pages
+		rpmHeader("openssl-libs", "3.0.7", "24.el9"+strings.Repeat("x", 600), "x86_64", 1),
+	)
+	packages, err := parseRpmPackages(db, "/var/lib/rpm/Packages")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(packages) != 2 || packages[0].Name != "bash" || packages[0].Version != "5.1.8-6.el9" ||
+		packages[1].Name != "openssl-libs" || packages[1].Epoch != 1 || !strings.HasPrefix(packages[1].Version, "3.0.7-24.el9x") {
+		t.Errorf("unexpected packages: %v", packages)
+	}
+	if purl := packages[0].PURL("rhel"); purl != "pkg:rpm/rhel/bash@5.1.8-6.el9?arch=x86_64" {
+		t.Errorf("unexpected purl: %s", purl)
+	}
+	if _, err := parseRpmPackages(make([]byte, 1024), "/var/lib/rpm/Packages"); err == nil {
+		t.Error("database which is not BerkeleyDB should be error")
+	}
+}
+
+// sqliteVarintBytes encode varint of SQLite, values are less than 2^56
+func sqliteVarintBytes(v uint64) []byte {
+	b := []byte{byte(v & 0x7f)}
+	for v >>= 7; v > 0; v >>= 7 {
+		b = append([]byte{byte(v&0x7f) | 0x80}, b...)
+	}
+	return b
+}
+
+// sqlitePackages make rpmdb.sqlite whose Packages table has an interior page and a leaf page for each header,
+// large headers are stored in overflow pages
+func sqlitePackages(pageSize int, headers ...[]byte) []byte {
+	newPage := func(kind byte, header int) []byte {
+		page := make([]byte, pageSize)
+		page[header] = kind
+		return page
+	}
+	// cell of a row at the end of the page, the rest of payload is put into overflow pages
+	var pages [][]byte
+	// columns are NULL, int8, text or blob
+	putRow := func(page []byte, header int, rowid uint64, columns ...interface{}) {
+		recordHeader, body := []byte{0}, []byte(nil)
+		for _, c := range columns {
+			switch c := c.(type) {
+			case nil:
+				recordHeader = append(recordHeader, 0)
+			case int:
+				recordHeader = append(recordHeader, 1)
+				body = append(body, byte(c))
+			case string:
+				recordHeader = append(recordHeader, sqliteVarintBytes(uint64(13+len(c)*2))...)
+				body = append(body, c...)
+			case []byte:
+				recordHeader = append(recordHeader, sqliteVarintBytes(uint64(12+len(c)*2))...)
+				body = append(body, c...)
+			}
+		}
+		recordHeader[0] = byte(len(recordHeader))
+		payload := append(recordHeader, body...)
+
+		local, maxLocal := len(payload), pageSize-35
+		if local > maxLocal {
+			minLocal := (pageSize-12)*32/255 - 23
+			local = minLocal + (len(payload)-minLocal)%(pageSize-4)
+			if local > maxLocal {
+				local = minLocal
+			}
+		}
+		cell := append(append(sqliteVarintBytes(uint64(len(payload))), sqliteVarintBytes(rowid)...), payload[:local]...)
+		if local < len(payload) {
+			cell = append(cell, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(cell[len(cell)-4:], uint32(len(pages)+1))
+			for rest := payload[local:]; len(rest) > 0; {
+				overflow := make([]byte, pageSize)
+				n := copy(overflow[4:], rest)
+				if rest = rest[n:]; len(rest) > 0 {
+					binary.BigEndian.PutUint32(overflow, uint32(len(pages)+2))
+				}
+				pages = append(pages, overflow)
+			}
+		}
+		offset := pageSize - len(cell)
+		copy(page[offset:], cell)
+		binary.BigEndian.PutUint16(page[header+3:], 1)
+		binary.BigEndian.PutUint16(page[header+5:], uint16(offset))
+		binary.BigEndian.PutUint16(page[header+8:], uint16(offset))
+	}
+
+	// page 1 is the schema, page 2 is the root of Packages
+	schema := newPage(sqliteLeafTable, sqliteFileHeader)
+	copy(schema, sqliteMagic)
+	binary.BigEndian.PutUint16(schema[16:], uint16(pageSize))
+	// file format versions, payload fractions, schema format and UTF-8
+	copy(schema[18:24], []byte{1, 1, 0, 64, 32, 32})
+	schema[47], schema[59] = 4, 1
+	root := newPage(sqliteInteriorTable, 0)
+	pages = append(pages, schema, root)
+	putRow(schema, sqliteFileHeader, 1, "table", "Packages", "Packages", 2, "CREATE TABLE 'Packages' (hnum INTEGER PRIMARY KEY AUTOINCREMENT,blob BLOB NOT NULL)")
+
+	for i, header := range headers {
+		leaf := newPage(sqliteLeafTable, 0)
+		pgno := uint32(len(pages) + 1)
+		pages = append(pages, leaf)
+		putRow(leaf, 0, uint64(i+1), nil, header)
+		if i == len(headers)-1 {
+			binary.BigEndian.PutUint32(root[8:], pgno)
+			continue
+		}
+		// interior cells are the left child and rowid
+		offset := pageSize - (i+1)*5
+		binary.BigEndian.PutUint32(root[offset:], pgno)
+		root[offset+4] = byte(i + 1)
+		binary.BigEndian.PutUint16(root[12+i*2:], uint16(offset))
+		binary.BigEndian.PutUint16(root[3:], uint16(i+1))
+		binary.BigEndian.PutUint16(root[5:], uint16(offset))
+	}
+	binary.BigEndian.PutUint32(schema[28:], uint32(len(pages)))
+	return bytes.Join(pages, nil)
+}
+
+func TestParseRpmSqlite(t *testing.T) {
+	db := sqlitePackages(512,
+		rpmHeader("bash", "5.1.8", "6.el9", "x86_64", 0),
+		// header over overflow pages
+		rpmHeader("openssl-libs", "3.0.7", "24.el9"+strings.Repeat("x", 1200), "x86_64", 1),
+		rpmHeader("glibc", "2.34", "100.el9", "x86_64", 0),
+	)
+	packages, err := parseRpmSqlite(db, "/var/lib/rpm/rpmdb.sqlite")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(packages) != 3 || packages[0].Name != "bash" || packages[0].Version != "5.1.8-6.el9" ||
+		packages[1].Name != "openssl-libs" || packages[1].Epoch != 1 || packages[1].Version != "3.0.7-24.el9"+strings.Repeat("x", 1200) ||
+		packages[2].Name != "glibc" || packages[2].Location != "/var/lib/rpm/rpmdb.sqlite" {
+		t.Errorf("unexpected packages: %v", packages)
+	}
+	if _, err := parseRpmSqlite(bdbPackages(512, rpmHeader("bash", "5.1.8", "6.el9", "x86_64", 0)), "/var/lib/rpm/rpmdb.sqlite"); err == nil {
+		t.Error("database which is not SQLite should be error")
+	}
+}
+
+func TestParseGoBinary(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("test binary is not ELF")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	packages := parseGoBinary(f, "/app")
+	if len(packages) == 0 || packages[0].Name != "stdlib" || packages[0].Version != runtime.Version() {
+		t.Errorf("Go version should be found: %v", packages)
+	}
+	if packages := parseGoBinary(strings.NewReader("#!/bin/sh\n"), "/app"); len(packages) != 0 {
+		t.Errorf("script is not Go binary: %v", packages)
+	}
+
+	// binaries in layers are read through temporary file, the truncated one has no section headers
+	data, err := ioutil.ReadFile(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := newFakeRegistry()
+	defer registry.Close()
+	app := registry.pushLayers("library/app", "1", gzipLayer(
+		layerFile{name: "usr/local/bin/app", mode: 0755, data: data},
+		layerFile{name: "usr/local/bin/truncated", mode: 0755, data: data[:len(data)/2]},
+	))
+	image, err := registry.Client().ScanPackages(registry.Host(), "library/app", app.Digest)
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	locations := map[string]bool{}
+	for _, p := range image.Packages {
+		locations[p.Location] = true
+	}
+	if !locations["/usr/local/bin/app"] || locations["/usr/local/bin/truncated"] {
+		t.Errorf("unexpected packages: %v", image.Packages)
+	}
+}
+
+func TestAttachSBOMs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	registry := newFakeRegistry()
+	defer registry.Close()
+	index := ImageManifest{SchemaVersion: 2, MediaType: MediaTypeDockerManifestList}
+	for _, arch := range []string{"amd64", "arm64"} {
+		d := registry.pushLayers("library/nginx", "", gzipLayer(layerFile{name: "etc/os-release", data: []byte("ID=debian\n# " + arch)}))
+		d.Platform = &Platform{OS: "linux", Architecture: arch}
+		index.Manifests = append(index.Manifests, d)
+	}
+	body, _ := json.Marshal(index)
+	registry.putManifest("library/nginx", "1.17", MediaTypeDockerManifestList, body)
+	client := registry.Client()
+	target := registry.Host() + "/library/nginx:1.17"
+
+	// SBOM of each platform is attached as referrer
+	attached, err := AttachSBOMs(client, SBOMOptions{Format: SBOMFormatCycloneDX}, []string{target, target})
+	if err != nil {
+		t.Fatalf("failed to attach: %v", err)
+	}
+	if len(attached) != 2 {
+		t.Fatalf("SBOMs should be attached to platforms: %v", attached)
+	}
+	for i, platform := range index.Manifests {
+		referrers, err := client.Referrers(registry.Host(), "library/nginx", platform.Digest)
+		if err != nil || len(referrers) != 1 || referrers[0].ArtifactType != MediaTypeCycloneDX {
+			t.Fatalf("unexpected referrers: %v, %v", referrers, err)
+		}
+		if attached[i] != registry.Host()+"/library/nginx@"+referrers[0].Digest {
+			t.Errorf("unexpected attached: %s", attached[i])
+		}
+	}
+
+	// SBOMs are written into the directory
+	attached, err = AttachSBOMs(client, SBOMOptions{Format: SBOMFormatSPDX, Dir: dir}, []string{target})
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	name := strings.NewReplacer("/", "_", ":", "-").Replace(registry.Host() + "/library/nginx@" + index.Manifests[0].Digest)
+	if len(attached) != 2 || attached[0] != filepath.Join(dir, name+".spdx.json") {
+		t.Errorf("unexpected files: %v", attached)
+	}
+	if _, err := os.Stat(attached[0]); err != nil {
+		t.Errorf("SBOM should be written: %v", err)
+	}
+}
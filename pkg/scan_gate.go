@@ -0,0 +1,328 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"strings"
+	"time"
+)
+
+// ScanConfig is settings of the gate by findings of ECR image scan
+type ScanConfig struct {
+	// findings of the vulnerabilities are ignored by the gate, e.g. "CVE-2023-44487"
+	Allowlist []string `yaml:"allowlist"`
+}
+
+// severities of findings from low to high
+var scanSeverities = []string{"UNDEFINED", "INFORMATIONAL", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// -1 when the severity is unknown
+func severityRank(severity string) int {
+	for i, s := range scanSeverities {
+		if strings.EqualFold(s, severity) {
+			return i
+		}
+	}
+	return -1
+}
+
+// FailedScanGate is in result message of images whose findings fail the gate
+const FailedScanGate = "failed scan gate"
+
+// ScanFinding is a vulnerability found by ECR image scan
+type ScanFinding struct {
+	// e.g. "CVE-2023-44487"
+	ID       string
+	Severity string
+	// e.g. "nghttp2 1.52.0-1"
+	Package string
+	// the ID is in allowlist
+	Allowed bool
+}
+
+// ScanReport is findings of an image in ECR, findings of all platforms are included
+type ScanReport struct {
+	Image    string
+	Findings []ScanFinding
+	// findings which fail the gate
+	Failures []ScanFinding
+}
+
+// Summary returns counts of findings by severity, e.g. "CRITICAL 1, HIGH 3 (1 allowlisted)"
+func (r *ScanReport) Summary() string {
+	if len(r.Findings) == 0 {
+		return "no findings"
+	}
+	var counts []string
+	for i := len(scanSeverities) - 1; i >= 0; i-- {
+		total, allowed := 0, 0
+		for _, f := range r.Findings {
+			if strings.EqualFold(f.Severity, scanSeverities[i]) {
+				total++
+				if f.Allowed {
+					allowed++
+				}
+			}
+		}
+		switch {
+		case allowed != 0:
+			counts = append(counts, fmt.Sprintf("%s %d (%d allowlisted)", scanSeverities[i], total, allowed))
+		case total != 0:
+			counts = append(counts, fmt.Sprintf("%s %d", scanSeverities[i], total))
+		}
+	}
+	return strings.Join(counts, ", ")
+}
+
+// ScanGateError means findings of the image fail the gate, it should not be retried
+type ScanGateError struct {
+	Report *ScanReport
+	FailOn string
+}
+
+func (e *ScanGateError) Error() string {
+	var ids []string
+	for i, f := range e.Report.Failures {
+		if i == 10 {
+			ids = append(ids, fmt.Sprintf("and %d more", len(e.Report.Failures)-i))
+			break
+		}
+		ids = append(ids, fmt.Sprintf("%s (%s, %s)", f.ID, f.Severity, f.Package))
+	}
+	return fmt.Sprintf("%s has findings of %s or higher: %s", e.Report.Image, e.FailOn, strings.Join(ids, ", "))
+}
+
+// scanNotFoundError is returned when the image is not in ECR, e.g. it is not transferred yet
+type scanNotFoundError struct {
+	image string
+}
+
+func (e *scanNotFoundError) Error() string {
+	return fmt.Sprintf("%s is not found in ECR", e.image)
+}
+
+// IsScanNotFound returns true when the image or its repository is not in ECR, so it has no scan
+func IsScanNotFound(err error) bool {
+	_, ok := err.(*scanNotFoundError)
+	return ok
+}
+
+// IsScanGateError returns true when findings of the image fail the gate
+func IsScanGateError(err error) bool {
+	_, ok := err.(*ScanGateError)
+	return ok
+}
+
+// ScanGate waits for findings of ECR image scan of pushed images, and fails images which have findings of FailOn or higher
+type ScanGate struct {
+	ECR       ecriface.ECRAPI
+	AccountId string
+	// severity, e.g. "HIGH". findings are only reported when it is empty
+	FailOn    string
+	Allowlist map[string]bool
+	// polling of findings while scan is in progress
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// NewScanGate make gate of the severity, allowlist of config is applied
+func NewScanGate(svc ecriface.ECRAPI, accountId, failOn string, config ScanConfig) (*ScanGate, error) {
+	if failOn != "" && severityRank(failOn) < 0 {
+		return nil, fmt.Errorf("severity should be one of %s: %q", strings.Join(scanSeverities, ", "), failOn)
+	}
+	g := &ScanGate{
+		ECR: svc, AccountId: accountId, FailOn: strings.ToUpper(failOn), Allowlist: map[string]bool{},
+		Interval: 5 * time.Second, Timeout: 10 * time.Minute,
+	}
+	for _, id := range config.Allowlist {
+		g.Allowlist[id] = true
+	}
+	return g, nil
+}
+
+// Wait for scan of the image in ECR is completed, and returns its findings.
+// returned error is ScanGateError when the findings fail the gate
+func (g *ScanGate) Wait(image string) (*ScanReport, error) {
+	return g.report(image, true)
+}
+
+// WaitTargets waits for findings of pushed images, tags in the same repository are checked once.
+// returned error is ScanGateError of the first image which fails the gate, reports of all images are returned with it
+func (g *ScanGate) WaitTargets(targets []string) ([]*ScanReport, error) {
+	var reports []*ScanReport
+	var gateErr error
+	seen := map[string]bool{}
+	for _, target := range targets {
+		ref, err := ParseImageReference(target)
+		if err != nil {
+			return nil, err
+		}
+		if seen[ref.Name] {
+			continue
+		}
+		seen[ref.Name] = true
+		report, err := g.Wait(target)
+		if err != nil && !IsScanGateError(err) {
+			return nil, err
+		}
+		if err != nil && gateErr == nil {
+			gateErr = err
+		}
+		reports = append(reports, report)
+	}
+	return reports, gateErr
+}
+
+// Check returns findings of the completed scan without waiting, e.g. before manifests point the image.
+// the error satisfies IsScanNotFound when the image is not transferred
+func (g *ScanGate) Check(image string) (*ScanReport, error) {
+	return g.report(image, false)
+}
+
+// findings of each platform are collected, scan of index doesn't exist
+func (g *ScanGate) report(image string, wait bool) (*ScanReport, error) {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	id := &ecr.ImageIdentifier{}
+	if ref.Digest != "" {
+		id.ImageDigest = aws.String(ref.Digest)
+	} else {
+		id.ImageTag = aws.String(manifestReference(ref))
+	}
+	out, err := g.ECR.BatchGetImage(&ecr.BatchGetImageInput{
+		RegistryId:         aws.String(g.AccountId),
+		RepositoryName:     aws.String(ref.Repository),
+		ImageIds:           []*ecr.ImageIdentifier{id},
+		AcceptedMediaTypes: aws.StringSlice(manifestMediaTypes),
+	})
+	if isAWSErrorCode(err, ecr.ErrCodeRepositoryNotFoundException) {
+		return nil, &scanNotFoundError{image: image}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Images) == 0 {
+		return nil, &scanNotFoundError{image: image}
+	}
+	digests := []string{aws.StringValue(out.Images[0].ImageId.ImageDigest)}
+	if mediaType := aws.StringValue(out.Images[0].ImageManifestMediaType); IsIndex(mediaType) {
+		index, err := ParseImageManifest([]byte(aws.StringValue(out.Images[0].ImageManifest)), mediaType)
+		if err != nil {
+			return nil, err
+		}
+		digests = digests[:0]
+		for _, d := range index.Manifests {
+			digests = append(digests, d.Digest)
+		}
+	}
+
+	report := &ScanReport{Image: image}
+	seen := map[string]bool{}
+	for _, digest := range digests {
+		findings, err := g.findings(ref.Repository, digest, wait)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get scan findings of %s: %v", image, err)
+		}
+		for _, f := range findings {
+			// the same vulnerability is found in each platform
+			key := f.ID + " " + f.Package
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			f.Allowed = g.Allowlist[f.ID]
+			report.Findings = append(report.Findings, f)
+			if g.FailOn != "" && !f.Allowed && severityRank(f.Severity) >= severityRank(g.FailOn) {
+				report.Failures = append(report.Failures, f)
+			}
+		}
+	}
+	if len(report.Failures) != 0 {
+		return report, &ScanGateError{Report: report, FailOn: g.FailOn}
+	}
+	return report, nil
+}
+
+// findings of basic scan and enhanced scan by Amazon Inspector
+func (g *ScanGate) findings(repository, digest string, wait bool) ([]ScanFinding, error) {
+	deadline := time.Now().Add(g.Timeout)
+	input := &ecr.DescribeImageScanFindingsInput{
+		RegistryId:     aws.String(g.AccountId),
+		RepositoryName: aws.String(repository),
+		ImageId:        &ecr.ImageIdentifier{ImageDigest: aws.String(digest)},
+	}
+	var findings []ScanFinding
+	for {
+		out, err := g.ECR.DescribeImageScanFindings(input)
+		status, description := "", ""
+		if err == nil && out.ImageScanStatus != nil {
+			status, description = aws.StringValue(out.ImageScanStatus.Status), aws.StringValue(out.ImageScanStatus.Description)
+		}
+		switch {
+		case isAWSErrorCode(err, ecr.ErrCodeScanNotFoundException) || status == ecr.ScanStatusInProgress || status == ecr.ScanStatusPending:
+			// scan on push may not be started yet
+			if !wait {
+				return nil, fmt.Errorf("scan of %s is not completed", digest)
+			}
+			if time.Now().After(deadline) {
+				return nil, fmt.Errorf("scan of %s is not completed in %s, scanOnPush of the repository may be disabled", digest, g.Timeout)
+			}
+			time.Sleep(g.Interval)
+			continue
+		case err != nil:
+			return nil, err
+		case status != ecr.ScanStatusComplete && status != ecr.ScanStatusActive:
+			return nil, fmt.Errorf("scan of %s is %s: %s", digest, status, description)
+		}
+
+		if out.ImageScanFindings != nil {
+			for _, f := range out.ImageScanFindings.Findings {
+				var name, version string
+				for _, a := range f.Attributes {
+					switch aws.StringValue(a.Key) {
+					case "package_name":
+						name = aws.StringValue(a.Value)
+					case "package_version":
+						version = aws.StringValue(a.Value)
+					}
+				}
+				findings = append(findings, ScanFinding{ID: aws.StringValue(f.Name), Severity: aws.StringValue(f.Severity), Package: strings.TrimSpace(name + " " + version)})
+			}
+			for _, f := range out.ImageScanFindings.EnhancedFindings {
+				finding := ScanFinding{ID: aws.StringValue(f.Title), Severity: aws.StringValue(f.Severity)}
+				if details := f.PackageVulnerabilityDetails; details != nil {
+					finding.ID = aws.StringValue(details.VulnerabilityId)
+					var packages []string
+					for _, p := range details.VulnerablePackages {
+						packages = append(packages, strings.TrimSpace(aws.StringValue(p.Name)+" "+aws.StringValue(p.Version)))
+					}
+					finding.Package = strings.Join(packages, ", ")
+				}
+				findings = append(findings, finding)
+			}
+		}
+		if out.NextToken == nil {
+			return findings, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
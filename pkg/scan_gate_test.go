@@ -0,0 +1,183 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"strings"
+	"testing"
+)
+
+// fakeScanECR returns scan results of each digest in order, the last result is repeated
+type fakeScanECR struct {
+	*fakeECR
+	scans map[string][]*ecr.DescribeImageScanFindingsOutput
+}
+
+func (f *fakeScanECR) DescribeImageScanFindings(input *ecr.DescribeImageScanFindingsInput) (*ecr.DescribeImageScanFindingsOutput, error) {
+	key := aws.StringValue(input.ImageId.ImageDigest) + aws.StringValue(input.NextToken)
+	scans := f.scans[key]
+	if len(scans) == 0 {
+		return nil, awserr.New(ecr.ErrCodeScanNotFoundException, "scan not found", nil)
+	}
+	if len(scans) > 1 {
+		f.scans[key] = scans[1:]
+	}
+	return scans[0], nil
+}
+
+func scanResult(status string, findings ...*ecr.ImageScanFinding) *ecr.DescribeImageScanFindingsOutput {
+	return &ecr.DescribeImageScanFindingsOutput{
+		ImageScanStatus:   &ecr.ImageScanStatus{Status: aws.String(status)},
+		ImageScanFindings: &ecr.ImageScanFindings{Findings: findings},
+	}
+}
+
+func basicFinding(id, severity, name string) *ecr.ImageScanFinding {
+	return &ecr.ImageScanFinding{Name: aws.String(id), Severity: aws.String(severity), Attributes: []*ecr.Attribute{
+		{Key: aws.String("package_version"), Value: aws.String("1.0")},
+		{Key: aws.String("package_name"), Value: aws.String(name)},
+	}}
+}
+
+func TestScanGateWait(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`)
+	digest := Digest(manifest)
+	svc := &fakeScanECR{fakeECR: newFakeECR(), scans: map[string][]*ecr.DescribeImageScanFindingsOutput{}}
+	svc.repositories["nginx"] = &fakeECRRepository{images: map[string]fakeManifest{
+		"1.17":          {MediaTypeOCIManifest, manifest},
+		"1.17-mirrored": {MediaTypeOCIManifest, manifest},
+	}}
+	svc.scans[digest] = []*ecr.DescribeImageScanFindingsOutput{
+		scanResult(ecr.ScanStatusInProgress),
+		scanResult(ecr.ScanStatusComplete,
+			basicFinding("CVE-2023-0001", "HIGH", "openssl"),
+			basicFinding("CVE-2023-0002", "CRITICAL", "zlib"),
+			basicFinding("CVE-2023-0003", "LOW", "bash"),
+		),
+	}
+
+	gate, err := NewScanGate(svc, "111222333444", "high", ScanConfig{Allowlist: []string{"CVE-2023-0002"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate.Interval = 0
+
+	image := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/nginx:1.17"
+	if _, err := gate.Check(image); err == nil || IsScanGateError(err) {
+		t.Errorf("scan in progress should be error without waiting, got: %v", err)
+	}
+
+	reports, err := gate.WaitTargets([]string{image, image + "-mirrored"})
+	if !IsScanGateError(err) {
+		t.Fatalf("findings of HIGH should fail the gate, got: %v", err)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("tags in the same repository should be checked once, got: %d reports", len(reports))
+	}
+	failures := reports[0].Failures
+	if len(failures) != 1 || failures[0].ID != "CVE-2023-0001" || failures[0].Package != "openssl 1.0" {
+		t.Errorf("unexpected failures: %+v", failures)
+	}
+	if expected := "CRITICAL 1 (1 allowlisted), HIGH 1, LOW 1"; reports[0].Summary() != expected {
+		t.Errorf("expected: %s, got: %s", expected, reports[0].Summary())
+	}
+	if !strings.Contains(err.Error(), "CVE-2023-0001 (HIGH, openssl 1.0)") {
+		t.Errorf("error should have the failed finding, got: %v", err)
+	}
+
+	// the completed scan is reported without waiting
+	gate.FailOn = "CRITICAL"
+	if report, err := gate.Check(image); err != nil || len(report.Findings) != 3 {
+		t.Errorf("allowlisted CRITICAL should pass the gate, got: %+v, %v", report, err)
+	}
+
+	if _, err := NewScanGate(svc, "111222333444", "SEVERE", ScanConfig{}); err == nil {
+		t.Errorf("unknown severity should be error")
+	}
+}
+
+func TestScanGateCheckNotFound(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`)
+	svc := &fakeScanECR{fakeECR: newFakeECR(), scans: map[string][]*ecr.DescribeImageScanFindingsOutput{}}
+	svc.repositories["nginx"] = &fakeECRRepository{images: map[string]fakeManifest{"1.17": {MediaTypeOCIManifest, manifest}}}
+	gate, err := NewScanGate(svc, "111222333444", "HIGH", ScanConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// images which are not transferred, e.g. replace --fail-on before transfer
+	ecrHost := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com"
+	for _, image := range []string{ecrHost + "/nginx:1.19", ecrHost + "/redis:7.2"} {
+		if _, err := gate.Check(image); !IsScanNotFound(err) {
+			t.Errorf("%s is not in ECR, got: %v", image, err)
+		}
+	}
+	// the image without completed scan is not passed
+	if _, err := gate.Check(ecrHost + "/nginx:1.17"); err == nil || IsScanNotFound(err) || IsScanGateError(err) {
+		t.Errorf("image without scan should be error, got: %v", err)
+	}
+}
+
+func TestScanGateIndex(t *testing.T) {
+	amd64 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[],"annotations":{"arch":"amd64"}}`)
+	arm64 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[],"annotations":{"arch":"arm64"}}`)
+	index := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"%s","digest":"%s","size":%d},{"mediaType":"%s","digest":"%s","size":%d}]}`,
+		MediaTypeOCIManifest, Digest(amd64), len(amd64), MediaTypeOCIManifest, Digest(arm64), len(arm64)))
+	svc := &fakeScanECR{fakeECR: newFakeECR(), scans: map[string][]*ecr.DescribeImageScanFindingsOutput{}}
+	svc.repositories["redis"] = &fakeECRRepository{images: map[string]fakeManifest{"6": {MediaTypeOCIIndex, index}}}
+
+	// findings of enhanced scan are paginated
+	page := scanResult(ecr.ScanStatusActive)
+	page.ImageScanFindings.EnhancedFindings = []*ecr.EnhancedImageScanFinding{{
+		Severity: aws.String("HIGH"),
+		PackageVulnerabilityDetails: &ecr.PackageVulnerabilityDetails{
+			VulnerabilityId:    aws.String("CVE-2023-0004"),
+			VulnerablePackages: []*ecr.VulnerablePackage{{Name: aws.String("libc6"), Version: aws.String("2.31")}},
+		},
+	}}
+	page.NextToken = aws.String("next")
+	svc.scans[Digest(amd64)] = []*ecr.DescribeImageScanFindingsOutput{page}
+	svc.scans[Digest(amd64)+"next"] = []*ecr.DescribeImageScanFindingsOutput{scanResult(ecr.ScanStatusActive, basicFinding("CVE-2023-0005", "MEDIUM", "curl"))}
+	// the same vulnerability of each platform is reported once
+	svc.scans[Digest(arm64)] = []*ecr.DescribeImageScanFindingsOutput{scanResult(ecr.ScanStatusComplete, basicFinding("CVE-2023-0005", "MEDIUM", "curl"))}
+
+	gate, err := NewScanGate(svc, "111222333444", "CRITICAL", ScanConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate.Interval = 0
+	report, err := gate.Wait("111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/redis:6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "HIGH 1, MEDIUM 1"; report.Summary() != expected {
+		t.Errorf("expected: %s, got: %s", expected, report.Summary())
+	}
+	if report.Findings[0].ID != "CVE-2023-0004" || report.Findings[0].Package != "libc6 2.31" {
+		t.Errorf("unexpected enhanced finding: %+v", report.Findings[0])
+	}
+
+	// scan on push is disabled
+	svc.scans[Digest(arm64)] = nil
+	gate.Timeout = 0
+	if _, err := gate.Wait("111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/redis:6"); err == nil || !strings.Contains(err.Error(), "scanOnPush") {
+		t.Errorf("scan which is not started should be timed out, got: %v", err)
+	}
+}
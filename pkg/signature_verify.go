@@ -0,0 +1,431 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// annotations of cosign signature layer
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+)
+
+// OIDC issuer in Fulcio certificate, the first is deprecated raw string and the second is DER UTF8String
+var (
+	fulcioIssuerOID   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	fulcioIssuerV2OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// SignaturePolicy is keys and identities which cosign signatures of images in the registry should be signed by
+type SignaturePolicy struct {
+	// registry host, glob pattern can be used, e.g. "ghcr.io", "*.gcr.io"
+	Registry string `yaml:"registry"`
+	// PEM files of public keys, e.g. "cosign.pub"
+	Keys []string `yaml:"keys"`
+	// identities of keyless signatures, certificates are verified by Roots
+	Keyless []KeylessIdentity `yaml:"keyless"`
+	// PEM file of Fulcio root and intermediate certificates
+	Roots string `yaml:"roots"`
+	// PEM file of Rekor public key, the transparency log entries of keyless signatures are verified by it
+	RekorKey string `yaml:"rekorKey"`
+}
+
+// KeylessIdentity is OIDC identity in the certificate of keyless signature
+type KeylessIdentity struct {
+	// e.g. "https://token.actions.githubusercontent.com"
+	Issuer string `yaml:"issuer"`
+	// email or URI in the certificate, e.g. "https://github.com/kyverno/kyverno/.github/workflows/release.yaml@refs/tags/v1.11.0"
+	Subject string `yaml:"subject"`
+	// regular expression of subject, it is used instead of Subject
+	SubjectRegexp string `yaml:"subjectRegexp"`
+}
+
+// SignatureError means the image is rejected by signature policy, it should not be retried
+type SignatureError struct {
+	Image  string
+	Reason string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("signature of %s is not verified: %s", e.Image, e.Reason)
+}
+
+// IsSignatureError returns true when the image is rejected by signature policy
+func IsSignatureError(err error) bool {
+	_, ok := err.(*SignatureError)
+	return ok
+}
+
+// SignatureVerifier verifies cosign signatures of images by policies of their registries
+type SignatureVerifier struct {
+	Client   *RegistryClient
+	policies []signaturePolicy
+}
+
+// keys and certificates are loaded
+type signaturePolicy struct {
+	registry string
+	keys     []crypto.PublicKey
+	keyless  []keylessIdentity
+	roots    *x509.CertPool
+	rekor    crypto.PublicKey
+}
+
+type keylessIdentity struct {
+	issuer  string
+	subject *regexp.Regexp
+}
+
+// NewSignatureVerifier load keys and root certificates of policies
+func NewSignatureVerifier(policies []SignaturePolicy, client *RegistryClient) (*SignatureVerifier, error) {
+	v := &SignatureVerifier{Client: client}
+	for _, p := range policies {
+		if _, err := path.Match(p.Registry, ""); err != nil || p.Registry == "" {
+			return nil, fmt.Errorf("registry of signature policy is wrong: %q", p.Registry)
+		}
+		if len(p.Keys) == 0 && len(p.Keyless) == 0 {
+			return nil, fmt.Errorf("signature policy of %s should have keys or keyless identities", p.Registry)
+		}
+		loaded := signaturePolicy{registry: p.Registry}
+		for _, file := range p.Keys {
+			key, err := LoadPublicKey(file)
+			if err != nil {
+				return nil, err
+			}
+			loaded.keys = append(loaded.keys, key)
+		}
+		if len(p.Keyless) != 0 {
+			if p.Roots == "" {
+				return nil, fmt.Errorf("signature policy of %s should have roots for keyless identities", p.Registry)
+			}
+			data, err := ioutil.ReadFile(p.Roots)
+			if err != nil {
+				return nil, err
+			}
+			loaded.roots = x509.NewCertPool()
+			if !loaded.roots.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("%s has no certificate", p.Roots)
+			}
+			// the time of the certificate check is trusted only when the log entry is signed by Rekor
+			if p.RekorKey == "" {
+				return nil, fmt.Errorf("signature policy of %s should have rekorKey for keyless identities", p.Registry)
+			}
+			if loaded.rekor, err = LoadPublicKey(p.RekorKey); err != nil {
+				return nil, err
+			}
+		}
+		for _, identity := range p.Keyless {
+			pattern := "^" + regexp.QuoteMeta(identity.Subject) + "$"
+			if identity.SubjectRegexp != "" {
+				pattern = identity.SubjectRegexp
+			}
+			subject, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("subject of keyless identity is wrong: %v", err)
+			}
+			if identity.Issuer == "" {
+				return nil, fmt.Errorf("keyless identity of %s should have issuer", p.Registry)
+			}
+			loaded.keyless = append(loaded.keyless, keylessIdentity{issuer: identity.Issuer, subject: subject})
+		}
+		v.policies = append(v.policies, loaded)
+	}
+	return v, nil
+}
+
+// LoadPublicKey read PEM file of ECDSA, RSA or Ed25519 public key
+func LoadPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %v", file, err)
+	}
+	return key, nil
+}
+
+// the first policy matching the registry is used
+func (v *SignatureVerifier) policy(registry string) *signaturePolicy {
+	for i, p := range v.policies {
+		if ok, _ := path.Match(p.registry, registry); ok {
+			return &v.policies[i]
+		}
+	}
+	return nil
+}
+
+// Verify the image digest has a cosign signature trusted by the policy of its registry,
+// images of registries without policy are not verified. rejected image returns SignatureError.
+// keyless certificates are checked at the time of the transparency log entry signed by Rekor
+func (v *SignatureVerifier) Verify(image, digest string) error {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return err
+	}
+	p := v.policy(ref.Registry)
+	if p == nil {
+		return nil
+	}
+	if digest == "" {
+		return &SignatureError{Image: image, Reason: "digest is unknown"}
+	}
+	m, err := v.Client.GetManifest(ref.Registry, ref.Repository, CosignTag(digest, ".sig"))
+	if IsNotFound(err) {
+		return &SignatureError{Image: image, Reason: "no signature"}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get signature: %v", err)
+	}
+	manifest, err := ParseImageManifest(m.Body, m.MediaType)
+	if err != nil {
+		return err
+	}
+	var reasons []string
+	for _, layer := range manifest.Layers {
+		payload, err := v.Client.GetBlob(ref.Registry, ref.Repository, layer.Digest)
+		if err != nil {
+			return fmt.Errorf("failed to get signature payload: %v", err)
+		}
+		err = p.verify(layer, payload, digest)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	if len(reasons) == 0 {
+		return &SignatureError{Image: image, Reason: "no signature"}
+	}
+	return &SignatureError{Image: image, Reason: strings.Join(reasons, ", ")}
+}
+
+// simple signing payload of cosign
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+func (p *signaturePolicy) verify(layer Descriptor, payload []byte, digest string) error {
+	var s simpleSigning
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return fmt.Errorf("payload is broken: %v", err)
+	}
+	if s.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("payload is signed for %s", s.Critical.Image.DockerManifestDigest)
+	}
+	signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+	if err != nil || len(signature) == 0 {
+		return errors.New("signature annotation is broken")
+	}
+
+	if certPEM := layer.Annotations[cosignCertificateAnnotation]; certPEM != "" {
+		return p.verifyKeyless(layer, certPEM, payload, signature)
+	}
+	for _, key := range p.keys {
+		if verifySignature(key, payload, signature) == nil {
+			return nil
+		}
+	}
+	return errors.New("signature doesn't match keys")
+}
+
+func (p *signaturePolicy) verifyKeyless(layer Descriptor, certPEM string, payload, signature []byte) error {
+	if len(p.keyless) == 0 {
+		return errors.New("keyless signature is not allowed")
+	}
+	cert, err := parseCertificate([]byte(certPEM))
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM([]byte(layer.Annotations[cosignChainAnnotation]))
+
+	// certificate is valid for a few minutes, it is checked at the time recorded in transparency log
+	integratedTime, err := p.verifyBundle(layer.Annotations[cosignBundleAnnotation], payload, signature)
+	if err != nil {
+		return err
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: intermediates,
+		CurrentTime:   integratedTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate is not trusted: %v", err)
+	}
+	if err := verifySignature(cert.PublicKey, payload, signature); err != nil {
+		return err
+	}
+
+	issuer := certificateIssuer(cert)
+	subjects := append([]string(nil), cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		subjects = append(subjects, u.String())
+	}
+	for _, identity := range p.keyless {
+		if identity.issuer != issuer {
+			continue
+		}
+		for _, subject := range subjects {
+			if identity.subject.MatchString(subject) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("identity %s of %s is not allowed", strings.Join(subjects, ", "), issuer)
+}
+
+// bundle of the transparency log entry, keys of Payload are in the order of canonical JSON
+type rekorBundle struct {
+	SignedEntryTimestamp []byte `json:"SignedEntryTimestamp"`
+	Payload              struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogID          string `json:"logID"`
+		LogIndex       int64  `json:"logIndex"`
+	} `json:"Payload"`
+}
+
+// hashedrekord entry in the body of the bundle
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content string `json:"content"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verifyBundle verify SignedEntryTimestamp by Rekor key and the entry is for the payload and the signature,
+// then the integrated time can be trusted
+func (p *signaturePolicy) verifyBundle(annotation string, payload, signature []byte) (time.Time, error) {
+	var bundle rekorBundle
+	if err := json.Unmarshal([]byte(annotation), &bundle); err != nil || bundle.Payload.IntegratedTime == 0 {
+		return time.Time{}, errors.New("keyless signature has no bundle")
+	}
+	var canonical bytes.Buffer
+	encoder := json.NewEncoder(&canonical)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(bundle.Payload); err != nil {
+		return time.Time{}, err
+	}
+	if err := verifySignature(p.rekor, bytes.TrimSuffix(canonical.Bytes(), []byte("\n")), bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("signed entry timestamp is not verified: %v", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, errors.New("transparency log entry is broken")
+	}
+	var entry hashedRekord
+	if err := json.Unmarshal(body, &entry); err != nil || entry.Kind != "hashedrekord" {
+		return time.Time{}, errors.New("transparency log entry is not hashedrekord")
+	}
+	hash := sha256.Sum256(payload)
+	content, _ := base64.StdEncoding.DecodeString(entry.Spec.Signature.Content)
+	if entry.Spec.Data.Hash.Value != hex.EncodeToString(hash[:]) || !bytes.Equal(content, signature) {
+		return time.Time{}, errors.New("transparency log entry is not for the signature")
+	}
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("certificate is not PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// OIDC issuer of Fulcio certificate
+func certificateIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(fulcioIssuerV2OID):
+			var issuer string
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err == nil {
+				return issuer
+			}
+		case ext.Id.Equal(fulcioIssuerOID):
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+// signature is made for SHA-256 of payload, Ed25519 signs payload itself
+func verifySignature(key crypto.PublicKey, payload, signature []byte) error {
+	hash := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		var sig struct {
+			R, S *big.Int
+		}
+		if _, err := asn1.Unmarshal(signature, &sig); err == nil && ecdsa.Verify(k, hash[:], sig.R, sig.S) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature) == nil {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(k, payload, signature) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported public key %T", key)
+	}
+	return errors.New("signature doesn't match")
+}
@@ -0,0 +1,274 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pushSignature put cosign signature of the digest, signed by the key
+func (r *fakeRegistry) pushSignature(repository, digest string, key *ecdsa.PrivateKey, annotations map[string]string) {
+	r.pushSignatureWith(repository, digest, key, func(payload, signature []byte) map[string]string {
+		return annotations
+	})
+}
+
+// pushSignatureWith put cosign signature with annotations made from the payload and its signature
+func (r *fakeRegistry) pushSignatureWith(repository, digest string, key *ecdsa.PrivateKey, annotate func(payload, signature []byte) map[string]string) {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"%s"},"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, repository, digest))
+	signature := signECDSA(key, payload)
+	layer := r.putBlob(payload)
+	layer.MediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	layer.Annotations = map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)}
+	for k, v := range annotate(payload, signature) {
+		layer.Annotations[k] = v
+	}
+	config := r.putBlob([]byte("{}"))
+	config.MediaType = "application/vnd.oci.image.config.v1+json"
+	body, _ := json.Marshal(ImageManifest{SchemaVersion: 2, MediaType: MediaTypeOCIManifest, Config: &config, Layers: []Descriptor{layer}})
+	r.putManifest(repository, CosignTag(digest, ".sig"), MediaTypeOCIManifest, body)
+}
+
+// ASN.1 ECDSA signature of SHA-256 of the data
+func signECDSA(key *ecdsa.PrivateKey, data []byte) []byte {
+	hash := sha256.Sum256(data)
+	r, s, _ := ecdsa.Sign(rand.Reader, key, hash[:])
+	signature, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	return signature
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) string {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestSignatureVerifierKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	registry := newFakeRegistry()
+	defer registry.Close()
+	signed := registry.pushImage("library/nginx", "1.17", Platform{OS: "linux", Architecture: "amd64"})
+	unsigned := registry.pushImage("library/nginx", "1.18", Platform{OS: "linux", Architecture: "amd64"})
+	tampered := registry.pushImage("library/nginx", "1.19", Platform{OS: "linux", Architecture: "amd64"})
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	keyFile := writePEM(t, filepath.Join(dir, "cosign.pub"), "PUBLIC KEY", der)
+	registry.pushSignature("library/nginx", signed.Digest, key, nil)
+	registry.pushSignature("library/nginx", tampered.Digest, other, nil)
+
+	v, err := NewSignatureVerifier([]SignaturePolicy{{Registry: "127.0.0.1:*", Keys: []string{keyFile}}}, registry.Client())
+	if err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+	image := registry.Host() + "/library/nginx:1.17"
+	if err := v.Verify(image, signed.Digest); err != nil {
+		t.Errorf("signature should be verified: %v", err)
+	}
+	for _, tc := range []struct {
+		digest string
+		reason string
+	}{
+		{unsigned.Digest, "no signature"},
+		{tampered.Digest, "signature doesn't match keys"},
+		// signature of the other digest
+		{"sha256:" + strings.Repeat("0", 64), "no signature"},
+	} {
+		err := v.Verify(image, tc.digest)
+		if !IsSignatureError(err) || !strings.Contains(err.Error(), tc.reason) {
+			t.Errorf("%s should be rejected by %q: %v", tc.digest, tc.reason, err)
+		}
+	}
+
+	// rejected image is not pushed
+	client := registry.Client()
+	mapper := &ImageMapper{Destination: NewRegistryDestination(registry.Host()+"/mirror", client)}
+	mapper.Transfer.Verifier = v
+	if _, err := NativeTransfer(client, mapper)(registry.Host() + "/library/nginx:1.18"); !IsSignatureError(err) {
+		t.Errorf("unsigned image should be rejected: %v", err)
+	}
+	if _, ok := registry.manifests["mirror/"+registry.Host()+"/library/nginx"]; ok {
+		t.Error("rejected image should not be pushed")
+	}
+	if _, err := NativeTransfer(client, mapper)(image); err != nil {
+		t.Errorf("signed image should be transferred: %v", err)
+	}
+
+	// images of registries without policy are not verified
+	if err := v.Verify("nginx:1.17", unsigned.Digest); err != nil {
+		t.Errorf("image without policy should not be verified: %v", err)
+	}
+
+	// wrong policies
+	for _, policy := range []SignaturePolicy{
+		{Registry: "docker.io"},
+		{Registry: "[", Keys: []string{keyFile}},
+		{Registry: "docker.io", Keys: []string{filepath.Join(dir, "missing.pub")}},
+		{Registry: "docker.io", Keyless: []KeylessIdentity{{Issuer: "https://accounts.google.com", Subject: "a@example.com"}}},
+	} {
+		if _, err := NewSignatureVerifier([]SignaturePolicy{policy}, registry.Client()); err == nil {
+			t.Errorf("policy should be error: %v", policy)
+		}
+	}
+}
+
+func TestSignatureVerifierKeyless(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	registry := newFakeRegistry()
+	defer registry.Close()
+
+	// fulcio issues short-lived certificate with OIDC identity
+	signedAt := time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fake fulcio"},
+		NotBefore: signedAt.Add(-time.Hour), NotAfter: signedAt.Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	ca, _ = x509.ParseCertificate(caDER)
+	roots := writePEM(t, filepath.Join(dir, "fulcio.pem"), "CERTIFICATE", caDER)
+
+	// rekor signs the log entry of the signature with its integrated time
+	rekor, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rekorDER, _ := x509.MarshalPKIXPublicKey(&rekor.PublicKey)
+	rekorKey := writePEM(t, filepath.Join(dir, "rekor.pub"), "PUBLIC KEY", rekorDER)
+	bundle := func(logKey *ecdsa.PrivateKey, payload, signature []byte) string {
+		hash := sha256.Sum256(payload)
+		body := fmt.Sprintf(`{"apiVersion":"0.0.1","kind":"hashedrekord","spec":{"data":{"hash":{"algorithm":"sha256","value":"%s"}},"signature":{"content":"%s"}}}`,
+			hex.EncodeToString(hash[:]), base64.StdEncoding.EncodeToString(signature))
+		entry := fmt.Sprintf(`{"body":"%s","integratedTime":%d,"logID":"c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d","logIndex":1}`,
+			base64.StdEncoding.EncodeToString([]byte(body)), signedAt.Unix())
+		return fmt.Sprintf(`{"SignedEntryTimestamp":"%s","Payload":%s}`, base64.StdEncoding.EncodeToString(signECDSA(logKey, []byte(entry))), entry)
+	}
+
+	sign := func(subject, issuer string) (*ecdsa.PrivateKey, map[string]string) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		issuerValue, _ := asn1.Marshal(issuer)
+		u, _ := url.Parse(subject)
+		leaf := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			NotBefore:    signedAt.Add(-time.Minute), NotAfter: signedAt.Add(10 * time.Minute),
+			KeyUsage:        x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+			URIs:            []*url.URL{u},
+			ExtraExtensions: []pkix.Extension{{Id: fulcioIssuerV2OID, Value: issuerValue}},
+		}
+		der, _ := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+		return key, map[string]string{
+			cosignCertificateAnnotation: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		}
+	}
+	// push keyless signature with the bundle made by logKey
+	push := func(digest string, key *ecdsa.PrivateKey, annotations map[string]string, logKey *ecdsa.PrivateKey) {
+		registry.pushSignatureWith("kyverno/kyverno", digest, key, func(payload, signature []byte) map[string]string {
+			if logKey != nil {
+				annotations[cosignBundleAnnotation] = bundle(logKey, payload, signature)
+			}
+			return annotations
+		})
+	}
+	github := "https://token.actions.githubusercontent.com"
+	workflow := "https://github.com/kyverno/kyverno/.github/workflows/release.yaml@refs/tags/v1.11.0"
+
+	trusted := registry.pushImage("kyverno/kyverno", "v1.11.0", Platform{OS: "linux", Architecture: "amd64"})
+	key, annotations := sign(workflow, github)
+	push(trusted.Digest, key, annotations, rekor)
+
+	fork := registry.pushImage("kyverno/kyverno", "fork", Platform{OS: "linux", Architecture: "amd64"})
+	key, annotations = sign("https://github.com/attacker/kyverno/.github/workflows/release.yaml@refs/heads/main", github)
+	push(fork.Digest, key, annotations, rekor)
+
+	noBundle := registry.pushImage("kyverno/kyverno", "nobundle", Platform{OS: "linux", Architecture: "amd64"})
+	key, annotations = sign(workflow, github)
+	push(noBundle.Digest, key, annotations, nil)
+
+	// bundle is signed by other key than rekor
+	forged := registry.pushImage("kyverno/kyverno", "forged", Platform{OS: "linux", Architecture: "amd64"})
+	key, annotations = sign(workflow, github)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	push(forged.Digest, key, annotations, other)
+
+	// bundle of the trusted signature is reused for another signature
+	replayed := registry.pushImage("kyverno/kyverno", "replayed", Platform{OS: "linux", Architecture: "amd64"})
+	key, annotations = sign(workflow, github)
+	registry.pushSignatureWith("kyverno/kyverno", replayed.Digest, key, func(payload, signature []byte) map[string]string {
+		annotations[cosignBundleAnnotation] = bundle(rekor, []byte("other payload"), signature)
+		return annotations
+	})
+
+	policy := SignaturePolicy{
+		Registry: "127.0.0.1:*",
+		Keyless:  []KeylessIdentity{{Issuer: github, SubjectRegexp: `^https://github\.com/kyverno/kyverno/\.github/workflows/release\.yaml@refs/tags/v`}},
+		Roots:    roots,
+	}
+	// keyless signature is refused unless the log entry can be verified
+	if _, err := NewSignatureVerifier([]SignaturePolicy{policy}, registry.Client()); err == nil {
+		t.Error("keyless policy without rekor key should be error")
+	}
+	policy.RekorKey = rekorKey
+	v, err := NewSignatureVerifier([]SignaturePolicy{policy}, registry.Client())
+	if err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+	image := registry.Host() + "/kyverno/kyverno:v1.11.0"
+	if err := v.Verify(image, trusted.Digest); err != nil {
+		t.Errorf("keyless signature should be verified: %v", err)
+	}
+	for digest, reason := range map[string]string{
+		fork.Digest:     "is not allowed",
+		noBundle.Digest: "no bundle",
+		forged.Digest:   "signed entry timestamp is not verified",
+		replayed.Digest: "is not for the signature",
+	} {
+		err := v.Verify(image, digest)
+		if !IsSignatureError(err) || !strings.Contains(err.Error(), reason) {
+			t.Errorf("%s should be rejected by %q: %v", digest, reason, err)
+		}
+	}
+}
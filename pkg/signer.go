@@ -0,0 +1,353 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Signer makes cosign signature of payload
+type Signer interface {
+	// Sign returns signature of the payload, it is verified by the public key
+	Sign(payload []byte) ([]byte, error)
+	PublicKey() (crypto.PublicKey, error)
+}
+
+// FileSigner signs by private key in the file
+type FileSigner struct {
+	key crypto.Signer
+}
+
+// LoadFileSigner read PEM private key, key made by "cosign generate-key-pair" is decrypted by the password
+func LoadFileSigner(file string, password []byte) (*FileSigner, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM", file)
+	}
+	der := block.Bytes
+	switch block.Type {
+	case "ENCRYPTED COSIGN PRIVATE KEY", "ENCRYPTED SIGSTORE PRIVATE KEY":
+		der, err = decryptCosignKey(block.Bytes, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %v", file, err)
+		}
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key %s: %v", file, err)
+		}
+		return &FileSigner{key: key}, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %v", file, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	return &FileSigner{key: signer}, nil
+}
+
+// encrypted key of cosign, PKCS8 is encrypted by nacl/secretbox with the key derived by scrypt
+type cosignEncryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func decryptCosignKey(data, password []byte) ([]byte, error) {
+	var encrypted cosignEncryptedKey
+	if err := json.Unmarshal(data, &encrypted); err != nil {
+		return nil, err
+	}
+	if encrypted.KDF.Name != "scrypt" || encrypted.Cipher.Name != "nacl/secretbox" || len(encrypted.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("unsupported encryption %s, %s", encrypted.KDF.Name, encrypted.Cipher.Name)
+	}
+	params := encrypted.KDF.Params
+	derived, err := scrypt.Key(password, encrypted.KDF.Salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], derived)
+	copy(nonce[:], encrypted.Cipher.Nonce)
+	der, ok := secretbox.Open(nil, encrypted.Ciphertext, &nonce, &key)
+	if !ok {
+		return nil, errors.New("password is wrong")
+	}
+	return der, nil
+}
+
+// Sign by SHA-256 of payload, Ed25519 signs payload itself
+func (s *FileSigner) Sign(payload []byte) ([]byte, error) {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return s.key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	hash := sha256.Sum256(payload)
+	return s.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+}
+
+func (s *FileSigner) PublicKey() (crypto.PublicKey, error) {
+	return s.key.Public(), nil
+}
+
+// KMSSigner signs by asymmetric key of AWS KMS, the private key doesn't leave KMS
+type KMSSigner struct {
+	// key ID, ARN or alias, e.g. "alias/cosign"
+	KeyId  string
+	Region string
+	KMS    kmsiface.KMSAPI
+
+	once      sync.Once
+	publicKey crypto.PublicKey
+	algorithm string
+	err       error
+}
+
+// NewKMSSigner make signer of the key in the region, the region of ARN is used when the key is given by ARN
+func NewKMSSigner(keyId, region string) *KMSSigner {
+	// e.g. "arn:aws:kms:us-east-1:111222333444:key/..."
+	if parts := strings.SplitN(keyId, ":", 5); len(parts) == 5 && parts[0] == "arn" && parts[3] != "" {
+		region = parts[3]
+	}
+	return &KMSSigner{KeyId: keyId, Region: region}
+}
+
+func (s *KMSSigner) service() kmsiface.KMSAPI {
+	if s.KMS == nil {
+		s.KMS = kms.New(session.Must(session.NewSession()), aws.NewConfig().WithRegion(s.Region))
+	}
+	return s.KMS
+}
+
+// public key and signing algorithm are read once
+func (s *KMSSigner) load() error {
+	s.once.Do(func() {
+		out, err := s.service().GetPublicKey(&kms.GetPublicKeyInput{KeyId: aws.String(s.KeyId)})
+		if err != nil {
+			s.err = err
+			return
+		}
+		s.publicKey, err = x509.ParsePKIXPublicKey(out.PublicKey)
+		if err != nil {
+			s.err = fmt.Errorf("failed to parse public key of %s: %v", s.KeyId, err)
+			return
+		}
+		switch s.publicKey.(type) {
+		case *ecdsa.PublicKey:
+			s.algorithm = kms.SigningAlgorithmSpecEcdsaSha256
+		case *rsa.PublicKey:
+			s.algorithm = kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256
+		default:
+			s.err = fmt.Errorf("unsupported key %s of %s", aws.StringValue(out.KeySpec), s.KeyId)
+			return
+		}
+		for _, algorithm := range out.SigningAlgorithms {
+			if aws.StringValue(algorithm) == s.algorithm {
+				return
+			}
+		}
+		s.err = fmt.Errorf("%s doesn't support %s", s.KeyId, s.algorithm)
+	})
+	return s.err
+}
+
+// Sign the digest of payload by KMS
+func (s *KMSSigner) Sign(payload []byte) ([]byte, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(payload)
+	out, err := s.service().Sign(&kms.SignInput{
+		KeyId:            aws.String(s.KeyId),
+		Message:          hash[:],
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(s.algorithm),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Signature, nil
+}
+
+func (s *KMSSigner) PublicKey() (crypto.PublicKey, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s.publicKey, nil
+}
+
+// SignTargets sign pushed images of targets, it returns image paths of signatures.
+// targets of the same digest are signed once
+func SignTargets(client *RegistryClient, signer Signer, targets []string) ([]string, error) {
+	var signatures []string
+	signed := map[string]bool{}
+	for _, target := range targets {
+		ref, err := ParseImageReference(target)
+		if err != nil {
+			return signatures, err
+		}
+		m, err := client.GetManifest(ref.Registry, ref.Repository, manifestReference(ref))
+		if err != nil {
+			return signatures, fmt.Errorf("failed to get pushed manifest of %s: %v", target, err)
+		}
+		key := ref.Registry + "/" + ref.Repository + "@" + m.Digest
+		if signed[key] {
+			continue
+		}
+		signed[key] = true
+		signature, err := SignImage(client, signer, ref.Registry, ref.Repository, m.Digest)
+		if err != nil {
+			return signatures, err
+		}
+		signatures = append(signatures, signature)
+	}
+	return signatures, nil
+}
+
+// SignImage push cosign signature of the digest signed by signer, it is appended to the existing signatures.
+// the image already signed by signer is not signed again, because ECDSA signatures differ in every signing.
+// it returns image path of the signature, e.g. "<registry>/nginx:sha256-<hex>.sig"
+func SignImage(client *RegistryClient, signer Signer, registry, repository, digest string) (string, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"critical": map[string]interface{}{
+			"identity": map[string]string{"docker-reference": registry + "/" + repository},
+			"image":    map[string]string{"docker-manifest-digest": digest},
+			"type":     "cosign container image signature",
+		},
+		"optional": nil,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	tag := CosignTag(digest, ".sig")
+	manifest := ImageManifest{SchemaVersion: 2, MediaType: MediaTypeOCIManifest}
+	existing, err := client.GetManifest(registry, repository, tag)
+	if err == nil {
+		m, err := ParseImageManifest(existing.Body, existing.MediaType)
+		if err != nil {
+			return "", err
+		}
+		manifest = *m
+	} else if !IsNotFound(err) {
+		return "", err
+	}
+	publicKey, err := signer.PublicKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to get public key of signer: %v", err)
+	}
+	for _, l := range manifest.Layers {
+		if l.Digest != Digest(payload) {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(l.Annotations[cosignSignatureAnnotation])
+		if err == nil && verifySignature(publicKey, payload, signature) == nil {
+			return registry + "/" + repository + ":" + tag, nil
+		}
+	}
+
+	signature, err := signer.Sign(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign %s@%s: %v", repository, digest, err)
+	}
+	layer := Descriptor{
+		MediaType:   "application/vnd.dev.cosign.simplesigning.v1+json",
+		Digest:      Digest(payload),
+		Size:        int64(len(payload)),
+		Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+	}
+	manifest.Layers = append(manifest.Layers, layer)
+
+	// config of cosign signature lists diff IDs of layers, they are not compressed
+	var config struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		RootFS       struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	config.RootFS.Type = "layers"
+	for _, l := range manifest.Layers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, l.Digest)
+	}
+	configBody, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	manifest.Config = &Descriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: Digest(configBody), Size: int64(len(configBody))}
+
+	for _, blob := range []struct {
+		descriptor Descriptor
+		data       []byte
+	}{{layer, payload}, {*manifest.Config, configBody}} {
+		data := blob.data
+		err := client.PushBlob(registry, repository, blob.descriptor, func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to push signature: %v", err)
+		}
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	if err := client.PutManifest(registry, repository, tag, manifest.MediaType, body); err != nil {
+		return "", fmt.Errorf("failed to push %s:%s: %v", repository, tag, err)
+	}
+	return registry + "/" + repository + ":" + tag, nil
+}
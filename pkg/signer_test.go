@@ -0,0 +1,234 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeCosignKey write private key encrypted in the format of "cosign generate-key-pair"
+func writeCosignKey(t *testing.T, file string, key *ecdsa.PrivateKey, password string) {
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	var encrypted cosignEncryptedKey
+	encrypted.KDF.Name = "scrypt"
+	encrypted.KDF.Params.N, encrypted.KDF.Params.R, encrypted.KDF.Params.P = 1024, 8, 1
+	encrypted.KDF.Salt = []byte("0123456789abcdef0123456789abcdef")
+	encrypted.Cipher.Name = "nacl/secretbox"
+	encrypted.Cipher.Nonce = []byte("0123456789abcdef01234567")
+	derived, _ := scrypt.Key([]byte(password), encrypted.KDF.Salt, 1024, 8, 1, 32)
+	var k [32]byte
+	var nonce [24]byte
+	copy(k[:], derived)
+	copy(nonce[:], encrypted.Cipher.Nonce)
+	encrypted.Ciphertext = secretbox.Seal(nil, der, &nonce, &k)
+	data, _ := json.Marshal(encrypted)
+	writePEM(t, file, "ENCRYPTED SIGSTORE PRIVATE KEY", data)
+}
+
+func TestLoadFileSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encrypted := filepath.Join(dir, "cosign.key")
+	writeCosignKey(t, encrypted, key, "secret")
+	der, _ := x509.MarshalECPrivateKey(key)
+	plain := writePEM(t, filepath.Join(dir, "ec.key"), "EC PRIVATE KEY", der)
+
+	for _, file := range []string{encrypted, plain} {
+		signer, err := LoadFileSigner(file, []byte("secret"))
+		if err != nil {
+			t.Fatalf("failed to load %s: %v", file, err)
+		}
+		signature, err := signer.Sign([]byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verifySignature(&key.PublicKey, []byte("payload"), signature); err != nil {
+			t.Errorf("signature of %s should be verified: %v", file, err)
+		}
+	}
+	if _, err := LoadFileSigner(encrypted, []byte("wrong")); err == nil {
+		t.Error("wrong password should be error")
+	}
+}
+
+func TestSignImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := newFakeRegistry()
+	defer source.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	nginx := source.pushImage("library/nginx", "1.17", Platform{OS: "linux", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "arm64"})
+	upstream, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	source.pushSignature("library/nginx", nginx.Digest, upstream, nil)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(key)
+	signer, err := LoadFileSigner(writePEM(t, filepath.Join(dir, "cosign.key"), "EC PRIVATE KEY", der), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(source.Certificate())
+	pool.AddCert(registry.Certificate())
+	client := &RegistryClient{Client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}}
+	client.SetCredential(source.Host(), RegistryCredential{Username: "user", Password: "pass"})
+	client.SetCredential(registry.Host(), RegistryCredential{Username: "user", Password: "pass"})
+
+	mapper := &ImageMapper{Destination: NewRegistryDestination(registry.Host()+"/mirror", client)}
+	mapper.Transfer.CopySignatures = true
+	mapper.Transfer.Signer = signer
+	targets, err := NativeTransfer(client, mapper)(source.Host() + "/library/nginx:1.17")
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+	repository := "mirror/" + source.Host() + "/library/nginx"
+	signature := registry.Host() + "/" + repository + ":" + CosignTag(nginx.Digest, ".sig")
+	if len(targets) != 3 || targets[1] != signature || targets[2] != signature {
+		t.Errorf("signature should be copied and made: %v", targets)
+	}
+
+	// both of upstream and our signatures are in the tag
+	m := registry.manifests[repository][CosignTag(nginx.Digest, ".sig")]
+	manifest, _ := ParseImageManifest(m.body, m.mediaType)
+	if len(manifest.Layers) != 2 {
+		t.Errorf("signature should be appended: %v", manifest.Layers)
+	}
+	for _, k := range []*ecdsa.PrivateKey{upstream, key} {
+		pub, _ := x509.MarshalPKIXPublicKey(&k.PublicKey)
+		keyFile := writePEM(t, filepath.Join(dir, "cosign.pub"), "PUBLIC KEY", pub)
+		v, err := NewSignatureVerifier([]SignaturePolicy{{Registry: "127.0.0.1:*", Keys: []string{keyFile}}}, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := v.Verify(registry.Host()+"/"+repository+":1.17", nginx.Digest); err != nil {
+			t.Errorf("signature should be verified: %v", err)
+		}
+	}
+}
+
+func TestSignImageTwice(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	nginx := registry.pushImage("library/nginx", "1.17", Platform{OS: "linux", Architecture: "amd64"})
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer := &KMSSigner{KeyId: "alias/cosign", KMS: &fakeKMS{key: key}}
+
+	// ECDSA signature of the same payload differs, but the image is signed once
+	for i := 0; i < 2; i++ {
+		if _, err := SignImage(registry.Client(), signer, registry.Host(), "library/nginx", nginx.Digest); err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+	}
+	m := registry.manifests["library/nginx"][CosignTag(nginx.Digest, ".sig")]
+	manifest, _ := ParseImageManifest(m.body, m.mediaType)
+	if len(manifest.Layers) != 1 {
+		t.Errorf("signature should not be appended again: %v", manifest.Layers)
+	}
+
+	// signature of another key is appended
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := SignImage(registry.Client(), &KMSSigner{KeyId: "alias/other", KMS: &fakeKMS{key: other}}, registry.Host(), "library/nginx", nginx.Digest); err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	m = registry.manifests["library/nginx"][CosignTag(nginx.Digest, ".sig")]
+	manifest, _ = ParseImageManifest(m.body, m.mediaType)
+	if len(manifest.Layers) != 2 {
+		t.Errorf("signature of another key should be appended: %v", manifest.Layers)
+	}
+}
+
+// fakeKMS signs by local key
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	key *ecdsa.PrivateKey
+}
+
+func (f *fakeKMS) GetPublicKey(in *kms.GetPublicKeyInput) (*kms.GetPublicKeyOutput, error) {
+	der, _ := x509.MarshalPKIXPublicKey(&f.key.PublicKey)
+	return &kms.GetPublicKeyOutput{
+		KeyId: in.KeyId, PublicKey: der, KeySpec: aws.String(kms.KeySpecEccNistP256),
+		SigningAlgorithms: aws.StringSlice([]string{kms.SigningAlgorithmSpecEcdsaSha256}),
+	}, nil
+}
+
+func (f *fakeKMS) Sign(in *kms.SignInput) (*kms.SignOutput, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, f.key, in.Message)
+	if err != nil {
+		return nil, err
+	}
+	signature, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	return &kms.SignOutput{KeyId: in.KeyId, Signature: signature, SigningAlgorithm: in.SigningAlgorithm}, nil
+}
+
+func TestKMSSigner(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer := &KMSSigner{KeyId: "alias/cosign", KMS: &fakeKMS{key: key}}
+	signature, err := signer.Sign([]byte("payload"))
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	hash := sha256.Sum256([]byte("payload"))
+	var sig struct{ R, S *big.Int }
+	asn1.Unmarshal(signature, &sig)
+	if !ecdsa.Verify(&key.PublicKey, hash[:], sig.R, sig.S) {
+		t.Error("signature should be verified by the public key")
+	}
+	pub, err := signer.PublicKey()
+	if err != nil || pub.(*ecdsa.PublicKey).X.Cmp(key.X) != 0 {
+		t.Errorf("unexpected public key: %v, %v", pub, err)
+	}
+}
+
+func TestNewKMSSigner(t *testing.T) {
+	if s := NewKMSSigner("alias/cosign", "ap-northeast-1"); s.Region != "ap-northeast-1" {
+		t.Errorf("region should be the given one: %s", s.Region)
+	}
+	// the key of other region, or region is not given with --registry
+	for _, region := range []string{"ap-northeast-1", ""} {
+		if s := NewKMSSigner("arn:aws:kms:us-west-2:111222333444:key/1234abcd", region); s.Region != "us-west-2" {
+			t.Errorf("region of ARN should be used: %s", s.Region)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// SyncSpec is the declaration of images which should be in ECR, e.g. images.yaml
+type SyncSpec struct {
+	// default settings of repositories
+	Repository RepositorySettings `yaml:"repository"`
+	Images     []SyncImage        `yaml:"images"`
+}
+
+// SyncImage is a source repository and tags to mirror
+type SyncImage struct {
+	// repository without tag, e.g. "registry.k8s.io/kube-proxy"
+	Source      string `yaml:"source"`
+	TagSelector `yaml:",inline"`
+	// repository in ECR, default is the same as source
+	Destination string `yaml:"destination"`
+	// settings override Repository of SyncSpec
+	Repository RepositorySettings `yaml:"repository"`
+}
+
+// LoadSyncSpec read spec file, unknown keys are error
+func LoadSyncSpec(filepath string) (*SyncSpec, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	var spec SyncSpec
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath, err)
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath, err)
+	}
+	return &spec, nil
+}
+
+// Validate checks sources and settings
+func (s *SyncSpec) Validate() error {
+	if err := s.Repository.Validate(); err != nil {
+		return fmt.Errorf("repository: %v", err)
+	}
+	for i, image := range s.Images {
+		ref, err := ParseImageReference(image.Source)
+		if err != nil {
+			return fmt.Errorf("images[%d]: source %q is wrong", i, image.Source)
+		}
+		if ref.Tag != "" || ref.Digest != "" {
+			return fmt.Errorf("images[%d]: source %q should not have tag, use tags", i, image.Source)
+		}
+		if err := image.Repository.Validate(); err != nil {
+			return fmt.Errorf("images[%d]: repository: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Destinations returns repository names in ECR which are specified by destination
+func (s *SyncSpec) Destinations() map[string]string {
+	destinations := map[string]string{}
+	for _, image := range s.Images {
+		if image.Destination != "" {
+			destinations[image.Source] = image.Destination
+		}
+	}
+	return destinations
+}
+
+// RepositoryChange is a repository to create, or to update settings
+type RepositoryChange struct {
+	Name     string
+	Create   bool
+	Settings RepositorySettings
+	// drifts of settings, all settings when the repository is created
+	Changes []SettingChange
+
+	current *ECRRepository
+}
+
+// ImageDeletion is tags to delete from the repository by prune
+type ImageDeletion struct {
+	Repository string
+	Tags       []string
+}
+
+// SyncPlan is changes to make ECR match SyncSpec
+type SyncPlan struct {
+	Repositories []RepositoryChange
+	// source images to transfer, and their targets
+	Images  []string
+	Targets map[string][]string
+	Deletes []ImageDeletion
+	// messages of images which are not transferred
+	Skipped []string
+}
+
+// Empty returns true if ECR already matches the spec
+func (p *SyncPlan) Empty() bool {
+	return len(p.Repositories) == 0 && len(p.Images) == 0 && len(p.Deletes) == 0
+}
+
+// Syncer reconcile ECR with SyncSpec
+type Syncer struct {
+	ECR      ecriface.ECRAPI
+	Registry *RegistryClient
+	Mapper   *ImageMapper
+}
+
+// Plan compares spec with ECR, tags in ECR not in spec are deleted only when prune is true
+func (s *Syncer) Plan(spec *SyncSpec, prune bool) (*SyncPlan, error) {
+	plan := &SyncPlan{Targets: map[string][]string{}}
+
+	// settings and desired tags of each repository, in order of spec
+	var repositories []string
+	settings := map[string]RepositorySettings{}
+	desired := map[string]map[string]bool{}
+	var images []string
+	allTargets := map[string][]string{}
+	// tags of skipped images, and sources of each repository. they are not pruned
+	kept := map[string]map[string]bool{}
+	sources := map[string]map[string]bool{}
+
+	for _, image := range spec.Images {
+		ref, _ := ParseImageReference(image.Source)
+		tags, err := s.Registry.ListTags(ref.Registry, ref.Repository)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags of %s: %v", image.Source, err)
+		}
+		tags, err = image.TagSelector.Select(tags)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", image.Source, err)
+		}
+
+		repoSettings := spec.Repository.Merge(image.Repository)
+		for _, tag := range tags {
+			imagePath := image.Source + ":" + tag
+			if _, ok := allTargets[imagePath]; ok {
+				continue
+			}
+			if reason := s.Mapper.Skip(imagePath); reason != "" {
+				plan.Skipped = append(plan.Skipped, fmt.Sprintf("%s is skipped, %s", imagePath, reason))
+				s.keepTags(kept, imagePath)
+				continue
+			}
+			repository, err := s.Mapper.Repository(imagePath)
+			if err != nil {
+				return nil, err
+			}
+			targets, err := s.Mapper.Targets(imagePath, "")
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", imagePath, err)
+			}
+
+			if _, ok := desired[repository]; !ok {
+				repositories = append(repositories, repository)
+				settings[repository] = repoSettings
+				desired[repository] = map[string]bool{}
+			} else if !reflect.DeepEqual(settings[repository], repoSettings) {
+				return nil, fmt.Errorf("repository %s has different settings in spec", repository)
+			}
+			for _, target := range targets {
+				desired[repository][targetTag(target)] = true
+			}
+			if sources[repository] == nil {
+				sources[repository] = map[string]bool{}
+			}
+			sources[repository][image.Source] = true
+			images = append(images, imagePath)
+			allTargets[imagePath] = targets
+		}
+	}
+
+	accountId := s.Mapper.AccountId
+	existing := map[string]map[string]bool{}
+	for _, name := range repositories {
+		current, err := describeRepository(s.ECR, accountId, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe repository %s: %v", name, err)
+		}
+		if current == nil {
+			plan.Repositories = append(plan.Repositories, RepositoryChange{
+				Name:     name,
+				Create:   true,
+				Settings: settings[name],
+				Changes:  settings[name].Diff(RepositorySettings{}),
+			})
+			existing[name] = map[string]bool{}
+			continue
+		}
+		if changes := settings[name].Diff(current.Settings); len(changes) != 0 {
+			plan.Repositories = append(plan.Repositories, RepositoryChange{
+				Name:     name,
+				Settings: settings[name],
+				Changes:  changes,
+				current:  current,
+			})
+		}
+		tags, err := listImageTags(s.ECR, accountId, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags of %s in ECR: %v", name, err)
+		}
+		existing[name] = tags
+	}
+
+	// images are transferred when any target tag is missing
+	for _, imagePath := range images {
+		repository, _ := s.Mapper.Repository(imagePath)
+		for _, target := range allTargets[imagePath] {
+			if !existing[repository][targetTag(target)] {
+				plan.Images = append(plan.Images, imagePath)
+				plan.Targets[imagePath] = allTargets[imagePath]
+				break
+			}
+		}
+	}
+
+	if prune {
+		for _, name := range repositories {
+			var tags []string
+			for tag := range existing[name] {
+				if !desired[name][tag] && !kept[name][tag] && !s.skipped(sources[name], tag) {
+					tags = append(tags, tag)
+				}
+			}
+			if len(tags) != 0 {
+				sort.Strings(tags)
+				plan.Deletes = append(plan.Deletes, ImageDeletion{Repository: name, Tags: tags})
+			}
+		}
+	}
+	return plan, nil
+}
+
+// tags which the skipped image would be pushed to are kept by prune
+func (s *Syncer) keepTags(kept map[string]map[string]bool, imagePath string) {
+	repository, err := s.Mapper.Repository(imagePath)
+	if err != nil {
+		return
+	}
+	targets, err := s.Mapper.Targets(imagePath, "")
+	if err != nil {
+		return
+	}
+	if kept[repository] == nil {
+		kept[repository] = map[string]bool{}
+	}
+	for _, target := range targets {
+		kept[repository][targetTag(target)] = true
+	}
+}
+
+// the tag in ECR is of image skipped by filters, e.g. tags excluded after they were mirrored
+func (s *Syncer) skipped(sources map[string]bool, tag string) bool {
+	for source := range sources {
+		if s.Mapper.Skip(source+":"+tag) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply create and update repositories, transfer images by transfer, and then delete pruned tags.
+// transfer returns messages of failed images, tags are not pruned when any image failed
+func (s *Syncer) Apply(plan *SyncPlan, transfer func(images []string) []string) error {
+	accountId := s.Mapper.AccountId
+	for _, repo := range plan.Repositories {
+		var err error
+		if repo.Create {
+			err = createRepository(s.ECR, repo.Name, repo.Settings)
+		} else {
+			err = updateRepository(s.ECR, accountId, repo.current, repo.Settings)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply settings of repository %s: %v", repo.Name, err)
+		}
+	}
+	if len(plan.Images) != 0 {
+		if failures := transfer(plan.Images); len(failures) != 0 {
+			return fmt.Errorf("%d of %d images failed to transfer, tags are not pruned", len(failures), len(plan.Images))
+		}
+	}
+	for _, d := range plan.Deletes {
+		if err := deleteImageTags(s.ECR, accountId, d.Repository, d.Tags); err != nil {
+			return fmt.Errorf("failed to prune %s: %v", d.Repository, err)
+		}
+	}
+	return nil
+}
+
+// Write outputs the plan, "+" is added, "~" is changed and "-" is deleted
+func (p *SyncPlan) Write(w io.Writer) {
+	if p.Empty() {
+		fmt.Fprintln(w, "No changes. ECR is up-to-date.")
+		for _, msg := range p.Skipped {
+			fmt.Fprintln(w, msg)
+		}
+		return
+	}
+
+	var add, change, destroy int
+	for _, repo := range p.Repositories {
+		mark := "~"
+		if repo.Create {
+			mark = "+"
+			add++
+		} else {
+			change++
+		}
+		fmt.Fprintf(w, "%s repository %s\n", mark, repo.Name)
+		for _, c := range repo.Changes {
+			if repo.Create {
+				fmt.Fprintf(w, "    %s: %s\n", c.Name, c.To)
+			} else {
+				fmt.Fprintf(w, "    %s: %s -> %s\n", c.Name, displaySetting(c.From), c.To)
+			}
+		}
+	}
+	for _, imagePath := range p.Images {
+		fmt.Fprintf(w, "+ image %s -> %s\n", imagePath, strings.Join(p.Targets[imagePath], ", "))
+		add++
+	}
+	for _, d := range p.Deletes {
+		for _, tag := range d.Tags {
+			fmt.Fprintf(w, "- image %s:%s\n", d.Repository, tag)
+			destroy++
+		}
+	}
+	for _, msg := range p.Skipped {
+		fmt.Fprintln(w, msg)
+	}
+	fmt.Fprintf(w, "\nPlan: %d to add, %d to change, %d to destroy.\n", add, change, destroy)
+}
+
+func displaySetting(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+// tag of target image path, "latest" when it is omitted
+func targetTag(target string) string {
+	ref, err := ParseImageReference(target)
+	if err != nil || ref.Tag == "" {
+		return "latest"
+	}
+	return ref.Tag
+}
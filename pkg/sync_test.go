@@ -0,0 +1,150 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go/aws"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadSyncSpec(t *testing.T) {
+	spec, err := LoadSyncSpec("../testfiles/input/images.yaml")
+	if err != nil {
+		t.Fatalf("failed to load spec: %v", err)
+	}
+	if len(spec.Images) != 2 {
+		t.Fatalf("expected 2 images, got: %d", len(spec.Images))
+	}
+	kubeProxy := spec.Images[0]
+	if kubeProxy.Semver != ">=1.28.0" || kubeProxy.Latest != 3 || kubeProxy.Destination != "k8s/kube-proxy" {
+		t.Errorf("unexpected image: %+v", kubeProxy)
+	}
+	nginx := spec.Repository.Merge(spec.Images[1].Repository)
+	if nginx.TagMutability != "MUTABLE" || !*nginx.ScanOnPush || nginx.LifecyclePolicy == "" {
+		t.Errorf("unexpected settings: %+v", nginx)
+	}
+	expected := map[string]string{"registry.k8s.io/kube-proxy": "k8s/kube-proxy"}
+	if actual := spec.Destinations(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %v, got: %v", expected, actual)
+	}
+
+	invalid := &SyncSpec{Images: []SyncImage{{Source: "nginx:1.17"}}}
+	if err := invalid.Validate(); err == nil {
+		t.Errorf("source with tag should be error")
+	}
+}
+
+func TestSyncerPlanAndApply(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	registry.tags["kube-proxy"] = []string{"v1.27.0", "v1.28.0", "v1.28.1", "v1.29.0"}
+	registry.tags["library/nginx"] = []string{"1.24", "1.25"}
+
+	svc := newFakeECR()
+	// nginx is mirrored by hand, with different settings and extra tags.
+	// "1.22-rc1" is excluded by filter, it is not pruned
+	nginxRepository := registry.Host() + "/library/nginx"
+	svc.repositories[nginxRepository] = &fakeECRRepository{
+		settings: RepositorySettings{ScanOnPush: aws.Bool(false), TagMutability: "MUTABLE"},
+		tags:     map[string]bool{"1.25": true, "1.23": true, "1.22-rc1": true},
+	}
+
+	spec := &SyncSpec{
+		Repository: RepositorySettings{ScanOnPush: aws.Bool(true)},
+		Images: []SyncImage{
+			{Source: registry.Host() + "/kube-proxy", TagSelector: TagSelector{Semver: ">=1.28.0"}, Destination: "k8s/kube-proxy"},
+			{Source: registry.Host() + "/library/nginx", TagSelector: TagSelector{Tags: []string{"1.24", "1.25"}}},
+		},
+	}
+	filter, _ := NewImageFilter(nil, []string{"tag=~-rc[0-9]+$"})
+	mapper := &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444", Destinations: spec.Destinations(), Filter: filter}
+	syncer := &Syncer{ECR: svc, Registry: registry.Client(), Mapper: mapper}
+
+	plan, err := syncer.Plan(spec, true)
+	if err != nil {
+		t.Fatalf("failed to plan: %v", err)
+	}
+	var out bytes.Buffer
+	plan.Write(&out)
+	ecrHost := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/"
+	expected := strings.Join([]string{
+		"+ repository k8s/kube-proxy",
+		"    scanOnPush: true",
+		"~ repository " + nginxRepository,
+		"    scanOnPush: false -> true",
+		"+ image " + registry.Host() + "/kube-proxy:v1.28.0 -> " + ecrHost + "k8s/kube-proxy:v1.28.0",
+		"+ image " + registry.Host() + "/kube-proxy:v1.28.1 -> " + ecrHost + "k8s/kube-proxy:v1.28.1",
+		"+ image " + registry.Host() + "/kube-proxy:v1.29.0 -> " + ecrHost + "k8s/kube-proxy:v1.29.0",
+		"+ image " + registry.Host() + "/library/nginx:1.24 -> " + ecrHost + nginxRepository + ":1.24",
+		"- image " + nginxRepository + ":1.23",
+		"",
+		"Plan: 5 to add, 1 to change, 1 to destroy.",
+		"",
+	}, "\n")
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	// tags are not pruned when transfer failed
+	err = syncer.Apply(plan, func(images []string) []string {
+		return []string{images[0] + " failed to transfer. error message: timeout"}
+	})
+	if err == nil || !svc.repositories[nginxRepository].tags["1.23"] {
+		t.Fatalf("failed transfer should be error without prune, got: %v", err)
+	}
+	// repositories are already created
+	plan, err = syncer.Plan(spec, true)
+	if err != nil {
+		t.Fatalf("failed to plan: %v", err)
+	}
+
+	// transfer is replaced by pushing tags to fake ECR
+	var transferred []string
+	err = syncer.Apply(plan, func(images []string) []string {
+		transferred = images
+		for _, image := range images {
+			repository, _ := mapper.Repository(image)
+			svc.repositories[repository].tags[targetTag(image)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+	if len(transferred) != 4 {
+		t.Errorf("expected 4 images are transferred, got: %v", transferred)
+	}
+	if svc.repositories[nginxRepository].tags["1.23"] || !svc.repositories[nginxRepository].tags["1.22-rc1"] {
+		t.Errorf("only tags out of spec should be pruned, got: %v", svc.repositories[nginxRepository].tags)
+	}
+	if !*svc.repositories["k8s/kube-proxy"].settings.ScanOnPush || !*svc.repositories[nginxRepository].settings.ScanOnPush {
+		t.Errorf("scanOnPush should be enabled")
+	}
+
+	// nothing to do after apply
+	plan, err = syncer.Plan(spec, true)
+	if err != nil {
+		t.Fatalf("failed to plan: %v", err)
+	}
+	if !plan.Empty() {
+		out.Reset()
+		plan.Write(&out)
+		t.Errorf("plan should be empty after apply, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// TagPolicy decides tags of images pushed into ECR
+type TagPolicy struct {
+	template *template.Template
+	// template refers digest, it is known only after pulling images
+	usesDigest bool
+	// push images with the original tag in addition to the new tag
+	KeepOriginalTag bool
+	Overrides       []TagOverride
+	// value of {{.Date}}, format is YYYYMMDD
+	Date string
+}
+
+// TagOverride change the tag of the image before template is applied, e.g. promote "latest" to a fixed version
+type TagOverride struct {
+	// image path with tag, e.g. "nginx:latest"
+	Image string `yaml:"image"`
+	Tag   string `yaml:"tag"`
+}
+
+// TagData is the value of tag template
+type TagData struct {
+	Registry   string
+	Repository string
+	Name       string
+	// "latest" when it is omitted, DigestTag when the image is referenced only by digest
+	Tag string
+	// e.g. "sha256:..."
+	Digest string
+	// digest which can be used as tag, e.g. "sha256-..."
+	DigestTag string
+	// first 12 characters of digest
+	ShortDigest string
+	Date        string
+}
+
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// NewTagPolicy parse template of tag, e.g. "{{.Tag}}-mirrored-{{.Date}}"
+func NewTagPolicy(config TagPolicyConfig) (*TagPolicy, error) {
+	date := config.Date
+	if date == "" {
+		date = time.Now().Format("20060102")
+	}
+	p := &TagPolicy{KeepOriginalTag: config.KeepOriginalTag, Overrides: config.Overrides, Date: date}
+	if config.Template != "" {
+		tmpl, err := template.New("tag").Option("missingkey=error").Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("tag template is wrong: %v", err)
+		}
+		p.template = tmpl
+		p.usesDigest = usesDigest(tmpl.Tree.Root)
+	}
+	return p, nil
+}
+
+// fields of TagData which are known only by digest
+var digestFields = map[string]bool{"Digest": true, "DigestTag": true, "ShortDigest": true}
+
+// template refers fields of digest, e.g. {{.DigestTag}}, {{if .Digest}}
+func usesDigest(node parse.Node) bool {
+	var nodes []parse.Node
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			nodes = n.Nodes
+		}
+	case *parse.ActionNode:
+		nodes = []parse.Node{n.Pipe}
+	case *parse.PipeNode:
+		if n != nil {
+			for _, c := range n.Cmds {
+				nodes = append(nodes, c)
+			}
+		}
+	case *parse.CommandNode:
+		nodes = n.Args
+	case *parse.ChainNode:
+		nodes = []parse.Node{n.Node}
+	case *parse.TemplateNode:
+		nodes = []parse.Node{n.Pipe}
+	case *parse.IfNode:
+		nodes = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.RangeNode:
+		nodes = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.WithNode:
+		nodes = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.FieldNode:
+		return digestFields[n.Ident[0]]
+	case *parse.VariableNode:
+		// e.g. $.Digest
+		return len(n.Ident) > 1 && digestFields[n.Ident[1]]
+	}
+	for _, n := range nodes {
+		if usesDigest(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesDigest returns true when the template refers digest, the digest of images should be resolved before Tag
+func (p *TagPolicy) UsesDigest() bool {
+	return p.usesDigest
+}
+
+// Tag returns new tag of the image, digest is the digest of the source image.
+// error is returned when template needs digest and it is unknown
+func (p *TagPolicy) Tag(ref ImageReference, digest string) (string, error) {
+	tag := ref.Tag
+	if tag == "" && ref.Digest == "" {
+		tag = "latest"
+	}
+	if digest == "" {
+		digest = ref.Digest
+	}
+	for _, o := range p.Overrides {
+		if o.Image == ref.Name+":"+tag {
+			tag = o.Tag
+			break
+		}
+	}
+	if p.template == nil {
+		return tag, nil
+	}
+	if p.usesDigest && digest == "" {
+		return "", fmt.Errorf("digest of %s is unknown until it is pulled, tag template needs it", ref)
+	}
+
+	data := TagData{
+		Registry:   ref.Registry,
+		Repository: ref.Repository,
+		Name:       ref.Name,
+		Tag:        tag,
+		Digest:     digest,
+		DigestTag:  strings.Replace(digest, ":", "-", 1),
+		Date:       p.Date,
+	}
+	if data.Tag == "" {
+		// the image is referenced only by digest, tag made by {{.Tag}} should be valid
+		data.Tag = data.DigestTag
+	}
+	if i := strings.Index(digest, ":"); i >= 0 {
+		data.ShortDigest = digest[i+1:]
+		if len(data.ShortDigest) > 12 {
+			data.ShortDigest = data.ShortDigest[:12]
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := p.template.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	newTag := buf.String()
+	if !tagPattern.MatchString(newTag) {
+		return "", fmt.Errorf("tag %q made by template is not valid", newTag)
+	}
+	return newTag, nil
+}
@@ -0,0 +1,169 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagPolicyTag(t *testing.T) {
+	digest := "sha256:60049e8aa1bb97242ce1a5fc5f9d86478d3f3407c2643edb054c717ac12c14bb"
+	overrides := []TagOverride{{Image: "nginx:latest", Tag: "1.17.8"}}
+
+	patterns := []struct {
+		template string
+		image    string
+		digest   string
+		expected string
+		err      bool
+	}{
+		{"", "nginx:1.17", "", "1.17", false},
+		{"{{.Tag}}-mirrored-{{.Date}}", "nginx:1.17", "", "1.17-mirrored-20261018", false},
+		{"{{.Tag}}-mirrored-{{.Date}}", "nginx", "", "1.17.8-mirrored-20261018", false},
+		{"{{.DigestTag}}", "nginx:1.17", digest, "sha256-60049e8aa1bb97242ce1a5fc5f9d86478d3f3407c2643edb054c717ac12c14bb", false},
+		{"{{.Tag}}-{{.ShortDigest}}", "gcr.io/google_samples/gb-frontend:v3", digest, "v3-60049e8aa1bb", false},
+		// digest in image path is used
+		{"{{.ShortDigest}}", "nginx@" + digest, "", "60049e8aa1bb", false},
+		{"", "nginx:latest", "", "1.17.8", false},
+		// word "Digest" out of fields doesn't need digest
+		{"{{.Tag}}-NoDigest", "nginx:1.17", "", "1.17-NoDigest", false},
+		// image referenced only by digest has DigestTag as tag
+		{"{{.Tag}}-mirrored", "nginx@" + digest, "", "sha256-60049e8aa1bb97242ce1a5fc5f9d86478d3f3407c2643edb054c717ac12c14bb-mirrored", false},
+
+		// Failed Case
+		{"{{.DigestTag}}", "nginx:1.17", "", "", true},
+		{"{{.Tag}}{{with $.ShortDigest}}-{{.}}{{end}}", "nginx:1.17", "", "", true},
+		{"{{.Tag}}:mirrored", "nginx:1.17", "", "", true},
+		{"{{.Unknown}}", "nginx:1.17", "", "", true},
+	}
+
+	for idx, pattern := range patterns {
+		policy, err := NewTagPolicy(TagPolicyConfig{Template: pattern.template, Overrides: overrides, Date: "20261018"})
+		if err != nil {
+			t.Fatalf("pattern %d: failed to parse template: %v", idx, err)
+		}
+		ref, _ := ParseImageReference(pattern.image)
+		actual, err := policy.Tag(ref, pattern.digest)
+		if (err != nil) != pattern.err {
+			t.Errorf("pattern %d: unexpected error %v", idx, err)
+		} else if actual != pattern.expected {
+			t.Errorf("pattern %d: want %v, actual %v", idx, pattern.expected, actual)
+		}
+	}
+}
+
+func TestNewTagPolicyWrongTemplate(t *testing.T) {
+	if _, err := NewTagPolicy(TagPolicyConfig{Template: "{{.Tag"}); err == nil {
+		t.Fatalf("expected error for wrong template")
+	}
+}
+
+func TestImageMapperTargets(t *testing.T) {
+	config := &Config{TagPolicy: TagPolicyConfig{Template: "{{.Tag}}-mirrored", KeepOriginalTag: true}}
+	mapper, err := NewImageMapper(config, "ap-northeast-1", "111222333444")
+	if err != nil {
+		t.Fatalf("failed to make mapper: %v", err)
+	}
+	ecr := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/"
+
+	actual, err := mapper.Targets("nginx:1.17", "")
+	if err != nil {
+		t.Fatalf("failed to get targets: %v", err)
+	}
+	expected := []string{ecr + "nginx:1.17-mirrored", ecr + "nginx:1.17"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+
+	// replace uses the new tag
+	m, err := mapper.Map("nginx")
+	if err != nil {
+		t.Fatalf("failed to map: %v", err)
+	}
+	if m.Target != ecr+"nginx:latest-mirrored" {
+		t.Fatalf("expected: %v, got: %v", ecr+"nginx:latest-mirrored", m.Target)
+	}
+
+	// digest of the reference is kept
+	digest := "sha256:60049e8aa1bb97242ce1a5fc5f9d86478d3f3407c2643edb054c717ac12c14bb"
+	m, err = mapper.Map("nginx:1.17@" + digest)
+	if err != nil || m.Target != ecr+"nginx:1.17-mirrored@"+digest {
+		t.Fatalf("expected: %v, got: %v, %v", ecr+"nginx:1.17-mirrored@"+digest, m.Target, err)
+	}
+
+	// replace fails when template needs digest and it can't be resolved
+	config.TagPolicy.Template = "{{.DigestTag}}"
+	mapper, _ = NewImageMapper(config, "ap-northeast-1", "111222333444")
+	manifests, _ := ParseMultiDocYaml("../testfiles/input/pod.yml")
+	if _, err := ReplaceImages(manifests[0], mapper); err == nil {
+		t.Fatalf("expected error when digest is unknown")
+	}
+
+	mapper.ResolveDigest = func(image string) (string, error) {
+		return digest, nil
+	}
+	m, err = mapper.Map("nginx:1.17")
+	if err != nil || m.Target != ecr+"nginx:sha256-60049e8aa1bb97242ce1a5fc5f9d86478d3f3407c2643edb054c717ac12c14bb" {
+		t.Fatalf("digest should be resolved, got: %v, %v", m.Target, err)
+	}
+}
+
+func TestKustomizeImagesTagPolicy(t *testing.T) {
+	config := &Config{TagPolicy: TagPolicyConfig{Template: "{{.Tag}}-mirrored"}}
+	mapper, _ := NewImageMapper(config, "ap-northeast-1", "111222333444")
+	ecr := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/"
+
+	actual, err := KustomizeImages(nil, []string{"nginx:1.17", "redis"}, mapper)
+	if err != nil {
+		t.Fatalf("failed to generate images: %v", err)
+	}
+	expected := []KustomizeImage{
+		{Name: "nginx", NewName: ecr + "nginx", NewTag: "1.17-mirrored"},
+		{Name: "redis", NewName: ecr + "redis", NewTag: "latest-mirrored"},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+
+	// one entry can't have different tags
+	if _, err := KustomizeImages(nil, []string{"nginx:1.17", "nginx:1.18"}, mapper); err == nil {
+		t.Fatalf("expected error for different tags of the same name")
+	}
+}
+
+func TestGenerateHelmValuesTagPolicy(t *testing.T) {
+	chart := &HelmChart{Name: "redis", Values: map[interface{}]interface{}{
+		"image": map[interface{}]interface{}{"registry": "docker.io", "repository": "bitnami/redis", "tag": 5.0},
+	}}
+	config := &Config{TagPolicy: TagPolicyConfig{Template: "{{.Tag}}-mirrored"}}
+	mapper, _ := NewImageMapper(config, "ap-northeast-1", "111222333444")
+
+	actual, err := GenerateHelmValues(chart, config, mapper)
+	if err != nil {
+		t.Fatalf("failed to generate values: %v", err)
+	}
+	expected := map[interface{}]interface{}{
+		"image": map[interface{}]interface{}{
+			"registry":   "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com",
+			"repository": "docker.io/bitnami/redis",
+			"tag":        "5-mirrored",
+		},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %v, got: %v", expected, actual)
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is semantic version of tag, "v" prefix and omitted minor and patch are allowed, e.g. v1.17
+type Version struct {
+	Major, Minor, Patch int64
+	Prerelease          string
+}
+
+var versionPattern = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// ParseVersion parse tag as semantic version
+func ParseVersion(s string) (Version, error) {
+	m := versionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return Version{}, fmt.Errorf("%q is not semantic version", s)
+	}
+	var v Version
+	v.Major, _ = strconv.ParseInt(m[1], 10, 64)
+	if m[2] != "" {
+		v.Minor, _ = strconv.ParseInt(m[2], 10, 64)
+	}
+	if m[3] != "" {
+		v.Patch, _ = strconv.ParseInt(m[3], 10, 64)
+	}
+	v.Prerelease = m[4]
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1
+func (v Version) Compare(o Version) int {
+	for _, d := range []int64{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	// prerelease is lower than release
+	switch {
+	case v.Prerelease == o.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case o.Prerelease == "":
+		return -1
+	}
+	return comparePrerelease(v.Prerelease, o.Prerelease)
+}
+
+// compare dot separated identifiers, numeric identifiers are lower than others
+func comparePrerelease(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.ParseInt(as[i], 10, 64)
+		bn, bErr := strconv.ParseInt(bs[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// VersionConstraint is a set of conditions, e.g. ">=1.20.0 <1.30.0", "~1.17", "^2.0", "1.20.x || 1.22.x".
+// conditions separated by space or comma are AND, "||" is OR
+type VersionConstraint struct {
+	groups [][]versionCondition
+	// prerelease versions are selected only when constraint mentions prerelease
+	allowPrerelease bool
+}
+
+type versionCondition struct {
+	op      string
+	version Version
+}
+
+var conditionPattern = regexp.MustCompile(`^(>=|<=|!=|>|<|=|~|\^)?\s*(.+)$`)
+
+// ParseVersionConstraint parse constraint of semantic version
+func ParseVersionConstraint(s string) (*VersionConstraint, error) {
+	c := &VersionConstraint{}
+	for _, group := range strings.Split(s, "||") {
+		// operator can be separated from version, e.g. ">= 1.20"
+		fields := strings.FieldsFunc(group, func(r rune) bool { return r == ' ' || r == ',' })
+		var terms []string
+		for i := 0; i < len(fields); i++ {
+			if strings.Trim(fields[i], "<>=!~^") == "" && i+1 < len(fields) {
+				terms = append(terms, fields[i]+fields[i+1])
+				i++
+				continue
+			}
+			terms = append(terms, fields[i])
+		}
+		if len(terms) == 0 {
+			return nil, fmt.Errorf("constraint %q is wrong", s)
+		}
+
+		var conditions []versionCondition
+		for _, term := range terms {
+			cs, err := parseCondition(term)
+			if err != nil {
+				return nil, fmt.Errorf("constraint %q is wrong: %v", s, err)
+			}
+			for _, cond := range cs {
+				if cond.version.Prerelease != "" {
+					c.allowPrerelease = true
+				}
+			}
+			conditions = append(conditions, cs...)
+		}
+		c.groups = append(c.groups, conditions)
+	}
+	return c, nil
+}
+
+// wildcard, tilde and caret are converted into range
+func parseCondition(term string) ([]versionCondition, error) {
+	m := conditionPattern.FindStringSubmatch(term)
+	op, s := m[1], m[2]
+
+	// wildcard, e.g. 1.20.x, 1.*
+	parts := strings.SplitN(strings.TrimPrefix(s, "v"), ".", 3)
+	for i, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			if op != "" && op != "=" {
+				return nil, fmt.Errorf("wildcard can't be used with %s", op)
+			}
+			if i == 0 {
+				return nil, nil
+			}
+			lower, err := ParseVersion(strings.Join(parts[:i], "."))
+			if err != nil {
+				return nil, err
+			}
+			upper := lower
+			if i == 1 {
+				upper = Version{Major: lower.Major + 1}
+			} else {
+				upper = Version{Major: lower.Major, Minor: lower.Minor + 1}
+			}
+			return []versionCondition{{">=", lower}, {"<", upper}}, nil
+		}
+	}
+
+	v, err := ParseVersion(s)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "~":
+		// ~1.2.3 is >=1.2.3 <1.3.0, ~1 is >=1.0.0 <2.0.0
+		upper := Version{Major: v.Major, Minor: v.Minor + 1}
+		if len(parts) == 1 {
+			upper = Version{Major: v.Major + 1}
+		}
+		return []versionCondition{{">=", v}, {"<", upper}}, nil
+	case "^":
+		// ^1.2.3 is >=1.2.3 <2.0.0, ^0.2.3 is >=0.2.3 <0.3.0
+		upper := Version{Major: v.Major + 1}
+		if v.Major == 0 {
+			upper = Version{Minor: v.Minor + 1}
+		}
+		return []versionCondition{{">=", v}, {"<", upper}}, nil
+	case "":
+		op = "="
+	}
+	return []versionCondition{{op, v}}, nil
+}
+
+func (cond versionCondition) match(v Version) bool {
+	c := v.Compare(cond.version)
+	switch cond.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	}
+	return false
+}
+
+// Match returns true if the version satisfies the constraint
+func (c *VersionConstraint) Match(v Version) bool {
+	if v.Prerelease != "" && !c.allowPrerelease {
+		return false
+	}
+	for _, group := range c.groups {
+		matched := true
+		for _, cond := range group {
+			if !cond.match(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// TagSelector select tags of repository, all conditions should be satisfied
+type TagSelector struct {
+	// constraint of semantic version, e.g. ">=1.20.0 <1.30.0"
+	Semver string `yaml:"semver"`
+	// regular expression, e.g. "^v1\.2[0-9]\."
+	Regex string `yaml:"regex"`
+	// only the latest N versions by semantic version, 0 means all
+	Latest int `yaml:"latest"`
+	// tags selected explicitly, they are added to the result of other conditions
+	Tags []string `yaml:"tags"`
+}
+
+// Select returns selected tags in order of version, tags which are not semantic version are sorted by name after them
+func (s TagSelector) Select(tags []string) ([]string, error) {
+	var constraint *VersionConstraint
+	if s.Semver != "" {
+		c, err := ParseVersionConstraint(s.Semver)
+		if err != nil {
+			return nil, err
+		}
+		constraint = c
+	}
+	var re *regexp.Regexp
+	if s.Regex != "" {
+		r, err := regexp.Compile(s.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("regex %q is wrong: %v", s.Regex, err)
+		}
+		re = r
+	}
+
+	type versionTag struct {
+		tag     string
+		version Version
+		ok      bool
+	}
+	var selected []versionTag
+	// only explicit tags are selected when no other condition is set
+	filtering := constraint != nil || re != nil || s.Latest > 0 || len(s.Tags) == 0
+	if filtering {
+		for _, tag := range tags {
+			v, err := ParseVersion(tag)
+			isVersion := err == nil
+			if constraint != nil && (!isVersion || !constraint.Match(v)) {
+				continue
+			}
+			if re != nil && !re.MatchString(tag) {
+				continue
+			}
+			if s.Latest > 0 && (!isVersion || (v.Prerelease != "" && constraint == nil)) {
+				continue
+			}
+			selected = append(selected, versionTag{tag, v, isVersion})
+		}
+	}
+
+	sort.SliceStable(selected, func(i, j int) bool {
+		a, b := selected[i], selected[j]
+		if a.ok != b.ok {
+			return a.ok
+		}
+		if a.ok {
+			if c := a.version.Compare(b.version); c != 0 {
+				return c < 0
+			}
+		}
+		return a.tag < b.tag
+	})
+	if s.Latest > 0 && len(selected) > s.Latest {
+		selected = selected[len(selected)-s.Latest:]
+	}
+
+	results := make([]string, 0, len(selected)+len(s.Tags))
+	seen := map[string]bool{}
+	for _, t := range selected {
+		results = append(results, t.tag)
+		seen[t.tag] = true
+	}
+	for _, tag := range s.Tags {
+		if !seen[tag] {
+			results = append(results, tag)
+			seen[tag] = true
+		}
+	}
+	return results, nil
+}
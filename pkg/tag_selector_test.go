@@ -0,0 +1,137 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVersionCompare(t *testing.T) {
+	patterns := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.20.0", "v1.20.0", 0},
+		{"1.20", "1.20.0", 0},
+		{"1.20.1", "1.20.0", 1},
+		{"1.9.0", "1.10.0", -1},
+		{"2", "1.99.99", 1},
+		{"1.20.0-rc.1", "1.20.0", -1},
+		{"1.20.0-rc.2", "1.20.0-rc.10", -1},
+		{"1.20.0-alpha", "1.20.0-beta", -1},
+		{"1.20.0-1", "1.20.0-alpha", -1},
+	}
+
+	for i, p := range patterns {
+		a, err := ParseVersion(p.a)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		b, err := ParseVersion(p.b)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if actual := a.Compare(b); actual != p.expected {
+			t.Errorf("#%d: Compare(%s, %s) = %d, expected %d", i, p.a, p.b, actual, p.expected)
+		}
+	}
+
+	for _, s := range []string{"latest", "1.2.3.4", "stable-1.20", ""} {
+		if _, err := ParseVersion(s); err == nil {
+			t.Errorf("%q should not be semantic version", s)
+		}
+	}
+}
+
+func TestVersionConstraintMatch(t *testing.T) {
+	patterns := []struct {
+		constraint string
+		version    string
+		expected   bool
+	}{
+		{">=1.20.0 <1.30.0", "v1.20.0", true},
+		{">=1.20.0 <1.30.0", "v1.30.0", false},
+		{">= 1.20, < 1.30", "v1.29.9", true},
+		{">=1.20.0 <1.30.0", "v1.25.0-rc.1", false},
+		{">=1.25.0-rc.0", "v1.25.0-rc.1", true},
+		{"1.20.x", "1.20.7", true},
+		{"1.20.x", "1.21.0", false},
+		{"1.*", "1.99.0", true},
+		{"*", "3.0.0", true},
+		{"~1.20", "1.20.9", true},
+		{"~1.20", "1.21.0", false},
+		{"~1", "1.21.0", true},
+		{"^1.2.3", "1.9.0", true},
+		{"^1.2.3", "2.0.0", false},
+		{"^0.2.3", "0.3.0", false},
+		{"1.17.x || 1.19.x", "1.19.2", true},
+		{"1.17.x || 1.19.x", "1.18.2", false},
+		{"!=1.18.0", "1.18.0", false},
+		{"1.18", "1.18.0", true},
+	}
+
+	for i, p := range patterns {
+		c, err := ParseVersionConstraint(p.constraint)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		v, err := ParseVersion(p.version)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if actual := c.Match(v); actual != p.expected {
+			t.Errorf("#%d: %q match %s = %v, expected %v", i, p.constraint, p.version, actual, p.expected)
+		}
+	}
+
+	for _, s := range []string{">=foo", "", ">1.x", "1.20 ||"} {
+		if _, err := ParseVersionConstraint(s); err == nil {
+			t.Errorf("constraint %q should be error", s)
+		}
+	}
+}
+
+func TestTagSelectorSelect(t *testing.T) {
+	tags := []string{"latest", "v1.19.3", "v1.20.0", "v1.20.1", "v1.21.0-rc.0", "v1.21.0", "v1.22.2", "v1.3.0", "stable"}
+
+	patterns := []struct {
+		selector TagSelector
+		expected []string
+	}{
+		{TagSelector{Semver: ">=1.20.0 <1.22.0"}, []string{"v1.20.0", "v1.20.1", "v1.21.0"}},
+		{TagSelector{Regex: `^v1\.2[0-9]\.`}, []string{"v1.20.0", "v1.20.1", "v1.21.0-rc.0", "v1.21.0", "v1.22.2"}},
+		{TagSelector{Latest: 2}, []string{"v1.21.0", "v1.22.2"}},
+		{TagSelector{Semver: "1.20.x", Latest: 1}, []string{"v1.20.1"}},
+		{TagSelector{Semver: "~1.20", Tags: []string{"latest"}}, []string{"v1.20.0", "v1.20.1", "latest"}},
+		{TagSelector{Tags: []string{"stable"}}, []string{"stable"}},
+		{TagSelector{}, []string{"v1.3.0", "v1.19.3", "v1.20.0", "v1.20.1", "v1.21.0-rc.0", "v1.21.0", "v1.22.2", "latest", "stable"}},
+	}
+
+	for i, p := range patterns {
+		actual, err := p.selector.Select(tags)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(actual, p.expected) {
+			t.Errorf("#%d: Select() = %v, expected %v", i, actual, p.expected)
+		}
+	}
+
+	if _, err := (TagSelector{Regex: "("}).Select(tags); err == nil {
+		t.Errorf("wrong regex should be error")
+	}
+}
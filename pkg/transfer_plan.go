@@ -0,0 +1,219 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// TransferPlanVersion is the format version of plan file
+const TransferPlanVersion = 1
+
+// TransferPlan is images resolved to digests, transfer --apply copies exactly these digests
+type TransferPlan struct {
+	Version   int            `json:"version"`
+	Region    string         `json:"region"`
+	AccountId string         `json:"accountId"`
+	Images    []PlannedImage `json:"images"`
+	// messages of images which are not transferred
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// PlannedImage is a source image and its targets in ECR
+type PlannedImage struct {
+	Source string `json:"source"`
+	ResolvedImage
+	Targets []string `json:"targets"`
+}
+
+// ResolvedImage is manifest of the image at the time it is resolved
+type ResolvedImage struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	// sum of compressed size of manifests, configs and layers
+	Size      int64           `json:"size"`
+	Platforms []PlatformImage `json:"platforms,omitempty"`
+}
+
+// PlatformImage is an image of the platform in index
+type PlatformImage struct {
+	Platform
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// ResolveImage get digest, size and platforms of the image from registry
+func (c *RegistryClient) ResolveImage(image string) (*ResolvedImage, error) {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	reference := ref.Digest
+	if reference == "" {
+		reference = ref.Tag
+	}
+	if reference == "" {
+		reference = "latest"
+	}
+	m, err := c.GetManifest(ref.Registry, ref.Repository, reference)
+	if err != nil {
+		return nil, err
+	}
+	resolved := &ResolvedImage{Digest: m.Digest, MediaType: m.MediaType, Size: int64(len(m.Body))}
+
+	if !IsIndex(m.MediaType) {
+		p, size, err := c.resolvePlatformImage(ref, m)
+		if err != nil {
+			return nil, err
+		}
+		resolved.Size += size
+		resolved.Platforms = []PlatformImage{{Platform: p, Digest: m.Digest, Size: int64(len(m.Body)) + size}}
+		return resolved, nil
+	}
+
+	index, err := ParseImageManifest(m.Body, m.MediaType)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range index.Manifests {
+		// e.g. attestation manifests of buildkit
+		if d.Platform == nil || d.Platform.OS == "unknown" {
+			continue
+		}
+		child, err := c.GetManifest(ref.Registry, ref.Repository, d.Digest)
+		if err != nil {
+			return nil, err
+		}
+		_, size, err := c.resolvePlatformImage(ref, child)
+		if err != nil {
+			return nil, err
+		}
+		size += int64(len(child.Body))
+		resolved.Size += size
+		resolved.Platforms = append(resolved.Platforms, PlatformImage{Platform: *d.Platform, Digest: d.Digest, Size: size})
+	}
+	return resolved, nil
+}
+
+// returns platform in config and size of config and layers
+func (c *RegistryClient) resolvePlatformImage(ref ImageReference, m *RegistryManifest) (Platform, int64, error) {
+	manifest, err := ParseImageManifest(m.Body, m.MediaType)
+	if err != nil {
+		return Platform{}, 0, err
+	}
+	if manifest.Config == nil {
+		return Platform{}, 0, fmt.Errorf("%s@%s is not image manifest", ref.Name, m.Digest)
+	}
+	size := manifest.Config.Size
+	for _, l := range manifest.Layers {
+		size += l.Size
+	}
+	config, err := c.GetBlob(ref.Registry, ref.Repository, manifest.Config.Digest)
+	if err != nil {
+		return Platform{}, 0, err
+	}
+	var p Platform
+	if err := json.Unmarshal(config, &p); err != nil {
+		return Platform{}, 0, fmt.Errorf("config of %s@%s is broken: %v", ref.Name, m.Digest, err)
+	}
+	return p, size, nil
+}
+
+// ResolveTransferPlan resolve images to digests, targets are decided by mapper with the digests
+func ResolveTransferPlan(images []string, mapper *ImageMapper, client *RegistryClient) (*TransferPlan, error) {
+	plan := &TransferPlan{Version: TransferPlanVersion, Region: mapper.Region, AccountId: mapper.AccountId}
+	for _, image := range images {
+		if reason := mapper.Skip(image); reason != "" {
+			plan.Skipped = append(plan.Skipped, fmt.Sprintf("%s is skipped, %s", image, reason))
+			continue
+		}
+		resolved, err := client.ResolveImage(image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %v", image, err)
+		}
+		targets, err := mapper.Targets(image, resolved.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", image, err)
+		}
+		plan.Images = append(plan.Images, PlannedImage{Source: image, ResolvedImage: *resolved, Targets: targets})
+	}
+	return plan, nil
+}
+
+// WriteTransferPlan write plan as JSON
+func WriteTransferPlan(path string, plan *TransferPlan) error {
+	data, err := json.MarshalIndent(plan, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// ReadTransferPlan read plan file, the plan should be made for the region and account of mapper,
+// and targets should be in the repositories which mapper decides now, e.g. prefix of repositories is not changed
+func ReadTransferPlan(path string, mapper *ImageMapper) (*TransferPlan, error) {
+	region, accountId := mapper.Region, mapper.AccountId
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plan TransferPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if plan.Version != TransferPlanVersion {
+		return nil, fmt.Errorf("%s: version %d is not supported", path, plan.Version)
+	}
+	if plan.Region != region || plan.AccountId != accountId {
+		return nil, fmt.Errorf("%s: plan is made for %s, but target is %s", path, ECRRegistry(plan.Region, plan.AccountId), ECRRegistry(region, accountId))
+	}
+	for i, image := range plan.Images {
+		if image.Source == "" || image.Digest == "" || len(image.Targets) == 0 {
+			return nil, fmt.Errorf("%s: images[%d] should have source, digest and targets", path, i)
+		}
+		if err := checkPlannedTargets(image, mapper); err != nil {
+			return nil, fmt.Errorf("%s: images[%d]: %v", path, i, err)
+		}
+	}
+	return &plan, nil
+}
+
+// repositories of planned targets should be the same as mapper, tags are not compared because they may have date
+func checkPlannedTargets(image PlannedImage, mapper *ImageMapper) error {
+	targets, err := mapper.Targets(image.Source, image.Digest)
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, target := range targets {
+		if ref, err := ParseImageReference(target); err == nil {
+			names[ref.Name] = true
+		}
+	}
+	for _, target := range image.Targets {
+		ref, err := ParseImageReference(target)
+		if err != nil {
+			return err
+		}
+		if !names[ref.Name] {
+			return fmt.Errorf("target %s is not where %s is transferred by current settings, %s", target, image.Source, strings.Join(targets, ", "))
+		}
+	}
+	return nil
+}
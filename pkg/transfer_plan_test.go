@@ -0,0 +1,168 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveTransferPlan(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	amd64 := Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	single := registry.pushImage("app", "v1", amd64)
+	multi := registry.pushImage("library/nginx", "1.17", amd64, arm64)
+
+	policy, err := NewTagPolicy(TagPolicyConfig{Template: "{{.Tag}}-{{.ShortDigest}}", KeepOriginalTag: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapper := &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444", TagPolicy: policy}
+	ecrHost := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/"
+	images := []string{registry.Host() + "/app:v1", registry.Host() + "/library/nginx:1.17", ecrHost + "mirrored:v1"}
+
+	plan, err := ResolveTransferPlan(images, mapper, registry.Client())
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if len(plan.Images) != 2 || len(plan.Skipped) != 1 {
+		t.Fatalf("unexpected plan: %+v", plan)
+	}
+
+	app := plan.Images[0]
+	if app.Digest != single.Digest || app.MediaType != MediaTypeDockerManifest {
+		t.Errorf("unexpected digest of app: %+v", app)
+	}
+	if len(app.Platforms) != 1 || app.Platforms[0].Platform != amd64 || app.Platforms[0].Size != app.Size {
+		t.Errorf("unexpected platforms of app: %+v", app.Platforms)
+	}
+	expectedTargets := []string{
+		ecrHost + registry.Host() + "/app:v1-" + strings.TrimPrefix(single.Digest, "sha256:")[:12],
+		ecrHost + registry.Host() + "/app:v1",
+	}
+	if !reflect.DeepEqual(app.Targets, expectedTargets) {
+		t.Errorf("expected: %v, got: %v", expectedTargets, app.Targets)
+	}
+
+	nginx := plan.Images[1]
+	if nginx.Digest != multi.Digest || !IsIndex(nginx.MediaType) {
+		t.Errorf("unexpected digest of nginx: %+v", nginx)
+	}
+	if len(nginx.Platforms) != 2 || nginx.Platforms[1].Platform != arm64 {
+		t.Errorf("unexpected platforms of nginx: %+v", nginx.Platforms)
+	}
+	if nginx.Size != multi.Size+nginx.Platforms[0].Size+nginx.Platforms[1].Size {
+		t.Errorf("size of index should be sum of platforms, got: %d", nginx.Size)
+	}
+
+	// plan is read back for the same target only
+	dir, err := ioutil.TempDir("", "trimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "plan.json")
+	if err := WriteTransferPlan(path, plan); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadTransferPlan(path, mapper)
+	if err != nil {
+		t.Fatalf("failed to read plan: %v", err)
+	}
+	if !reflect.DeepEqual(read, plan) {
+		t.Errorf("expected: %+v, got: %+v", plan, read)
+	}
+	if _, err := ReadTransferPlan(path, &ImageMapper{Region: "us-east-1", AccountId: "111222333444", TagPolicy: policy}); err == nil {
+		t.Errorf("plan for other region should be error")
+	}
+
+	// tag which doesn't exist
+	if _, err := ResolveTransferPlan([]string{registry.Host() + "/app:v2"}, mapper, registry.Client()); err == nil {
+		t.Errorf("unknown tag should be error")
+	}
+}
+
+func TestCopyTransferJobPlan(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	registry := newFakeRegistry()
+	defer registry.Close()
+	planned := source.pushImage("library/nginx", "1.17", Platform{OS: "linux", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "arm64"})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(source.Certificate())
+	pool.AddCert(registry.Certificate())
+	client := &RegistryClient{Client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}}
+	client.SetCredential(source.Host(), RegistryCredential{Username: "user", Password: "pass"})
+	client.SetCredential(registry.Host(), RegistryCredential{Username: "user", Password: "pass"})
+
+	image := source.Host() + "/library/nginx:1.17"
+	mapper := &ImageMapper{Destination: NewRegistryDestination(registry.Host()+"/mirror", client)}
+	plan, err := ResolveTransferPlan([]string{image}, mapper, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := registry.Host() + "/mirror/" + image
+	if !reflect.DeepEqual(plan.Images[0].Targets, []string{target}) {
+		t.Fatalf("unexpected targets: %v", plan.Images[0].Targets)
+	}
+	// the tag is moved after the plan
+	source.pushImage("library/nginx", "1.17", Platform{OS: "linux", Architecture: "amd64"})
+
+	dir, err := ioutil.TempDir("", "trimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "plan.json")
+	if err := WriteTransferPlan(path, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	// prefix of the destination is changed after the plan
+	changed := &ImageMapper{Destination: NewRegistryDestination(registry.Host()+"/other", client)}
+	if _, err := ReadTransferPlan(path, changed); err == nil || !strings.Contains(err.Error(), target) {
+		t.Errorf("plan whose targets are different from settings should be error, got: %v", err)
+	}
+	read, err := ReadTransferPlan(path, mapper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// planned targets are pushed even if mapper decides other repositories
+	job := TransferJob{Source: image, Digest: read.Images[0].Digest, Targets: read.Images[0].Targets}
+	targets, _, err := CopyTransferJob(client, changed, job)
+	if err != nil || !reflect.DeepEqual(targets, []string{target}) {
+		t.Fatalf("unexpected targets: %v, %v", targets, err)
+	}
+	// index of all platforms is pushed as it is
+	m, err := client.GetManifest(registry.Host(), "mirror/"+source.Host()+"/library/nginx", "1.17")
+	if err != nil || m.Digest != planned.Digest {
+		t.Errorf("expected: %s, got: %v, %v", planned.Digest, m, err)
+	}
+	if _, err := client.GetManifest(registry.Host(), "other/"+source.Host()+"/library/nginx", "1.17"); !IsNotFound(err) {
+		t.Errorf("repository which is not planned should not be pushed, got: %v", err)
+	}
+}
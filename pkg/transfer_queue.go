@@ -0,0 +1,103 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"github.com/vbauerster/mpb"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// TransferQueue transfer images in background by bounded workers, the same image is not queued twice
+type TransferQueue struct {
+	jobs   chan string
+	mu     sync.Mutex
+	queued map[string]bool
+	wg     sync.WaitGroup
+
+	// Transfer runs transfer of the image and returns the result message, ImageTransfer is used by default
+	Transfer func(image string) string
+	// Done is called when transfer finishes
+	Done func(image, msg string)
+}
+
+// NewTransferQueue start workers, size is the number of images which can wait
+func NewTransferQueue(mapper *ImageMapper, workers, size int) *TransferQueue {
+	q := &TransferQueue{
+		jobs:   make(chan string, size),
+		queued: map[string]bool{},
+		Transfer: func(image string) string {
+			return transferInBackground(image, mapper)
+		},
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// run ImageTransfer without progress bar
+func transferInBackground(image string, mapper *ImageMapper) string {
+	var wg sync.WaitGroup
+	p := mpb.New(mpb.WithOutput(ioutil.Discard))
+	bar := p.AddBar(TransferSteps)
+	resultMsg := make(chan string, 1)
+	wg.Add(1)
+	ImageTransfer(image, mapper, &wg, bar, resultMsg)
+	bar.SetTotal(5, true)
+	p.Wait()
+	return <-resultMsg
+}
+
+func (q *TransferQueue) work() {
+	defer q.wg.Done()
+	for image := range q.jobs {
+		msg := q.Transfer(image)
+		// failed image can be queued again
+		if strings.Contains(msg, "failed to transfer") {
+			q.mu.Lock()
+			delete(q.queued, image)
+			q.mu.Unlock()
+		}
+		if q.Done != nil {
+			q.Done(image, msg)
+		}
+	}
+}
+
+// Enqueue returns false when the image is already queued or the queue is full
+func (q *TransferQueue) Enqueue(image string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued[image] {
+		return false
+	}
+	select {
+	case q.jobs <- image:
+		q.queued[image] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting images, and waits queued images
+func (q *TransferQueue) Close() {
+	close(q.jobs)
+	q.wg.Wait()
+}
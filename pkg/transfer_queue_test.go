@@ -0,0 +1,68 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestTransferQueue(t *testing.T) {
+	var mu sync.Mutex
+	var transferred []string
+	release := make(chan struct{})
+	q := NewTransferQueue(&ImageMapper{}, 2, 10)
+	q.Transfer = func(image string) string {
+		<-release
+		mu.Lock()
+		transferred = append(transferred, image)
+		mu.Unlock()
+		if image == "broken:v1" {
+			return "broken:v1 failed to transfer"
+		}
+		return image + " transferred"
+	}
+	var done []string
+	q.Done = func(image, msg string) {
+		mu.Lock()
+		done = append(done, msg)
+		mu.Unlock()
+	}
+
+	if !q.Enqueue("nginx:1.17") || !q.Enqueue("broken:v1") {
+		t.Fatal("images should be queued")
+	}
+	if q.Enqueue("nginx:1.17") {
+		t.Error("the same image should not be queued twice")
+	}
+	close(release)
+	q.Close()
+
+	sort.Strings(transferred)
+	if len(transferred) != 2 || transferred[0] != "broken:v1" || transferred[1] != "nginx:1.17" {
+		t.Errorf("unexpected transferred images: %v", transferred)
+	}
+	if len(done) != 2 {
+		t.Errorf("Done should be called for each image: %v", done)
+	}
+	// failed image can be queued again, transferred one is not
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued["broken:v1"] || !q.queued["nginx:1.17"] {
+		t.Errorf("unexpected queued images: %v", q.queued)
+	}
+}
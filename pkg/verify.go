@@ -0,0 +1,269 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"sort"
+	"strings"
+)
+
+// status of VerifyResult
+const (
+	VerifyOK       = "OK"
+	VerifyMissing  = "MISSING"
+	VerifyMismatch = "MISMATCH"
+	VerifyNotECR   = "NOT ECR"
+	VerifySkipped  = "SKIPPED"
+	VerifyError    = "ERROR"
+)
+
+// VerifyResult is the result of an image
+type VerifyResult struct {
+	Image  string
+	Status string
+	// digest in ECR, or the reason of the status
+	Message string
+}
+
+// Failed returns true if the image is not available from ECR as expected
+func (r VerifyResult) Failed() bool {
+	return r.Status != VerifyOK && r.Status != VerifySkipped
+}
+
+// VerifyExpectation is the expected state of the image in ECR
+type VerifyExpectation struct {
+	// digest which the image points, e.g. index of all platforms
+	Digest string
+	// e.g. "linux/amd64", all of them should be in the image. variant is compared only when it is given
+	Platforms []string
+}
+
+// Verifier checks images exist in ECR, or in the destination of Mapper
+type Verifier struct {
+	// ECR API client of the region
+	ECR func(region string) ecriface.ECRAPI
+	// used to read platform from config of image manifest
+	Registry *RegistryClient
+	// images in internal registries are skipped, images in the destination other than ECR are checked by it
+	Mapper *ImageMapper
+	// platforms required for all images
+	Platforms []string
+	// expectations of images, e.g. made by transfer --plan, key is image path in ECR
+	Expected map[string]VerifyExpectation
+}
+
+// Verify checks each image, results are in the same order as images
+func (v *Verifier) Verify(images []string) []VerifyResult {
+	results := make([]VerifyResult, 0, len(images))
+	for _, image := range images {
+		status, msg := v.verify(image)
+		results = append(results, VerifyResult{Image: image, Status: status, Message: msg})
+	}
+	return results
+}
+
+func (v *Verifier) verify(image string) (string, string) {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return VerifyError, err.Error()
+	}
+	accountId, region, ok := ParseECRRegistry(ref.Registry)
+	if !ok {
+		if d := v.registryDestination(image); d != nil {
+			return v.verifyDestination(image, ref, d)
+		}
+		if v.Mapper != nil && v.Mapper.IsMirrored(image) {
+			return VerifySkipped, "internal registry"
+		}
+		return VerifyNotECR, "image is not replaced to ECR"
+	}
+	// cache is made by the first pull
+	if v.Mapper != nil && v.Mapper.IsCached(image) {
+		return VerifySkipped, "pull-through cache"
+	}
+
+	id := &ecr.ImageIdentifier{}
+	if ref.Digest != "" {
+		id.ImageDigest = aws.String(ref.Digest)
+	} else if ref.Tag != "" {
+		id.ImageTag = aws.String(ref.Tag)
+	} else {
+		id.ImageTag = aws.String("latest")
+	}
+	svc := v.ECR(region)
+	out, err := svc.BatchGetImage(&ecr.BatchGetImageInput{
+		RegistryId:         aws.String(accountId),
+		RepositoryName:     aws.String(ref.Repository),
+		ImageIds:           []*ecr.ImageIdentifier{id},
+		AcceptedMediaTypes: aws.StringSlice(manifestMediaTypes),
+	})
+	if err != nil {
+		if isAWSErrorCode(err, ecr.ErrCodeRepositoryNotFoundException) {
+			return VerifyMissing, "repository " + ref.Repository + " is not found"
+		}
+		return VerifyError, err.Error()
+	}
+	if len(out.Images) == 0 {
+		msg := "image is not found"
+		if len(out.Failures) != 0 && aws.StringValue(out.Failures[0].FailureCode) != ecr.ImageFailureCodeImageNotFound {
+			msg = aws.StringValue(out.Failures[0].FailureReason)
+		}
+		return VerifyMissing, msg
+	}
+	found := out.Images[0]
+	digest := aws.StringValue(found.ImageId.ImageDigest)
+	credential := func() (RegistryCredential, error) {
+		return ECRCredential(v.ECR(region))
+	}
+	return v.check(image, ref, digest, []byte(aws.StringValue(found.ImageManifest)), aws.StringValue(found.ImageManifestMediaType), credential)
+}
+
+// destination other than ECR which has the image, e.g. destination.registry of config
+func (v *Verifier) registryDestination(image string) Destination {
+	if v.Mapper == nil || v.Mapper.Destination == nil {
+		return nil
+	}
+	if _, ok := v.Mapper.Destination.(*ECRDestination); ok {
+		return nil
+	}
+	if v.Mapper.Destination.ImagePath(image) != image {
+		return nil
+	}
+	return v.Mapper.Destination
+}
+
+// the image is checked by the destination, and the manifest is read by registry API to compare digest and platforms
+func (v *Verifier) verifyDestination(image string, ref ImageReference, d Destination) (string, string) {
+	reference := manifestReference(ref)
+	exists, err := d.ImageExists(ref.Repository, reference)
+	if err != nil {
+		return VerifyError, err.Error()
+	}
+	if !exists {
+		return VerifyMissing, "image is not found"
+	}
+	if _, ok := v.Registry.credential(ref.Registry); !ok {
+		credential, err := d.Credential()
+		if err != nil {
+			return VerifyError, err.Error()
+		}
+		if credential.Username != "" {
+			v.Registry.SetCredential(ref.Registry, credential)
+		}
+	}
+	m, err := v.Registry.GetManifest(ref.Registry, ref.Repository, reference)
+	if err != nil {
+		return VerifyError, err.Error()
+	}
+	return v.check(image, ref, m.Digest, m.Body, m.MediaType, d.Credential)
+}
+
+// compare the found manifest with expectations, credential is used to read config of the image
+func (v *Verifier) check(image string, ref ImageReference, digest string, manifest []byte, mediaType string, credential func() (RegistryCredential, error)) (string, string) {
+	expected := v.Expected[image]
+	if expected.Digest != "" && expected.Digest != digest {
+		return VerifyMismatch, fmt.Sprintf("digest is %s, expected %s", digest, expected.Digest)
+	}
+
+	required := append(append([]string(nil), v.Platforms...), expected.Platforms...)
+	if len(required) == 0 {
+		return VerifyOK, digest
+	}
+	platforms, err := v.platforms(ref, manifest, mediaType, credential)
+	if err != nil {
+		return VerifyError, err.Error()
+	}
+	var missing []string
+	seen := map[string]bool{}
+	for _, p := range required {
+		if !hasPlatform(platforms, p) && !seen[p] {
+			missing = append(missing, p)
+		}
+		seen[p] = true
+	}
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return VerifyMismatch, fmt.Sprintf("platform %s is missing", strings.Join(missing, ", "))
+	}
+	return VerifyOK, digest
+}
+
+// required platform is in platforms, e.g. "linux/arm64" matches "linux/arm64/v8"
+func hasPlatform(platforms []Platform, required string) bool {
+	parts := strings.SplitN(required, "/", 3)
+	for _, p := range platforms {
+		if len(parts) < 2 || p.OS != parts[0] || p.Architecture != parts[1] {
+			continue
+		}
+		if len(parts) == 2 || p.Variant == parts[2] {
+			return true
+		}
+	}
+	return false
+}
+
+// platforms of the image, config is read from the registry when it is not index
+func (v *Verifier) platforms(ref ImageReference, manifest []byte, mediaType string, credential func() (RegistryCredential, error)) ([]Platform, error) {
+	m, err := ParseImageManifest(manifest, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	var platforms []Platform
+	if IsIndex(m.MediaType) {
+		for _, d := range m.Manifests {
+			if d.Platform != nil {
+				platforms = append(platforms, *d.Platform)
+			}
+		}
+		return platforms, nil
+	}
+	if m.Config == nil {
+		return nil, fmt.Errorf("manifest has no config")
+	}
+
+	if _, ok := v.Registry.credential(ref.Registry); !ok {
+		credential, err := credential()
+		if err != nil {
+			return nil, err
+		}
+		v.Registry.SetCredential(ref.Registry, credential)
+	}
+	config, err := v.Registry.GetBlob(ref.Registry, ref.Repository, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var p Platform
+	if err := json.Unmarshal(config, &p); err != nil {
+		return nil, fmt.Errorf("config is broken: %v", err)
+	}
+	return append(platforms, p), nil
+}
+
+// ExpectedFromPlan returns expectations of targets in the plan, transfer --apply pushes the planned digests as they are
+func ExpectedFromPlan(plan *TransferPlan) map[string]VerifyExpectation {
+	expected := map[string]VerifyExpectation{}
+	for _, image := range plan.Images {
+		for _, target := range image.Targets {
+			expected[target] = VerifyExpectation{Digest: image.Digest}
+		}
+	}
+	return expected
+}
@@ -0,0 +1,157 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// routeTransport sends all requests to the host
+type routeTransport struct {
+	host      string
+	transport http.RoundTripper
+}
+
+func (t *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Host = t.host
+	return t.transport.RoundTrip(req)
+}
+
+func TestVerifier(t *testing.T) {
+	// fake registry serves blobs of fake ECR
+	registry := newFakeRegistry()
+	defer registry.Close()
+	amd64 := Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	single := registry.pushImage("app", "v1", amd64)
+	multi := registry.pushImage("library/nginx", "1.17", amd64, arm64)
+
+	svc := newFakeECR()
+	svc.repositories["app"] = &fakeECRRepository{images: map[string]fakeManifest{"v1": registry.manifests["app"]["v1"]}}
+	svc.repositories["nginx"] = &fakeECRRepository{images: map[string]fakeManifest{
+		"1.17":       registry.manifests["library/nginx"]["1.17"],
+		multi.Digest: registry.manifests["library/nginx"]["1.17"],
+	}}
+
+	client := registry.Server.Client()
+	client.Transport = &routeTransport{host: registry.Host(), transport: client.Transport}
+	ecrHost := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com"
+	verifier := &Verifier{
+		ECR:      func(region string) ecriface.ECRAPI { return svc },
+		Registry: &RegistryClient{Client: client},
+		Mapper:   &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444", InternalRegistries: []string{"harbor.example.com"}},
+		Expected: map[string]VerifyExpectation{
+			ecrHost + "/app:v1": {Digest: "sha256:0000"},
+		},
+	}
+
+	images := []string{
+		ecrHost + "/nginx:1.17",
+		ecrHost + "/nginx@" + multi.Digest,
+		ecrHost + "/app:v1",
+		ecrHost + "/app:v2",
+		ecrHost + "/redis:6",
+		"nginx:1.17",
+		"harbor.example.com/app/web:v1",
+	}
+	var statuses []string
+	for _, r := range verifier.Verify(images) {
+		statuses = append(statuses, r.Status)
+	}
+	expected := []string{VerifyOK, VerifyOK, VerifyMismatch, VerifyMissing, VerifyMissing, VerifyNotECR, VerifySkipped}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("expected: %v, got: %v", expected, statuses)
+	}
+
+	// platforms of index and config of image manifest
+	verifier.Expected = nil
+	verifier.Platforms = []string{"linux/arm64"}
+	results := verifier.Verify([]string{ecrHost + "/nginx:1.17", ecrHost + "/app:v1"})
+	if results[0].Status != VerifyOK {
+		t.Errorf("nginx has linux/arm64/v8, got: %+v", results[0])
+	}
+	if results[1].Status != VerifyMismatch || !strings.Contains(results[1].Message, "linux/arm64") {
+		t.Errorf("app doesn't have linux/arm64, got: %+v", results[1])
+	}
+	// variant is compared when it is given
+	verifier.Platforms = []string{"linux/arm64/v8"}
+	if r := verifier.Verify([]string{ecrHost + "/nginx:1.17"})[0]; r.Status != VerifyOK {
+		t.Errorf("nginx has linux/arm64/v8, got: %+v", r)
+	}
+	verifier.Platforms = []string{"linux/arm64/v7"}
+	if r := verifier.Verify([]string{ecrHost + "/nginx:1.17"})[0]; r.Status != VerifyMismatch {
+		t.Errorf("nginx doesn't have linux/arm64/v7, got: %+v", r)
+	}
+	verifier.Platforms = []string{"linux/amd64"}
+	if r := verifier.Verify([]string{ecrHost + "/app:v1"})[0]; r.Status != VerifyOK || r.Message != single.Digest {
+		t.Errorf("app has linux/amd64, got: %+v", r)
+	}
+}
+
+func TestVerifierRegistryDestination(t *testing.T) {
+	registry := newFakeRegistry()
+	defer registry.Close()
+	app := registry.pushImage("mirror/app", "v1", Platform{OS: "linux", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "arm64"})
+
+	destination := NewRegistryDestination(registry.Host()+"/mirror", registry.Client())
+	verifier := &Verifier{
+		Registry:  registry.Client(),
+		Mapper:    &ImageMapper{Destination: destination},
+		Platforms: []string{"linux/arm64"},
+		Expected: map[string]VerifyExpectation{
+			registry.Host() + "/mirror/app:v1":            {Digest: app.Digest},
+			registry.Host() + "/mirror/app@" + app.Digest: {Digest: "sha256:0000"},
+		},
+	}
+	images := []string{
+		registry.Host() + "/mirror/app:v1",
+		registry.Host() + "/mirror/app:v2",
+		registry.Host() + "/mirror/app@" + app.Digest,
+		"nginx:1.17",
+	}
+	var statuses []string
+	for _, r := range verifier.Verify(images) {
+		statuses = append(statuses, r.Status)
+	}
+	expected := []string{VerifyOK, VerifyMissing, VerifyMismatch, VerifyNotECR}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("expected: %v, got: %v", expected, statuses)
+	}
+
+	verifier.Expected = nil
+	verifier.Platforms = []string{"linux/arm/v7"}
+	if r := verifier.Verify(images[:1])[0]; r.Status != VerifyMismatch || !strings.Contains(r.Message, "linux/arm/v7") {
+		t.Errorf("app doesn't have linux/arm/v7, got: %+v", r)
+	}
+}
+
+func TestExpectedFromPlan(t *testing.T) {
+	plan := &TransferPlan{Images: []PlannedImage{{
+		Source:        "nginx:1.17",
+		ResolvedImage: ResolvedImage{Digest: "sha256:1111", Platforms: []PlatformImage{{Digest: "sha256:2222"}, {Digest: "sha256:3333"}}},
+		Targets:       []string{"111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/nginx:1.17"},
+	}}}
+	// digest of index is expected, not digests of platforms
+	expected := map[string]VerifyExpectation{"111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/nginx:1.17": {Digest: "sha256:1111"}}
+	if actual := ExpectedFromPlan(plan); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %v, got: %v", expected, actual)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// PodImageMutator is a mutating admission webhook which replaces images of pods with ECR
+type PodImageMutator struct {
+	Mapper *ImageMapper
+	// namespaces whose pods are mutated, all namespaces when empty. patterns like "team-*" are available
+	Namespaces []string
+	// namespaces whose pods are not mutated, prior to Namespaces
+	ExcludeNamespaces []string
+	// audit log is written as json lines, nothing is written when nil
+	Audit io.Writer
+	// called with the source image when the image is replaced and should be transferred, e.g. to queue transfer
+	OnReplace func(image string)
+
+	mu sync.Mutex
+}
+
+// ImageChange is a replaced image in pod
+type ImageChange struct {
+	Path string `json:"path"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type auditRecord struct {
+	Time      string        `json:"time"`
+	UID       string        `json:"uid"`
+	Namespace string        `json:"namespace"`
+	Name      string        `json:"name"`
+	User      string        `json:"user"`
+	Changes   []ImageChange `json:"changes"`
+	Error     string        `json:"error,omitempty"`
+}
+
+type patchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+// ServeHTTP handles AdmissionReview request
+func (m *PodImageMutator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+	response := m.Mutate(review.Request)
+	// respond with the same version as request, v1 and v1beta1 have the same structure
+	out := admissionv1.AdmissionReview{TypeMeta: review.TypeMeta, Response: response}
+	data, err := json.Marshal(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Mutate returns the response with JSONPatch replacing images of pod.
+// pod is always allowed, images are kept when they can't be mapped not to block deployments
+func (m *PodImageMutator) Mutate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+	if req.Kind.Kind != "Pod" || !m.targetNamespace(req.Namespace) {
+		return response
+	}
+	pod := corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		m.audit(req, &pod, nil, err)
+		return response
+	}
+	changes, err := m.podChanges(&pod)
+	if err != nil {
+		m.audit(req, &pod, nil, err)
+		return response
+	}
+	if len(changes) == 0 {
+		return response
+	}
+	patch := make([]patchOperation, 0, len(changes))
+	for _, change := range changes {
+		patch = append(patch, patchOperation{Op: "replace", Path: change.Path, Value: change.To})
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		m.audit(req, &pod, nil, err)
+		return response
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.Patch = data
+	response.PatchType = &patchType
+	m.audit(req, &pod, changes, nil)
+	if m.OnReplace != nil {
+		for _, change := range changes {
+			// e.g. pull-through cache is replaced without transfer
+			if m.Mapper.Skip(change.From) == "" {
+				m.OnReplace(change.From)
+			}
+		}
+	}
+	return response
+}
+
+// images of all containers are validated before replacing, not to leave pod half replaced
+func (m *PodImageMutator) podChanges(pod *corev1.Pod) ([]ImageChange, error) {
+	changes := []ImageChange{}
+	add := func(field string, i int, image string) error {
+		mapping, err := m.Mapper.Map(image)
+		if err != nil {
+			return fmt.Errorf("%s: %v", image, err)
+		}
+		if mapping.Replaced() {
+			changes = append(changes, ImageChange{Path: fmt.Sprintf("/spec/%s/%d/image", field, i), From: image, To: mapping.Target})
+		}
+		return nil
+	}
+	for i, c := range pod.Spec.InitContainers {
+		if err := add("initContainers", i, c.Image); err != nil {
+			return nil, err
+		}
+	}
+	for i, c := range pod.Spec.Containers {
+		if err := add("containers", i, c.Image); err != nil {
+			return nil, err
+		}
+	}
+	for i, c := range pod.Spec.EphemeralContainers {
+		if err := add("ephemeralContainers", i, c.Image); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+func (m *PodImageMutator) targetNamespace(namespace string) bool {
+	if matchNamespace(m.ExcludeNamespaces, namespace) {
+		return false
+	}
+	return len(m.Namespaces) == 0 || matchNamespace(m.Namespaces, namespace)
+}
+
+func matchNamespace(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *PodImageMutator) audit(req *admissionv1.AdmissionRequest, pod *corev1.Pod, changes []ImageChange, err error) {
+	if m.Audit == nil {
+		return
+	}
+	record := auditRecord{
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		UID:       string(req.UID),
+		Namespace: req.Namespace,
+		Name:      podName(req, pod.ObjectMeta),
+		User:      req.UserInfo.Username,
+		Changes:   changes,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	data, _ := json.Marshal(record)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Audit.Write(append(data, '\n'))
+}
+
+// name of pod is empty when it is created by controllers, use generateName instead
+func podName(req *admissionv1.AdmissionRequest, meta metav1.ObjectMeta) string {
+	if req.Name != "" {
+		return req.Name
+	}
+	if meta.Name != "" {
+		return meta.Name
+	}
+	return meta.GenerateName
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2020 esakat <esaka.tom@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const admissionReview = `{
+  "apiVersion": "admission.k8s.io/v1",
+  "kind": "AdmissionReview",
+  "request": {
+    "uid": "705ab4f5-6393-11e8-b7cc-42010a800002",
+    "kind": {"group": "", "version": "v1", "kind": "Pod"},
+    "resource": {"group": "", "version": "v1", "resource": "pods"},
+    "namespace": "%s",
+    "operation": "CREATE",
+    "userInfo": {"username": "admin"},
+    "object": {
+      "apiVersion": "v1",
+      "kind": "Pod",
+      "metadata": {"generateName": "web-"},
+      "spec": {
+        "initContainers": [{"name": "init", "image": "busybox:1.31"}],
+        "containers": [
+          {"name": "web", "image": "nginx:1.17"},
+          {"name": "sidecar", "image": "harbor.example.com/proxy:v1"}
+        ]
+      }
+    }
+  }
+}`
+
+func postAdmissionReview(t *testing.T, handler http.Handler, namespace string) map[string]interface{} {
+	body := strings.Replace(admissionReview, "%s", namespace, 1)
+	req := httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	review := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return review
+}
+
+func TestPodImageMutator(t *testing.T) {
+	ecr := "111222333444.dkr.ecr.ap-northeast-1.amazonaws.com/"
+	audit := &bytes.Buffer{}
+	var replaced []string
+	mutator := &PodImageMutator{
+		Mapper: &ImageMapper{
+			Region:             "ap-northeast-1",
+			AccountId:          "111222333444",
+			InternalRegistries: []string{"harbor.example.com"},
+		},
+		Namespaces:        []string{"team-*"},
+		ExcludeNamespaces: []string{"team-infra"},
+		Audit:             audit,
+		OnReplace: func(image string) {
+			replaced = append(replaced, image)
+		},
+	}
+
+	review := postAdmissionReview(t, mutator, "team-web")
+	if review["apiVersion"] != "admission.k8s.io/v1" || review["kind"] != "AdmissionReview" {
+		t.Errorf("response should have the same version as request: %v", review)
+	}
+	response := review["response"].(map[string]interface{})
+	if response["uid"] != "705ab4f5-6393-11e8-b7cc-42010a800002" || response["allowed"] != true {
+		t.Errorf("unexpected response: %v", response)
+	}
+	if response["patchType"] != "JSONPatch" {
+		t.Errorf("expected JSONPatch, got: %v", response["patchType"])
+	}
+	// patch is base64 encoded by json
+	var patch []patchOperation
+	data, _ := json.Marshal(response["patch"])
+	var raw []byte
+	json.Unmarshal(data, &raw)
+	if err := json.Unmarshal(raw, &patch); err != nil {
+		t.Fatalf("failed to decode patch: %v", err)
+	}
+	expectedPatch := []patchOperation{
+		{"replace", "/spec/initContainers/0/image", ecr + "busybox:1.31"},
+		{"replace", "/spec/containers/0/image", ecr + "nginx:1.17"},
+	}
+	if !reflect.DeepEqual(patch, expectedPatch) {
+		t.Errorf("expected: %v, got: %v", expectedPatch, patch)
+	}
+	if !reflect.DeepEqual(replaced, []string{"busybox:1.31", "nginx:1.17"}) {
+		t.Errorf("unexpected replaced images: %v", replaced)
+	}
+
+	record := auditRecord{}
+	if err := json.Unmarshal(audit.Bytes(), &record); err != nil {
+		t.Fatalf("failed to decode audit log: %v", err)
+	}
+	if record.Namespace != "team-web" || record.Name != "web-" || record.User != "admin" || len(record.Changes) != 2 {
+		t.Errorf("unexpected audit log: %v", record)
+	}
+
+	// pods out of target namespaces are not mutated
+	for _, namespace := range []string{"default", "team-infra"} {
+		audit.Reset()
+		response := postAdmissionReview(t, mutator, namespace)["response"].(map[string]interface{})
+		if response["allowed"] != true || response["patch"] != nil {
+			t.Errorf("%s should not be mutated: %v", namespace, response)
+		}
+		if audit.Len() != 0 {
+			t.Errorf("%s should not be audited: %s", namespace, audit.String())
+		}
+	}
+}
+
+func TestPodImageMutatorInvalidImage(t *testing.T) {
+	audit := &bytes.Buffer{}
+	mutator := &PodImageMutator{
+		Mapper: &ImageMapper{Region: "ap-northeast-1", AccountId: "111222333444", TagPolicy: &TagPolicy{}},
+		Audit:  audit,
+	}
+	body := strings.Replace(strings.Replace(admissionReview, "%s", "default", 1), "nginx:1.17", "nginx@latest", 1)
+	req := httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	mutator.ServeHTTP(rec, req)
+	review := map[string]interface{}{}
+	json.Unmarshal(rec.Body.Bytes(), &review)
+	response := review["response"].(map[string]interface{})
+	// fail open, pod is not blocked
+	if response["allowed"] != true || response["patch"] != nil {
+		t.Errorf("pod should be allowed without patch: %v", response)
+	}
+	if !strings.Contains(audit.String(), "nginx@latest: image format is wrong") {
+		t.Errorf("error should be audited: %s", audit.String())
+	}
+
+	rec = httptest.NewRecorder()
+	mutator.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader("{}")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for empty review, got: %d", rec.Code)
+	}
+}